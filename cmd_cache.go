@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const adminRequestTimeout = 10 * time.Second
+
+var errUnknownCacheCommand = errors.New("expected one of 'stats', 'dump' or 'flush'")
+
+// cacheCommand inspects or flushes the cache of a running proxy through its
+// admin API.
+func cacheCommand(args []string) error {
+	flags := flag.NewFlagSet("cache", flag.ExitOnError)
+	adminURL, token := adminFlags(flags)
+	name := flags.String("name", "", "Only flush responses for this name")
+	zone := flags.String("zone", "", "Only flush responses for names in this zone")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s cache [flags] stats|dump|flush\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errUnknownCacheCommand
+	}
+
+	method := http.MethodGet
+	path := "/cache"
+	query := url.Values{}
+	switch flags.Arg(0) {
+	case "stats":
+	case "dump":
+		path = "/cache/entries"
+	case "flush":
+		method = http.MethodPost
+		path = "/cache/flush"
+		if *name != "" {
+			query.Set("name", *name)
+		}
+		if *zone != "" {
+			query.Set("zone", *zone)
+		}
+	default:
+		return errUnknownCacheCommand
+	}
+
+	endpoint, err := url.JoinPath(*adminURL, path)
+	if err != nil {
+		return fmt.Errorf("invalid admin URL: %w", err)
+	}
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	return callAdminAPI(method, endpoint, *token, os.Stdout)
+}
+
+// adminFlags adds the flags needed to call the admin API to the flag set. The
+// token defaults to the TSDNSPROXY_ADMIN__AUTH_TOKEN environment variable,
+// as used to configure the proxy itself, so it needn't be on the command line.
+func adminFlags(flags *flag.FlagSet) (adminURL *string, token *string) {
+	adminURL = flags.String("admin", "http://localhost:8053", "URL of the proxy's admin API")
+	token = flags.String("token", os.Getenv(envVar("admin.auth_token")), "Auth token of the proxy's admin API")
+	return adminURL, token
+}
+
+// callAdminAPI makes a request to the admin API and copies the response body
+// to out.
+func callAdminAPI(method string, endpoint string, token string, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), adminRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call admin API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, body)
+	}
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("failed to read admin API response: %w", err)
+	}
+
+	return nil
+}
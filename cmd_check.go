@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/proxy"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"go.uber.org/zap"
+)
+
+const probeTimeout = 30 * time.Second
+
+var errCheckFailed = errors.New("config check failed")
+
+// checkCommand loads and validates the config, exiting non-zero if it's
+// invalid. With -probe, it also checks that the upstreams and the resolver's
+// backend are reachable.
+func checkCommand(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := configFlag(flags)
+	overrides := configOverrideFlags(flags)
+	probe := flags.Bool("probe", false, "Also check that upstreams and the resolver's backend are reachable")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s check [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath, overrides)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	resolver, err := cfg.Resolver.Create()
+	if err != nil {
+		return fmt.Errorf("failed to create Tailscale IP resolver: %w", err)
+	}
+
+	// Remote blocklists are only fetched when probing, since checking the
+	// config shouldn't depend on the network
+	if !*probe {
+		if err := proxy.Check(zap.NewNop(), resolver, &cfg.Proxy); err != nil {
+			return fmt.Errorf("proxy config is invalid: %w", err)
+		}
+		fmt.Println("config is valid")
+		return nil
+	}
+
+	server, err := proxy.New(zap.NewNop(), resolver, &cfg.Proxy)
+	if err != nil {
+		return fmt.Errorf("proxy config is invalid: %w", err)
+	}
+	fmt.Println("config is valid")
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	failed := false
+	if startable, ok := resolver.(resolvers.Startable); ok {
+		if err := resolvers.StartWithTimeout(ctx, startable, cfg.Resolver.startTimeout()); err != nil {
+			fmt.Printf("resolver: FAIL: %v\n", err)
+			failed = true
+		}
+	}
+	if checker, ok := resolver.(resolvers.ReadinessChecker); ok && !failed {
+		if err := checker.Ready(); err != nil {
+			fmt.Printf("resolver: FAIL: %v\n", err)
+			failed = true
+		}
+	}
+	if !failed {
+		fmt.Println("resolver: ok")
+	}
+
+	for _, result := range server.ProbeUpstreams(ctx) {
+		if result.Err != nil {
+			fmt.Printf("upstream %s: FAIL: %v\n", result.Upstream, result.Err)
+			failed = true
+			continue
+		}
+		fmt.Printf("upstream %s: ok\n", result.Upstream)
+	}
+
+	if failed {
+		return errCheckFailed
+	}
+	return nil
+}
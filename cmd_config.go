@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+var errUnknownConfigCommand = errors.New("expected 'dump' or 'schema'")
+
+// configCommand inspects the config that the proxy would run with, or prints
+// a JSON Schema for config files.
+func configCommand(args []string) error {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	configPath := configFlag(flags)
+	overrides := configOverrideFlags(flags)
+	showSecrets := flags.Bool("show-secrets", false, "Don't redact secrets")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s config [flags] dump|schema\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errUnknownConfigCommand
+	}
+
+	switch flags.Arg(0) {
+	case "dump":
+		return dumpConfig(*configPath, overrides, *showSecrets)
+	case "schema":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(configSchema()); err != nil {
+			return fmt.Errorf("failed to encode schema: %w", err)
+		}
+		return nil
+	default:
+		flags.Usage()
+		return errUnknownConfigCommand
+	}
+}
+
+func dumpConfig(configPath string, overrides configOverrides, showSecrets bool) error {
+	// The config is dumped even if it's invalid, since that's when it's most
+	// useful to see what the proxy made of it
+	cfg, err := readConfig(configPath, overrides)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(configValue(reflect.ValueOf(cfg), showSecrets)); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	return encoder.Close()
+}
+
+// configValue converts a config struct into maps keyed the same way as the
+// config file, redacting secrets unless told otherwise.
+func configValue(v reflect.Value, showSecrets bool) any {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return configValue(v.Elem(), showSecrets)
+	case reflect.Struct:
+		out := make(map[string]any)
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+			if name == "-" {
+				continue
+			}
+
+			value := configValue(v.Field(i), showSecrets)
+			if options == "squash" {
+				if fields, ok := value.(map[string]any); ok {
+					for k, v := range fields {
+						out[k] = v
+					}
+				}
+				continue
+			}
+
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			if !showSecrets && isSecretKey(name) && !v.Field(i).IsZero() {
+				value = redacted
+			}
+			out[name] = value
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return []any{}
+		}
+		out := make([]any, v.Len())
+		for i := range out {
+			out[i] = configValue(v.Index(i), showSecrets)
+		}
+		return out
+	case reflect.Map:
+		out := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out[fmt.Sprint(iter.Key().Interface())] = configValue(iter.Value(), showSecrets)
+		}
+		return out
+	default:
+		// Durations are shown as duration strings, which are valid for any
+		// unit, rather than as nanoseconds
+		if d, ok := v.Interface().(time.Duration); ok {
+			return d.String()
+		}
+		return v.Interface()
+	}
+}
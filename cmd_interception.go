@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+var errUnknownInterceptionCommand = errors.New("expected one of 'status', 'enable' or 'disable'")
+
+// interceptionCommand shows, enables or disables interception in a running
+// proxy through its admin API. Disabling it is an escape hatch for when a bad
+// mapping breaks something: every query is forwarded untouched until it's
+// enabled again.
+func interceptionCommand(args []string) error {
+	flags := flag.NewFlagSet("interception", flag.ExitOnError)
+	adminURL, token := adminFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s interception [flags] status|enable|disable\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errUnknownInterceptionCommand
+	}
+
+	method := http.MethodPost
+	query := url.Values{}
+	switch flags.Arg(0) {
+	case "status":
+		method = http.MethodGet
+	case "enable":
+		query.Set("enabled", "true")
+	case "disable":
+		query.Set("enabled", "false")
+	default:
+		return errUnknownInterceptionCommand
+	}
+
+	endpoint, err := url.JoinPath(*adminURL, "/interception")
+	if err != nil {
+		return fmt.Errorf("invalid admin URL: %w", err)
+	}
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	return callAdminAPI(method, endpoint, *token, os.Stdout)
+}
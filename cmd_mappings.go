@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// mappingsCommand dumps the external IP to Tailscale IP mappings of a running
+// proxy's resolver through its admin API.
+func mappingsCommand(args []string) error {
+	flags := flag.NewFlagSet("mappings", flag.ExitOnError)
+	adminURL, token := adminFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s mappings [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	endpoint, err := url.JoinPath(*adminURL, "/mappings")
+	if err != nil {
+		return fmt.Errorf("invalid admin URL: %w", err)
+	}
+
+	return callAdminAPI(http.MethodGet, endpoint, *token, os.Stdout)
+}
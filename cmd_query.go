@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/proxy"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const queryTimeout = 30 * time.Second
+
+var (
+	errQueryUsage       = errors.New("expected exactly one name to query")
+	errUnknownQueryType = errors.New("unknown query type")
+	errInvalidClientIP  = errors.New("invalid client IP")
+)
+
+// queryCommand sends a query through the proxy's handlers in-process, using
+// the configured resolver and upstreams, and prints what happened to it: what
+// upstream answered, the resolver lookups made, whether the query was
+// intercepted and why, and the final answer.
+func queryCommand(args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	configPath := configFlag(flags)
+	overrides := configOverrideFlags(flags)
+	qtype := flags.String("type", "A", "Type of record to query")
+	client := flags.String("client", "127.0.0.1", "IP of the client to pretend the query came from")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s query [flags] <name>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errQueryUsage
+	}
+
+	qtypeValue, ok := dns.StringToType[strings.ToUpper(*qtype)]
+	if !ok {
+		return fmt.Errorf("%w: '%s'", errUnknownQueryType, *qtype)
+	}
+
+	clientIP := net.ParseIP(*client)
+	if clientIP == nil {
+		return fmt.Errorf("%w: '%s'", errInvalidClientIP, *client)
+	}
+
+	cfg, err := loadConfig(*configPath, overrides)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	resolver, err := cfg.Resolver.Create()
+	if err != nil {
+		return fmt.Errorf("failed to create Tailscale IP resolver: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	if startable, ok := resolver.(resolvers.Startable); ok {
+		if err := resolvers.StartWithTimeout(ctx, startable, cfg.Resolver.startTimeout()); err != nil {
+			return fmt.Errorf("failed to start resolver: %w", err)
+		}
+	}
+
+	server, err := proxy.New(zap.NewNop(), resolver, &cfg.Proxy)
+	if err != nil {
+		return fmt.Errorf("failed to create proxy server: %w", err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(flags.Arg(0)), qtypeValue)
+
+	trace, err := server.TraceQuery(ctx, req, clientIP)
+	if err != nil {
+		return fmt.Errorf("failed to trace query: %w", err)
+	}
+
+	for _, step := range trace.Steps {
+		fmt.Printf("[%8s] %s\n", step.Elapsed.Round(time.Microsecond), step.Message)
+	}
+
+	fmt.Println()
+	fmt.Printf("intercepted: %t\n", trace.Intercepted)
+	if trace.Upstream != "" {
+		fmt.Printf("upstream: %s\n", trace.Upstream)
+	}
+	fmt.Println()
+	fmt.Println(trace.Response)
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"github.com/miekg/dns"
+)
+
+var (
+	errResolveUsage           = errors.New("expected exactly one IP or name to resolve")
+	errNameResolveUnsupported = errors.New("resolver can't resolve names directly")
+)
+
+// resolveCommand loads the configured resolver and prints the Tailscale IPs
+// that an external IP or name maps to, without going through DNS.
+func resolveCommand(args []string) error {
+	flags := flag.NewFlagSet("resolve", flag.ExitOnError)
+	configPath := configFlag(flags)
+	overrides := configOverrideFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s resolve [flags] <ip-or-name>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errResolveUsage
+	}
+
+	cfg, err := loadConfig(*configPath, overrides)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	resolver, err := cfg.Resolver.Create()
+	if err != nil {
+		return fmt.Errorf("failed to create Tailscale IP resolver: %w", err)
+	}
+
+	if startable, ok := resolver.(resolvers.Startable); ok {
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+
+		if err := resolvers.StartWithTimeout(ctx, startable, cfg.Resolver.startTimeout()); err != nil {
+			return fmt.Errorf("failed to start resolver: %w", err)
+		}
+	}
+
+	ips, evidence, err := resolveWithEvidence(resolver, flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to resolve %q: %w", flags.Arg(0), err)
+	}
+
+	if len(ips) == 0 {
+		fmt.Println("no Tailscale IPs")
+		return nil
+	}
+
+	for _, ip := range ips {
+		fmt.Println(ip)
+	}
+	for _, e := range evidence {
+		fmt.Printf("evidence: %s\n", e)
+	}
+
+	return nil
+}
+
+// resolveWithEvidence looks up a query, which is either an external IP or a
+// name, using the resolver's evidence methods if it has them.
+func resolveWithEvidence(resolver resolvers.Resolver, query string) ([]net.IP, []string, error) {
+	explainer, explains := resolver.(resolvers.EvidenceResolver)
+
+	if ip := net.ParseIP(query); ip != nil {
+		if explains {
+			return explainer.ExplainTailscaleIPsByExternalIP(ip)
+		}
+
+		ips, err := resolver.GetTailscaleIPsByExternalIP(ip)
+		return ips, nil, err
+	}
+
+	name := dns.Fqdn(query)
+	if explains {
+		return explainer.ExplainTailscaleIPsByName(name)
+	}
+
+	nameResolver, ok := resolver.(resolvers.NameResolver)
+	if !ok {
+		return nil, nil, errNameResolveUnsupported
+	}
+
+	ips, err := nameResolver.GetTailscaleIPsByName(name)
+	return ips, nil, err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/iplist"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/proxy"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	selftestTimeout = time.Minute
+
+	// Where the self-test's queries come from
+	selftestClientCIDR = "127.0.0.0/8"
+
+	// Attempts at finding a port that's free for both UDP and TCP
+	selftestPortAttempts = 10
+)
+
+var (
+	errSelftestFailed       = errors.New("self-test failed")
+	errNoFreePort           = errors.New("no port free for both UDP and TCP")
+	errSelftestRcode        = errors.New("query failed with rcode")
+	errSelftestNoAnswer     = errors.New("query wasn't answered")
+	errSelftestNotRewritten = errors.New("answer has IPs that aren't Tailscale IPs")
+)
+
+// selftestCommand runs the proxy on an ephemeral loopback port and sends real
+// queries through it, reporting which components work: the config, the
+// resolver, the upstreams, serving over UDP and TCP, and interception. It
+// exits non-zero if anything fails, so it can be used as a startup probe.
+func selftestCommand(args []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	configPath := configFlag(flags)
+	overrides := configOverrideFlags(flags)
+	name := flags.String("name", "", "Name that should be intercepted (default: a name from the resolver's mappings, if it lists them)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s selftest [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+
+	failed := false
+	report := func(component string, err error) bool {
+		if err != nil {
+			fmt.Printf("%s: FAIL: %v\n", component, err)
+			failed = true
+			return false
+		}
+		fmt.Printf("%s: ok\n", component)
+		return true
+	}
+
+	// Nothing else can be tested without a config and a resolver
+	cfg, err := loadConfig(*configPath, overrides)
+	if !report("config", err) {
+		return errSelftestFailed
+	}
+
+	resolver, err := startSelftestResolver(ctx, cfg)
+	if !report("resolver", err) {
+		return errSelftestFailed
+	}
+
+	// The proxy runs on loopback, and mustn't touch anything that the real
+	// proxy might be using
+	config := cfg.Proxy
+	config.ProxyProtocol = false
+	config.Listeners = 1
+	config.DnstapSocketPath = ""
+	config.DnstapFilePath = ""
+	config.QueryLogPath = ""
+	config.AuditLogPath = ""
+	config.CachePersistPath = ""
+	allowSelftestClient(&config)
+
+	port, err := freeLocalPort()
+	if !report("listen", err) {
+		return errSelftestFailed
+	}
+	config.ListenAddr = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	server, err := proxy.New(zap.NewNop(), resolver, &config)
+	if !report("proxy", err) {
+		return errSelftestFailed
+	}
+
+	for _, result := range server.ProbeUpstreams(ctx) {
+		report("upstream "+result.Upstream, result.Err)
+	}
+
+	serveCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ListenAndServeContext(serveCtx) }()
+
+	select {
+	case <-server.Listening():
+	case err := <-serveErr:
+		report("serve", err)
+		return errSelftestFailed
+	case <-ctx.Done():
+		report("serve", ctx.Err())
+		return errSelftestFailed
+	}
+
+	// Any name will do to check that queries get through to upstream and back
+	healthName := config.UpstreamHealthCheckName
+	if healthName == "" {
+		healthName = "."
+	}
+	for _, transport := range []string{"udp", "tcp"} {
+		_, err := selftestQuery(ctx, transport, config.ListenAddr, healthName, dns.TypeSOA)
+		report("serve "+transport, err)
+	}
+
+	interceptName, qtype := *name, dns.TypeA
+	if interceptName == "" {
+		interceptName, qtype = mappedName(resolver, append(slices.Clone(config.ProxyZones), config.AnswerWithoutUpstreamZones...))
+	}
+	if interceptName == "" {
+		fmt.Println("interception: skipped (no name given with -name, and none in a proxy zone found in the resolver's mappings)")
+	} else {
+		report("interception of "+interceptName, selftestInterception(ctx, config.ListenAddr, interceptName, qtype))
+	}
+
+	stop()
+	<-serveErr
+
+	if failed {
+		return errSelftestFailed
+	}
+	return nil
+}
+
+func startSelftestResolver(ctx context.Context, cfg *appConfig) (resolvers.Resolver, error) {
+	resolver, err := cfg.Resolver.Create()
+	if err != nil {
+		return nil, err
+	}
+
+	if startable, ok := resolver.(resolvers.Startable); ok {
+		if err := resolvers.StartWithTimeout(ctx, startable, cfg.Resolver.startTimeout()); err != nil {
+			return nil, err
+		}
+	}
+
+	if checker, ok := resolver.(resolvers.ReadinessChecker); ok {
+		if err := checker.Ready(); err != nil {
+			return nil, err
+		}
+	}
+
+	return resolver, nil
+}
+
+// allowSelftestClient lets the self-test's queries from loopback through the
+// config's client ACLs and interception client networks, which usually only
+// allow the tailnet. Nobody else queries the self-test's proxy, so it doesn't
+// matter that allowing loopback explicitly refuses everyone else.
+func allowSelftestClient(config *proxy.Config) {
+	config.AllowedClients = append(slices.Clone(config.AllowedClients), selftestClientCIDR)
+	if len(config.InterceptClientCIDRs) > 0 {
+		config.InterceptClientCIDRs = append(slices.Clone(config.InterceptClientCIDRs), selftestClientCIDR)
+	}
+
+	zoneACLs := make([]proxy.ZoneACL, len(config.ZoneACLs))
+	for i, acl := range config.ZoneACLs {
+		acl.AllowedClients = append(slices.Clone(acl.AllowedClients), selftestClientCIDR)
+		zoneACLs[i] = acl
+	}
+	config.ZoneACLs = zoneACLs
+}
+
+// freeLocalPort finds a loopback port that's free for both UDP and TCP, since
+// the proxy listens on both with the same address.
+func freeLocalPort() (int, error) {
+	for i := 0; i < selftestPortAttempts; i++ {
+		tcp, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, fmt.Errorf("failed to listen on TCP: %w", err)
+		}
+		port := tcp.Addr().(*net.TCPAddr).Port
+
+		udp, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		_ = tcp.Close()
+		if err != nil {
+			continue
+		}
+		_ = udp.Close()
+
+		return port, nil
+	}
+
+	return 0, errNoFreePort
+}
+
+// mappedName returns a name in one of the zones from the resolver's mappings,
+// and the type of query that should be intercepted for it, or an empty name
+// if there isn't one.
+func mappedName(resolver resolvers.Resolver, zones []string) (string, uint16) {
+	lister, ok := resolver.(resolvers.MappingLister)
+	if !ok {
+		return "", 0
+	}
+
+	mappings, err := lister.Mappings()
+	if err != nil {
+		return "", 0
+	}
+
+	for _, mapping := range mappings {
+		if len(mapping.TailscaleIPs) == 0 {
+			continue
+		}
+
+		qtype := dns.TypeA
+		if ip := net.ParseIP(mapping.TailscaleIPs[0]); ip != nil && ip.To4() == nil {
+			qtype = dns.TypeAAAA
+		}
+
+		for _, name := range mapping.Names {
+			for _, zone := range zones {
+				if dns.IsSubDomain(zone, dns.CanonicalName(name)) {
+					return name, qtype
+				}
+			}
+		}
+	}
+
+	return "", 0
+}
+
+func selftestQuery(ctx context.Context, transport string, addr string, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+
+	client := &dns.Client{Net: transport}
+	resp, _, err := client.ExchangeContext(ctx, req, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+		return nil, fmt.Errorf("%w %s", errSelftestRcode, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// selftestInterception checks that a query for the name is answered with
+// nothing but Tailscale IPs.
+func selftestInterception(ctx context.Context, addr string, name string, qtype uint16) error {
+	resp, err := selftestQuery(ctx, "udp", addr, name, qtype)
+	if err != nil {
+		return err
+	}
+
+	var ips []net.IP
+	for _, answer := range resp.Answer {
+		switch rr := answer.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+
+	if len(ips) == 0 {
+		return errSelftestNoAnswer
+	}
+	for _, ip := range ips {
+		if !iplist.IsTailscaleIP(ip) {
+			return fmt.Errorf("%w: %s", errSelftestNotRewritten, ip)
+		}
+	}
+	return nil
+}
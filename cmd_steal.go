@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/internal/ipstealer"
+	"go.uber.org/zap"
+)
+
+const stealTimeout = time.Minute
+
+var errStealerNotConfigured = errors.New("IP stealer credentials, target hostname and desired IP must be configured")
+
+// stealCommand runs the IP stealer once with the configured credentials, e.g.
+// to fix up the desired IP by hand or to check that the credentials work. It
+// runs even if the periodic stealer is disabled.
+func stealCommand(args []string) error {
+	flags := flag.NewFlagSet("steal", flag.ExitOnError)
+	configPath := configFlag(flags)
+	overrides := configOverrideFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s steal [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath, overrides)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	config := &cfg.IPStealer.Config
+	if config.ClientID == "" || config.ClientSecret == "" || config.TargetHostname == "" || config.DesiredIP == "" {
+		return errStealerNotConfigured
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return fmt.Errorf("failed to create logger: %w", err)
+	}
+	defer logger.Sync() //nolint:errcheck
+
+	ctx, cancel := context.WithTimeout(context.Background(), stealTimeout)
+	defer cancel()
+
+	stealer := ipstealer.New(ctx, logger, config)
+	if err := stealer.Steal(ctx); err != nil {
+		return fmt.Errorf("failed to steal IP: %w", err)
+	}
+
+	fmt.Printf("%s is held by %s\n", config.DesiredIP, config.TargetHostname)
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/davejbax/tailscale-dns-proxy/internal/version"
+)
+
+// versionCommand prints the build metadata of the binary.
+func versionCommand(args []string) error {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the build metadata as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s version [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	info := version.Get()
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(info); err != nil {
+			return fmt.Errorf("failed to encode build metadata: %w", err)
+		}
+		return nil
+	}
+
+	fmt.Printf("tailscale-dns-proxy %s\n", info)
+	return nil
+}
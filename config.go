@@ -1,22 +1,37 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/davejbax/tailscale-dns-proxy/internal/admin"
 	"github.com/davejbax/tailscale-dns-proxy/internal/ipstealer"
-	"github.com/davejbax/tailscale-dns-proxy/internal/proxy"
-	"github.com/davejbax/tailscale-dns-proxy/internal/resolvers"
+	"github.com/davejbax/tailscale-dns-proxy/internal/logging"
+	"github.com/davejbax/tailscale-dns-proxy/internal/reporting"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/metrics"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/proxy"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/viper"
 )
 
-var errNoResolvers = errors.New("no resolvers specified in resolver config")
+var (
+	errNoResolvers             = errors.New("no resolvers specified in resolver config")
+	errUnsupportedConfigFormat = errors.New("config file must be YAML (.yaml or .yml), JSON (.json) or TOML (.toml)")
+	errDuplicateResolverName   = errors.New("more than one resolver has name")
+)
 
 const (
 	envPrefix = "TSDNSPROXY"
+
+	defaultResolverStartTimeout = time.Minute
+	defaultWatchDebounce        = 500 * time.Millisecond
 )
 
 type appConfig struct {
@@ -25,64 +40,279 @@ type appConfig struct {
 		Enabled          bool `mapstructure:"enabled"`
 		ipstealer.Config `mapstructure:",squash" validate:"required_if=Enabled true"`
 	}
-	Resolver resolverConfig `mapstructure:"resolver"`
+	Resolver  resolverConfig    `mapstructure:"resolver"`
+	Admin     admin.Config      `mapstructure:"admin"`
+	Metrics   metrics.Config    `mapstructure:"metrics"`
+	Debug     admin.DebugConfig `mapstructure:"debug"`
+	Reporting reporting.Config  `mapstructure:"reporting"`
+	Logging   logging.Config    `mapstructure:"logging"`
+	Reload    reloadConfig      `mapstructure:"reload"`
 }
 
 type resolverConfig struct {
-	StartTimeoutSeconds int                         `mapstructure:"start_timeout_seconds"`
-	Kubernetes          *resolvers.KubernetesConfig `mapstructure:"kubernetes"`
+	// How long to wait for the resolvers to start (default 60)
+	StartTimeoutSeconds time.Duration `mapstructure:"start_timeout_seconds"`
+	// Resolvers to consult, in order of priority
+	Resolvers []resolverBlockConfig `mapstructure:"resolvers" validate:"dive"`
+
+	// A single resolver, as an alternative to Resolvers. It's consulted with
+	// priority zero alongside any others.
+	Kubernetes *resolvers.KubernetesConfig `mapstructure:"kubernetes"`
+	Plugin     *resolvers.PluginConfig     `mapstructure:"plugin"`
+}
+
+type resolverBlockConfig struct {
+	// Name by which proxy resolver bindings refer to the resolver
+	Name string `mapstructure:"name"`
+	// Resolvers with higher priorities are consulted first (default 0)
+	Priority int `mapstructure:"priority"`
+	// If given, the resolver is only consulted for queries in these zones
+	Zones []string `mapstructure:"zones"`
+
+	Kubernetes *resolvers.KubernetesConfig `mapstructure:"kubernetes"`
+	Plugin     *resolvers.PluginConfig     `mapstructure:"plugin"`
 }
 
 func (r *resolverConfig) Create() (resolvers.Resolver, error) {
+	blocks := r.Resolvers
+	if r.Kubernetes != nil || r.Plugin != nil {
+		blocks = append(blocks, resolverBlockConfig{Kubernetes: r.Kubernetes, Plugin: r.Plugin})
+	}
+
+	// There's no need for a composite resolver in the common case of a single
+	// resolver for everything
+	if len(blocks) == 1 && len(blocks[0].Zones) == 0 && blocks[0].Name == "" {
+		return blocks[0].Create()
+	}
+
+	var prioritised []resolvers.Prioritised
+	for i, block := range blocks {
+		resolver, err := block.Create()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create resolver %d: %w", i, err)
+		}
+		prioritised = append(prioritised, resolvers.Prioritised{
+			Resolver: resolver,
+			Name:     block.Name,
+			Priority: block.Priority,
+			Zones:    block.Zones,
+		})
+	}
+
+	if len(prioritised) == 0 {
+		return nil, errNoResolvers
+	}
+	return resolvers.NewCompositeResolver(prioritised...), nil
+}
+
+func (b *resolverBlockConfig) Create() (resolvers.Resolver, error) {
 	switch {
-	case r.Kubernetes != nil:
-		return resolvers.NewKubernetesResolverWithDefaultClient(r.Kubernetes)
+	case b.Kubernetes != nil:
+		return resolvers.NewKubernetesResolverWithDefaultClient(b.Kubernetes)
+	case b.Plugin != nil:
+		return resolvers.NewPluginResolver(b.Plugin)
 	default:
 		return nil, errNoResolvers
 	}
 }
 
-func loadConfig() (*appConfig, error) {
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath("/etc/tsdnsproxy")
-	viper.AddConfigPath(".")
-	viper.SetEnvPrefix(envPrefix)
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "__")) // Converts Viper keys into env var keys
+// configDirs returns the directories searched for a config file, in order.
+func configDirs() []string {
+	return []string{"/etc/tsdnsproxy", "."}
+}
 
-	// TODO: replace this with viper.BindStruct once released and stable;
-	// see https://github.com/spf13/viper/issues/1706
-	// and https://github.com/spf13/viper/pull/1707
-	// and https://github.com/spf13/viper/issues/761
-	for _, e := range os.Environ() {
-		split := strings.Split(e, "=")
-		envVariable := split[0]
+// configExtensions returns the extensions of the config formats we accept.
+func configExtensions() []string {
+	return []string{".yaml", ".yml", ".json", ".toml"}
+}
 
-		// Trim prefix and only proceed if we successfully trimmed it (i.e. skip non-prefixed vars)
-		if envKey := strings.TrimPrefix(envVariable, envPrefix+"_"); envKey != envVariable && len(envKey) > 0 {
-			// Only cause of error here is if the argument is empty, which we know it isn't
-			_ = viper.BindEnv(strings.ReplaceAll(envKey, "__", "."))
+func isConfigExtension(ext string) bool {
+	for _, e := range configExtensions() {
+		if strings.EqualFold(e, ext) {
+			return true
 		}
 	}
+	return false
+}
 
-	if err := viper.ReadInConfig(); err != nil {
-		if errors.As(err, &viper.ConfigFileNotFoundError{}) {
+// findConfigFile returns the first config file in the config directories, or
+// an empty string if there isn't one.
+func findConfigFile() string {
+	for _, dir := range configDirs() {
+		for _, ext := range configExtensions() {
+			path := filepath.Join(dir, "config"+ext)
+			if _, err := os.Stat(path); err == nil {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// configFlag adds a flag for the path of the config file to the flag set. It
+// defaults to the TSDNSPROXY_CONFIG environment variable.
+func configFlag(flags *flag.FlagSet) *string {
+	return flags.String("config", os.Getenv(envPrefix+"_CONFIG"),
+		"Path of the config file, as YAML, JSON or TOML (default: config.{yaml,yml,json,toml} in /etc/tsdnsproxy or the working directory)")
+}
+
+// loadConfig reads the config from the given file (or, if empty, the first
+// config file found), the environment and any overrides, and validates it.
+func loadConfig(path string, overrides configOverrides) (*appConfig, error) {
+	config, err := readConfig(path, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	if err := normaliseZones(config); err != nil {
+		return nil, fmt.Errorf("config is invalid: %w", err)
+	}
+
+	return config, nil
+}
+
+// readConfig reads the config from the given file (or, if empty, the first
+// config file found), the environment and any overrides.
+func readConfig(path string, overrides configOverrides) (*appConfig, error) {
+	// We don't care about the config not being found when we're searching
+	// for it, because it's theoretically possible to configure entirely with
+	// env vars
+	if path == "" {
+		path = findConfigFile()
+	}
+
+	if path != "" {
+		// The format is chosen by the file's extension
+		ext := filepath.Ext(path)
+		if !isConfigExtension(ext) {
+			return nil, fmt.Errorf("%w: '%s'", errUnsupportedConfigFormat, path)
+		}
+		viper.SetConfigType(strings.ToLower(strings.TrimPrefix(ext, ".")))
+
+		contents, err := os.ReadFile(path)
+		if err != nil {
 			return nil, fmt.Errorf("failed to read config: %w", err)
 		}
-		// We don't care about the config not being found, because it's theoretically
-		// possible to configure entirely with env vars.
+
+		if err := viper.ReadConfig(bytes.NewReader(contents)); err != nil {
+			return nil, fmt.Errorf("failed to parse config '%s': %w", path, err)
+		}
+
+		// Env var references are interpolated in the parsed values, rather
+		// than the file's text, so that they can't change its structure
+		file := viper.AllSettings()
+		if err := interpolateEnv(file, ""); err != nil {
+			return nil, fmt.Errorf("failed to interpolate config '%s': %w", path, err)
+		}
+		if err := viper.MergeConfigMap(file); err != nil {
+			return nil, fmt.Errorf("failed to interpolate config '%s': %w", path, err)
+		}
 	}
 
-	var config appConfig
-	err := viper.Unmarshal(&config)
+	// Env vars take precedence over the config file, and flags over both
+	env, err := envSettings()
 	if err != nil {
+		return nil, fmt.Errorf("failed to read config from environment: %w", err)
+	}
+	if err := viper.MergeConfigMap(env); err != nil {
+		return nil, fmt.Errorf("failed to read config from environment: %w", err)
+	}
+
+	for key, value := range overrides {
+		viper.Set(key, value)
+	}
+
+	// Duration strings have to be converted before unmarshalling, since
+	// decode hooks can't tell which unit an int field is in. Secret files are
+	// read at the same time, as they don't correspond to fields at all.
+	settings := viper.AllSettings()
+	if err := normaliseDurations(settings, ""); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := loadSecretFiles(settings, ""); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	normalised := viper.New()
+	if err := normalised.MergeConfigMap(settings); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var config appConfig
+	if err := normalised.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	return &config, nil
+}
+
+func validateConfig(config *appConfig) error {
 	validate := validator.New()
 	if err := validate.Struct(config); err != nil {
-		return nil, fmt.Errorf("config is invalid: %w", err)
+		return fmt.Errorf("config is invalid: %w", err)
+	}
+	if err := config.Resolver.validateNames(); err != nil {
+		return fmt.Errorf("config is invalid: %w", err)
 	}
+	return nil
+}
 
-	return &config, nil
+// validateNames checks that resolver names are unique, as bindings would
+// otherwise silently pick whichever resolver with the name comes first.
+func (r *resolverConfig) validateNames() error {
+	seen := make(map[string]bool)
+	for _, block := range r.Resolvers {
+		if block.Name == "" {
+			continue
+		}
+		if seen[block.Name] {
+			return fmt.Errorf("%w '%s'", errDuplicateResolverName, block.Name)
+		}
+		seen[block.Name] = true
+	}
+	return nil
+}
+
+// normaliseZones canonicalises the zone names in the config, in place.
+func normaliseZones(config *appConfig) error {
+	if err := config.Proxy.NormaliseZones(); err != nil {
+		return fmt.Errorf("proxy: %w", err)
+	}
+
+	for i, block := range config.Resolver.Resolvers {
+		for j, zone := range block.Zones {
+			normalised, err := proxy.NormaliseZone(zone)
+			if err != nil {
+				return fmt.Errorf("resolver.resolvers[%d].zones: %w", i, err)
+			}
+			block.Zones[j] = normalised
+		}
+	}
+
+	return nil
+}
+
+func (r *resolverConfig) startTimeout() time.Duration {
+	if r.StartTimeoutSeconds <= 0 {
+		return defaultResolverStartTimeout
+	}
+	return r.StartTimeoutSeconds
+}
+
+type reloadConfig struct {
+	// Reload when the config file changes, e.g. for configs mounted from a
+	// Kubernetes ConfigMap, where signalling is awkward
+	WatchFile           bool          `mapstructure:"watch_file"`
+	WatchDebounceMillis time.Duration `mapstructure:"watch_debounce_millis" validate:"gte=0"`
+}
+
+func (c *reloadConfig) watchDebounce() time.Duration {
+	if c.WatchDebounceMillis == 0 {
+		return defaultWatchDebounce
+	}
+	return c.WatchDebounceMillis
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errDurationType = errors.New("duration must be a number or a duration string")
+
+// durationUnit returns the unit of config values with the given key, going
+// by its suffix, or zero if the key isn't a duration.
+func durationUnit(key string) time.Duration {
+	switch {
+	case strings.HasSuffix(key, "_seconds"):
+		return time.Second
+	case strings.HasSuffix(key, "_millis"):
+		return time.Millisecond
+	default:
+		return 0
+	}
+}
+
+// normaliseDurations converts *_seconds and *_millis config values into
+// durations, in place, so that they can be given either as numbers of the
+// key's unit or as Go duration strings (e.g. "2m" or "500ms").
+func normaliseDurations(settings map[string]any, path string) error {
+	for key, value := range settings {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		switch value := value.(type) {
+		case map[string]any:
+			if err := normaliseDurations(value, keyPath); err != nil {
+				return err
+			}
+		case []any:
+			for i, element := range value {
+				if m, ok := element.(map[string]any); ok {
+					if err := normaliseDurations(m, fmt.Sprintf("%s[%d]", keyPath, i)); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			unit := durationUnit(key)
+			if unit == 0 || value == nil {
+				continue
+			}
+
+			converted, err := parseDurationIn(value, unit)
+			if err != nil {
+				return fmt.Errorf("invalid duration for '%s': %w", keyPath, err)
+			}
+			settings[key] = converted
+		}
+	}
+
+	return nil
+}
+
+// parseDurationIn parses either a number of the unit, which may be a string
+// (as it would be from an environment variable), or a duration string.
+func parseDurationIn(value any, unit time.Duration) (time.Duration, error) {
+	switch value := value.(type) {
+	case time.Duration:
+		return value, nil
+	case int:
+		return time.Duration(value) * unit, nil
+	case int64:
+		return time.Duration(value) * unit, nil
+	case float64:
+		return time.Duration(value * float64(unit)), nil
+	case string:
+		if n, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			return time.Duration(n * float64(unit)), nil
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse duration: %w", err)
+		}
+		return d, nil
+	default:
+		return 0, fmt.Errorf("%w, not %T", errDurationType, value)
+	}
+}
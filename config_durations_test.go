@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDurationIn(t *testing.T) {
+	tests := []struct {
+		value any
+		unit  time.Duration
+		want  time.Duration
+	}{
+		{30, time.Second, 30 * time.Second},
+		{250, time.Millisecond, 250 * time.Millisecond},
+		{1.5, time.Second, 1500 * time.Millisecond},
+		{"45", time.Second, 45 * time.Second},
+		{" 0.25 ", time.Second, 250 * time.Millisecond},
+		{"500ms", time.Second, 500 * time.Millisecond},
+		{"2m", time.Millisecond, 2 * time.Minute},
+		{90 * time.Second, time.Millisecond, 90 * time.Second},
+	}
+	for _, test := range tests {
+		got, err := parseDurationIn(test.value, test.unit)
+		if err != nil {
+			t.Errorf("%v in %s: %v", test.value, test.unit, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%v in %s: got %s, want %s", test.value, test.unit, got, test.want)
+		}
+	}
+
+	for _, value := range []any{"soon", true, []any{1}} {
+		if _, err := parseDurationIn(value, time.Second); err == nil {
+			t.Errorf("%v: expected an error", value)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envVar returns the name of the env var that sets the config option with
+// the given key, e.g. TSDNSPROXY_PROXY__LISTEN_ADDR for proxy.listen_addr.
+func envVar(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "__"))
+}
+
+// envSettings returns the config options set by env vars, nested like the
+// config file. Lists of scalars are given comma-separated (e.g.
+// TSDNSPROXY_PROXY__UPSTREAMS=1.1.1.1,8.8.8.8); lists of structs, maps, and
+// lists that need commas in their values are given as JSON or YAML. Maps can
+// also be set a key at a time, e.g.
+// TSDNSPROXY_RESOLVER__PLUGIN__CONFIG__ENDPOINT for resolver.plugin.config's
+// 'endpoint' key. Empty env vars are treated as unset.
+func envSettings() (map[string]any, error) {
+	settings := make(map[string]any)
+
+	var err error
+	walkConfigOptions(reflect.TypeOf(appConfig{}), "", func(key string, t reflect.Type) {
+		if err != nil {
+			return
+		}
+
+		keys := []string{key}
+		if isSecretKey(key[strings.LastIndex(key, ".")+1:]) {
+			keys = append(keys, key+secretFileSuffix)
+		}
+
+		for _, key := range keys {
+			raw, ok := os.LookupEnv(envVar(key))
+			if !ok || strings.TrimSpace(raw) == "" {
+				continue
+			}
+
+			var value any
+			value, err = envValue(raw, t)
+			if err != nil {
+				err = fmt.Errorf("invalid value for %s: %w", envVar(key), err)
+				return
+			}
+			setNested(settings, strings.Split(key, "."), value)
+		}
+
+		if t.Kind() == reflect.Map {
+			err = envMapEntries(settings, key, t.Elem())
+		}
+	})
+
+	return settings, err
+}
+
+// envMapEntries sets the entries of the map option with the given key that
+// are given by their own env vars, on top of any given for the whole map.
+// Keys are lower-cased, as env vars are conventionally upper case, and
+// nested with '__' like option keys.
+func envMapEntries(settings map[string]any, key string, elem reflect.Type) error {
+	prefix := envVar(key) + "__"
+
+	for _, env := range os.Environ() {
+		name, raw, _ := strings.Cut(env, "=")
+		entry, ok := strings.CutPrefix(name, prefix)
+		if !ok || entry == "" || strings.TrimSpace(raw) == "" {
+			continue
+		}
+
+		value, err := envValue(raw, elem)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+
+		path := strings.Split(key, ".")
+		path = append(path, strings.Split(strings.ToLower(entry), "__")...)
+		setNested(settings, path, value)
+	}
+
+	return nil
+}
+
+// envValue converts an env var's value for an option of the given type into
+// what the option would hold if it came from the config file. Scalars are
+// left as strings for the usual weakly-typed decoding.
+func envValue(raw string, t reflect.Type) (any, error) {
+	switch t.Kind() {
+	case reflect.Slice:
+		if isScalar(t.Elem()) && !strings.HasPrefix(strings.TrimSpace(raw), "[") {
+			values := strings.Split(raw, ",")
+			for i, value := range values {
+				values[i] = strings.TrimSpace(value)
+			}
+			return values, nil
+		}
+	case reflect.Map, reflect.Interface:
+		// Always structured
+	default:
+		return raw, nil
+	}
+
+	// JSON is YAML, so this takes either
+	var value any
+	if err := yaml.Unmarshal([]byte(raw), &value); err != nil {
+		return nil, fmt.Errorf("failed to parse as JSON or YAML: %w", err)
+	}
+	return value, nil
+}
+
+// setNested sets the value at the path of keys in nested maps, creating maps
+// along the way as needed.
+func setNested(settings map[string]any, path []string, value any) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := settings[key].(map[string]any)
+		if !ok {
+			next = make(map[string]any)
+			settings[key] = next
+		}
+		settings = next
+	}
+	settings[path[len(path)-1]] = value
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnvSettings(t *testing.T) {
+	tests := []struct {
+		desc string
+		env  map[string]string
+		want map[string]any
+	}{
+		{
+			desc: "scalar",
+			env:  map[string]string{"TSDNSPROXY_PROXY__LISTEN_ADDR": "0.0.0.0:53"},
+			want: map[string]any{"proxy": map[string]any{"listen_addr": "0.0.0.0:53"}},
+		},
+		{
+			desc: "comma-separated list",
+			env:  map[string]string{"TSDNSPROXY_PROXY__UPSTREAMS": "1.1.1.1, 8.8.8.8"},
+			want: map[string]any{"proxy": map[string]any{"upstreams": []string{"1.1.1.1", "8.8.8.8"}}},
+		},
+		{
+			desc: "JSON list",
+			env:  map[string]string{"TSDNSPROXY_PROXY__UPSTREAMS": `["tls://1.1.1.1", "8.8.8.8"]`},
+			want: map[string]any{"proxy": map[string]any{"upstreams": []any{"tls://1.1.1.1", "8.8.8.8"}}},
+		},
+		{
+			desc: "list of structs as YAML",
+			env:  map[string]string{"TSDNSPROXY_PROXY__VIEWS": "[{name: kids, client_cidrs: [100.64.1.0/24]}]"},
+			want: map[string]any{"proxy": map[string]any{"views": []any{
+				map[string]any{"name": "kids", "client_cidrs": []any{"100.64.1.0/24"}},
+			}}},
+		},
+		{
+			desc: "whole map and map entries",
+			env: map[string]string{
+				"TSDNSPROXY_RESOLVER__PLUGIN__CONFIG":                 `{"endpoint": "http://localhost", "retries": 3}`,
+				"TSDNSPROXY_RESOLVER__PLUGIN__CONFIG__TIMEOUT":        "5s",
+				"TSDNSPROXY_RESOLVER__PLUGIN__CONFIG__AUTH__USERNAME": "proxy",
+			},
+			want: map[string]any{"resolver": map[string]any{"plugin": map[string]any{"config": map[string]any{
+				"endpoint": "http://localhost",
+				"retries":  3,
+				"timeout":  "5s",
+				"auth":     map[string]any{"username": "proxy"},
+			}}}},
+		},
+		{
+			desc: "secret file",
+			env:  map[string]string{"TSDNSPROXY_IPSTEALER__CLIENT_SECRET_FILE": "/run/secrets/client"},
+			want: map[string]any{"ipstealer": map[string]any{"client_secret_file": "/run/secrets/client"}},
+		},
+		{
+			desc: "empty and blank values are unset",
+			env:  map[string]string{"TSDNSPROXY_PROXY__LISTEN_ADDR": "", "TSDNSPROXY_PROXY__UPSTREAMS": "  "},
+			want: map[string]any{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			got, err := envSettings()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEnvSettingsInvalid(t *testing.T) {
+	t.Setenv("TSDNSPROXY_RESOLVER__PLUGIN__CONFIG", "{unterminated")
+	if _, err := envSettings(); err == nil {
+		t.Error("expected an error for an unparseable map")
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := map[string]any{
+		"ipstealer": map[string]any{"client_secret_file": path},
+		"proxy":     map[string]any{"upstream_tls_ca_file": "/etc/ssl/ca.pem"},
+	}
+	if err := loadSecretFiles(settings, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{
+		"ipstealer": map[string]any{"client_secret": "hunter2"},
+		"proxy":     map[string]any{"upstream_tls_ca_file": "/etc/ssl/ca.pem"},
+	}
+	if !reflect.DeepEqual(settings, want) {
+		t.Errorf("got %#v, want %#v", settings, want)
+	}
+
+	twice := map[string]any{"client_secret": "direct", "client_secret_file": path}
+	if err := loadSecretFiles(twice, ""); err == nil {
+		t.Error("expected an error for a secret given twice")
+	}
+}
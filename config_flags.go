@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+)
+
+// configOverrides are config values given as command-line flags, keyed like
+// the config file (e.g. proxy.listen_addr). They take precedence over both
+// the config file and env vars.
+type configOverrides map[string]any
+
+// configOverrideFlag sets a config value from a flag. Lists are given
+// comma-separated.
+type configOverrideFlag struct {
+	overrides configOverrides
+	key       string
+	list      bool
+	isBool    bool
+}
+
+func (f *configOverrideFlag) String() string {
+	if f == nil || f.overrides == nil {
+		return ""
+	}
+	if value, ok := f.overrides[f.key]; ok {
+		if list, ok := value.([]string); ok {
+			return strings.Join(list, ",")
+		}
+		if s, ok := value.(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+func (f *configOverrideFlag) Set(value string) error {
+	if f.list {
+		f.overrides[f.key] = strings.Split(value, ",")
+		return nil
+	}
+	f.overrides[f.key] = value
+	return nil
+}
+
+func (f *configOverrideFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// configOverrideFlags defines a flag for every config option that can be
+// given on the command line: everything except lists of structs and maps.
+func configOverrideFlags(flags *flag.FlagSet) configOverrides {
+	overrides := make(configOverrides)
+	walkConfigOptions(reflect.TypeOf(appConfig{}), "", func(key string, t reflect.Type) {
+		if !isScalar(t) && !(t.Kind() == reflect.Slice && isScalar(t.Elem())) {
+			return
+		}
+
+		option := &configOverrideFlag{overrides: overrides, key: key}
+		usage := "Config option " + key
+
+		switch t.Kind() {
+		case reflect.Slice:
+			option.list = true
+			usage += " (comma-separated)"
+		case reflect.Bool:
+			option.isBool = true
+		}
+
+		// Secrets can only be given in files, since command lines are visible
+		// to other users, e.g. through ps
+		if isSecretKey(key[strings.LastIndex(key, ".")+1:]) {
+			flags.Var(&configOverrideFlag{overrides: overrides, key: key + secretFileSuffix}, key+secretFileSuffix, usage+", read from a file")
+			return
+		}
+		flags.Var(option, key, usage)
+	})
+
+	return overrides
+}
+
+// walkConfigOptions calls visit with the key and type of every config option,
+// descending into structs (but not lists or maps of them).
+func walkConfigOptions(t reflect.Type, prefix string, visit func(key string, t reflect.Type)) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+
+		if options == "squash" {
+			walkConfigOptions(fieldType, prefix, visit)
+			continue
+		}
+
+		key := prefix + name
+		if fieldType.Kind() == reflect.Struct {
+			walkConfigOptions(fieldType, key+".", visit)
+			continue
+		}
+		visit(key, fieldType)
+	}
+}
+
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	default:
+		return false
+	}
+}
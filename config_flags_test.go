@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestConfigOverrideFlags(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := configOverrideFlags(flags)
+
+	for _, name := range []string{"admin.auth_token", "admin.dashboard.password", "ipstealer.client_secret"} {
+		if flags.Lookup(name) != nil {
+			t.Errorf("secret %s has a plaintext flag", name)
+		}
+		if flags.Lookup(name+secretFileSuffix) == nil {
+			t.Errorf("secret %s has no %s flag", name, secretFileSuffix)
+		}
+	}
+
+	err := flags.Parse([]string{
+		"-proxy.listen_addr", "127.0.0.1:53",
+		"-proxy.upstreams", "1.1.1.1,8.8.8.8",
+		"-admin.auth_token_file", "/run/secrets/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := overrides["proxy.listen_addr"]; got != "127.0.0.1:53" {
+		t.Errorf("got listen_addr %v", got)
+	}
+	if got, ok := overrides["proxy.upstreams"].([]string); !ok || len(got) != 2 {
+		t.Errorf("got upstreams %v", overrides["proxy.upstreams"])
+	}
+	if got := overrides["admin.auth_token_file"]; got != "/run/secrets/token" {
+		t.Errorf("got auth_token_file %v", got)
+	}
+}
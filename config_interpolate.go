@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var errUndefinedEnvVar = errors.New("config refers to undefined environment variable")
+
+// envReference matches ${VAR} and ${VAR:-default}, and $${...}, which escapes
+// them.
+func envReference() *regexp.Regexp {
+	return regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+}
+
+// interpolateEnv replaces ${VAR} references in the config file's string
+// values with the values of environment variables, in place. Only parsed
+// values are interpolated, so references in comments are ignored and values
+// never need escaping for the file's format. ${VAR:-default} gives a default
+// for when the variable is unset or empty, and $${VAR} is left as a literal
+// ${VAR}. Bare $VAR references aren't replaced, so that regexes in the config
+// don't need escaping.
+func interpolateEnv(settings map[string]any, path string) error {
+	var errs []error
+	for key, value := range settings {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		interpolated, err := interpolateValue(value, keyPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		settings[key] = interpolated
+	}
+
+	return errors.Join(errs...)
+}
+
+func interpolateValue(value any, path string) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		return value, interpolateEnv(value, path)
+	case []any:
+		var errs []error
+		for i, element := range value {
+			interpolated, err := interpolateValue(element, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			value[i] = interpolated
+		}
+		return value, errors.Join(errs...)
+	case string:
+		return interpolateString(value, path)
+	default:
+		return value, nil
+	}
+}
+
+func interpolateString(value string, path string) (string, error) {
+	re := envReference()
+
+	var undefined []error
+	interpolated := re.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref[1] == '$' {
+			return ref[1:]
+		}
+
+		match := re.FindStringSubmatch(ref)
+		name, hasDefault, fallback := match[1], match[2] != "", match[3]
+
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		if hasDefault {
+			return fallback
+		}
+
+		undefined = append(undefined, fmt.Errorf("%w: '%s' in '%s'", errUndefinedEnvVar, name, path))
+		return ""
+	})
+
+	if len(undefined) > 0 {
+		return "", errors.Join(undefined...)
+	}
+	return interpolated, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("TEST_UPSTREAM", "1.1.1.1")
+	t.Setenv("TEST_EMPTY", "")
+
+	tests := []struct {
+		desc     string
+		settings map[string]any
+		want     map[string]any
+		err      error
+	}{
+		{
+			desc:     "nested values and lists",
+			settings: map[string]any{"proxy": map[string]any{"upstreams": []any{"tls://${TEST_UPSTREAM}", "8.8.8.8"}}},
+			want:     map[string]any{"proxy": map[string]any{"upstreams": []any{"tls://1.1.1.1", "8.8.8.8"}}},
+		},
+		{
+			desc:     "defaults for unset and empty variables",
+			settings: map[string]any{"a": "${TEST_UNSET:-x}", "b": "${TEST_EMPTY:-y}", "c": "${TEST_UNSET:-}"},
+			want:     map[string]any{"a": "x", "b": "y", "c": ""},
+		},
+		{
+			desc:     "escaped and bare references",
+			settings: map[string]any{"pattern": "^$TEST_UPSTREAM$", "literal": "$${TEST_UPSTREAM}"},
+			want:     map[string]any{"pattern": "^$TEST_UPSTREAM$", "literal": "${TEST_UPSTREAM}"},
+		},
+		{
+			desc:     "non-string values",
+			settings: map[string]any{"port": 53, "enabled": true},
+			want:     map[string]any{"port": 53, "enabled": true},
+		},
+		{
+			desc:     "undefined variable",
+			settings: map[string]any{"proxy": map[string]any{"views": []any{map[string]any{"name": "${TEST_UNSET}"}}}},
+			err:      errUndefinedEnvVar,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := interpolateEnv(tt.settings, "")
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.settings, tt.want) {
+				t.Errorf("got %v, want %v", tt.settings, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigInterpolatesValues(t *testing.T) {
+	// Values are inserted after parsing, so they can't break out of a string,
+	// and references in comments don't need to be defined
+	t.Setenv("TEST_LISTEN_ADDR", "127.0.0.1:53\"\nupstreams: [evil]")
+	t.Setenv("TEST_EDNS_SIZE", "1232")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	contents := `# Set ${TEST_UNDEFINED} to do something
+proxy:
+  listen_addr: "${TEST_LISTEN_ADDR}"
+  upstreams: [1.1.1.1]
+  edns_udp_size: ${TEST_EDNS_SIZE}
+`
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := readConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Proxy.ListenAddr != "127.0.0.1:53\"\nupstreams: [evil]" {
+		t.Errorf("got listen address %q", config.Proxy.ListenAddr)
+	}
+	if !reflect.DeepEqual(config.Proxy.Upstreams, []string{"1.1.1.1"}) {
+		t.Errorf("got upstreams %v", config.Proxy.Upstreams)
+	}
+	if config.Proxy.EDNSUDPSize != 1232 {
+		t.Errorf("got EDNS UDP size %d", config.Proxy.EDNSUDPSize)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Largest config patch that the admin API will read
+const maxConfigPatchSize = 1 << 20
+
+var (
+	errConfigPatchNotObject = errors.New("config patch must be a JSON object")
+	errConfigPatchScope     = errors.New("only the proxy section can be patched")
+)
+
+// configPatches are changes to the config made through the admin API, keyed
+// like configOverrides. They're kept in memory, on top of the config file, env
+// vars and flags, so that they survive reloads but not restarts.
+type configPatches map[string]any
+
+// apply returns the patches with a JSON merge patch (RFC 7396) applied: each
+// value replaces the option (or section) at its key, and nulls remove patches,
+// returning options to the value they'd have without them.
+func (c configPatches) apply(patch map[string]any) configPatches {
+	patched := make(configPatches, len(c))
+	for key, value := range c {
+		patched[key] = value
+	}
+
+	flattenPatch(patched, "", patch)
+	return patched
+}
+
+// flattenPatch sets the leaves of a nested patch in the patches by their dotted
+// keys. Objects are merged into what's already patched, whereas other values
+// (and nulls) replace anything patched below their key.
+func flattenPatch(patches configPatches, prefix string, patch map[string]any) {
+	for key, value := range patch {
+		key = prefix + strings.ToLower(key)
+
+		if section, ok := value.(map[string]any); ok {
+			delete(patches, key)
+			flattenPatch(patches, key+".", section)
+			continue
+		}
+
+		for existing := range patches {
+			if strings.HasPrefix(existing, key+".") {
+				delete(patches, existing)
+			}
+		}
+
+		if value == nil {
+			delete(patches, key)
+		} else {
+			patches[key] = value
+		}
+	}
+}
+
+// withPatches returns the overrides with the patches on top of them.
+func withPatches(overrides configOverrides, patches configPatches) configOverrides {
+	combined := make(configOverrides, len(overrides)+len(patches))
+	for key, value := range overrides {
+		combined[key] = value
+	}
+	for key, value := range patches {
+		combined[key] = value
+	}
+	return combined
+}
+
+// readConfigPatch reads a JSON merge patch of the proxy section from a
+// request body.
+func readConfigPatch(body io.Reader) (map[string]any, error) {
+	var patch map[string]any
+	if err := json.NewDecoder(io.LimitReader(body, maxConfigPatchSize)).Decode(&patch); err != nil {
+		return nil, fmt.Errorf("%w: %w", errConfigPatchNotObject, err)
+	}
+
+	if err := validateConfigPatch(patch); err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// validateConfigPatch checks that a JSON merge patch only patches the proxy
+// section.
+func validateConfigPatch(patch map[string]any) error {
+	// Only the proxy section can be reloaded, so patches to anything else
+	// wouldn't take effect until a restart (which would lose them)
+	for key := range patch {
+		if !strings.EqualFold(key, "proxy") {
+			return fmt.Errorf("%w: '%s'", errConfigPatchScope, key)
+		}
+	}
+	for _, section := range patch {
+		if _, ok := section.(map[string]any); !ok && section != nil {
+			return fmt.Errorf("%w: 'proxy'", errConfigPatchNotObject)
+		}
+	}
+
+	return nil
+}
+
+// patchConfig asks for the patch to be applied and the config reloaded,
+// returning the outcome of the reload, or the context's error if it's done
+// first.
+func patchConfig(ctx context.Context, reloads chan<- reloadRequest, trigger string, patch map[string]any) error {
+	result := make(chan error, 1)
+	select {
+	case reloads <- reloadRequest{trigger: trigger, patch: patch, result: result}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// grpcPatchConfig implements the gRPC control API's PatchConfig, which works
+// like PATCH /config.
+func grpcPatchConfig(reloads chan<- reloadRequest) func(context.Context, map[string]any) error {
+	return func(ctx context.Context, patch map[string]any) error {
+		if err := validateConfigPatch(patch); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		if err := patchConfig(ctx, reloads, "gRPC config patch", patch); err != nil {
+			if ctx.Err() != nil {
+				return status.FromContextError(ctx.Err()).Err()
+			}
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil
+	}
+}
+
+// configPatchHandler serves the admin API's PATCH /config, which applies a
+// JSON merge patch to the proxy section of the config and reloads it, for
+// controllers that manage the proxy at runtime. Patches that don't make a
+// valid config are rejected, leaving the config as it was.
+func configPatchHandler(reloads chan<- reloadRequest) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		patch, err := readConfigPatch(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := patchConfig(r.Context(), reloads, "admin API config patch", patch); err != nil {
+			if r.Context().Err() == nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// configSchema returns a JSON Schema for config files, derived from the
+// config structs' mapstructure and validate tags. Required fields aren't
+// marked as such, since they may be given as env vars instead.
+func configSchema() map[string]any {
+	schema := typeSchema(reflect.TypeOf(appConfig{}), "")
+	schema["$schema"] = jsonSchemaDraft
+	schema["title"] = "tailscale-dns-proxy config"
+	return schema
+}
+
+// typeSchema returns the schema for values of the type, with the constraints
+// from a validate tag applied.
+func typeSchema(t reflect.Type, validate string) map[string]any {
+	// Constraints after 'dive' apply to elements rather than the value itself
+	own, elements, _ := strings.Cut(validate, ",dive")
+	if strings.HasPrefix(validate, "dive") {
+		own, elements = "", strings.TrimPrefix(validate, "dive")
+	}
+	elements = strings.TrimPrefix(elements, ",")
+
+	var schema map[string]any
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), validate)
+	case reflect.Struct:
+		schema = structSchema(t)
+	case reflect.Slice, reflect.Array:
+		schema = map[string]any{"type": "array", "items": typeSchema(t.Elem(), elements)}
+	case reflect.Map:
+		schema = map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem(), elements)}
+	case reflect.Bool:
+		schema = map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema = map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		schema = map[string]any{"type": "number"}
+	case reflect.String:
+		schema = map[string]any{"type": "string"}
+	default:
+		// Anything goes, e.g. plugin config
+		return map[string]any{}
+	}
+
+	applyConstraints(schema, t, own)
+
+	// Env var references are interpolated in string values, and strings are
+	// converted when unmarshalling, so any scalar can be given as a string
+	// holding one, e.g. port: "${PORT}"
+	if schema["type"] != "string" && isScalar(t) {
+		return map[string]any{"anyOf": []any{schema, envReferenceSchema()}}
+	}
+	return schema
+}
+
+func envReferenceSchema() map[string]any {
+	return map[string]any{"type": "string", "pattern": envReference().String()}
+}
+
+func structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "-" {
+			continue
+		}
+
+		schema := typeSchema(field.Type, field.Tag.Get("validate"))
+		if options == "squash" {
+			if squashed, ok := schema["properties"].(map[string]any); ok {
+				for k, v := range squashed {
+					properties[k] = v
+				}
+			}
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		// Durations can be fractions of their unit, or any string, e.g.
+		// "90s", which covers env var references too
+		if anyOf, ok := schema["anyOf"].([]any); ok && durationUnit(name) != 0 {
+			if integer, ok := anyOf[0].(map[string]any); ok && integer["type"] == "integer" {
+				integer["type"] = []string{"number", "string"}
+				schema = integer
+			}
+		}
+
+		properties[name] = schema
+		if isSecretKey(name) {
+			properties[name+secretFileSuffix] = map[string]any{"type": "string"}
+		}
+	}
+
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// applyConstraints adds the constraints of validate tag rules that have a
+// JSON Schema equivalent to the schema. Other rules are left out.
+func applyConstraints(schema map[string]any, t reflect.Type, validate string) {
+	var lower, upper, exclusiveLower, exclusiveUpper string
+	switch schema["type"] {
+	case "integer", "number":
+		lower, upper, exclusiveLower, exclusiveUpper = "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum"
+	case "string":
+		lower, upper = "minLength", "maxLength"
+	case "array":
+		lower, upper = "minItems", "maxItems"
+	}
+
+	for _, rule := range strings.Split(validate, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "gte", "min":
+			setBound(schema, lower, param)
+		case "lte", "max":
+			setBound(schema, upper, param)
+		case "gt":
+			setBound(schema, exclusiveLower, param)
+		case "lt":
+			setBound(schema, exclusiveUpper, param)
+		case "oneof":
+			var values []any
+			for _, value := range strings.Fields(param) {
+				if n, err := strconv.ParseInt(value, 10, 64); err == nil && t.Kind() != reflect.String {
+					values = append(values, n)
+				} else {
+					values = append(values, value)
+				}
+			}
+			schema["enum"] = values
+		case "url":
+			schema["format"] = "uri"
+		case "hostname":
+			schema["format"] = "hostname"
+		case "ipv4", "ipv6":
+			schema["format"] = name
+		}
+	}
+}
+
+func setBound(schema map[string]any, keyword string, param string) {
+	if keyword == "" {
+		return
+	}
+	if n, err := strconv.ParseFloat(param, 64); err == nil {
+		schema[keyword] = n
+	}
+}
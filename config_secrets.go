@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const secretFileSuffix = "_file"
+
+var errSecretGivenTwice = errors.New("secret given both directly and as a file")
+
+// isSecretKey returns true if config values with the key are secret.
+func isSecretKey(key string) bool {
+	switch key {
+	case "client_secret", "secret", "password", "auth_token", "sentry_dsn",
+		// Webhook URLs carry their own credentials
+		"webhook_url", "url":
+		return true
+	default:
+		return false
+	}
+}
+
+// loadSecretFiles replaces *_file variants of secret config values (e.g.
+// client_secret_file) with the trimmed contents of the files they name, in
+// place, so that secrets can be mounted as files rather than put in the
+// config or environment.
+func loadSecretFiles(settings map[string]any, path string) error {
+	for key, value := range settings {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		switch value := value.(type) {
+		case map[string]any:
+			if err := loadSecretFiles(value, keyPath); err != nil {
+				return err
+			}
+		case []any:
+			for i, element := range value {
+				if m, ok := element.(map[string]any); ok {
+					if err := loadSecretFiles(m, fmt.Sprintf("%s[%d]", keyPath, i)); err != nil {
+						return err
+					}
+				}
+			}
+		case string:
+			secretKey, ok := strings.CutSuffix(key, secretFileSuffix)
+			if !ok || !isSecretKey(secretKey) || value == "" {
+				continue
+			}
+
+			if existing, ok := settings[secretKey]; ok && existing != "" {
+				return fmt.Errorf("%w: '%s'", errSecretGivenTwice, keyPath)
+			}
+
+			contents, err := os.ReadFile(value)
+			if err != nil {
+				return fmt.Errorf("failed to read secret file for '%s': %w", keyPath, err)
+			}
+
+			settings[secretKey] = strings.TrimSpace(string(contents))
+			delete(settings, key)
+		}
+	}
+
+	return nil
+}
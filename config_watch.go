@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// Symlink through which Kubernetes atomically updates the files of a mounted
+// ConfigMap or Secret
+const configMapDataDir = "..data"
+
+// watchConfigFile requests a config reload whenever the contents of the config
+// file change, until the context is done. Changes are only acted on once the
+// file has been quiet for the debounce period, so that a reload doesn't see a
+// half-written file.
+func watchConfigFile(ctx context.Context, logger *zap.Logger, path string, debounce time.Duration, reloads chan<- reloadRequest) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config file watcher: %w", err)
+	}
+
+	// Editors and Kubernetes replace the file (or a symlink to it) rather than
+	// writing to it, which would lose a watch on the file itself, so we watch
+	// its directory instead
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("failed to watch config file '%s': %w", path, err)
+	}
+
+	// Contents are compared so that unrelated changes in the directory, or
+	// writes that change nothing, don't cause reloads
+	last, err := hashFile(path)
+	if err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var settled <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isConfigFileEvent(event, path) {
+					continue
+				}
+				settled = time.After(debounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("error watching config file", zap.Error(err))
+			case <-settled:
+				settled = nil
+
+				// The file may be missing briefly while it's replaced; the
+				// event for it reappearing will bring us back here
+				sum, err := hashFile(path)
+				if err != nil {
+					logger.Warn("failed to read changed config file", zap.Error(err))
+					continue
+				}
+				if sum == last {
+					continue
+				}
+				last = sum
+
+				select {
+				case reloads <- reloadRequest{trigger: "config file changed"}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// isConfigFileEvent returns true if a change in the config file's directory
+// may have changed the config file: a change to the file itself, or to the
+// '..data' symlink that Kubernetes swaps to update a mounted ConfigMap.
+// Anything else in the directory (e.g. other mounted files, or an editor's
+// swap files) is ignored, so that it doesn't keep putting off the reload.
+func isConfigFileEvent(event fsnotify.Event, path string) bool {
+	name := filepath.Base(event.Name)
+	return name == filepath.Base(path) || name == configMapDataDir
+}
+
+func hashFile(path string) ([sha256.Size]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return sha256.Sum256(contents), nil
+}
@@ -0,0 +1,174 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Full name of the service in control.proto
+const controlServiceName = "tsdnsproxy.admin.v1.Control"
+
+// ControlHandlers implement the gRPC control API's methods.
+type ControlHandlers struct {
+	// TailQueries calls send with each query as it's answered, until the
+	// context is done or send fails
+	TailQueries func(ctx context.Context, send func(entry any) error) error
+	// PatchConfig applies a JSON merge patch to the config and reloads it.
+	// Errors should be gRPC statuses, so that clients can tell bad patches
+	// from failed reloads.
+	PatchConfig func(ctx context.Context, patch map[string]any) error
+}
+
+// ControlServer serves the gRPC control API described by control.proto.
+type ControlServer struct {
+	logger   *zap.Logger
+	config   *Config
+	handlers ControlHandlers
+}
+
+// NewControl creates a server for the gRPC control API, which requires the
+// auth token.
+func NewControl(logger *zap.Logger, config *Config, handlers ControlHandlers) (*ControlServer, error) {
+	if config.AuthToken == "" {
+		return nil, errNoAuthToken
+	}
+
+	return &ControlServer{logger: logger, config: config, handlers: handlers}, nil
+}
+
+func (s *ControlServer) Addr() string {
+	return s.config.GRPCListenAddr
+}
+
+func (s *ControlServer) ListenAndServeContext(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.config.GRPCListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for gRPC control API: %w", err)
+	}
+
+	server := s.grpcServer()
+
+	go func() {
+		<-ctx.Done()
+
+		// Query tails never finish by themselves, so they're cut off if they
+		// outlast the shutdown timeout
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(shutdownTimeout):
+			s.logger.Debug("closing gRPC control API streams for shutdown")
+			server.Stop()
+		}
+	}()
+
+	if err := server.Serve(listener); err != nil {
+		return fmt.Errorf("failed to serve gRPC control API: %w", err)
+	}
+
+	return nil
+}
+
+func (s *ControlServer) grpcServer() *grpc.Server {
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := s.authenticate(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := s.authenticate(stream.Context()); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	)
+	server.RegisterService(controlServiceDesc(), s)
+	return server
+}
+
+// authenticate requires calls to carry the auth token in their metadata.
+func (s *ControlServer) authenticate(ctx context.Context) error {
+	expected := []byte("Bearer " + s.config.AuthToken)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(value), expected) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid auth token")
+}
+
+// controlServiceDesc describes the service in control.proto, which only uses
+// well-known types, so there's no generated code to register.
+func controlServiceDesc() *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: controlServiceName,
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{
+			{MethodName: "PatchConfig", Handler: patchConfigHandler},
+		},
+		Streams: []grpc.StreamDesc{
+			{StreamName: "TailQueries", Handler: tailQueriesHandler, ServerStreams: true},
+		},
+		Metadata: "control.proto",
+	}
+}
+
+func patchConfigHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	patch := &structpb.Struct{}
+	if err := dec(patch); err != nil {
+		return nil, err
+	}
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		if err := srv.(*ControlServer).handlers.PatchConfig(ctx, req.(*structpb.Struct).AsMap()); err != nil {
+			return nil, err
+		}
+		return &emptypb.Empty{}, nil
+	}
+	if interceptor == nil {
+		return handler(ctx, patch)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + controlServiceName + "/PatchConfig"}
+	return interceptor(ctx, patch, info, handler)
+}
+
+func tailQueriesHandler(srv any, stream grpc.ServerStream) error {
+	if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+		return err
+	}
+
+	return srv.(*ControlServer).handlers.TailQueries(stream.Context(), func(entry any) error {
+		// Entries are sent as they'd be encoded for the HTTP API
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to encode query: %v", err)
+		}
+
+		message := &structpb.Struct{}
+		if err := protojson.Unmarshal(encoded, message); err != nil {
+			return status.Errorf(codes.Internal, "failed to encode query: %v", err)
+		}
+		return stream.SendMsg(message)
+	})
+}
@@ -0,0 +1,134 @@
+package admin
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// dialControl serves the control API with the handlers over an in-memory
+// connection, returning a client connection to it.
+func dialControl(t *testing.T, handlers ControlHandlers) *grpc.ClientConn {
+	t.Helper()
+
+	server, err := NewControl(zap.NewNop(), &Config{AuthToken: "secret"}, handlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := bufconn.Listen(1 << 16)
+	grpcServer := server.grpcServer()
+	go func() { _ = grpcServer.Serve(listener) }()
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestControlAuthentication(t *testing.T) {
+	conn := dialControl(t, ControlHandlers{
+		PatchConfig: func(context.Context, map[string]any) error { return nil },
+	})
+
+	tests := []struct {
+		desc  string
+		token string
+		code  codes.Code
+	}{
+		{"no token", "", codes.Unauthenticated},
+		{"wrong token", "Bearer wrong", codes.Unauthenticated},
+		{"token", "Bearer secret", codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.token != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", tt.token)
+			}
+
+			err := conn.Invoke(ctx, "/"+controlServiceName+"/PatchConfig", &structpb.Struct{}, &emptypb.Empty{})
+			if code := status.Code(err); code != tt.code {
+				t.Errorf("got %v, want %v", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestControlPatchConfig(t *testing.T) {
+	patches := make(chan map[string]any, 1)
+	conn := dialControl(t, ControlHandlers{
+		PatchConfig: func(_ context.Context, patch map[string]any) error {
+			patches <- patch
+			return status.Error(codes.FailedPrecondition, "invalid config")
+		},
+	})
+
+	patch, err := structpb.NewStruct(map[string]any{"proxy": map[string]any{"upstreams": []any{"1.1.1.1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	err = conn.Invoke(ctx, "/"+controlServiceName+"/PatchConfig", patch, &emptypb.Empty{})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("got %v, want the handler's error", err)
+	}
+
+	got := <-patches
+	if upstreams := got["proxy"].(map[string]any)["upstreams"].([]any); len(upstreams) != 1 || upstreams[0] != "1.1.1.1" {
+		t.Errorf("got patch %v", got)
+	}
+}
+
+func TestControlTailQueries(t *testing.T) {
+	conn := dialControl(t, ControlHandlers{
+		TailQueries: func(_ context.Context, send func(entry any) error) error {
+			for _, name := range []string{"a.example.", "b.example."} {
+				if err := send(map[string]any{"name": name, "rcode": "NOERROR"}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/"+controlServiceName+"/TailQueries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"a.example.", "b.example."} {
+		entry := &structpb.Struct{}
+		if err := stream.RecvMsg(entry); err != nil {
+			t.Fatal(err)
+		}
+		if name := entry.GetFields()["name"].GetStringValue(); name != want {
+			t.Errorf("got %s, want %s", name, want)
+		}
+	}
+}
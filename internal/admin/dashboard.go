@@ -0,0 +1,83 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/client/tailscale"
+)
+
+const (
+	dashboardAuthBasic     = "basic"
+	dashboardAuthTailscale = "tailscale"
+
+	whoIsTimeout = 5 * time.Second
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+type DashboardConfig struct {
+	// Serve a web dashboard at /dashboard; it reads the admin API, so anyone
+	// allowed to see the dashboard is also allowed to read from the API.
+	// Changing anything through the API still needs the auth token.
+	Enabled bool `mapstructure:"enabled"`
+	// Either 'basic', for HTTP basic auth with the username and password, or
+	// 'tailscale', for Tailscale users with one of the allowed login names
+	// (as identified by the local tailscaled)
+	Auth          string   `mapstructure:"auth" validate:"required_if=Enabled true,omitempty,oneof=basic tailscale"`
+	Username      string   `mapstructure:"username" validate:"required_if=Auth basic"`
+	Password      string   `mapstructure:"password" validate:"required_if=Auth basic"`
+	AllowedLogins []string `mapstructure:"allowed_logins" validate:"required_if=Auth tailscale"`
+}
+
+func (s *Server) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	_, _ = w.Write(dashboardHTML)
+}
+
+// dashboardAuthenticated returns true if the request is from someone allowed
+// to see the dashboard.
+func (s *Server) dashboardAuthenticated(r *http.Request) bool {
+	config := &s.config.Dashboard
+	if !config.Enabled {
+		return false
+	}
+
+	switch config.Auth {
+	case dashboardAuthBasic:
+		username, password, ok := r.BasicAuth()
+		return ok &&
+			subtle.ConstantTimeCompare([]byte(username), []byte(config.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(config.Password)) == 1
+	case dashboardAuthTailscale:
+		ctx, cancel := context.WithTimeout(r.Context(), whoIsTimeout)
+		defer cancel()
+
+		var client tailscale.LocalClient
+		who, err := client.WhoIs(ctx, r.RemoteAddr)
+		if err != nil || who.UserProfile == nil {
+			s.logger.Debug("failed to identify dashboard user", zap.String("remote", r.RemoteAddr), zap.Error(err))
+			return false
+		}
+
+		for _, login := range config.AllowedLogins {
+			if login == who.UserProfile.LoginName {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
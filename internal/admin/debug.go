@@ -0,0 +1,42 @@
+package admin
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http/pprof"
+
+	"go.uber.org/zap"
+)
+
+var errDebugNotLoopback = errors.New("debug listener must be on a loopback address")
+
+type DebugConfig struct {
+	// Loopback address to serve pprof and expvar on; empty disables them
+	ListenAddr string `mapstructure:"listen_addr" validate:"omitempty,hostname_port"`
+}
+
+// NewDebug creates a server for the runtime debugging endpoints. These reveal
+// a lot about the process and can be expensive to call, so they may only be
+// served on a loopback address.
+func NewDebug(logger *zap.Logger, config *DebugConfig) (*Server, error) {
+	host, _, err := net.SplitHostPort(config.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid debug listen address: %w", err)
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%w: '%s'", errDebugNotLoopback, config.ListenAddr)
+	}
+
+	server := NewUnauthenticated(logger, config.ListenAddr)
+	server.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	server.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	server.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	server.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	server.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server.mux.Handle("/debug/vars", expvar.Handler())
+
+	return server, nil
+}
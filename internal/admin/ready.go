@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ReadinessCheck is a named check that returns an error if whatever it checks
+// isn't ready.
+type ReadinessCheck struct {
+	Name  string
+	Check func() error
+}
+
+// ReadinessHandler serves 200 if every check passes, and 503 listing the
+// failures otherwise.
+func ReadinessHandler(checks ...ReadinessCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		var failures []string
+		for _, check := range checks {
+			if err := check.Check(); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", check.Name, err))
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(failures) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(failures, "\n"))
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
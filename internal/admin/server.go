@@ -0,0 +1,155 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errNoAuthToken = errors.New("admin API needs an auth token")
+
+const (
+	readHeaderTimeout = 10 * time.Second
+	shutdownTimeout   = 5 * time.Second
+)
+
+type Config struct {
+	// Address to serve the admin API on; empty disables it
+	ListenAddr string `mapstructure:"listen_addr" validate:"omitempty,hostname_port"`
+	// Address to serve the gRPC control API on (see control.proto); empty
+	// disables it
+	GRPCListenAddr string `mapstructure:"grpc_listen_addr" validate:"omitempty,hostname_port"`
+	// Bearer token that requests must carry in their Authorization header (or
+	// gRPC metadata), which is required to serve either API at all
+	AuthToken string `mapstructure:"auth_token" validate:"required_with=ListenAddr GRPCListenAddr"`
+
+	Dashboard DashboardConfig `mapstructure:"dashboard"`
+}
+
+// Paths that are served without authentication, so that e.g. Kubernetes
+// probes don't need the token
+func publicPaths() []string {
+	return []string{"/readyz"}
+}
+
+// Server serves the HTTP API used to inspect and manage the proxy while it's
+// running.
+type Server struct {
+	logger *zap.Logger
+	config *Config
+	mux    *http.ServeMux
+
+	// Whether requests need the auth token (or the dashboard's credentials)
+	authenticate bool
+}
+
+// New creates a server for the admin API, which requires the auth token.
+func New(logger *zap.Logger, config *Config) (*Server, error) {
+	if config.AuthToken == "" {
+		return nil, errNoAuthToken
+	}
+
+	server := &Server{
+		logger:       logger,
+		config:       config,
+		mux:          http.NewServeMux(),
+		authenticate: true,
+	}
+
+	if config.Dashboard.Enabled {
+		server.mux.HandleFunc("/dashboard", server.serveDashboard)
+	}
+
+	return server, nil
+}
+
+// NewUnauthenticated creates a server that serves its endpoints to anyone who
+// can reach the address, for endpoints that are safe to expose (e.g. metrics)
+// or that are protected otherwise.
+func NewUnauthenticated(logger *zap.Logger, listenAddr string) *Server {
+	return &Server{
+		logger: logger,
+		config: &Config{ListenAddr: listenAddr},
+		mux:    http.NewServeMux(),
+	}
+}
+
+// Mux returns the mux that endpoints should be registered on.
+func (s *Server) Mux() *http.ServeMux {
+	return s.mux
+}
+
+func (s *Server) Addr() string {
+	return s.config.ListenAddr
+}
+
+func (s *Server) ListenAndServeContext(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.config.ListenAddr,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			s.logger.Warn("failed to shutdown admin server", zap.Error(err))
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve admin API: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) handler() http.Handler {
+	if !s.authenticate {
+		return s.mux
+	}
+	return s.authenticated(s.mux)
+}
+
+// authenticated requires requests to the handler to carry the auth token, or
+// to pass the dashboard's authentication if it's enabled. The dashboard's
+// credentials only allow reading, since a browser would send them along with
+// requests forged by any other page.
+func (s *Server) authenticated(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + s.config.AuthToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range publicPaths() {
+			if r.URL.Path == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		tokenValid := subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+		if !tokenValid && !(readOnly(r) && s.dashboardAuthenticated(r)) {
+			if s.config.Dashboard.Auth == dashboardAuthBasic && readOnly(r) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="tsdnsproxy"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readOnly returns true if the request can't change anything.
+func readOnly(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+}
@@ -0,0 +1,152 @@
+package ipstealer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"tailscale.com/client/tailscale"
+)
+
+// Status describes the outcome of recent steal attempts.
+type Status struct {
+	DesiredIP           string    `json:"desired_ip"`
+	LastAttempt         time.Time `json:"last_attempt"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+
+	// Name of the device that held the desired IP when we last looked, before
+	// any eviction
+	CurrentHolder string `json:"current_holder"`
+	Evictions     int    `json:"evictions"`
+}
+
+type stealerStatus struct {
+	mu     sync.Mutex
+	status Status
+
+	apiErrors *prometheus.CounterVec
+}
+
+func newStealerStatus(desiredIP string) *stealerStatus {
+	return &stealerStatus{
+		status: Status{DesiredIP: desiredIP},
+		apiErrors: metrics.NewCounterVec(
+			"tsdnsproxy_ipstealer_api_errors_total",
+			"Failed Tailscale API calls, by operation and HTTP status code.",
+			"operation", "status",
+		),
+	}
+}
+
+func (s *stealerStatus) recordAttempt(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.status.LastAttempt = now
+	if err != nil {
+		s.status.LastError = err.Error()
+		s.status.ConsecutiveFailures++
+		return
+	}
+
+	s.status.LastSuccess = now
+	s.status.LastError = ""
+	s.status.ConsecutiveFailures = 0
+}
+
+func (s *stealerStatus) recordHolder(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.CurrentHolder = name
+}
+
+func (s *stealerStatus) recordEviction() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Evictions++
+}
+
+// recordAPIError counts a failed API call. Errors without an HTTP status
+// (e.g. network errors) are counted with a status of 'error'.
+func (s *stealerStatus) recordAPIError(operation string, err error) {
+	status := "error"
+	var errResp tailscale.ErrResponse
+	if errors.As(err, &errResp) {
+		status = strconv.Itoa(errResp.Status)
+	}
+
+	s.apiErrors.WithLabelValues(operation, status).Inc()
+}
+
+func (s *stealerStatus) recordAPIStatus(operation string, code int) {
+	s.apiErrors.WithLabelValues(operation, strconv.Itoa(code)).Inc()
+}
+
+func (s *stealerStatus) get() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Status returns the outcome of recent steal attempts.
+func (p *PeriodicThief) Status() Status {
+	return p.status.get()
+}
+
+// RegisterMetrics registers the stealer's metrics with the registry.
+func (p *PeriodicThief) RegisterMetrics(registry prometheus.Registerer) {
+	gauge := func(name string, help string, value func(Status) float64) prometheus.Collector {
+		return metrics.NewGaugeFunc(name, help, func() []metrics.Sample {
+			return []metrics.Sample{{Value: value(p.Status())}}
+		})
+	}
+
+	registry.MustRegister(
+		p.status.apiErrors,
+		gauge("tsdnsproxy_ipstealer_last_success_timestamp_seconds",
+			"Unix time of the last successful steal attempt, or zero if there hasn't been one.",
+			func(s Status) float64 {
+				if s.LastSuccess.IsZero() {
+					return 0
+				}
+				return float64(s.LastSuccess.Unix())
+			}),
+		gauge("tsdnsproxy_ipstealer_consecutive_failures",
+			"Steal attempts that have failed since the last successful one.",
+			func(s Status) float64 { return float64(s.ConsecutiveFailures) }),
+		gauge("tsdnsproxy_ipstealer_evictions",
+			"Devices moved off the desired IP since startup.",
+			func(s Status) float64 { return float64(s.Evictions) }),
+		metrics.NewGaugeFunc(
+			"tsdnsproxy_ipstealer_holder_info",
+			"Always 1, labelled with the device that held the desired IP when last checked.",
+			func() []metrics.Sample {
+				s := p.Status()
+				return []metrics.Sample{{LabelValues: []string{s.DesiredIP, s.CurrentHolder}, Value: 1}}
+			},
+			"ip", "device",
+		),
+	)
+}
+
+// RegisterAdminRoutes adds a GET /ipstealer endpoint reporting the stealer's
+// status to the mux.
+func (p *PeriodicThief) RegisterAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/ipstealer", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.Status())
+	})
+}
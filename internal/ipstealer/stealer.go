@@ -16,6 +16,8 @@ import (
 const (
 	tailscaleAPIBase      = "https://api.tailscale.com"
 	setDeviceIPv4Endpoint = "/api/v2/device/%s/ip"
+
+	defaultPeriod = 5 * time.Minute
 )
 
 var (
@@ -27,6 +29,23 @@ type PeriodicThief struct {
 	logger *zap.Logger
 	config *Config
 	client *tailscale.Client
+	status *stealerStatus
+
+	// Called after each steal; nil if unset
+	onSteal func(ctx context.Context, event StealEvent)
+}
+
+// StealEvent describes a steal of the desired IP.
+type StealEvent struct {
+	IP             string
+	TargetDeviceID string
+	TargetName     string
+
+	// The device that held the IP before us, if any, and the IP it was moved
+	// to
+	EvictedDeviceID string
+	EvictedName     string
+	EvictedNewIP    string
 }
 
 type Config struct {
@@ -35,7 +54,15 @@ type Config struct {
 	ClientSecret   string `mapstructure:"client_secret"`
 	TargetHostname string `mapstructure:"target_hostname"`
 	DesiredIP      string `mapstructure:"desired_ip"`
-	PeriodSeconds  int    `mapstructure:"period_seconds"`
+	// How often to steal the IP (default 300)
+	PeriodSeconds time.Duration `mapstructure:"period_seconds"`
+}
+
+func (c *Config) period() time.Duration {
+	if c.PeriodSeconds <= 0 {
+		return defaultPeriod
+	}
+	return c.PeriodSeconds
 }
 
 func New(ctx context.Context, logger *zap.Logger, config *Config) *PeriodicThief {
@@ -57,17 +84,19 @@ func New(ctx context.Context, logger *zap.Logger, config *Config) *PeriodicThief
 		logger: logger,
 		client: client,
 		config: config,
+		status: newStealerStatus(config.DesiredIP),
 	}
 }
 
 func (p *PeriodicThief) Start(ctx context.Context) *time.Ticker {
-	ticker := time.NewTicker(time.Duration(p.config.PeriodSeconds) * time.Second)
+	ticker := time.NewTicker(p.config.period())
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
 				p.logger.Info("starting scheduled IP steal")
 				err := p.Steal(ctx)
+				p.status.recordAttempt(err)
 				if err != nil {
 					p.logger.Error("failed to steal IP", zap.Error(err))
 				}
@@ -83,6 +112,7 @@ func (p *PeriodicThief) Start(ctx context.Context) *time.Ticker {
 func (p *PeriodicThief) Steal(ctx context.Context) error {
 	devices, err := p.client.Devices(ctx, tailscale.DeviceDefaultFields)
 	if err != nil {
+		p.status.recordAPIError("list_devices", err)
 		return fmt.Errorf("failed to fetch list of devices: %w", err)
 	}
 
@@ -118,6 +148,12 @@ func (p *PeriodicThief) Steal(ctx context.Context) error {
 		}
 	}
 
+	holder := ""
+	if currentDevice != nil {
+		holder = currentDevice.Name
+	}
+	p.status.recordHolder(holder)
+
 	if targetDevice == nil {
 		return errFailedToFindTargetDevice
 	}
@@ -125,23 +161,53 @@ func (p *PeriodicThief) Steal(ctx context.Context) error {
 	if currentDevice == targetDevice {
 		p.logger.Debug("target device has the desired IP; nothing to do")
 		return nil
-	} else if currentDevice != nil {
+	}
+
+	event := StealEvent{IP: p.config.DesiredIP, TargetDeviceID: targetDevice.DeviceID, TargetName: targetDevice.Name}
+	if currentDevice != nil {
+		newIP := randomTailscaleIPv4(occupiedIPs)
+		event.EvictedDeviceID, event.EvictedName, event.EvictedNewIP = currentDevice.DeviceID, currentDevice.Name, newIP
 		p.logger.Info("device is occupying our desired IP; setting to random new IP",
 			zap.String("deviceID", currentDevice.DeviceID),
 			zap.String("name", currentDevice.Name),
+			zap.String("newIP", newIP),
 		)
 
-		err := p.setDeviceIPv4(ctx, currentDevice, randomTailscaleIPv4(occupiedIPs))
+		err := p.setDeviceIPv4(ctx, currentDevice, newIP)
 		if err != nil {
 			return fmt.Errorf("failed to change currently occupying device's IP: %w", err)
 		}
+
+		p.status.recordEviction()
+		p.logger.Warn("evicted device from desired IP",
+			zap.String("event", "eviction"),
+			zap.String("ip", p.config.DesiredIP),
+			zap.String("evictedDeviceID", currentDevice.DeviceID),
+			zap.String("evictedName", currentDevice.Name),
+			zap.String("evictedNewIP", newIP),
+			zap.String("targetDeviceID", targetDevice.DeviceID),
+			zap.String("targetName", targetDevice.Name),
+		)
 	}
 
 	p.logger.Info("attempting to change target device to desired IP",
 		zap.String("deviceID", targetDevice.DeviceID),
 		zap.String("name", targetDevice.Name),
 	)
-	return p.setDeviceIPv4(ctx, targetDevice, p.config.DesiredIP)
+	if err := p.setDeviceIPv4(ctx, targetDevice, p.config.DesiredIP); err != nil {
+		return err
+	}
+
+	if p.onSteal != nil {
+		p.onSteal(ctx, event)
+	}
+	return nil
+}
+
+// OnSteal sets a function to call after each steal of the desired IP. It must
+// be called before the thief is started.
+func (p *PeriodicThief) OnSteal(handler func(ctx context.Context, event StealEvent)) {
+	p.onSteal = handler
 }
 
 func (p *PeriodicThief) setDeviceIPv4(ctx context.Context, device *tailscale.Device, ip string) error {
@@ -152,10 +218,13 @@ func (p *PeriodicThief) setDeviceIPv4(ctx context.Context, device *tailscale.Dev
 
 	resp, err := p.client.Do(req)
 	if err != nil {
+		p.status.recordAPIError("set_device_ip", err)
 		return fmt.Errorf("tailscale API call to change IP could not be made: %w", err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		p.status.recordAPIStatus("set_device_ip", resp.StatusCode)
 		body, _ := io.ReadAll(resp.Body)
 		p.logger.Error("obtained non-200 status from device IP change request",
 			zap.Int("status", resp.StatusCode),
@@ -0,0 +1,74 @@
+//go:build linux
+
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldPriority maps a level to a syslog priority, as used by journald.
+func journaldPriority(level zapcore.Level) int {
+	switch {
+	case level >= zapcore.FatalLevel:
+		return 1
+	case level >= zapcore.DPanicLevel:
+		return 2
+	case level >= zapcore.ErrorLevel:
+		return 3
+	case level >= zapcore.WarnLevel:
+		return 4
+	case level >= zapcore.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func newJournaldCore(level zapcore.LevelEnabler, config *JournaldConfig) (zapcore.Core, error) {
+	identifier := config.Identifier
+	if identifier == "" {
+		identifier = defaultIdentifier
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to journald: %w", err)
+	}
+
+	return &sinkCore{
+		LevelEnabler: level,
+		encoder:      sinkEncoder(),
+		write: func(level zapcore.Level, line string) error {
+			var msg bytes.Buffer
+			writeJournaldField(&msg, "PRIORITY", fmt.Sprint(journaldPriority(level)))
+			writeJournaldField(&msg, "SYSLOG_IDENTIFIER", identifier)
+			writeJournaldField(&msg, "MESSAGE", line)
+
+			if _, err := conn.Write(msg.Bytes()); err != nil {
+				return fmt.Errorf("failed to write to journald: %w", err)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// writeJournaldField writes a field in journald's native protocol, which
+// needs values containing newlines to be length-prefixed.
+func writeJournaldField(buf *bytes.Buffer, key string, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(key + "=" + value + "\n")
+		return
+	}
+
+	buf.WriteString(key + "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package logging
+
+import (
+	"errors"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var errJournaldUnsupported = errors.New("journald is not supported on this platform")
+
+func newJournaldCore(_ zapcore.LevelEnabler, _ *JournaldConfig) (zapcore.Core, error) {
+	return nil, errJournaldUnsupported
+}
@@ -0,0 +1,113 @@
+// Package logging adds sinks (syslog and journald) that logs are sent to as
+// well as stderr, for deployments that aggregate logs that way.
+package logging
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const defaultIdentifier = "tsdnsproxy"
+
+type Config struct {
+	Syslog   SyslogConfig   `mapstructure:"syslog"`
+	Journald JournaldConfig `mapstructure:"journald"`
+}
+
+type SyslogConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Network and address of the syslog server (e.g. 'udp' and
+	// 'localhost:514'); leave both empty to use the local syslog daemon
+	Network string `mapstructure:"network" validate:"omitempty,oneof=udp tcp unix unixgram"`
+	Address string `mapstructure:"address" validate:"required_with=Network"`
+	// Facility to log as (default 'daemon')
+	Facility string `mapstructure:"facility" validate:"omitempty,oneof=kern user mail daemon auth syslog lpr news uucp cron authpriv ftp local0 local1 local2 local3 local4 local5 local6 local7"`
+	// Tag of log lines (default 'tsdnsproxy')
+	Tag string `mapstructure:"tag"`
+}
+
+type JournaldConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// SYSLOG_IDENTIFIER of journal entries (default 'tsdnsproxy')
+	Identifier string `mapstructure:"identifier"`
+}
+
+// WithSinks returns a logger that writes to the configured sinks as well as
+// wherever the given logger writes, at the same level.
+func WithSinks(logger *zap.Logger, config *Config) (*zap.Logger, error) {
+	var cores []zapcore.Core
+	level := logger.Core()
+
+	if config.Syslog.Enabled {
+		core, err := newSyslogCore(level, &config.Syslog)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create syslog sink: %w", err)
+		}
+		cores = append(cores, core)
+	}
+
+	if config.Journald.Enabled {
+		core, err := newJournaldCore(level, &config.Journald)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create journald sink: %w", err)
+		}
+		cores = append(cores, core)
+	}
+
+	if len(cores) == 0 {
+		return logger, nil
+	}
+
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(append([]zapcore.Core{core}, cores...)...)
+	})), nil
+}
+
+// sinkEncoder returns an encoder for sinks that record the time and level of
+// entries themselves.
+func sinkEncoder() zapcore.Encoder {
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = ""
+	config.LevelKey = ""
+	return zapcore.NewJSONEncoder(config)
+}
+
+// sinkCore encodes entries and passes them, along with their level, to a
+// sink's write function.
+type sinkCore struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	write   func(level zapcore.Level, line string) error
+}
+
+func (c *sinkCore) With(fields []zapcore.Field) zapcore.Core {
+	encoder := c.encoder.Clone()
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+	return &sinkCore{LevelEnabler: c.LevelEnabler, encoder: encoder, write: c.write}
+}
+
+func (c *sinkCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *sinkCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.encoder.EncodeEntry(entry, fields)
+	if err != nil {
+		return fmt.Errorf("failed to encode log entry: %w", err)
+	}
+	defer buf.Free()
+
+	return c.write(entry.Level, strings.TrimSuffix(buf.String(), "\n"))
+}
+
+func (c *sinkCore) Sync() error {
+	return nil
+}
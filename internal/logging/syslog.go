@@ -0,0 +1,88 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"fmt"
+	"log/syslog"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func syslogFacility(name string) syslog.Priority {
+	switch name {
+	case "kern":
+		return syslog.LOG_KERN
+	case "user":
+		return syslog.LOG_USER
+	case "mail":
+		return syslog.LOG_MAIL
+	case "auth":
+		return syslog.LOG_AUTH
+	case "syslog":
+		return syslog.LOG_SYSLOG
+	case "lpr":
+		return syslog.LOG_LPR
+	case "news":
+		return syslog.LOG_NEWS
+	case "uucp":
+		return syslog.LOG_UUCP
+	case "cron":
+		return syslog.LOG_CRON
+	case "authpriv":
+		return syslog.LOG_AUTHPRIV
+	case "ftp":
+		return syslog.LOG_FTP
+	case "local0":
+		return syslog.LOG_LOCAL0
+	case "local1":
+		return syslog.LOG_LOCAL1
+	case "local2":
+		return syslog.LOG_LOCAL2
+	case "local3":
+		return syslog.LOG_LOCAL3
+	case "local4":
+		return syslog.LOG_LOCAL4
+	case "local5":
+		return syslog.LOG_LOCAL5
+	case "local6":
+		return syslog.LOG_LOCAL6
+	case "local7":
+		return syslog.LOG_LOCAL7
+	default:
+		return syslog.LOG_DAEMON
+	}
+}
+
+func newSyslogCore(level zapcore.LevelEnabler, config *SyslogConfig) (zapcore.Core, error) {
+	tag := config.Tag
+	if tag == "" {
+		tag = defaultIdentifier
+	}
+
+	writer, err := syslog.Dial(config.Network, config.Address, syslogFacility(config.Facility)|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+
+	return &sinkCore{
+		LevelEnabler: level,
+		encoder:      sinkEncoder(),
+		write: func(level zapcore.Level, line string) error {
+			switch {
+			case level >= zapcore.FatalLevel:
+				return writer.Alert(line)
+			case level >= zapcore.DPanicLevel:
+				return writer.Crit(line)
+			case level >= zapcore.ErrorLevel:
+				return writer.Err(line)
+			case level >= zapcore.WarnLevel:
+				return writer.Warning(line)
+			case level >= zapcore.InfoLevel:
+				return writer.Info(line)
+			default:
+				return writer.Debug(line)
+			}
+		},
+	}, nil
+}
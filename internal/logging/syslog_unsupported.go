@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"errors"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var errSyslogUnsupported = errors.New("syslog is not supported on this platform")
+
+func newSyslogCore(_ zapcore.LevelEnabler, _ *SyslogConfig) (zapcore.Core, error) {
+	return nil, errSyslogUnsupported
+}
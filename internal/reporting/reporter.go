@@ -0,0 +1,259 @@
+// Package reporting sends panics, persistent error conditions and other
+// notable events to Sentry and/or webhooks, for deployments where nobody is
+// watching the logs.
+package reporting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/internal/version"
+	"github.com/getsentry/sentry-go"
+	"go.uber.org/zap"
+)
+
+const (
+	// Reports are sent synchronously when panicking, so they mustn't hold up
+	// the crash for too long
+	reportTimeout = 5 * time.Second
+
+	userAgent = "tailscale-dns-proxy"
+
+	formatSlack = "slack"
+
+	// Conditions of the events we report
+	ConditionPanic               = "panic"
+	ConditionIPSteal             = "ip_steal"
+	ConditionResolverNotReady    = "resolver_not_ready"
+	ConditionAllUpstreamsFailing = "all_upstreams_failing"
+
+	LevelError = "error"
+	LevelFatal = "fatal"
+	LevelInfo  = "info"
+)
+
+var (
+	errInvalidSentryDSN = errors.New("invalid Sentry DSN")
+	errReportFailed     = errors.New("error report was not accepted")
+	errReportTimeout    = errors.New("timed out sending error report")
+)
+
+type Config struct {
+	// Sentry DSN, e.g. https://<key>@o0.ingest.sentry.io/<project>
+	SentryDSN string `mapstructure:"sentry_dsn" validate:"omitempty,url"`
+	// URL that events are POSTed to as JSON
+	WebhookURL string `mapstructure:"webhook_url" validate:"omitempty,url"`
+	// Further webhooks, which can be limited to some events
+	Webhooks []WebhookConfig `mapstructure:"webhooks" validate:"dive"`
+
+	// How often to check for error conditions (default 30), how many checks
+	// in a row must fail before a condition is reported (default 3), and how
+	// often to report a condition again while it persists (default 3600)
+	CheckIntervalSeconds  time.Duration `mapstructure:"check_interval_seconds" validate:"gte=0"`
+	FailureThreshold      int           `mapstructure:"failure_threshold" validate:"gte=0"`
+	RepeatIntervalSeconds time.Duration `mapstructure:"repeat_interval_seconds" validate:"gte=0"`
+}
+
+type WebhookConfig struct {
+	URL string `mapstructure:"url" validate:"required,url"`
+	// Either 'json' (the default), for the event as JSON, or 'slack', for a
+	// Slack-compatible message
+	Format string `mapstructure:"format" validate:"omitempty,oneof=json slack"`
+	// Conditions of the events to send (e.g. 'ip_steal'); empty for all
+	Events []string `mapstructure:"events"`
+}
+
+func (w *WebhookConfig) wants(event *Event) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, condition := range w.Events {
+		if condition == event.Condition {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is something worth telling a human about.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Level      string    `json:"level"`
+	Condition  string    `json:"condition"`
+	Message    string    `json:"message"`
+	Stacktrace string    `json:"stacktrace,omitempty"`
+}
+
+// Reporter sends events to the configured destinations.
+type Reporter struct {
+	logger *zap.Logger
+	config *Config
+	client *http.Client
+	sentry *sentry.Client
+}
+
+// New returns a reporter for the config, or nil if reporting is disabled.
+func New(logger *zap.Logger, config *Config) (*Reporter, error) {
+	if config.SentryDSN == "" && config.WebhookURL == "" && len(config.Webhooks) == 0 {
+		return nil, nil
+	}
+
+	reporter := &Reporter{
+		logger: logger,
+		config: config,
+		client: &http.Client{Timeout: reportTimeout},
+	}
+
+	if config.SentryDSN != "" {
+		client, err := sentry.NewClient(sentry.ClientOptions{
+			Dsn:        config.SentryDSN,
+			Release:    version.Get().Version,
+			HTTPClient: reporter.client,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidSentryDSN, err)
+		}
+		reporter.sentry = client
+	}
+
+	return reporter, nil
+}
+
+// Report sends the event to every destination, returning the errors of any
+// that failed.
+func (r *Reporter) Report(ctx context.Context, event *Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	var errs []error
+	if r.sentry != nil {
+		if err := r.sendSentry(ctx, event); err != nil {
+			errs = append(errs, fmt.Errorf("failed to report to Sentry: %w", err))
+		}
+	}
+	if r.config.WebhookURL != "" {
+		if err := r.post(ctx, r.config.WebhookURL, nil, event); err != nil {
+			errs = append(errs, fmt.Errorf("failed to report to webhook: %w", err))
+		}
+	}
+	for i := range r.config.Webhooks {
+		webhook := &r.config.Webhooks[i]
+		if !webhook.wants(event) {
+			continue
+		}
+
+		var body any = event
+		if webhook.Format == formatSlack {
+			body = slackMessage(event)
+		}
+
+		if err := r.post(ctx, webhook.URL, nil, body); err != nil {
+			errs = append(errs, fmt.Errorf("failed to report to webhook %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Notify reports the event, logging rather than returning any failures.
+func (r *Reporter) Notify(ctx context.Context, event *Event) {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+
+	if err := r.Report(ctx, event); err != nil {
+		r.logger.Warn("failed to report event", zap.String("condition", event.Condition), zap.Error(err))
+	}
+}
+
+// slackMessage formats an event as a message for Slack's incoming webhooks
+// (and the many services compatible with them).
+func slackMessage(event *Event) map[string]string {
+	text := fmt.Sprintf("*[%s] %s*: %s", strings.ToUpper(event.Level), event.Condition, event.Message)
+	if event.Stacktrace != "" {
+		text += "\n```" + event.Stacktrace + "```"
+	}
+	return map[string]string{"text": text}
+}
+
+// ReportPanic reports a recovered panic. It blocks until the report is sent,
+// as the caller is expected to crash afterwards.
+func (r *Reporter) ReportPanic(recovered any, stack []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+
+	err := r.Report(ctx, &Event{
+		Level:      LevelFatal,
+		Condition:  ConditionPanic,
+		Message:    fmt.Sprint(recovered),
+		Stacktrace: string(stack),
+	})
+	if err != nil {
+		r.logger.Error("failed to report panic", zap.Error(err))
+	}
+}
+
+func (r *Reporter) post(ctx context.Context, endpoint string, headers map[string]string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send report: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: status %d", errReportFailed, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// sendSentry sends the event to Sentry, waiting until it has been sent or the
+// context is done.
+func (r *Reporter) sendSentry(ctx context.Context, event *Event) error {
+	sentryEvent := &sentry.Event{
+		Timestamp: event.Time,
+		Level:     sentry.Level(event.Level),
+		Logger:    userAgent,
+		Message:   event.Message,
+		Tags:      map[string]string{"condition": event.Condition},
+	}
+	if event.Stacktrace != "" {
+		sentryEvent.Extra = map[string]any{"stacktrace": event.Stacktrace}
+	}
+
+	if r.sentry.CaptureEvent(sentryEvent, nil, nil) == nil {
+		return errReportFailed
+	}
+
+	timeout := reportTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if !r.sentry.Flush(timeout) {
+		return errReportTimeout
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package reporting
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestReportSentry(t *testing.T) {
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "://", "://public@", 1) + "/sentry/42"
+	reporter, err := New(zap.NewNop(), &Config{SentryDSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reporter.Report(context.Background(), &Event{Level: LevelError, Condition: ConditionPanic, Message: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path := <-paths; path != "/sentry/api/42/envelope/" {
+		t.Errorf("got report at %s, want the envelope endpoint", path)
+	}
+}
+
+func TestNewInvalidSentryDSN(t *testing.T) {
+	if _, err := New(zap.NewNop(), &Config{SentryDSN: "https://o0.ingest.sentry.io/42"}); err == nil {
+		t.Error("expected an error for a DSN without a key")
+	}
+}
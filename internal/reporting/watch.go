@@ -0,0 +1,77 @@
+package reporting
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultCheckInterval    = 30 * time.Second
+	defaultFailureThreshold = 3
+	defaultRepeatInterval   = time.Hour
+)
+
+// Condition is a named check for an error condition, e.g. the resolver being
+// out of sync.
+type Condition struct {
+	Name  string
+	Check func() error
+}
+
+type conditionState struct {
+	failures     int
+	lastReported time.Time
+}
+
+// Watch checks the conditions periodically until the context is done,
+// reporting any that fail repeatedly, and reporting again once they recover.
+func (r *Reporter) Watch(ctx context.Context, conditions ...Condition) {
+	interval := r.config.CheckIntervalSeconds
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	states := make([]conditionState, len(conditions))
+	for {
+		select {
+		case <-ticker.C:
+			for i, condition := range conditions {
+				r.check(ctx, condition, &states[i])
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Reporter) check(ctx context.Context, condition Condition, state *conditionState) {
+	threshold := r.config.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+
+	repeat := r.config.RepeatIntervalSeconds
+	if repeat <= 0 {
+		repeat = defaultRepeatInterval
+	}
+
+	err := condition.Check()
+	if err == nil {
+		if !state.lastReported.IsZero() {
+			r.Notify(ctx, &Event{Level: LevelInfo, Condition: condition.Name, Message: "recovered"})
+		}
+		*state = conditionState{}
+		return
+	}
+
+	state.failures++
+	if state.failures < threshold || time.Since(state.lastReported) < repeat {
+		return
+	}
+
+	state.lastReported = time.Now()
+	r.Notify(ctx, &Event{Level: LevelError, Condition: condition.Name, Message: err.Error()})
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package systemd
+
+import "time"
+
+// Notify does nothing, as there's no systemd on this platform.
+func Notify(string) error {
+	return nil
+}
+
+// WatchdogInterval returns zero, as there's no systemd on this platform.
+func WatchdogInterval() time.Duration {
+	return 0
+}
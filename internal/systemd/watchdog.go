@@ -0,0 +1,39 @@
+// Package systemd implements the parts of the sd_notify protocol that we need
+// to run as a Type=notify service: reporting readiness and shutdown, and
+// pinging the watchdog.
+package systemd
+
+import (
+	"context"
+	"time"
+)
+
+// States sent with Notify
+const (
+	StateReady    = "READY=1"
+	StateStopping = "STOPPING=1"
+	StateWatchdog = "WATCHDOG=1"
+)
+
+// Watchdog pings the systemd watchdog at half the interval it expects, for as
+// long as the health check passes, until the context is done. If the check
+// keeps failing, systemd will consider us hung and restart us.
+func Watchdog(ctx context.Context, interval time.Duration, healthy func() error, onError func(error)) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := healthy(); err != nil {
+				onError(err)
+				continue
+			}
+			if err := Notify(StateWatchdog); err != nil {
+				onError(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package version reports build metadata: the release version, commit and
+// build date are injected at build time with e.g.
+//
+//	go build -ldflags "-X github.com/davejbax/tailscale-dns-proxy/internal/version.version=v1.2.3"
+//
+// and otherwise fall back to what the Go toolchain embedded in the binary.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const unknown = "unknown"
+
+// Set through -ldflags -X, so these have to be variables
+//
+//nolint:gochecknoglobals
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// Info is the build metadata of the running binary.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build metadata, preferring values injected through ldflags
+// over those recorded by the Go toolchain.
+func Get() Info {
+	info := Info{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && build.Main.Version != "(devel)" {
+			info.Version = build.Main.Version
+		}
+
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			}
+		}
+	}
+
+	for _, field := range []*string{&info.Version, &info.Commit, &info.BuildDate} {
+		if *field == "" {
+			*field = unknown
+		}
+	}
+
+	return info
+}
+
+// String formats the build metadata for humans.
+func (i Info) String() string {
+	return i.Version + " (commit " + i.Commit + ", built " + i.BuildDate + ", " + i.GoVersion + ")"
+}
+
+// Fields returns the build metadata as log fields.
+func (i Info) Fields() []zap.Field {
+	return []zap.Field{
+		zap.String("version", i.Version),
+		zap.String("commit", i.Commit),
+		zap.String("build_date", i.BuildDate),
+		zap.String("go_version", i.GoVersion),
+	}
+}
+
+// RegisterMetrics registers a build_info gauge with the registry.
+func RegisterMetrics(registry prometheus.Registerer) {
+	info := Get()
+	registry.MustRegister(metrics.NewGaugeFunc(
+		"tsdnsproxy_build_info",
+		"Always 1, labelled with the build metadata of the running binary.",
+		func() []metrics.Sample {
+			return []metrics.Sample{{LabelValues: []string{info.Version, info.Commit, info.BuildDate, info.GoVersion}, Value: 1}}
+		},
+		"version", "commit", "build_date", "go_version",
+	))
+}
@@ -7,24 +7,63 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"time"
+	"runtime/debug"
 
+	"github.com/davejbax/tailscale-dns-proxy/internal/admin"
 	"github.com/davejbax/tailscale-dns-proxy/internal/ipstealer"
-	"github.com/davejbax/tailscale-dns-proxy/internal/proxy"
-	"github.com/davejbax/tailscale-dns-proxy/internal/resolvers"
+	"github.com/davejbax/tailscale-dns-proxy/internal/logging"
+	"github.com/davejbax/tailscale-dns-proxy/internal/reporting"
+	"github.com/davejbax/tailscale-dns-proxy/internal/version"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/proxy"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 func main() {
-	if err := mainE(); err != nil {
+	var command string
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	var err error
+	switch command {
+	case "config":
+		err = configCommand(os.Args[2:])
+	case "check", "validate":
+		err = checkCommand(os.Args[2:])
+	case "cache":
+		err = cacheCommand(os.Args[2:])
+	case "interception":
+		err = interceptionCommand(os.Args[2:])
+	case "mappings":
+		err = mappingsCommand(os.Args[2:])
+	case "query":
+		err = queryCommand(os.Args[2:])
+	case "resolve":
+		err = resolveCommand(os.Args[2:])
+	case "selftest":
+		err = selftestCommand(os.Args[2:])
+	case "steal":
+		err = stealCommand(os.Args[2:])
+	case "version":
+		err = versionCommand(os.Args[2:])
+	default:
+		err = mainE()
+	}
+
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func parseFlags() (*zap.Logger, error) {
+func parseFlags() (*zap.Logger, string, configOverrides, error) {
 	debug := flag.Bool("debug", false, "Enable debug output")
 	level := zap.LevelFlag("level", zapcore.WarnLevel, "Verbosity level of logs")
+	configPath := configFlag(flag.CommandLine)
+	overrides := configOverrideFlags(flag.CommandLine)
 	flag.Parse()
 
 	var cfg zap.Config
@@ -35,22 +74,30 @@ func parseFlags() (*zap.Logger, error) {
 	}
 
 	cfg.Level.SetLevel(*level)
-	return cfg.Build()
+	logger, err := cfg.Build()
+	return logger, *configPath, overrides, err
 }
 
 func mainE() error {
-	logger, err := parseFlags()
+	logger, configPath, overrides, err := parseFlags()
 	if err != nil {
 		return fmt.Errorf("failed to parse flags and/or create logger: %w", err)
 	}
 
 	defer logger.Sync() //nolint:errcheck
 
-	cfg, err := loadConfig()
+	cfg, err := loadConfig(configPath, overrides)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	logger, err = logging.WithSinks(logger, &cfg.Logging)
+	if err != nil {
+		return fmt.Errorf("failed to set up log sinks: %w", err)
+	}
+
+	logger.Info("starting tailscale-dns-proxy", version.Get().Fields()...)
+
 	resolver, err := cfg.Resolver.Create()
 	if err != nil {
 		return fmt.Errorf("failed to create Tailscale IP resolver: %w", err)
@@ -63,22 +110,165 @@ func mainE() error {
 	// and involve background processing. Do that now.
 	if startable, ok := resolver.(resolvers.Startable); ok {
 		logger.Info("starting resolver", zap.Any("resolver", resolver))
-		if err := resolvers.StartWithTimeout(ctx, startable, time.Duration(cfg.Resolver.StartTimeoutSeconds)*time.Second); err != nil {
+		if err := resolvers.StartWithTimeout(ctx, startable, cfg.Resolver.startTimeout()); err != nil {
 			return fmt.Errorf("failed to start resolver: %w", err)
 		}
 	}
 
+	reporter, err := reporting.New(logger, &cfg.Reporting)
+	if err != nil {
+		return fmt.Errorf("failed to create error reporter: %w", err)
+	}
+
 	// Start the IP stealer now
 	// TODO: build in some verification process so that we don't steal an IP if
 	// we aren't actually up
+	var stealer *ipstealer.PeriodicThief
 	if cfg.IPStealer.Enabled {
 		logger.Info("starting IP stealer")
-		stealer := ipstealer.New(ctx, logger, &cfg.IPStealer.Config)
+		stealer = ipstealer.New(ctx, logger, &cfg.IPStealer.Config)
+		if reporter != nil {
+			stealer.OnSteal(func(ctx context.Context, event ipstealer.StealEvent) {
+				reporter.Notify(ctx, stealEvent(event))
+			})
+		}
 		ticker := stealer.Start(ctx)
 		defer ticker.Stop()
 	}
 
-	proxy := proxy.New(logger, resolver, &cfg.Proxy)
+	proxy, err := proxy.New(logger, resolver, &cfg.Proxy)
+	if err != nil {
+		return fmt.Errorf("failed to create proxy server: %w", err)
+	}
+
+	// Reloads can be requested by SIGHUP, the admin API, or changes to the
+	// config file
+	reloads := make(chan reloadRequest)
+	go runReloads(ctx, logger, proxy, configPath, overrides, reloads)
+
+	if cfg.Admin.ListenAddr != "" {
+		adminServer, err := admin.New(logger, &cfg.Admin)
+		if err != nil {
+			return fmt.Errorf("failed to create admin server: %w", err)
+		}
+		proxy.RegisterAdminRoutes(adminServer.Mux())
+		adminServer.Mux().Handle("/reload", reloadHandler(reloads))
+		adminServer.Mux().Handle("/config", configPatchHandler(reloads))
+		if stealer != nil {
+			stealer.RegisterAdminRoutes(adminServer.Mux())
+		}
+
+		var checks []admin.ReadinessCheck
+		if checker, ok := resolver.(resolvers.ReadinessChecker); ok {
+			checks = append(checks, admin.ReadinessCheck{Name: "resolver", Check: checker.Ready})
+		}
+		adminServer.Mux().Handle("/readyz", admin.ReadinessHandler(checks...))
+
+		serveInBackground(ctx, logger, "admin", adminServer)
+	}
+
+	if cfg.Admin.GRPCListenAddr != "" {
+		proxy.EnableQueryTail()
+		controlServer, err := admin.NewControl(logger, &cfg.Admin, admin.ControlHandlers{
+			TailQueries: proxy.TailQueries,
+			PatchConfig: grpcPatchConfig(reloads),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create gRPC control server: %w", err)
+		}
+
+		serveInBackground(ctx, logger, "gRPC control", controlServer)
+	}
+
+	if cfg.Metrics.ListenAddr != "" {
+		registry := prometheus.NewRegistry()
+		version.RegisterMetrics(registry)
+		proxy.RegisterMetrics(registry)
+		if resolverMetrics, ok := resolver.(resolvers.MetricsReporter); ok {
+			resolverMetrics.RegisterMetrics(registry)
+		}
+		if stealer != nil {
+			stealer.RegisterMetrics(registry)
+		}
+
+		// The metrics listener is separate from the admin API, so that it can
+		// be exposed to scrapers without exposing the admin endpoints
+		metricsServer := admin.NewUnauthenticated(logger, cfg.Metrics.ListenAddr)
+		metricsServer.Mux().Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+		serveInBackground(ctx, logger, "metrics", metricsServer)
+	}
+
+	if cfg.Debug.ListenAddr != "" {
+		debugServer, err := admin.NewDebug(logger, &cfg.Debug)
+		if err != nil {
+			return fmt.Errorf("failed to create debug server: %w", err)
+		}
+
+		serveInBackground(ctx, logger, "debug", debugServer)
+	}
+
+	if reporter != nil {
+		proxy.SetPanicHandler(reporter.ReportPanic)
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				reporter.ReportPanic(recovered, debug.Stack())
+				panic(recovered)
+			}
+		}()
+
+		conditions := []reporting.Condition{{Name: reporting.ConditionAllUpstreamsFailing, Check: proxy.CheckUpstreams}}
+		if checker, ok := resolver.(resolvers.ReadinessChecker); ok {
+			conditions = append(conditions, reporting.Condition{Name: reporting.ConditionResolverNotReady, Check: checker.Ready})
+		}
+		go reporter.Watch(ctx, conditions...)
+	}
+
+	handleInterceptionSignals(ctx, logger, proxy)
+
+	handleReloadSignal(ctx, reloads)
+	if cfg.Reload.WatchFile {
+		watchPath := configPath
+		if watchPath == "" {
+			watchPath = findConfigFile()
+		}
+
+		if watchPath == "" {
+			logger.Warn("not watching the config file for changes, as there isn't one")
+		} else if err := watchConfigFile(ctx, logger, watchPath, cfg.Reload.watchDebounce(), reloads); err != nil {
+			return err
+		}
+	}
+
+	go notifySystemd(ctx, logger, proxy, resolver)
+
 	logger.Info("starting proxy server")
 	return proxy.ListenAndServeContext(ctx)
 }
+
+// stealEvent describes a steal of the desired IP for reporting.
+func stealEvent(event ipstealer.StealEvent) *reporting.Event {
+	message := fmt.Sprintf("gave %s to %s (%s)", event.IP, event.TargetName, event.TargetDeviceID)
+	if event.EvictedDeviceID != "" {
+		message += fmt.Sprintf(", moving %s (%s) to %s", event.EvictedName, event.EvictedDeviceID, event.EvictedNewIP)
+	}
+
+	return &reporting.Event{Level: reporting.LevelInfo, Condition: reporting.ConditionIPSteal, Message: message}
+}
+
+// backgroundServer is a server for one of the APIs served alongside DNS.
+type backgroundServer interface {
+	Addr() string
+	ListenAndServeContext(ctx context.Context) error
+}
+
+// serveInBackground runs a server until the context is done. The DNS server is
+// what matters, so failures are logged rather than fatal.
+func serveInBackground(ctx context.Context, logger *zap.Logger, name string, server backgroundServer) {
+	logger.Info("starting "+name+" server", zap.String("addr", server.Addr()))
+	go func() {
+		if err := server.ListenAndServeContext(ctx); err != nil {
+			logger.Error(name+" server failed", zap.Error(err))
+		}
+	}()
+}
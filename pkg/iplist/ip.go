@@ -1,3 +1,5 @@
+// Package iplist has helpers for lists of IPs, e.g. telling Tailscale IPs
+// apart from others.
 package iplist
 
 import (
@@ -45,3 +47,15 @@ func ParseIPs(ips []string) ([]net.IP, error) {
 
 	return parsed, nil
 }
+
+// IsTailscaleIP returns true if the IP is in one of the ranges that Tailscale
+// assigns device IPs from: the CGNAT range 100.64.0.0/10, or the ULA prefix
+// fd7a:115c:a1e0::/48.
+func IsTailscaleIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 100 && ip4[1]&0xc0 == 64
+	}
+
+	return len(ip) == net.IPv6len &&
+		ip[0] == 0xfd && ip[1] == 0x7a && ip[2] == 0x11 && ip[3] == 0x5c && ip[4] == 0xa1 && ip[5] == 0xe0
+}
@@ -0,0 +1,64 @@
+// Package metrics holds what we need on top of the Prometheus client library:
+// constructors for our usual metric options, and metrics whose values are read
+// from a callback when scraped, for state that is already tracked elsewhere.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultLatencyBuckets are histogram buckets, in seconds, suited to DNS
+// exchanges.
+func DefaultLatencyBuckets() []float64 {
+	return []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+}
+
+func NewCounterVec(name string, help string, labels ...string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+}
+
+// Sample is a value reported by a callback metric.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// funcMetric is a metric whose values are read from a callback when scraped.
+type funcMetric struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	fn        func() []Sample
+}
+
+// NewGaugeFunc creates a gauge whose samples are returned by fn.
+func NewGaugeFunc(name string, help string, fn func() []Sample, labels ...string) prometheus.Collector {
+	return &funcMetric{desc: prometheus.NewDesc(name, help, labels, nil), valueType: prometheus.GaugeValue, fn: fn}
+}
+
+// NewCounterFunc creates a counter whose samples are returned by fn.
+func NewCounterFunc(name string, help string, fn func() []Sample, labels ...string) prometheus.Collector {
+	return &funcMetric{desc: prometheus.NewDesc(name, help, labels, nil), valueType: prometheus.CounterValue, fn: fn}
+}
+
+func (f *funcMetric) Describe(descs chan<- *prometheus.Desc) {
+	descs <- f.desc
+}
+
+func (f *funcMetric) Collect(metrics chan<- prometheus.Metric) {
+	for _, sample := range f.fn() {
+		metric, err := prometheus.NewConstMetric(f.desc, f.valueType, sample.Value, sample.LabelValues...)
+		if err != nil {
+			metric = prometheus.NewInvalidMetric(f.desc, err)
+		}
+		metrics <- metric
+	}
+}
+
+type Config struct {
+	// Address to serve metrics on; empty disables them
+	ListenAddr string `mapstructure:"listen_addr" validate:"omitempty,hostname_port"`
+}
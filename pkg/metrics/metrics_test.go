@@ -0,0 +1,52 @@
+package metrics_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGaugeFunc(t *testing.T) {
+	gauge := metrics.NewGaugeFunc("test_entries", "Entries.", func() []metrics.Sample {
+		return []metrics.Sample{
+			{LabelValues: []string{"kids"}, Value: math.Inf(1)},
+			{LabelValues: []string{"default"}, Value: 12},
+		}
+	}, "view")
+
+	want := `# HELP test_entries Entries.
+# TYPE test_entries gauge
+test_entries{view="default"} 12
+test_entries{view="kids"} +Inf
+`
+	if err := testutil.CollectAndCompare(gauge, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCounterFunc(t *testing.T) {
+	counter := metrics.NewCounterFunc("test_hits_total", "Hits.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: 1.5}}
+	})
+
+	want := `# HELP test_hits_total Hits.
+# TYPE test_hits_total counter
+test_hits_total 1.5
+`
+	if err := testutil.CollectAndCompare(counter, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFuncMetricWithWrongLabelCount(t *testing.T) {
+	gauge := metrics.NewGaugeFunc("test_entries", "Entries.", func() []metrics.Sample {
+		return []metrics.Sample{{LabelValues: []string{"a", "b"}, Value: 1}}
+	}, "view")
+
+	if _, err := testutil.CollectAndLint(gauge); err == nil {
+		t.Error("expected an error for the wrong number of label values")
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Deny queries from clients not explicitly allowed
+	clientACLDeny = "deny"
+
+	// Silently drop denied queries rather than refusing them
+	clientACLActionDrop = "drop"
+)
+
+type zoneACL struct {
+	zone    string
+	clients []*net.IPNet
+}
+
+func makeZoneACLs(configs []ZoneACL) ([]*zoneACL, error) {
+	acls := make([]*zoneACL, 0, len(configs))
+	for _, config := range configs {
+		clients, err := parseCIDRs(fmt.Sprintf("zone '%s' ACL", config.Zone), config.AllowedClients)
+		if err != nil {
+			return nil, err
+		}
+		acls = append(acls, &zoneACL{zone: dns.CanonicalName(config.Zone), clients: clients})
+	}
+	return acls, nil
+}
+
+// clientAllowed decides whether a client may query a name. Names in a zone
+// with an ACL may only be queried by the clients in the ACL of the most
+// specific such zone. Other names may be queried by clients in the allowed
+// clients list, or by anyone if nobody is explicitly allowed and the default
+// isn't deny.
+func (s *Server) clientAllowed(ip net.IP, name string) bool {
+	name = dns.CanonicalName(name)
+	var best *zoneACL
+	for _, acl := range s.zoneACLs {
+		if dns.IsSubDomain(acl.zone, name) && (best == nil || dns.CountLabel(acl.zone) > dns.CountLabel(best.zone)) {
+			best = acl
+		}
+	}
+
+	if best != nil {
+		return ip != nil && containsIP(best.clients, ip)
+	}
+
+	if ip != nil && containsIP(s.allowedClients, ip) {
+		return true
+	}
+
+	return len(s.allowedClients) == 0 && s.config.ClientACLDefault != clientACLDeny
+}
+
+// clientACL refuses (or drops) queries from clients that aren't allowed to
+// make them.
+type clientACL struct {
+	server *Server
+	next   dns.Handler
+}
+
+func (a *clientACL) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	name := "."
+	if len(req.Question) > 0 {
+		name = req.Question[0].Name
+	}
+
+	ip := addrIP(w.RemoteAddr())
+	if a.server.clientAllowed(ip, name) {
+		a.next.ServeDNS(w, req)
+		return
+	}
+
+	// Our own liveness checks are refused rather than dropped, so that they
+	// still get an answer
+	if a.server.config.ClientACLAction == clientACLActionDrop && !isLivenessProbe(ip, req) {
+		return
+	}
+
+	msg := new(dns.Msg)
+	msg.SetRcode(req, dns.RcodeRefused)
+	(&handler{server: a.server}).writeMsg(w, req, msg)
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientAllowed(t *testing.T) {
+	zoneACLs := []ZoneACL{
+		{Zone: "internal.example", AllowedClients: []string{"100.64.0.0/10"}},
+		{Zone: "admin.internal.example", AllowedClients: []string{"100.64.0.1/32"}},
+	}
+
+	tests := []struct {
+		desc   string
+		config Config
+		client string
+		name   string
+		want   bool
+	}{
+		{"open by default", Config{}, "192.0.2.1", "www.example.com.", true},
+		{"default deny", Config{ClientACLDefault: clientACLDeny}, "192.0.2.1", "www.example.com.", false},
+		{"allowed client", Config{AllowedClients: []string{"192.0.2.0/24"}}, "192.0.2.1", "www.example.com.", true},
+		{"other client", Config{AllowedClients: []string{"192.0.2.0/24"}}, "198.51.100.1", "www.example.com.", false},
+		{"unknown client", Config{AllowedClients: []string{"192.0.2.0/24"}}, "", "www.example.com.", false},
+
+		// Zone ACLs apply instead of the allowed clients, and the most
+		// specific zone wins
+		{"zone member", Config{ZoneACLs: zoneACLs}, "100.64.0.2", "db.internal.example.", true},
+		{"zone outsider", Config{ZoneACLs: zoneACLs}, "192.0.2.1", "db.internal.example.", false},
+		{"zone is case-insensitive", Config{ZoneACLs: zoneACLs}, "192.0.2.1", "DB.Internal.Example.", false},
+		{"subzone member", Config{ZoneACLs: zoneACLs}, "100.64.0.1", "admin.internal.example.", true},
+		{"parent zone member in subzone", Config{ZoneACLs: zoneACLs}, "100.64.0.2", "x.admin.internal.example.", false},
+		{"zone ACL overrides allowed clients", Config{ZoneACLs: zoneACLs, AllowedClients: []string{"192.0.2.0/24"}}, "192.0.2.1", "db.internal.example.", false},
+		{"outside zones", Config{ZoneACLs: zoneACLs}, "192.0.2.1", "www.example.com.", true},
+		{"lookalike zone", Config{ZoneACLs: zoneACLs}, "192.0.2.1", "notinternal.example.", true},
+	}
+	for _, test := range tests {
+		config := test.config
+		config.Upstreams = []string{"192.0.2.53"}
+		server := newTestServer(t, &config)
+
+		if got := server.clientAllowed(net.ParseIP(test.client), test.name); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestClientACLAction(t *testing.T) {
+	probe := new(dns.Msg)
+	probe.SetQuestion("www.example.com.", dns.TypeSOA)
+	probe.SetEdns0(dns.DefaultMsgSize, false)
+	probe.IsEdns0().Option = append(probe.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: livenessProbeOption})
+
+	plain := new(dns.Msg)
+	plain.SetQuestion("www.example.com.", dns.TypeA)
+
+	tests := []struct {
+		desc   string
+		action string
+		client string
+		req    *dns.Msg
+		want   int
+	}{
+		{"refuse", "", "192.0.2.1", plain, dns.RcodeRefused},
+		{"drop", clientACLActionDrop, "192.0.2.1", plain, -1},
+		{"drop from loopback", clientACLActionDrop, "127.0.0.1", plain, -1},
+		{"liveness probe", clientACLActionDrop, "127.0.0.1", probe, dns.RcodeRefused},
+		{"liveness option from elsewhere", clientACLActionDrop, "192.0.2.1", probe, -1},
+	}
+	for _, test := range tests {
+		server := newTestServer(t, &Config{
+			Upstreams:        []string{"192.0.2.53"},
+			ClientACLDefault: clientACLDeny,
+			ClientACLAction:  test.action,
+		})
+		w := newTestResponseWriter(test.client)
+		acl := &clientACL{server: server, next: dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {
+			t.Errorf("%s: denied query was passed on", test.desc)
+		})}
+		acl.ServeDNS(w, test.req.Copy())
+
+		got := -1
+		if len(w.msgs) > 0 {
+			got = w.msgs[0].Rcode
+		}
+		if got != test.want {
+			t.Errorf("%s: got rcode %d, want %d", test.desc, got, test.want)
+		}
+	}
+}
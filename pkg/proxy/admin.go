@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"go.uber.org/zap"
+)
+
+// RegisterAdminRoutes adds the server's administration endpoints to the mux:
+//
+//   - GET /cache: statistics for each view's cache
+//   - GET /cache/entries: every cached response
+//   - POST /cache/flush: flush the cache, or only the responses for the
+//     'name' or 'zone' query parameter
+//   - GET /upstreams: recent success rates and latencies of each upstream
+//   - GET /mappings: the resolver's external IP to Tailscale IP mappings
+//   - GET /interception: whether interception is enabled
+//   - POST /interception?enabled=true|false: enable or disable interception
+//   - GET /queries: the most recent queries
+//   - GET /queries/tail: a stream of queries as JSON lines, as they're answered
+//
+// Queries are only recorded for /queries once the routes are registered, which
+// must be done before the server starts.
+func (s *Server) RegisterAdminRoutes(mux *http.ServeMux) {
+	s.EnableQueryTail()
+
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.CacheStats())
+	})
+
+	mux.HandleFunc("/cache/entries", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.DumpCache())
+	})
+
+	mux.HandleFunc("/cache/flush", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		name, zone := r.URL.Query().Get("name"), r.URL.Query().Get("zone")
+		if name != "" && zone != "" {
+			http.Error(w, "only one of 'name' and 'zone' may be given", http.StatusBadRequest)
+			return
+		}
+
+		flushed := s.FlushCache(name, zone)
+		s.logger.Info("flushed cache", zap.String("name", name), zap.String("zone", zone), zap.Int("flushed", flushed))
+		writeJSON(w, map[string]int{"flushed": flushed})
+	})
+
+	mux.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.UpstreamStats())
+	})
+
+	mux.HandleFunc("/mappings", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		lister, ok := s.resolver.(resolvers.MappingLister)
+		if !ok {
+			http.Error(w, "resolver can't list its mappings", http.StatusNotImplemented)
+			return
+		}
+
+		mappings, err := lister.Mappings()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, mappings)
+	})
+
+	mux.HandleFunc("/interception", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(w, "'enabled' must be true or false", http.StatusBadRequest)
+				return
+			}
+
+			s.SetInterceptionEnabled(enabled)
+			s.logger.Warn("interception toggled through admin API", zap.Bool("enabled", enabled))
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, map[string]bool{"enabled": s.InterceptionEnabled()})
+	})
+
+	mux.HandleFunc("/queries", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.queryTail.recentQueries())
+	})
+
+	mux.HandleFunc("/queries/tail", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveQueryTail(w, r)
+	})
+}
+
+// SetInterceptionEnabled enables or disables interception, in every view.
+// While it's disabled, every query is forwarded untouched.
+func (s *Server) SetInterceptionEnabled(enabled bool) {
+	// The reload lock keeps a reload from inheriting the old setting
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	for _, server := range []*Server{s, s.current()} {
+		server.interceptionDisabled.Store(!enabled)
+		for _, view := range server.views {
+			view.server.interceptionDisabled.Store(!enabled)
+		}
+	}
+}
+
+func (s *Server) InterceptionEnabled() bool {
+	return !s.current().interceptionDisabled.Load()
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
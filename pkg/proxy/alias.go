@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// aliases rewrites queries for alias names to their targets before passing
+// them on, so that they go through the same forwarding and interception as
+// the target. Answers are renamed back to the alias.
+type aliases struct {
+	next    dns.Handler
+	targets map[string]string
+}
+
+func makeAliasTargets(configs []Alias) map[string]string {
+	targets := make(map[string]string, len(configs))
+	for _, config := range configs {
+		targets[dns.CanonicalName(config.Name)] = dns.CanonicalName(config.Target)
+	}
+	return targets
+}
+
+func (a *aliases) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		a.next.ServeDNS(w, req)
+		return
+	}
+
+	target, ok := a.targets[dns.CanonicalName(req.Question[0].Name)]
+	if !ok {
+		a.next.ServeDNS(w, req)
+		return
+	}
+
+	aliased := req.Copy()
+	aliased.Question[0].Name = target
+	a.next.ServeDNS(&aliasWriter{ResponseWriter: w, alias: req.Question[0].Name, target: target}, aliased)
+}
+
+// aliasWriter renames records for an alias's target back to the alias in
+// responses.
+type aliasWriter struct {
+	dns.ResponseWriter
+	alias  string
+	target string
+}
+
+func (w *aliasWriter) Unwrap() dns.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *aliasWriter) WriteMsg(msg *dns.Msg) error {
+	for i := range msg.Question {
+		if dns.CanonicalName(msg.Question[i].Name) == w.target {
+			msg.Question[i].Name = w.alias
+		}
+	}
+
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if dns.CanonicalName(rr.Header().Name) == w.target {
+				rr.Header().Name = w.alias
+			}
+		}
+	}
+
+	return w.ResponseWriter.WriteMsg(msg)
+}
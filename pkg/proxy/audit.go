@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// auditEntry is a line of the audit log, recording an answer that we
+// rewrote.
+type auditEntry struct {
+	Time         time.Time `json:"time"`
+	Client       string    `json:"client"`
+	Name         string    `json:"qname"`
+	Type         string    `json:"qtype"`
+	OriginalIPs  []string  `json:"original_ips"`
+	TailscaleIPs []string  `json:"tailscale_ips"`
+	Evidence     []string  `json:"evidence"`
+	// Whether the rewrite was only recorded, in shadow mode
+	Shadow bool `json:"shadow,omitempty"`
+}
+
+// rewriteRecord is the addresses of a response before and after we rewrote
+// it.
+type rewriteRecord struct {
+	original  []net.IP
+	rewritten []net.IP
+	shadow    bool
+}
+
+// newAuditLogger returns an audit logger for the config, or nil if the audit
+// log is disabled.
+func newAuditLogger(logger *zap.Logger, config *Config) *jsonLogger {
+	if config.AuditLogPath == "" {
+		return nil
+	}
+
+	return newJSONLogger(logger, "audit log", &rotatingFile{
+		path:       config.AuditLogPath,
+		maxSize:    int64(config.AuditLogMaxSizeMB) * 1024 * 1024,
+		maxAge:     config.AuditLogMaxAgeSeconds,
+		maxBackups: config.AuditLogMaxBackups,
+	})
+}
+
+func recordEvidence(ctx context.Context, evidence []string) {
+	if record := recordFromContext(ctx); record != nil && len(evidence) > 0 {
+		record.mu.Lock()
+		defer record.mu.Unlock()
+		record.evidence = append(record.evidence, evidence...)
+	}
+}
+
+// recordedEvidence returns a copy of the evidence recorded for the query so
+// far.
+func recordedEvidence(ctx context.Context) []string {
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		defer record.mu.Unlock()
+		return append([]string(nil), record.evidence...)
+	}
+	return nil
+}
+
+// recordRewrite notes in the query's record that we rewrote its answer (or
+// would have done, in shadow mode), whether just now or when the cached
+// response was made.
+func recordRewrite(ctx context.Context, outcome *interceptionOutcome) {
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		defer record.mu.Unlock()
+		record.evidence = outcome.Evidence
+		record.rewrite = &rewriteRecord{
+			original:  outcome.OriginalIPs,
+			rewritten: outcome.TailscaleIPs,
+			shadow:    outcome.Result == interceptionShadowed,
+		}
+	}
+}
+
+// auditIPs returns the addresses in a response's answers, including those in
+// SVCB/HTTPS hints.
+func auditIPs(msg *dns.Msg) []net.IP {
+	ips := answerIPs(msg)
+	for _, answer := range msg.Answer {
+		var svcb *dns.SVCB
+		switch rr := answer.(type) {
+		case *dns.SVCB:
+			svcb = rr
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		default:
+			continue
+		}
+
+		for _, value := range svcb.Value {
+			switch hint := value.(type) {
+			case *dns.SVCBIPv4Hint:
+				ips = append(ips, hint.Hint...)
+			case *dns.SVCBIPv6Hint:
+				ips = append(ips, hint.Hint...)
+			}
+		}
+	}
+	return ips
+}
+
+// auditRewrite writes the rewrite made for a query to the audit log. The
+// record must be locked.
+func (s *Server) auditRewrite(w dns.ResponseWriter, req *dns.Msg, record *queryRecord) {
+	entry := &auditEntry{
+		Time:         time.Now(),
+		OriginalIPs:  ipStrings(record.rewrite.original),
+		TailscaleIPs: ipStrings(record.rewrite.rewritten),
+		Evidence:     record.evidence,
+		Shadow:       record.rewrite.shadow,
+	}
+
+	if ip := addrIP(w.RemoteAddr()); ip != nil {
+		entry.Client = ip.String()
+	}
+
+	if len(req.Question) > 0 {
+		entry.Name = req.Question[0].Name
+		entry.Type = dns.Type(req.Question[0].Qtype).String()
+	}
+
+	// Unlike the query log, the audit log is meant to be complete, so make
+	// sure that anything we can't write to it is at least in our own logs
+	if !s.auditLog.log(entry) {
+		s.logger.Error("audit log queue is full; dropping entry",
+			zap.String("client", entry.Client),
+			zap.String("qname", entry.Name),
+			zap.Strings("original_ips", entry.OriginalIPs),
+			zap.Strings("tailscale_ips", entry.TailscaleIPs),
+			zap.Strings("evidence", entry.Evidence),
+		)
+	}
+}
+
+func ipStrings(ips []net.IP) []string {
+	strs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		strs = append(strs, ip.String())
+	}
+	return strs
+}
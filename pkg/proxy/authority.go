@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// makeInterceptedZones creates zones holding the synthesized SOA and NS
+// records of the proxy zones, if configured to answer for them.
+func (s *Server) makeInterceptedZones() ([]*staticZone, error) {
+	if !s.config.InterceptedZoneAuthority {
+		return nil, nil
+	}
+
+	serial := uint32(time.Now().Unix())
+	origins := append(slices.Clone(s.config.ProxyZones), s.config.AnswerWithoutUpstreamZones...)
+
+	zones := make([]*staticZone, 0, len(origins))
+	for _, origin := range origins {
+		zone, err := newStaticZone(&StaticZone{Zone: origin, Nameservers: s.config.InterceptedZoneNameservers}, serial)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+
+	return zones, nil
+}
+
+// interceptedZoneFor returns the most specific proxy zone containing the name,
+// or nil if we don't answer for any zone containing it.
+func (s *Server) interceptedZoneFor(name string) *staticZone {
+	name = dns.CanonicalName(name)
+
+	var best *staticZone
+	for _, zone := range s.interceptedZones {
+		if !dns.IsSubDomain(zone.origin, name) {
+			continue
+		}
+
+		if best == nil || dns.CountLabel(zone.origin) > dns.CountLabel(best.origin) {
+			best = zone
+		}
+	}
+
+	return best
+}
+
+// answerZoneAuthority answers SOA and NS queries for the apex of a proxy
+// zone, returning false if the query isn't one of those.
+func (h *handler) answerZoneAuthority(w dns.ResponseWriter, req *dns.Msg) bool {
+	if len(req.Question) != 1 {
+		return false
+	}
+
+	question := req.Question[0]
+	if question.Qtype != dns.TypeSOA && question.Qtype != dns.TypeNS {
+		return false
+	}
+
+	zone := h.server.interceptedZoneFor(question.Name)
+	if zone == nil || dns.CanonicalName(question.Name) != zone.origin {
+		return false
+	}
+
+	h.writeMsg(w, req, zone.answer(req))
+	return true
+}
+
+// noDataResponse returns a NODATA response carrying the SOA of the proxy zone
+// that the name is in, so that it can be cached as per RFC 2308. Returns nil
+// if we don't answer for a zone containing the name.
+func (s *Server) noDataResponse(req *dns.Msg) *dns.Msg {
+	zone := s.interceptedZoneFor(req.Question[0].Name)
+	if zone == nil {
+		return nil
+	}
+
+	msg := s.synthesizedReply(req)
+	msg.Ns = []dns.RR{dns.Copy(zone.soa)}
+	return msg
+}
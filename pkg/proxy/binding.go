@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+)
+
+var (
+	errResolversUnnamed = errors.New("resolver bindings need named resolvers")
+	errUnknownResolver  = errors.New("no resolver with name")
+)
+
+// resolverBinding is a resolver that answers for the names matching some
+// patterns, in place of the resolver as a whole.
+type resolverBinding struct {
+	patterns namePatterns
+	resolver resolvers.Resolver
+}
+
+func makeResolverBindings(resolver resolvers.Resolver, bindings []ResolverBinding) ([]*resolverBinding, error) {
+	if len(bindings) == 0 {
+		return nil, nil
+	}
+
+	named, ok := resolver.(resolvers.NamedResolvers)
+	if !ok {
+		return nil, errResolversUnnamed
+	}
+
+	resolverBindings := make([]*resolverBinding, 0, len(bindings))
+	for _, binding := range bindings {
+		bound, ok := named.Named(binding.Resolver)
+		if !ok {
+			return nil, fmt.Errorf("%w '%s'", errUnknownResolver, binding.Resolver)
+		}
+
+		patterns, err := compileNamePatterns(binding.Patterns)
+		if err != nil {
+			return nil, fmt.Errorf("invalid patterns for resolver '%s': %w", binding.Resolver, err)
+		}
+
+		resolverBindings = append(resolverBindings, &resolverBinding{
+			patterns: patterns,
+			resolver: bound,
+		})
+	}
+
+	return resolverBindings, nil
+}
+
+// resolverFor returns the resolver to consult for the answers to a query for
+// the name: the resolver bound to it, if any, or else whichever of the
+// resolvers are consulted for it.
+func (s *Server) resolverFor(name string) resolvers.Resolver {
+	for _, binding := range s.resolverBindings {
+		if binding.patterns.matches(name) {
+			return binding.resolver
+		}
+	}
+
+	if scoped, ok := s.resolver.(resolvers.ScopedResolver); ok {
+		return scoped.ForName(name)
+	}
+	return s.resolver
+}
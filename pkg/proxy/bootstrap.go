@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+var errBootstrapResolverNotIP = errors.New("bootstrap resolvers must be IP addresses")
+
+// newBootstrapResolver creates a resolver that looks up hostnames using only
+// the given DNS servers. This is used to resolve the hostnames of DoT and DoH
+// upstreams, which we can't rely on the system resolver for if the system
+// resolver is us.
+func newBootstrapResolver(servers []string) (*net.Resolver, error) {
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		addr := withDefaultPort(server, "53")
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("%w: '%s'", errBootstrapResolverNotIP, server)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	// The Go resolver dials once per attempt, so rotating through the servers
+	// here means that retries go to a different server
+	var next atomic.Uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			var d net.Dialer
+			addr := addrs[int(next.Add(1)-1)%len(addrs)]
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
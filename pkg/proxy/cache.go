@@ -0,0 +1,339 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	// TTL of stale answers, as recommended by RFC 8767
+	staleAnswerTTL = 30
+
+	// Popular entries are prefetched once they have less than this fraction
+	// of their TTL left
+	prefetchThreshold = 0.1
+
+	// Cache key prefixes, keeping answers we intercepted apart from plain
+	// forwarded answers for the same query
+	cacheKindForward   = "forward"
+	cacheKindIntercept = "intercept"
+
+	// Responses that mustn't be cached at all
+	cacheKindNone = ""
+)
+
+type cacheEntry struct {
+	key     string
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+
+	// What became of the interception that made the response, for
+	// intercepted responses
+	outcome *interceptionOutcome
+
+	hits        int
+	prefetching bool
+}
+
+// responseCache is an LRU cache of responses, which expire according to the
+// TTLs of their records.
+type responseCache struct {
+	maxEntries int
+
+	// How long expired entries are kept around to be served stale; zero
+	// disables serving stale entries
+	staleWindow time.Duration
+
+	// Number of hits after which entries are prefetched before they expire;
+	// zero disables prefetching
+	prefetchHits int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// Lookups since the cache was created, for reporting
+	hits   uint64
+	misses uint64
+}
+
+func newResponseCache(maxEntries int, staleWindow time.Duration, prefetchHits int) *responseCache {
+	return &responseCache{
+		maxEntries:   maxEntries,
+		staleWindow:  staleWindow,
+		prefetchHits: prefetchHits,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+// cacheKey identifies the responses that a query can share: those to queries
+// for the same name, type and class, with the same DNSSEC bits and ECS option.
+func cacheKey(kind string, req *dns.Msg) string {
+	question := req.Question[0]
+
+	var do bool
+	var ecs string
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+		if subnet := findECS(opt); subnet != nil {
+			ecs = subnet.String()
+		}
+	}
+
+	return fmt.Sprintf("%s/%s/%d/%d/%t/%t/%s",
+		kind, strings.ToLower(question.Name), question.Qtype, question.Qclass, do, req.CheckingDisabled, ecs)
+}
+
+// responseTTL returns how long a response may be cached for: the lowest TTL
+// of its records.
+func responseTTL(msg *dns.Msg) (time.Duration, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return time.Duration(ttl) * time.Second, found
+}
+
+// get returns a copy of the cached response, what became of its interception,
+// and its age, and whether the caller should prefetch a fresh response because
+// the entry is popular and about to expire.
+func (c *responseCache) get(key string) (msg *dns.Msg, outcome *interceptionOutcome, age time.Duration, prefetch bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, nil, 0, false, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		// Keep expired entries that we might still serve stale
+		if time.Now().After(entry.expires.Add(c.staleWindow)) {
+			c.lru.Remove(element)
+			delete(c.entries, key)
+		}
+		c.misses++
+		return nil, nil, 0, false, false
+	}
+
+	c.hits++
+	c.lru.MoveToFront(element)
+
+	entry.hits++
+	if c.prefetchHits > 0 && entry.hits >= c.prefetchHits && !entry.prefetching {
+		ttl := entry.expires.Sub(entry.stored)
+		if time.Until(entry.expires) < time.Duration(prefetchThreshold*float64(ttl)) {
+			entry.prefetching = true
+			prefetch = true
+		}
+	}
+
+	return entry.msg.Copy(), entry.outcome, time.Since(entry.stored), prefetch, true
+}
+
+// getStale returns an entry that has expired, but not by more than the stale
+// window.
+func (c *responseCache) getStale(key string) (*dns.Msg, *interceptionOutcome, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires.Add(c.staleWindow)) {
+		return nil, nil, false
+	}
+
+	return entry.msg.Copy(), entry.outcome, true
+}
+
+func (c *responseCache) set(key string, msg *dns.Msg, outcome *interceptionOutcome, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{key: key, msg: msg.Copy(), stored: now, expires: now.Add(ttl), outcome: outcome}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheable returns true if responses to the query may be cached as the
+// given kind.
+func (s *Server) cacheable(req *dns.Msg, kind string) bool {
+	if s.cache == nil || kind == cacheKindNone || len(req.Question) != 1 {
+		return false
+	}
+
+	name := dns.CanonicalName(req.Question[0].Name)
+	for _, zone := range s.config.CacheExcludeZones {
+		if dns.IsSubDomain(dns.CanonicalName(zone), name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// answerFromCache writes a cached response to the query, if there is one,
+// with its TTLs reduced by the time it's spent in the cache.
+func (h *handler) answerFromCache(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, kind string) bool {
+	if !h.server.cacheable(req, kind) {
+		return false
+	}
+
+	msg, outcome, age, prefetch, ok := h.server.cache.get(cacheKey(kind, req))
+	if !ok {
+		return false
+	}
+	h.recordOutcome(ctx, req, outcome)
+
+	if prefetch {
+		go h.prefetch(ctx, req.Copy(), kind)
+	}
+
+	elapsed := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl -= min(hdr.Ttl, elapsed)
+			}
+		}
+	}
+
+	msg.Id = req.Id
+	msg.Question = req.Question
+	traceStep(ctx, "answered from %s cache", kind)
+	h.writeMsg(w, req, msg)
+	return true
+}
+
+// negativeTTL returns how long a negative response may be cached for, as per
+// RFC 2308 § 5: the lower of the TTL of the SOA in the authority section and
+// its minimum field. Negative responses without an SOA can't be cached.
+func (s *Server) negativeTTL(msg *dns.Msg) (time.Duration, bool) {
+	for _, rr := range msg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		ttl := time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+		if s.config.CacheNegativeMaxTTLSeconds > 0 {
+			ttl = min(ttl, s.config.CacheNegativeMaxTTLSeconds)
+		}
+		return ttl, true
+	}
+
+	return 0, false
+}
+
+// storeInCache caches a response to the query, if it's a positive answer or
+// a cacheable negative one, along with what became of its interception (nil
+// if it wasn't intercepted).
+func (h *handler) storeInCache(req *dns.Msg, msg *dns.Msg, outcome *interceptionOutcome, kind string) {
+	if !h.server.cacheable(req, kind) || msg.Truncated {
+		return
+	}
+
+	var ttl time.Duration
+	var ok bool
+	switch {
+	case isNegativeResponse(req, msg):
+		ttl, ok = h.server.negativeTTL(msg)
+	case msg.Rcode == dns.RcodeSuccess:
+		ttl, ok = responseTTL(msg)
+	}
+
+	if ok {
+		h.server.cache.set(cacheKey(kind, req), msg, outcome, ttl)
+	}
+}
+
+// staleFromCache returns a cached response to the query even if it has
+// expired, with short TTLs, for use when upstream is unavailable (RFC 8767).
+func (h *handler) staleFromCache(ctx context.Context, req *dns.Msg, kind string) (*dns.Msg, bool) {
+	if !h.server.cacheable(req, kind) || h.server.cache.staleWindow == 0 {
+		return nil, false
+	}
+
+	msg, outcome, ok := h.server.cache.getStale(cacheKey(kind, req))
+	if !ok {
+		return nil, false
+	}
+	h.recordOutcome(ctx, req, outcome)
+
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = staleAnswerTTL
+			}
+		}
+	}
+
+	msg.Id = req.Id
+	msg.Question = req.Question
+	return msg, true
+}
+
+// prefetch refreshes the cached response to a query in the background.
+func (h *handler) prefetch(ctx context.Context, req *dns.Msg, kind string) {
+	var msg *dns.Msg
+	var outcome *interceptionOutcome
+	var err error
+	if kind == cacheKindIntercept {
+		msg, outcome, err = h.interceptedResponse(ctx, req)
+	} else {
+		msg, err = h.resolveForward(ctx, req)
+	}
+
+	if err != nil {
+		h.server.logger.Debug("failed to prefetch cache entry", zap.String("name", req.Question[0].Name), zap.Error(err))
+		return
+	}
+
+	// Failures don't replace the entry, which leaves it to expire (and be
+	// served stale, if enabled)
+	if msg.Rcode != dns.RcodeServerFailure {
+		h.storeInCache(req, msg, outcome, kind)
+	}
+}
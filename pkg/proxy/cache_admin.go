@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheStats describes the state of a view's response cache. The default
+// view has an empty name.
+type CacheStats struct {
+	View    string `json:"view"`
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// CacheEntry describes a cached response.
+type CacheEntry struct {
+	View  string `json:"view"`
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Rcode string `json:"rcode"`
+
+	// Seconds until the entry expires; negative once it has expired and is
+	// only being kept to be served stale
+	TTLSeconds int `json:"ttl_seconds"`
+	Hits       int `json:"hits"`
+}
+
+// entryName returns the query name that a cache entry answers.
+func entryName(entry *cacheEntry) string {
+	if len(entry.msg.Question) == 0 {
+		return ""
+	}
+	return dns.CanonicalName(entry.msg.Question[0].Name)
+}
+
+// flush removes the entries whose query names match, returning how many were
+// removed.
+func (c *responseCache) flush(match func(name string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flushed := 0
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+
+		entry := element.Value.(*cacheEntry)
+		if match(entryName(entry)) {
+			c.lru.Remove(element)
+			delete(c.entries, entry.key)
+			flushed++
+		}
+
+		element = next
+	}
+
+	return flushed
+}
+
+func (c *responseCache) stats() (entries int, hits uint64, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.hits, c.misses
+}
+
+// dump describes every entry in the cache, from most to least recently used.
+func (c *responseCache) dump(view string) []CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]CacheEntry, 0, c.lru.Len())
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+
+		var qtype string
+		if len(entry.msg.Question) > 0 {
+			qtype = dns.TypeToString[entry.msg.Question[0].Qtype]
+		}
+
+		kind, _, _ := strings.Cut(entry.key, "/")
+
+		entries = append(entries, CacheEntry{
+			View:       view,
+			Kind:       kind,
+			Name:       entryName(entry),
+			Type:       qtype,
+			Rcode:      dns.RcodeToString[entry.msg.Rcode],
+			TTLSeconds: int(time.Until(entry.expires) / time.Second),
+			Hits:       entry.hits,
+		})
+	}
+
+	return entries
+}
+
+type viewCache struct {
+	view  string
+	cache *responseCache
+}
+
+// caches returns the response caches of the server and its views.
+func (s *Server) caches() []viewCache {
+	var caches []viewCache
+	if s.cache != nil {
+		caches = append(caches, viewCache{cache: s.cache})
+	}
+
+	for _, view := range s.views {
+		if view.server.cache != nil {
+			caches = append(caches, viewCache{view: view.name, cache: view.server.cache})
+		}
+	}
+
+	return caches
+}
+
+// FlushCache removes cached responses from every view's cache: those for the
+// given name, those for names in the given zone, or everything if both are
+// empty. Returns the number of responses removed.
+func (s *Server) FlushCache(name string, zone string) int {
+	var match func(string) bool
+	switch {
+	case name != "":
+		name = dns.CanonicalName(name)
+		match = func(n string) bool { return n == name }
+	case zone != "":
+		zone = dns.CanonicalName(zone)
+		match = func(n string) bool { return dns.IsSubDomain(zone, n) }
+	default:
+		match = func(string) bool { return true }
+	}
+
+	flushed := 0
+	for _, c := range s.current().caches() {
+		flushed += c.cache.flush(match)
+	}
+
+	return flushed
+}
+
+// CacheStats returns the state of every view's cache.
+func (s *Server) CacheStats() []CacheStats {
+	var stats []CacheStats
+	for _, c := range s.current().caches() {
+		entries, hits, misses := c.cache.stats()
+		stats = append(stats, CacheStats{View: c.view, Entries: entries, Hits: hits, Misses: misses})
+	}
+
+	return stats
+}
+
+// DumpCache describes every cached response in every view's cache.
+func (s *Server) DumpCache() []CacheEntry {
+	var entries []CacheEntry
+	for _, c := range s.current().caches() {
+		entries = append(entries, c.cache.dump(c.view)...)
+	}
+
+	return entries
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// persistedEntry is a cache entry as saved to disk.
+type persistedEntry struct {
+	Key     string    `json:"key"`
+	Msg     []byte    `json:"msg"`
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+
+	Interception *interceptionOutcome `json:"interception,omitempty"`
+}
+
+// save writes the cache's entries to a file, from least to most recently
+// used, so that loading them in order restores the LRU order.
+func (c *responseCache) save(path string) error {
+	c.mu.Lock()
+	entries := make([]persistedEntry, 0, c.lru.Len())
+	for element := c.lru.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*cacheEntry)
+
+		packed, err := entry.msg.Pack()
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, persistedEntry{
+			Key:     entry.key,
+			Msg:     packed,
+			Stored:  entry.stored,
+			Expires: entry.expires,
+
+			Interception: entry.outcome,
+		})
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache: %w", err)
+	}
+
+	// Write to a temporary file first, so that we never leave a half-written
+	// cache behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace cache file: %w", err)
+	}
+
+	return nil
+}
+
+// load adds the entries saved in a file to the cache, skipping any that have
+// expired (and are too old to serve stale). A missing file isn't an error.
+func (c *responseCache) load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read cache file: %w", err)
+	}
+
+	var entries []persistedEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to decode cache file: %w", err)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, persisted := range entries {
+		if now.After(persisted.Expires.Add(c.staleWindow)) {
+			continue
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(persisted.Msg); err != nil {
+			continue
+		}
+
+		entry := &cacheEntry{
+			key:     persisted.Key,
+			msg:     msg,
+			stored:  persisted.Stored,
+			expires: persisted.Expires,
+			outcome: persisted.Interception,
+		}
+		if element, ok := c.entries[entry.key]; ok {
+			c.lru.Remove(element)
+		}
+		c.entries[entry.key] = c.lru.PushFront(entry)
+	}
+
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+
+	return nil
+}
+
+// saveCache persists the cache to disk, if configured to.
+func (s *Server) saveCache() {
+	if s.cache == nil || s.config.CachePersistPath == "" {
+		return
+	}
+
+	if err := s.cache.save(s.config.CachePersistPath); err != nil {
+		s.logger.Warn("failed to persist cache", zap.Error(err))
+	}
+}
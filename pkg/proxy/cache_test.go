@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// backdate makes a cache entry as old as if it had been stored age ago.
+func (c *responseCache) backdate(t *testing.T, key string, age time.Duration) {
+	t.Helper()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		t.Fatalf("no cache entry for %s", key)
+	}
+	entry := element.Value.(*cacheEntry)
+	entry.stored = entry.stored.Add(-age)
+	entry.expires = entry.expires.Add(-age)
+}
+
+func testResponse(t *testing.T, name string, qtype uint16, rcode int, answer []string, ns []string) (*dns.Msg, *dns.Msg) {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+
+	msg := new(dns.Msg)
+	msg.SetRcode(req, rcode)
+	for _, rr := range answer {
+		msg.Answer = append(msg.Answer, testRR(t, rr))
+	}
+	for _, rr := range ns {
+		msg.Ns = append(msg.Ns, testRR(t, rr))
+	}
+	return req, msg
+}
+
+func TestStoreInCacheTTLs(t *testing.T) {
+	soa := "example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 300"
+
+	tests := []struct {
+		desc      string
+		rcode     int
+		answer    []string
+		ns        []string
+		maxNegTTL time.Duration
+		want      time.Duration
+	}{
+		{"lowest TTL of the answer", dns.RcodeSuccess, []string{"www.example.com. 60 IN A 192.0.2.1", "www.example.com. 30 IN A 192.0.2.2"}, nil, 0, 30 * time.Second},
+		{"authority counts too", dns.RcodeSuccess, []string{"www.example.com. 60 IN A 192.0.2.1"}, []string{"example.com. 20 IN NS ns.example.com."}, 0, 20 * time.Second},
+		{"NXDOMAIN uses the SOA minimum", dns.RcodeNameError, nil, []string{soa}, 0, 300 * time.Second},
+		{"NODATA uses the SOA minimum", dns.RcodeSuccess, nil, []string{soa}, 0, 300 * time.Second},
+		{"SOA TTL below its minimum", dns.RcodeNameError, nil, []string{"example.com. 100 IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 300"}, 0, 100 * time.Second},
+		{"negative TTL capped", dns.RcodeNameError, nil, []string{soa}, 45 * time.Second, 45 * time.Second},
+		{"NXDOMAIN without SOA", dns.RcodeNameError, nil, nil, 0, 0},
+		{"SERVFAIL", dns.RcodeServerFailure, nil, []string{soa}, 0, 0},
+		{"zero TTL", dns.RcodeSuccess, []string{"www.example.com. 0 IN A 192.0.2.1"}, nil, 0, 0},
+	}
+	for _, test := range tests {
+		server := newTestServer(t, &Config{
+			Upstreams:                  []string{"192.0.2.53"},
+			CacheMaxEntries:            10,
+			CacheNegativeMaxTTLSeconds: test.maxNegTTL,
+		})
+		h := &handler{server: server}
+
+		req, msg := testResponse(t, "www.example.com.", dns.TypeA, test.rcode, test.answer, test.ns)
+		h.storeInCache(req, msg, nil, cacheKindForward)
+
+		var got time.Duration
+		if element, ok := server.cache.entries[cacheKey(cacheKindForward, req)]; ok {
+			entry := element.Value.(*cacheEntry)
+			got = entry.expires.Sub(entry.stored)
+		}
+		if got != test.want {
+			t.Errorf("%s: cached for %s, want %s", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestAnswerFromCacheAgesTTLs(t *testing.T) {
+	server := newTestServer(t, &Config{Upstreams: []string{"192.0.2.53"}, CacheMaxEntries: 10})
+	h := &handler{server: server}
+
+	req, msg := testResponse(t, "www.example.com.", dns.TypeA, dns.RcodeSuccess,
+		[]string{"www.example.com. 60 IN A 192.0.2.1"}, []string{"example.com. 300 IN NS ns.example.com."})
+	h.storeInCache(req, msg, nil, cacheKindForward)
+	server.cache.backdate(t, cacheKey(cacheKindForward, req), 25*time.Second)
+
+	w := newTestResponseWriter("192.0.2.1")
+	req.Id = 4321
+	if !h.answerFromCache(context.Background(), w, req, cacheKindForward) {
+		t.Fatal("response wasn't answered from the cache")
+	}
+
+	got := w.msgs[0]
+	if got.Id != 4321 {
+		t.Errorf("got ID %d, want the query's", got.Id)
+	}
+	if ttl := got.Answer[0].Header().Ttl; ttl != 35 {
+		t.Errorf("got answer TTL %d, want 35", ttl)
+	}
+	if ttl := got.Ns[0].Header().Ttl; ttl != 275 {
+		t.Errorf("got authority TTL %d, want 275", ttl)
+	}
+
+	// Other queries share only responses to the same question and bits
+	for _, other := range []func(*dns.Msg){
+		func(m *dns.Msg) { m.Question[0].Qtype = dns.TypeAAAA },
+		func(m *dns.Msg) { m.CheckingDisabled = true },
+		func(m *dns.Msg) { m.SetEdns0(1232, true) },
+	} {
+		otherReq := req.Copy()
+		other(otherReq)
+		if h.answerFromCache(context.Background(), newTestResponseWriter("192.0.2.1"), otherReq, cacheKindForward) {
+			t.Errorf("%v was answered with the response to another query", otherReq.Question[0])
+		}
+	}
+	if h.answerFromCache(context.Background(), newTestResponseWriter("192.0.2.1"), req, cacheKindIntercept) {
+		t.Error("intercepted query was answered with a forwarded response")
+	}
+
+	req.Question[0].Name = "WWW.Example.COM."
+	if !h.answerFromCache(context.Background(), newTestResponseWriter("192.0.2.1"), req, cacheKindForward) {
+		t.Error("cache lookups aren't case-insensitive")
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	cache := newResponseCache(10, time.Minute, 0)
+	_, msg := testResponse(t, "www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com. 60 IN A 192.0.2.1"}, nil)
+	cache.set("key", msg, nil, time.Minute)
+
+	tests := []struct {
+		age   time.Duration
+		fresh bool
+		stale bool
+	}{
+		{30 * time.Second, true, true},
+		{90 * time.Second, false, true},
+		{3 * time.Minute, false, false},
+	}
+	var aged time.Duration
+	for _, test := range tests {
+		cache.backdate(t, "key", test.age-aged)
+		aged = test.age
+
+		_, _, _, _, fresh := cache.get("key")
+		_, _, stale := cache.getStale("key")
+		if fresh != test.fresh || stale != test.stale {
+			t.Errorf("at %s: got fresh %t and stale %t, want %t and %t", test.age, fresh, stale, test.fresh, test.stale)
+		}
+	}
+
+	if _, ok := cache.entries["key"]; ok {
+		t.Error("entry outside the stale window wasn't removed")
+	}
+}
+
+func TestResponseCachePrefetch(t *testing.T) {
+	cache := newResponseCache(10, 0, 2)
+	_, msg := testResponse(t, "www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com. 100 IN A 192.0.2.1"}, nil)
+
+	tests := []struct {
+		desc string
+		age  time.Duration
+		want []bool
+	}{
+		// Entries are only prefetched once popular, and only once
+		{"popular and expiring", 95 * time.Second, []bool{false, true, false, false}},
+		{"popular but fresh", 50 * time.Second, []bool{false, false, false}},
+	}
+	for _, test := range tests {
+		cache.set("key", msg, nil, 100*time.Second)
+		cache.backdate(t, "key", test.age)
+
+		for i, want := range test.want {
+			if _, _, _, got, _ := cache.get("key"); got != want {
+				t.Errorf("%s: hit %d: got prefetch %t, want %t", test.desc, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newResponseCache(2, 0, 0)
+	_, msg := testResponse(t, "www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com. 60 IN A 192.0.2.1"}, nil)
+
+	cache.set("a", msg, nil, time.Minute)
+	cache.set("b", msg, nil, time.Minute)
+	cache.get("a")
+	cache.set("c", msg, nil, time.Minute)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, _, _, got := cache.get(key); got != want {
+			t.Errorf("%s: got cached %t, want %t", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var errCaseMismatch = errors.New("response question doesn't match case-randomized query name (possible spoofing)")
+
+// randomizeCase randomly flips the case of each letter in a name, as described
+// in draft-vixie-dnsext-dns0x20.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if rand.Intn(2) == 0 { //nolint:gosec
+			continue
+		}
+
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// exchangeRandomizedCase sends a query with the case of its name randomized,
+// and rejects responses that don't echo the name back exactly: an off-path
+// attacker spoofing responses would have to guess the case as well as the ID
+// and port. Names in the response are restored to the client's case.
+func (c *upstreamClients) exchangeRandomizedCase(ctx context.Context, client *dns.Client, u *upstream, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return c.exchangeDNS(ctx, client, u, req)
+	}
+
+	original := req.Question[0].Name
+	query := req.Copy()
+	query.Question[0].Name = randomizeCase(original)
+
+	resp, err := c.exchangeDNS(ctx, client, u, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Question) != 1 || resp.Question[0].Name != query.Question[0].Name {
+		return nil, errCaseMismatch
+	}
+
+	resp.Question[0].Name = original
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, original) {
+				rr.Header().Name = original
+			}
+		}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Maximum number of follow-up queries we'll make when chasing a CNAME chain
+const maxCNAMEChaseDepth = 8
+
+var errCNAMEChainTooLong = errors.New("CNAME chain too long to chase")
+
+// chaseCNAMEs follows a CNAME chain that the upstream didn't resolve for us
+// (e.g. because it uses minimal responses), by querying upstream for the
+// target of the chain. The returned response contains the whole chain along
+// with the answers for its target.
+func (h *handler) chaseCNAMEs(ctx context.Context, req *dns.Msg, resp *dns.Msg) (*dns.Msg, error) {
+	question := req.Question[0]
+
+	chased := resp
+	for depth := 0; depth < maxCNAMEChaseDepth; depth++ {
+		target, ok := unresolvedCNAMETarget(question.Name, question.Qtype, chased.Answer)
+		if !ok {
+			return chased, nil
+		}
+
+		followUp := new(dns.Msg)
+		followUp.SetQuestion(target, question.Qtype)
+		followUp.RecursionDesired = req.RecursionDesired
+
+		followUpResp, err := h.resolveUpstream(ctx, followUp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve CNAME target '%s': %w", target, err)
+		}
+
+		if followUpResp.Rcode != dns.RcodeSuccess || len(followUpResp.Answer) == 0 {
+			// The chain leads nowhere; there's nothing more for us to do
+			return chased, nil
+		}
+
+		merged := chased.Copy()
+		merged.Answer = append(merged.Answer, followUpResp.Answer...)
+		chased = merged
+	}
+
+	return nil, errCNAMEChainTooLong
+}
+
+// unresolvedCNAMETarget follows the CNAME chain in the given answers starting
+// from name, returning the end of the chain if there are no records of the
+// given type for it.
+func unresolvedCNAMETarget(name string, qtype uint16, answers []dns.RR) (string, bool) {
+	current := name
+	seen := map[string]bool{}
+
+	for {
+		key := strings.ToLower(current)
+		if seen[key] {
+			// CNAME loop: not something we can resolve
+			return "", false
+		}
+		seen[key] = true
+
+		next := ""
+		for _, answer := range answers {
+			hdr := answer.Header()
+			if !strings.EqualFold(hdr.Name, current) {
+				continue
+			}
+
+			if hdr.Rrtype == qtype {
+				return "", false
+			}
+
+			if cname, ok := answer.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		current = next
+	}
+
+	if strings.EqualFold(current, name) {
+		// No chain at all
+		return "", false
+	}
+
+	return current, true
+}
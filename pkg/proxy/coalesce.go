@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// coalescingKey identifies queries that would get identical answers from
+// upstream: the query as sent upstream, minus its ID and trace ID. The inbound
+// protocol is included as it decides which transport we use for some
+// upstreams.
+func (h *handler) coalescingKey(req *dns.Msg) (string, bool) {
+	query := req.Copy()
+	query.Id = 0
+	h.server.removeTraceOption(query)
+
+	packed, err := query.Pack()
+	if err != nil {
+		return "", false
+	}
+
+	return h.clients.inbound + "/" + string(packed), true
+}
+
+// exchangeCoalesced exchanges a query with upstream, sharing the exchange with
+// any identical query already in flight, so that lots of clients asking for
+// the same name at once only cost one round trip upstream.
+func (h *handler) exchangeCoalesced(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	defer recordPhase(ctx, phaseUpstream, time.Now())
+
+	if !h.server.config.CoalesceQueries {
+		return h.exchangeUpstreams(ctx, req)
+	}
+
+	key, ok := h.coalescingKey(req)
+	if !ok {
+		return h.exchangeUpstreams(ctx, req)
+	}
+
+	// The shared exchange mustn't be cut short if the query that started it
+	// is cancelled (e.g. its client goes away) while others are waiting on
+	// it, so it's detached from the query's context; exchangeUpstreams still
+	// bounds it by the total upstream timeout
+	results := h.server.inFlight.DoChan(key, func() (interface{}, error) {
+		return h.exchangeUpstreams(context.WithoutCancel(ctx), req)
+	})
+
+	var result singleflight.Result
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	// Every caller gets its own copy, as responses are modified before being
+	// written
+	resp := result.Val.(*dns.Msg).Copy()
+	resp.Id = req.Id
+	return resp, nil
+}
@@ -0,0 +1,465 @@
+package proxy
+
+import "time"
+
+type Config struct {
+	ListenAddr string `mapstructure:"listen_addr" validate:"required"`
+	// Upstream DNS servers, as '[scheme://]host[:port]'. The special value
+	// 'system' uses the nameservers in /etc/resolv.conf, which are re-read
+	// whenever the file changes.
+	Upstreams []string `mapstructure:"upstreams" validate:"required"`
+	// Timeouts for exchanges with upstreams: for dialing (default 2), reading
+	// (default 2) and writing (default 2) each attempt, and for the whole
+	// exchange, including retries and failover (default 5)
+	UpstreamDialTimeoutSeconds  time.Duration `mapstructure:"upstream_dial_timeout_seconds"`
+	UpstreamReadTimeoutSeconds  time.Duration `mapstructure:"upstream_read_timeout_seconds"`
+	UpstreamWriteTimeoutSeconds time.Duration `mapstructure:"upstream_write_timeout_seconds"`
+	UpstreamTotalTimeoutSeconds time.Duration `mapstructure:"upstream_total_timeout_seconds"`
+	ProxyZones                  []string      `mapstructure:"proxy_zones"`
+
+	// Names to intercept in addition to those in ProxyZones, and names never
+	// to intercept (even within ProxyZones). These are globs, where '*'
+	// matches within a single label and '**' matches any number of labels,
+	// or regular expressions prefixed with 'regex:', which must match the
+	// whole fully-qualified name.
+	ProxyPatterns        []string `mapstructure:"proxy_patterns"`
+	ProxyExcludePatterns []string `mapstructure:"proxy_exclude_patterns"`
+
+	// If set, only queries from clients in these networks (e.g. the tailnet's
+	// 100.64.0.0/10) are intercepted; everyone else gets upstream's answers
+	InterceptClientCIDRs []string `mapstructure:"intercept_client_cidrs" validate:"dive,cidr"`
+
+	// Zones in which A/AAAA queries are first answered from the resolver by
+	// name, without contacting upstream at all. On a miss, we fall back to
+	// intercepting as normal. Requires a resolver that supports name lookups.
+	AnswerWithoutUpstreamZones []string `mapstructure:"answer_without_upstream_zones"`
+
+	// Names whose answers are looked up with a particular resolver, rather
+	// than all of them. Requires named resolvers (see the resolver config).
+	ResolverBindings []ResolverBinding `mapstructure:"resolver_bindings" validate:"dive"`
+
+	// Answer SOA and NS queries for the apex of proxy zones ourselves, with
+	// synthesized records, and include the SOA in negative answers we make up
+	// for names in them. The nameservers default to 'ns.<zone>'.
+	InterceptedZoneAuthority   bool     `mapstructure:"intercepted_zone_authority"`
+	InterceptedZoneNameservers []string `mapstructure:"intercepted_zone_nameservers"`
+
+	// Whether intercepted answers 'replace' (the default) the upstream A/AAAA
+	// records with Tailscale ones, or 'append' Tailscale records after the
+	// upstream ones, giving clients a fallback if the tailnet is down. In
+	// 'shadow' mode, answers are rewritten only for the logs, metrics and
+	// audit log, and clients get the upstream ones, to see what would change
+	InterceptMode string `mapstructure:"intercept_mode" validate:"omitempty,oneof=replace append shadow"`
+
+	// Query types to intercept: 'A', 'AAAA' or both (the default). Queries of
+	// other address types are forwarded untouched, e.g. AAAA queries in
+	// tailnets without IPv6.
+	InterceptQtypes []string `mapstructure:"intercept_qtypes" validate:"dive,oneof=A AAAA"`
+
+	// Order of Tailscale IPs in intercepted answers when there are several:
+	// 'ordered' (the default) sorts them, 'shuffle' randomises them for each
+	// response, and 'round_robin' rotates them for each response
+	AnswerOrder string `mapstructure:"answer_order" validate:"omitempty,oneof=ordered shuffle round_robin"`
+
+	// How EDNS Client Subnet options in queries are handled when forwarding
+	// upstream: 'forward' (the default) passes them through as-is, 'strip'
+	// removes them, and 'inject' replaces them with ECSInjectSubnet (a CIDR)
+	ECSPolicy       string `mapstructure:"ecs_policy" validate:"omitempty,oneof=forward strip inject"`
+	ECSInjectSubnet string `mapstructure:"ecs_inject_subnet" validate:"omitempty,cidr"`
+
+	// NAT64 prefix (e.g. '64:ff9b::/96') used to synthesize AAAA answers from
+	// Tailscale IPv4 addresses for names that have no Tailscale IPv6 address,
+	// so that IPv6-only clients can reach them. Unset disables DNS64.
+	DNS64Prefix string `mapstructure:"dns64_prefix" validate:"omitempty,cidrv6"`
+
+	// Subnets behind Tailscale 4via6 subnet routers. AAAA queries for names
+	// whose Tailscale IPv4 addresses are in one of these subnets are answered
+	// with the 4via6 address for the site, so that sites with overlapping
+	// subnets can be told apart. Takes precedence over DNS64.
+	Via6Sites []Via6Site `mapstructure:"via6_sites" validate:"dive"`
+
+	// Bounds on the TTL of every record we answer with, whether forwarded or
+	// intercepted; zero means no bound. A low maximum forces clients to notice
+	// quickly when services move between external and tailnet exposure.
+	TTLMinSeconds time.Duration `mapstructure:"ttl_min_seconds" validate:"gte=0"`
+	TTLMaxSeconds time.Duration `mapstructure:"ttl_max_seconds" validate:"gte=0"`
+
+	// UDP payload size we advertise to EDNS clients, and the most we'll send
+	// over UDP regardless of what the client advertises (default 1232).
+	// Responses too large for the client are truncated with the TC bit set,
+	// so that the client retries over TCP.
+	EDNSUDPSize int `mapstructure:"edns_udp_size" validate:"omitempty,gte=512,lte=65535"`
+
+	// Set to 'validate' to validate DNSSEC signatures on forwarded responses
+	// ourselves, rather than trusting upstream's AD bit. Responses that fail
+	// validation become SERVFAILs, unless the client sets the CD bit.
+	DNSSECValidation string `mapstructure:"dnssec_validation" validate:"omitempty,oneof=validate"`
+	// Root DS records to use as trust anchors, in presentation format
+	// (default: the IANA root KSKs)
+	DNSSECTrustAnchors []string `mapstructure:"dnssec_trust_anchors"`
+
+	// In proxy zones, when upstream answers NXDOMAIN or has no records of the
+	// queried type, look the name up in the resolver and synthesize an answer
+	// from its Tailscale IPs. This allows tailnet-only hostnames that have no
+	// public records.
+	SynthesizeOnNegative bool `mapstructure:"synthesize_on_negative"`
+
+	// In proxy zones, follow CNAME chains that upstream didn't resolve (e.g.
+	// due to minimal responses) by querying upstream for the chain's target
+	ChaseCNAMEs bool `mapstructure:"chase_cnames"`
+
+	// Answer PTR queries for Tailscale IPs that we know about with the name
+	// we last intercepted for them and/or the device's MagicDNS name, rather
+	// than forwarding them upstream
+	ReversePTR bool `mapstructure:"reverse_ptr"`
+
+	// What to do with the ipv4hint/ipv6hint parameters of SVCB and HTTPS
+	// records in proxy zones: 'rewrite' (the default) replaces hints with
+	// Tailscale IPs where possible, 'strip' removes them, and 'passthrough'
+	// leaves them untouched
+	SVCBHints string `mapstructure:"svcb_hints" validate:"omitempty,oneof=rewrite strip passthrough"`
+
+	// Rcode to answer with when no upstream gives us a response: 'servfail'
+	// (the default) or 'refused'
+	UpstreamFailureRcode string `mapstructure:"upstream_failure_rcode" validate:"omitempty,oneof=servfail refused"`
+	// Whether to set the AA and RA bits on answers that we make up ourselves
+	// (i.e. direct answers and PTR records) rather than rewrite from upstream
+	SynthesizedAuthoritative      bool `mapstructure:"synthesized_authoritative"`
+	SynthesizedRecursionAvailable bool `mapstructure:"synthesized_recursion_available"`
+	// What to do with extended rcodes and Extended DNS Error options in
+	// upstream responses: 'preserve' (the default) or 'strip'
+	UpstreamEDNSOptions string `mapstructure:"upstream_edns_options" validate:"omitempty,oneof=preserve strip"`
+
+	// Strip the authority and additional sections from upstream responses
+	// (like BIND's minimal-responses), keeping only the SOA of negative
+	// answers. This cuts response sizes and avoids leaking upstream NS
+	// infrastructure to clients.
+	MinimalResponses bool `mapstructure:"minimal_responses"`
+
+	// Maximum number of responses to cache, for as long as their TTLs allow;
+	// zero disables caching. Names in the excluded zones are never cached.
+	CacheMaxEntries   int      `mapstructure:"cache_max_entries" validate:"gte=0"`
+	CacheExcludeZones []string `mapstructure:"cache_exclude_zones"`
+	// If non-zero, cached responses are kept for this long after they expire,
+	// and served (with a short TTL) if no upstream can answer (RFC 8767)
+	CacheServeStaleSeconds time.Duration `mapstructure:"cache_serve_stale_seconds" validate:"gte=0"`
+	// Entries hit at least this many times are refreshed in the background
+	// shortly before they expire; zero disables prefetching
+	CachePrefetchHits int `mapstructure:"cache_prefetch_hits" validate:"gte=0"`
+	// File that the cache is saved to on shutdown and loaded from on startup,
+	// so that restarts don't start with a cold cache
+	CachePersistPath string `mapstructure:"cache_persist_path"`
+	// NXDOMAIN and NODATA responses are cached according to their SOA (RFC
+	// 2308), for no longer than this if non-zero
+	CacheNegativeMaxTTLSeconds time.Duration `mapstructure:"cache_negative_max_ttl_seconds" validate:"gte=0"`
+
+	// Share upstream exchanges between identical queries in flight at the
+	// same time, even from different clients
+	CoalesceQueries bool `mapstructure:"coalesce_queries"`
+
+	// Drop retransmissions of UDP queries that we're still resolving, rather
+	// than sending identical queries upstream in parallel
+	DeduplicateUDPQueries bool `mapstructure:"deduplicate_udp_queries"`
+
+	// Randomize the case of query names sent to upstreams over plain UDP
+	// ('0x20' encoding), and discard responses that don't echo it back, to
+	// make spoofing responses harder. Some upstreams don't preserve case, so
+	// this is off by default.
+	UpstreamRandomizeCase bool `mapstructure:"upstream_randomize_case"`
+
+	// Clients allowed to query names outside of the zones with ACLs, and the
+	// only clients allowed to query names in those zones. If AllowedClients
+	// is set, or the default is 'deny', queries from other clients are
+	// refused (or, with the 'drop' action, ignored). Otherwise anyone may
+	// query names outside of the zones with ACLs.
+	AllowedClients   []string  `mapstructure:"allowed_clients" validate:"dive,cidr"`
+	ZoneACLs         []ZoneACL `mapstructure:"zone_acls" validate:"dive"`
+	ClientACLDefault string    `mapstructure:"client_acl_default" validate:"omitempty,oneof=allow deny"`
+	ClientACLAction  string    `mapstructure:"client_acl_action" validate:"omitempty,oneof=refuse drop"`
+
+	// How to answer ANY queries: 'forward' (the default) passes them upstream,
+	// 'hinfo' answers with a synthesized HINFO record as per RFC 8482, and
+	// 'refuse' answers REFUSED
+	AnyQueryPolicy string `mapstructure:"any_query_policy" validate:"omitempty,oneof=forward hinfo refuse"`
+	// Clients allowed to make AXFR/IXFR requests; all others are refused
+	ZoneTransferAllowedCIDRs []string `mapstructure:"zone_transfer_allowed_cidrs" validate:"dive,cidr"`
+	// Keys with which secondaries sign zone transfer requests. Static zones
+	// can only be transferred (by clients in ZoneTransferAllowedCIDRs) with a
+	// request signed by one of these keys.
+	TSIGKeys []TSIGKey `mapstructure:"tsig_keys" validate:"dive"`
+	// Silently drop queries with opcodes we don't implement, rather than
+	// answering NOTIMP
+	DropUnknownOpcodes bool `mapstructure:"drop_unknown_opcodes"`
+
+	// DNS servers (IP addresses only) used to resolve the hostnames of
+	// upstreams, e.g. DoT and DoH servers. If unset, the system resolver is
+	// used, which won't work if the system resolver is this proxy!
+	BootstrapResolvers []string `mapstructure:"bootstrap_resolvers"`
+
+	// Client certificate and key presented to DoT and DoH upstreams that
+	// require mutual TLS, and a CA bundle to verify upstreams against instead
+	// of the system roots
+	UpstreamTLSClientCertFile string `mapstructure:"upstream_tls_client_cert_file"`
+	UpstreamTLSClientKeyFile  string `mapstructure:"upstream_tls_client_key_file"`
+	UpstreamTLSCAFile         string `mapstructure:"upstream_tls_ca_file"`
+
+	// Individual records answered without consulting upstream, taking
+	// precedence over everything else, so that names can be pinned without
+	// setting up a static zone
+	Overrides []Override `mapstructure:"overrides" validate:"dive"`
+
+	// Names that are resolved as if they were another name, e.g. so that
+	// 'grafana.home' gets the (intercepted) answer for
+	// 'grafana.internal.example.com'. Answers are renamed back to the alias.
+	Aliases []Alias `mapstructure:"aliases" validate:"dive"`
+
+	// Lists of names to block, in hosts or adblock format. Blocked names are
+	// answered with NXDOMAIN, or with BlockResponse 'null', the unspecified
+	// address (0.0.0.0 or ::). Names in the allowlist (and their subdomains)
+	// are never blocked.
+	Blocklists    []Blocklist `mapstructure:"blocklists" validate:"dive"`
+	Allowlist     []string    `mapstructure:"allowlist"`
+	BlockResponse string      `mapstructure:"block_response" validate:"omitempty,oneof=nxdomain null"`
+
+	// Rules applied to the answer records of every response, in order: the
+	// first rule that matches a record decides what happens to it
+	RewriteRules []RewriteRule `mapstructure:"rewrite_rules" validate:"dive"`
+
+	// Alternative behaviour for particular client networks, e.g. so that
+	// guest networks get public answers while tailnet clients get Tailscale
+	// IPs. Queries use the first view containing the client, falling back to
+	// the rest of this config.
+	Views []View `mapstructure:"views" validate:"dive"`
+
+	// Send dnstap messages for client queries and responses, and for
+	// exchanges with upstreams, to a Frame Streams collector listening on a
+	// unix socket, or to a file. Each stream gets a new file, with the files
+	// from the previous few kept as file.1, file.2 and so on. The identity
+	// defaults to the hostname.
+	DnstapSocketPath string `mapstructure:"dnstap_socket_path" validate:"excluded_with=DnstapFilePath"`
+	DnstapFilePath   string `mapstructure:"dnstap_file_path"`
+	DnstapIdentity   string `mapstructure:"dnstap_identity"`
+
+	// Write a JSON line for every query answered to this file, rotating it
+	// once it reaches the maximum size or age (zero for no limit) and keeping
+	// the given number of old files
+	QueryLogPath          string        `mapstructure:"query_log_path"`
+	QueryLogMaxSizeMB     int           `mapstructure:"query_log_max_size_mb" validate:"gte=0"`
+	QueryLogMaxAgeSeconds time.Duration `mapstructure:"query_log_max_age_seconds" validate:"gte=0"`
+	QueryLogMaxBackups    int           `mapstructure:"query_log_max_backups" validate:"gte=0"`
+
+	// Write a JSON line for every answer that we rewrite to this file, with the
+	// resolver objects that the rewrite was based on. It's rotated in the same
+	// way as the query log.
+	AuditLogPath          string        `mapstructure:"audit_log_path"`
+	AuditLogMaxSizeMB     int           `mapstructure:"audit_log_max_size_mb" validate:"gte=0"`
+	AuditLogMaxAgeSeconds time.Duration `mapstructure:"audit_log_max_age_seconds" validate:"gte=0"`
+	AuditLogMaxBackups    int           `mapstructure:"audit_log_max_backups" validate:"gte=0"`
+
+	// EDNS0 option code, from the local/experimental range, used to send a
+	// random trace ID with each query upstream; zero disables it. The ID is
+	// also written to the query log and slow query log, so that upstream logs
+	// can be matched up with ours. Queries coalesced with an identical query
+	// already in flight only send that query's ID.
+	UpstreamTraceOptionCode int `mapstructure:"upstream_trace_option_code" validate:"omitempty,min=65001,max=65534"`
+
+	// Log queries that take at least this long to answer (zero disables the
+	// slow query log), with the time spent in each phase. Only one in every
+	// SlowQuerySampleEvery slow queries is logged, to limit log volume when
+	// everything is slow.
+	SlowQueryThresholdMillis time.Duration `mapstructure:"slow_query_threshold_millis" validate:"gte=0"`
+	SlowQuerySampleEvery     int           `mapstructure:"slow_query_sample_every" validate:"gte=0"`
+
+	// Zones that we're authoritative for, answered entirely from the config
+	StaticZones []StaticZone `mapstructure:"static_zones" validate:"dive"`
+
+	// Zones whose queries are sent to their own upstreams rather than
+	// Upstreams, e.g. to send internal zones to internal resolvers
+	ForwardZones []ForwardZone `mapstructure:"forward_zones" validate:"dive"`
+
+	// Number of UDP and TCP sockets to open on ListenAddr. Values greater
+	// than one bind each socket with SO_REUSEPORT, letting the kernel spread
+	// queries across them.
+	Listeners int `mapstructure:"listeners" validate:"gte=0"`
+
+	// Accept PROXY protocol (v1 or v2) headers on the TCP listener, so that we
+	// see real client addresses when running behind a TCP load balancer. Only
+	// connections from the trusted CIDRs (e.g. the load balancer's) are
+	// expected to send a header, so that nobody else can claim to be another
+	// client.
+	ProxyProtocol             bool     `mapstructure:"proxy_protocol"`
+	ProxyProtocolTrustedCIDRs []string `mapstructure:"proxy_protocol_trusted_cidrs" validate:"required_if=ProxyProtocol true,dive,cidr"`
+
+	// Maximum number of persistent connections to keep open to each TCP or
+	// TLS upstream. Zero disables pooling, dialing a new connection per query.
+	// Pooled connections idle for longer than the timeout (default 10) are
+	// closed rather than reused.
+	UpstreamPoolMaxConns           int           `mapstructure:"upstream_pool_max_conns" validate:"gte=0"`
+	UpstreamPoolIdleTimeoutSeconds time.Duration `mapstructure:"upstream_pool_idle_timeout_seconds"`
+
+	// Order in which upstreams are tried: 'sequential' (the default) uses the
+	// order given in Upstreams, 'round_robin' rotates through them,
+	// 'weighted' picks randomly according to UpstreamWeights, and
+	// 'lowest_latency' prefers the fastest upstream recently observed.
+	UpstreamSelectionStrategy string `mapstructure:"upstream_selection_strategy" validate:"omitempty,oneof=sequential round_robin weighted lowest_latency"`
+	// Weight of each upstream for the weighted strategy, in the same order as
+	// Upstreams. Upstreams default to a weight of one.
+	UpstreamWeights []int `mapstructure:"upstream_weights" validate:"omitempty,dive,gte=0"`
+
+	// Number of times to retry a failed exchange (including SERVFAIL/REFUSED
+	// responses) with an upstream before failing over to the next one. These
+	// retry settings are defaults that forward zones can override.
+	UpstreamRetries int `mapstructure:"upstream_retries" validate:"gte=0"`
+	// Timeout for each individual attempt; zero means that only the dial,
+	// read, write and total timeouts apply
+	UpstreamTryTimeoutMillis time.Duration `mapstructure:"upstream_try_timeout_millis" validate:"gte=0"`
+	// Delay before the first retry, doubling for each subsequent retry up to
+	// the maximum (if non-zero)
+	UpstreamRetryBackoffMillis    time.Duration `mapstructure:"upstream_retry_backoff_millis" validate:"gte=0"`
+	UpstreamRetryBackoffMaxMillis time.Duration `mapstructure:"upstream_retry_backoff_max_millis" validate:"gte=0"`
+
+	// How queries are sent to upstreams: 'sequential' (the default) tries each
+	// upstream in turn, whereas 'race' queries several upstreams in parallel
+	// and returns the first valid answer.
+	UpstreamQueryStrategy string `mapstructure:"upstream_query_strategy" validate:"omitempty,oneof=sequential race"`
+	// Number of upstreams to race; zero races all of them
+	UpstreamRaceCount int `mapstructure:"upstream_race_count" validate:"gte=0"`
+	// Delay before each additional upstream is queried when racing; zero
+	// queries them all at once
+	UpstreamHedgeDelayMillis time.Duration `mapstructure:"upstream_hedge_delay_millis" validate:"gte=0"`
+
+	// Upstreams that fail this many times in a row are skipped for the
+	// cooldown period. A zero cooldown disables circuit breaking.
+	UpstreamFailureThreshold         int           `mapstructure:"upstream_failure_threshold" validate:"gte=0"`
+	UpstreamUnhealthyCooldownSeconds time.Duration `mapstructure:"upstream_unhealthy_cooldown_seconds" validate:"gte=0"`
+	// How often to actively probe upstreams; zero disables probing
+	UpstreamHealthCheckPeriodSeconds time.Duration `mapstructure:"upstream_health_check_period_seconds" validate:"gte=0"`
+	// Name whose SOA record is queried by health check probes (default '.')
+	UpstreamHealthCheckName string `mapstructure:"upstream_health_check_name"`
+
+	// Per-zone metrics are labelled with the most specific configured zone of
+	// each query. Only this many zones (default 50) get their own label, to
+	// bound the metrics' cardinality; queries in the rest are counted under '.'
+	MetricsMaxZones int `mapstructure:"metrics_max_zones" validate:"gte=0"`
+
+	// Target fraction of resolutions that succeed (default 0.999), used to
+	// export error budget burn rates
+	SLOObjective float64 `mapstructure:"slo_objective" validate:"omitempty,gt=0,lt=1"`
+}
+
+// ForwardZone maps a zone to the upstreams that should answer queries for it.
+// This is a list rather than a map in the config because Viper splits map keys
+// containing dots, which every zone name does.
+type ForwardZone struct {
+	Zone      string   `mapstructure:"zone" validate:"required"`
+	Upstreams []string `mapstructure:"upstreams" validate:"required"`
+	// Weights for the weighted selection strategy; see Config.UpstreamWeights
+	UpstreamWeights []int `mapstructure:"upstream_weights" validate:"omitempty,dive,gte=0"`
+	// Retry policy for the zone's upstreams, overriding the Config settings
+	// of the same name where given, e.g. to fail fast to an internal
+	// resolver on the same network
+	UpstreamRetries               *int           `mapstructure:"upstream_retries" validate:"omitempty,gte=0"`
+	UpstreamTryTimeoutMillis      *time.Duration `mapstructure:"upstream_try_timeout_millis" validate:"omitempty,gte=0"`
+	UpstreamRetryBackoffMillis    *time.Duration `mapstructure:"upstream_retry_backoff_millis" validate:"omitempty,gte=0"`
+	UpstreamRetryBackoffMaxMillis *time.Duration `mapstructure:"upstream_retry_backoff_max_millis" validate:"omitempty,gte=0"`
+}
+
+// ResolverBinding binds names, given as patterns like ProxyPatterns (e.g.
+// '**.cluster-a.example.com'), to the resolver with the given name. The first
+// binding to match a name is used.
+type ResolverBinding struct {
+	Patterns []string `mapstructure:"patterns" validate:"required"`
+	Resolver string   `mapstructure:"resolver" validate:"required"`
+}
+
+// StaticZone is a zone served authoritatively from records in the config.
+type StaticZone struct {
+	Zone string `mapstructure:"zone" validate:"required"`
+	// Names of the zone's nameservers, used for its NS records and the SOA
+	// MNAME (default 'ns.<zone>')
+	Nameservers []string `mapstructure:"nameservers"`
+	// Email address of the zone's administrator for the SOA (default
+	// 'hostmaster@<zone>')
+	Hostmaster string `mapstructure:"hostmaster"`
+	// Default TTL of records, and the SOA minimum TTL (default 300)
+	TTLSeconds time.Duration `mapstructure:"ttl_seconds" validate:"gte=0"`
+	// Records in zone file format, with names relative to the zone, e.g.
+	// 'www IN A 192.0.2.1' or '_http._tcp 60 IN SRV 0 0 80 www'
+	Records []string `mapstructure:"records"`
+}
+
+// Via6Site is an IPv4 subnet advertised by a 4via6 subnet router.
+type Via6Site struct {
+	Subnet string `mapstructure:"subnet" validate:"required,cidrv4"`
+	// Site ID configured on the subnet router (0-65535)
+	SiteID int `mapstructure:"site_id" validate:"gte=0,lte=65535"`
+}
+
+// TSIGKey is a shared secret for signing requests with TSIG (RFC 8945).
+type TSIGKey struct {
+	Name string `mapstructure:"name" validate:"required"`
+	// HMAC algorithm, e.g. 'hmac-sha256.' (the default) or 'hmac-sha512.'
+	Algorithm string `mapstructure:"algorithm"`
+	// Base64-encoded secret
+	Secret string `mapstructure:"secret" validate:"required,base64"`
+}
+
+// Override pins a record for a name.
+type Override struct {
+	Name string `mapstructure:"name" validate:"required"`
+	Type string `mapstructure:"type" validate:"required,oneof=A AAAA CNAME TXT"`
+	// IP address, CNAME target or TXT string
+	Value      string        `mapstructure:"value" validate:"required"`
+	TTLSeconds time.Duration `mapstructure:"ttl_seconds" validate:"gte=0"`
+}
+
+// Blocklist is a list of names to block.
+type Blocklist struct {
+	// Path to a local file, or an HTTP(S) URL
+	Source string `mapstructure:"source" validate:"required"`
+	// 'hosts' (the default) or 'adblock'
+	Format string `mapstructure:"format" validate:"omitempty,oneof=hosts adblock"`
+	// How often to reload the list; zero loads it only at startup
+	RefreshSeconds time.Duration `mapstructure:"refresh_seconds" validate:"gte=0"`
+}
+
+// RewriteRule rewrites answer records matching all of its criteria.
+type RewriteRule struct {
+	// Regular expression matched against the query name
+	MatchName string `mapstructure:"match_name"`
+	// Network containing the IP of A/AAAA records to match
+	MatchAnswerCIDR string `mapstructure:"match_answer_cidr" validate:"omitempty,cidr"`
+	// Network containing the client's IP
+	MatchClientCIDR string `mapstructure:"match_client_cidr" validate:"omitempty,cidr"`
+
+	// 'replace_ip' replaces the IP of A/AAAA records with Value, 'replace_name'
+	// replaces the target of CNAME/PTR records with Value, and 'drop' removes
+	// the record
+	Action string `mapstructure:"action" validate:"required,oneof=replace_ip replace_name drop"`
+	Value  string `mapstructure:"value"`
+}
+
+// Alias makes a name resolve as its target.
+type Alias struct {
+	Name   string `mapstructure:"name" validate:"required"`
+	Target string `mapstructure:"target" validate:"required"`
+}
+
+// View changes the behaviour of the proxy for queries from some clients.
+// Anything not set in a view is the same as for other clients.
+type View struct {
+	Name        string   `mapstructure:"name" validate:"required"`
+	ClientCIDRs []string `mapstructure:"client_cidrs" validate:"required,dive,cidr"`
+	// Forward everything, never intercepting
+	DisableInterception bool `mapstructure:"disable_interception"`
+	// Upstreams to use instead of the default ones
+	Upstreams []string `mapstructure:"upstreams"`
+	// Overrides to use instead of the default ones
+	Overrides []Override `mapstructure:"overrides" validate:"dive"`
+}
+
+// ZoneACL restricts queries for names in a zone to the given clients.
+type ZoneACL struct {
+	Zone           string   `mapstructure:"zone" validate:"required"`
+	AllowedClients []string `mapstructure:"allowed_clients" validate:"required,dive,cidr"`
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// udpDedup drops retransmissions of UDP queries that we're still working on:
+// the response to the original query answers the retransmission too, as it
+// has the same ID and question, so there's no point asking upstream twice.
+type udpDedup struct {
+	server *Server
+	next   dns.Handler
+
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+}
+
+func newUDPDedup(server *Server, next dns.Handler) *udpDedup {
+	return &udpDedup{
+		server:   server,
+		next:     next,
+		inFlight: make(map[string]struct{}),
+	}
+}
+
+func (d *udpDedup) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	question := req.Question[0]
+	key := fmt.Sprintf("%s/%d/%s/%d/%d", w.RemoteAddr(), req.Id, strings.ToLower(question.Name), question.Qtype, question.Qclass)
+
+	d.mu.Lock()
+	if _, ok := d.inFlight[key]; ok {
+		d.mu.Unlock()
+		d.server.logger.Debug("dropping retransmitted query", zap.String("query", key))
+		return
+	}
+	d.inFlight[key] = struct{}{}
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.inFlight, key)
+		d.mu.Unlock()
+	}()
+
+	d.next.ServeDNS(w, req)
+}
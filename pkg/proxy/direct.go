@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/iplist"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"github.com/miekg/dns"
+)
+
+// TTL of answers synthesized without consulting upstream
+const directAnswerTTL = 300
+
+var (
+	errNoDirectAnswer       = errors.New("resolver has no Tailscale IPs for name")
+	errNoDirectAnswerOfType = errors.New("resolver has Tailscale IPs for name, but none of the queried type")
+)
+
+// inDirectAnswerZone returns true if the query is for a name in one of the
+// zones where we answer from the resolver without contacting upstream.
+func (s *Server) inDirectAnswerZone(req *dns.Msg) bool {
+	if len(req.Question) != 1 {
+		return false
+	}
+
+	for _, zone := range s.config.AnswerWithoutUpstreamZones {
+		if dns.IsSubDomain(dns.CanonicalName(zone), dns.CanonicalName(req.Question[0].Name)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// directAnswer asks the resolver for the Tailscale IPs of the queried name,
+// and synthesizes an answer from them if it has any.
+func (h *handler) directAnswer(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	question := req.Question[0]
+	if !h.server.interceptsQtype(question.Qtype) {
+		return nil, errNotInterceptableQuestion
+	}
+
+	nameResolver, ok := h.server.resolverFor(question.Name).(resolvers.NameResolver)
+	if !ok {
+		return nil, errNoDirectAnswer
+	}
+
+	var ips []net.IP
+	var err error
+	if explainer, ok := nameResolver.(resolvers.EvidenceResolver); ok && h.server.auditLog != nil {
+		var evidence []string
+		ips, evidence, err = explainer.ExplainTailscaleIPsByName(question.Name)
+		recordEvidence(ctx, evidence)
+	} else {
+		ips, err = nameResolver.GetTailscaleIPsByName(question.Name)
+	}
+	traceLookup(ctx, question.Name, ips, err)
+	if err != nil {
+		return nil, fmt.Errorf("error getting tailscale IPs by name: %w", err)
+	}
+
+	if len(ips) == 0 {
+		return nil, errNoDirectAnswer
+	}
+
+	if question.Qtype == dns.TypeA {
+		ips = iplist.FilterIPv4Only(ips)
+	} else if v6 := iplist.FilterIPv6Only(ips); len(v6) == 0 && h.server.synthesizesIPv6() {
+		ips = h.server.synthesizeIPv6(ips)
+	} else {
+		ips = v6
+	}
+
+	if len(ips) == 0 {
+		return nil, errNoDirectAnswerOfType
+	}
+
+	msg := h.server.synthesizedReply(req)
+	msg.Answer = makeIPRecords(&dns.RR_Header{Name: question.Name, Ttl: directAnswerTTL}, h.server.orderTailscaleIPs(ips))
+	return msg, nil
+}
+
+// isNegativeResponse returns true if upstream says the queried name doesn't
+// exist, or has no records of the queried type.
+func isNegativeResponse(req *dns.Msg, resp *dns.Msg) bool {
+	if resp.Rcode == dns.RcodeNameError {
+		return true
+	}
+
+	if resp.Rcode != dns.RcodeSuccess || len(req.Question) != 1 {
+		return false
+	}
+
+	for _, answer := range resp.Answer {
+		if answer.Header().Rrtype == req.Question[0].Qtype {
+			return false
+		}
+	}
+
+	return true
+}
+
+// answerIPs returns the IPs in the A and AAAA records of the message's answer.
+func answerIPs(msg *dns.Msg) []net.IP {
+	var ips []net.IP
+	for _, answer := range msg.Answer {
+		switch rr := answer.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	return ips
+}
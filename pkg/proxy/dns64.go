@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/iplist"
+	"github.com/miekg/dns"
+)
+
+var errInvalidDNS64Prefix = errors.New("DNS64 prefix must be an IPv6 prefix of length 32, 40, 48, 56, 64 or 96")
+
+// parseDNS64Prefix parses the NAT64 prefix used to synthesize AAAA records.
+func parseDNS64Prefix(config *Config) (*net.IPNet, error) {
+	if config.DNS64Prefix == "" {
+		return nil, nil
+	}
+
+	_, prefix, err := net.ParseCIDR(config.DNS64Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix: %w", err)
+	}
+
+	ones, bits := prefix.Mask.Size()
+	switch {
+	case bits != 8*net.IPv6len:
+		return nil, errInvalidDNS64Prefix
+	case ones == 32, ones == 40, ones == 48, ones == 56, ones == 64, ones == 96:
+		return prefix, nil
+	default:
+		return nil, errInvalidDNS64Prefix
+	}
+}
+
+// synthesizesIPv6 returns true if we can make IPv6 addresses out of IPv4 ones,
+// using either DNS64 or 4via6.
+func (s *Server) synthesizesIPv6() bool {
+	return s.dns64Prefix != nil || len(s.via6Sites) > 0
+}
+
+// synthesizeIPv6 makes IPv6 addresses for IPv4 addresses: 4via6 addresses for
+// those in a 4via6 site's subnet, and otherwise NAT64 addresses if DNS64 is
+// enabled. Addresses we can't synthesize an IPv6 address for are dropped.
+func (s *Server) synthesizeIPv6(ips []net.IP) []net.IP {
+	var synthesized []net.IP
+	for _, ip := range iplist.FilterIPv4Only(ips) {
+		if site := s.via6SiteFor(ip); site != nil {
+			synthesized = append(synthesized, site.embed(ip))
+		} else if s.dns64Prefix != nil {
+			synthesized = append(synthesized, embedNAT64(s.dns64Prefix, ip))
+		}
+	}
+
+	return synthesized
+}
+
+// embedNAT64 embeds an IPv4 address in the NAT64 prefix, as described in
+// RFC 6052 § 2.2.
+func embedNAT64(prefix *net.IPNet, ip net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, prefix.IP.To16())
+
+	// Bits 64 to 71 of the address must be zero, so the IPv4 address is split
+	// around them for prefixes shorter than /96
+	pos := ones / 8
+	for _, b := range ip.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip6[pos] = b
+		pos++
+	}
+
+	return ip6
+}
+
+// doIPv6Synthesis answers an AAAA query for a name with only Tailscale IPv4
+// addresses, by intercepting an A query for the name and turning the
+// resulting IPs into DNS64 or 4via6 addresses.
+func (h *handler) doIPv6Synthesis(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	aReq := req.Copy()
+	aReq.Id = dns.Id()
+	aReq.Question[0].Qtype = dns.TypeA
+
+	aResp, err := h.resolveUpstream(ctx, aReq)
+	if err != nil {
+		return nil, err
+	}
+
+	intercepted, err := h.interceptAddresses(ctx, aReq, aResp)
+	if err != nil {
+		return nil, err
+	}
+
+	answer := intercepted.Answer[:0]
+	for _, rr := range intercepted.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			hdr := a.Hdr
+			answer = append(answer, makeIPRecords(&hdr, h.server.synthesizeIPv6([]net.IP{a.A}))...)
+			continue
+		}
+		answer = append(answer, rr)
+	}
+
+	// We can only synthesize 4via6 addresses for some IPv4 addresses
+	if len(answerIPs(&dns.Msg{Answer: answer})) == 0 {
+		return nil, errNoTailscaleIPsAfterFiltering
+	}
+
+	intercepted.Answer = answer
+	intercepted.Id = req.Id
+	intercepted.Question = req.Question
+	return intercepted, nil
+}
@@ -0,0 +1,523 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	// Validate DNSSEC signatures on forwarded responses ourselves
+	dnssecValidate = "validate"
+
+	// Maximum number of zones we'll walk up when building a chain of trust
+	maxDNSSECChainDepth = 16
+
+	// Upper bound on how long we cache validated zone keys, regardless of TTL
+	maxDNSSECKeyCacheTTL = time.Hour
+
+	// NSEC3 flag for records that may skip delegations without DS records
+	nsec3OptOut = 0x01
+)
+
+// Root zone trust anchors (KSK-2017 and KSK-2024), as published by IANA at
+// https://data.iana.org/root-anchors/root-anchors.xml
+//
+//nolint:gochecknoglobals
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var (
+	// The zone (or one of its ancestors) isn't signed, so its records can't be
+	// validated. This isn't an error as such: the response just isn't secure.
+	errDNSSECInsecure = errors.New("zone is not signed")
+
+	// The name is inside its parent's zone, rather than the apex of a zone of
+	// its own
+	errNotZoneCut = errors.New("name is not a zone cut")
+
+	errDNSSECBogus        = errors.New("DNSSEC validation failed")
+	errInvalidTrustAnchor = errors.New("trust anchors must be root DS records")
+	errDNSSECNoTrustedKey = errors.New("no DNSKEY matches a trusted DS record")
+	errDNSSECChainTooLong = errors.New("chain of trust too long")
+)
+
+type zoneKeys struct {
+	keys []*dns.DNSKEY
+	// errDNSSECInsecure or errNotZoneCut, if the zone has no keys
+	err     error
+	expires time.Time
+}
+
+// dnssecValidator validates upstream responses by building a chain of trust
+// from the root trust anchors down to the zone that signed each RRset. Keys
+// for zones along the way are fetched from upstream and cached.
+type dnssecValidator struct {
+	anchors []*dns.DS
+
+	mu    sync.Mutex
+	cache map[string]*zoneKeys
+}
+
+func newDNSSECValidator(trustAnchors []string) (*dnssecValidator, error) {
+	if len(trustAnchors) == 0 {
+		trustAnchors = defaultTrustAnchors
+	}
+
+	validator := &dnssecValidator{
+		cache: make(map[string]*zoneKeys),
+	}
+
+	for _, anchor := range trustAnchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNSSEC trust anchor '%s': %w", anchor, err)
+		}
+
+		ds, ok := rr.(*dns.DS)
+		if !ok || ds.Hdr.Name != "." {
+			return nil, fmt.Errorf("%w: got '%s'", errInvalidTrustAnchor, anchor)
+		}
+		validator.anchors = append(validator.anchors, ds)
+	}
+
+	return validator, nil
+}
+
+// resolveValidated resolves a query upstream with DNSSEC records requested,
+// and validates the response. The AD bit of the response is set only if every
+// RRset in the answer validated; bogus responses are turned into SERVFAILs
+// unless the client set the CD bit.
+func (h *handler) resolveValidated(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	clientDO := false
+	if opt := req.IsEdns0(); opt != nil {
+		clientDO = opt.Do()
+	}
+
+	upstreamReq := req.Copy()
+	upstreamReq.CheckingDisabled = true
+	if opt := upstreamReq.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		upstreamReq.SetEdns0(defaultEDNSBufferSize, true)
+	}
+
+	resp, err := h.resolveUpstream(ctx, upstreamReq)
+	if err != nil {
+		return nil, err
+	}
+
+	secure, err := h.server.validator.validate(ctx, h, resp)
+	if err != nil && !req.CheckingDisabled {
+		h.server.logger.Info("upstream response failed DNSSEC validation",
+			zap.String("name", req.Question[0].Name),
+			zap.Error(err),
+		)
+
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeServerFailure)
+		return msg, nil
+	}
+
+	resp.AuthenticatedData = secure && err == nil
+	resp.CheckingDisabled = req.CheckingDisabled
+
+	if !clientDO {
+		stripDNSSECRecords(req, resp)
+	}
+
+	return resp, nil
+}
+
+// validate returns true if the response's answer is secure, false if it is
+// insecure (or a negative answer, whose denial of existence we don't attempt
+// to prove), and an error if it is bogus.
+func (v *dnssecValidator) validate(ctx context.Context, h *handler, resp *dns.Msg) (bool, error) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return false, nil
+	}
+
+	secure := true
+	rrsets, sigs := groupRRsets(resp.Answer)
+	for key, rrset := range rrsets {
+		err := v.verifyRRset(ctx, h, rrset, sigs[key], 0)
+		if errors.Is(err, errDNSSECInsecure) {
+			secure = false
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	return secure, nil
+}
+
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+func groupRRsets(records []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	rrsets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{name: name, rtype: sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+
+		key := rrsetKey{name: name, rtype: rr.Header().Rrtype}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	return rrsets, sigs
+}
+
+// verifyRRset checks that at least one of the signatures over the RRset is
+// valid and made by a trusted key of the signing zone. Unsigned RRsets are
+// insecure only if they're below an unsigned delegation.
+func (v *dnssecValidator) verifyRRset(ctx context.Context, h *handler, rrset []dns.RR, sigs []*dns.RRSIG, depth int) error {
+	owner := dns.CanonicalName(rrset[0].Header().Name)
+	if len(sigs) == 0 {
+		return v.verifyUnsigned(ctx, h, owner, depth)
+	}
+
+	var errs []error
+	for _, sig := range sigs {
+		// Zones can only sign their own names, and DS records are signed by
+		// the parent zone
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, owner) || (sig.TypeCovered == dns.TypeDS && signer == owner) {
+			errs = append(errs, fmt.Errorf("'%s' can't sign records for '%s'", signer, owner))
+			continue
+		}
+
+		keys, err := v.zoneKeys(ctx, h, signer, depth)
+		if errors.Is(err, errNotZoneCut) {
+			errs = append(errs, fmt.Errorf("signer '%s' is not a zone", signer))
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := verifyWithKeys(sig, keys, rrset); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: %w", errDNSSECBogus, errors.Join(errs...))
+}
+
+// verifyUnsigned returns errDNSSECInsecure if the name is below an unsigned
+// delegation, and a bogus error if it's in a signed zone, in which case the
+// signatures must have been stripped. Zones are walked from the root down to
+// find where the chain of trust ends.
+func (v *dnssecValidator) verifyUnsigned(ctx context.Context, h *handler, name string, depth int) error {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels); i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		if _, err := v.zoneKeys(ctx, h, zone, depth+1); err != nil && !errors.Is(err, errNotZoneCut) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("%w: records for '%s' are unsigned in a signed zone", errDNSSECBogus, name)
+}
+
+func verifyWithKeys(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) error {
+	if !sig.ValidityPeriod(time.Now()) {
+		return fmt.Errorf("signature by '%s' (key %d) is outside its validity period", sig.SignerName, sig.KeyTag)
+	}
+
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+
+		if err := sig.Verify(key, rrset); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no key of '%s' verifies signature with key tag %d", sig.SignerName, sig.KeyTag)
+}
+
+// zoneKeys returns the validated DNSKEYs of a zone, errDNSSECInsecure if the
+// zone is proven to be unsigned, or errNotZoneCut if the name isn't a zone.
+func (v *dnssecValidator) zoneKeys(ctx context.Context, h *handler, zone string, depth int) ([]*dns.DNSKEY, error) {
+	if depth > maxDNSSECChainDepth {
+		return nil, errDNSSECChainTooLong
+	}
+
+	v.mu.Lock()
+	cached, ok := v.cache[zone]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.keys, cached.err
+	}
+
+	keys, ttl, err := v.fetchZoneKeys(ctx, h, zone, depth)
+	if err != nil && !errors.Is(err, errDNSSECInsecure) && !errors.Is(err, errNotZoneCut) {
+		return nil, err
+	}
+
+	entry := &zoneKeys{
+		keys:    keys,
+		err:     err,
+		expires: time.Now().Add(min(ttl, maxDNSSECKeyCacheTTL)),
+	}
+
+	v.mu.Lock()
+	v.cache[zone] = entry
+	v.mu.Unlock()
+
+	return keys, err
+}
+
+func (v *dnssecValidator) fetchZoneKeys(ctx context.Context, h *handler, zone string, depth int) ([]*dns.DNSKEY, time.Duration, error) {
+	// First work out which DS records we trust for the zone: either the trust
+	// anchors, or the zone's DS records as validated by its parent
+	trustedDS := v.anchors
+	dsTTL := maxDNSSECKeyCacheTTL
+	if zone != "." {
+		dsResp, err := h.queryDNSSEC(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		rrsets, sigs := groupRRsets(dsResp.Answer)
+		key := rrsetKey{name: zone, rtype: dns.TypeDS}
+		dsSet := rrsets[key]
+		if len(dsSet) == 0 {
+			// Missing DS records only mean an insecure delegation if the
+			// parent proves that they don't exist: otherwise they could just
+			// have been stripped
+			err := v.verifyNoDS(ctx, h, zone, dsResp, depth+1)
+			return nil, minTTL(dsResp.Ns, maxDNSSECKeyCacheTTL), err
+		}
+
+		if err := v.verifyRRset(ctx, h, dsSet, sigs[key], depth+1); err != nil {
+			return nil, 0, err
+		}
+
+		trustedDS = nil
+		for _, rr := range dsSet {
+			trustedDS = append(trustedDS, rr.(*dns.DS))
+		}
+		dsTTL = minTTL(dsSet, maxDNSSECKeyCacheTTL)
+	}
+
+	keyResp, err := h.queryDNSSEC(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rrsets, sigs := groupRRsets(keyResp.Answer)
+	key := rrsetKey{name: zone, rtype: dns.TypeDNSKEY}
+	keySet := rrsets[key]
+
+	var keys []*dns.DNSKEY
+	var entryKeys []*dns.DNSKEY
+	for _, rr := range keySet {
+		dnskey := rr.(*dns.DNSKEY)
+		keys = append(keys, dnskey)
+		if matchesAnyDS(dnskey, trustedDS) {
+			entryKeys = append(entryKeys, dnskey)
+		}
+	}
+
+	if len(entryKeys) == 0 {
+		return nil, 0, fmt.Errorf("%w: zone '%s': %w", errDNSSECBogus, zone, errDNSSECNoTrustedKey)
+	}
+
+	// The DNSKEY RRset must be signed by one of the keys that the DS records
+	// vouch for
+	var verified bool
+	for _, sig := range sigs[key] {
+		if verifyWithKeys(sig, entryKeys, keySet) == nil {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, 0, fmt.Errorf("%w: DNSKEY RRset of zone '%s' is not signed by a trusted key", errDNSSECBogus, zone)
+	}
+
+	return keys, min(dsTTL, minTTL(keySet, maxDNSSECKeyCacheTTL)), nil
+}
+
+// verifyNoDS looks in a response to a DS query that has no DS records for a
+// signed NSEC or NSEC3 record from the parent zone that proves there are none.
+// Returns errDNSSECInsecure if the name is an unsigned delegation,
+// errNotZoneCut if it's a name inside the parent zone, or a bogus error if
+// there's no proof either way.
+func (v *dnssecValidator) verifyNoDS(ctx context.Context, h *handler, zone string, resp *dns.Msg, depth int) error {
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("%w: DS query for '%s' failed with rcode %s", errDNSSECBogus, zone, dns.RcodeToString[resp.Rcode])
+	}
+
+	// A name with a CNAME can't have NS records. Believing this without a
+	// signature is safe, since it can only make us stricter.
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME && dns.CanonicalName(rr.Header().Name) == zone {
+			return errNotZoneCut
+		}
+	}
+
+	rrsets, sigs := groupRRsets(resp.Ns)
+	for key, rrset := range rrsets {
+		if key.rtype != dns.TypeNSEC && key.rtype != dns.TypeNSEC3 {
+			continue
+		}
+
+		// The child zone's own NSEC records say nothing about its DS records
+		var parentSigs []*dns.RRSIG
+		for _, sig := range sigs[key] {
+			if signer := dns.CanonicalName(sig.SignerName); signer != zone && dns.IsSubDomain(signer, zone) {
+				parentSigs = append(parentSigs, sig)
+			}
+		}
+		if len(parentSigs) == 0 {
+			continue
+		}
+
+		for _, rr := range rrset {
+			denial := denialOfDS(zone, rr)
+			if denial == nil {
+				continue
+			}
+
+			if err := v.verifyRRset(ctx, h, rrset, parentSigs, depth); err != nil {
+				return err
+			}
+			return denial
+		}
+	}
+
+	return fmt.Errorf("%w: no signed proof that '%s' has no DS records", errDNSSECBogus, zone)
+}
+
+// denialOfDS returns errDNSSECInsecure if the NSEC or NSEC3 record proves that
+// the name is a delegation without DS records, errNotZoneCut if it proves that
+// it isn't a delegation, or nil if it proves neither.
+func denialOfDS(zone string, rr dns.RR) error {
+	switch rr := rr.(type) {
+	case *dns.NSEC:
+		owner := dns.CanonicalName(rr.Hdr.Name)
+		if owner == zone {
+			return delegationWithoutDS(rr.TypeBitMap)
+		}
+
+		// An NSEC record from before the name to a name below it means that
+		// the name has no records of its own (it's an empty non-terminal)
+		next := dns.CanonicalName(rr.NextDomain)
+		if !dns.IsSubDomain(zone, owner) && next != zone && dns.IsSubDomain(zone, next) {
+			return errNotZoneCut
+		}
+	case *dns.NSEC3:
+		if rr.Match(zone) {
+			return delegationWithoutDS(rr.TypeBitMap)
+		}
+
+		// With opt-out, delegations without DS records needn't have NSEC3
+		// records of their own
+		if rr.Flags&nsec3OptOut != 0 && rr.Cover(zone) {
+			return errDNSSECInsecure
+		}
+	}
+
+	return nil
+}
+
+func delegationWithoutDS(types []uint16) error {
+	// A SOA record means that this is the child zone's record for its apex
+	if slices.Contains(types, dns.TypeDS) || slices.Contains(types, dns.TypeSOA) {
+		return nil
+	}
+
+	if slices.Contains(types, dns.TypeNS) {
+		return errDNSSECInsecure
+	}
+	return errNotZoneCut
+}
+
+func matchesAnyDS(key *dns.DNSKEY, dsSet []*dns.DS) bool {
+	for _, ds := range dsSet {
+		if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+			continue
+		}
+
+		if computed := key.ToDS(ds.DigestType); computed != nil && strings.EqualFold(computed.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+func minTTL(records []dns.RR, ceiling time.Duration) time.Duration {
+	ttl := ceiling
+	for _, rr := range records {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	return ttl
+}
+
+// queryDNSSEC queries upstream for DNSSEC records needed to build a chain of
+// trust.
+func (h *handler) queryDNSSEC(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	query.CheckingDisabled = true
+	query.SetEdns0(defaultEDNSBufferSize, true)
+
+	start := time.Now()
+	resp, err := h.exchangeUpstreams(ctx, query)
+	recordPhase(ctx, phaseUpstream, start)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s records for '%s': %w", dns.TypeToString[qtype], name, err)
+	}
+
+	return resp, nil
+}
+
+// stripDNSSECRecords removes the DNSSEC records that we asked upstream for
+// on behalf of a client that didn't ask for them itself.
+func stripDNSSECRecords(req *dns.Msg, resp *dns.Msg) {
+	qtype := req.Question[0].Qtype
+	strip := func(records []dns.RR) []dns.RR {
+		kept := records[:0]
+		for _, rr := range records {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+
+	resp.Answer = strip(resp.Answer)
+	resp.Ns = strip(resp.Ns)
+	resp.Extra = strip(resp.Extra)
+
+	if opt := resp.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+}
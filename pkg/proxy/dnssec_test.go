@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testZoneKey struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+func newTestZoneKey(t *testing.T, zone string) *testZoneKey {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZoneKey{key: key, signer: private.(crypto.Signer)}
+}
+
+// sign returns the RRset with a signature by the key, valid from the given
+// offsets from now.
+func (k *testZoneKey) sign(t *testing.T, rrset []dns.RR, inception, expiration time.Duration) []dns.RR {
+	t.Helper()
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  k.key.Algorithm,
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+		Inception:  uint32(time.Now().Add(inception).Unix()),
+		Expiration: uint32(time.Now().Add(expiration).Unix()),
+	}
+	if err := sig.Sign(k.signer, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]dns.RR{}, rrset...), sig)
+}
+
+func (k *testZoneKey) signValid(t *testing.T, rrset ...dns.RR) []dns.RR {
+	t.Helper()
+	return k.sign(t, rrset, -time.Hour, time.Hour)
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// newTestDNSSECServer creates a validating server whose upstream serves a
+// signed root, a signed example. zone below it, and these names in it:
+//
+//   - www.example.: signed A record
+//   - forged.example.: A record signed by a key that isn't the zone's
+//   - expired.example.: A record with an expired signature
+//   - stripped.example.: unsigned A record, proven not to be a zone cut
+//   - insecure.example.: delegation proven by NSEC to have no DS records
+//   - optout.example.: delegation covered by an opt-out NSEC3 record
+//   - unproven.example.: delegation with no DS records and no proof
+func newTestDNSSECServer(t *testing.T) *Server {
+	t.Helper()
+
+	upstream := newTestUpstream(t)
+	root := newTestZoneKey(t, ".")
+	example := newTestZoneKey(t, "example.")
+	rogue := newTestZoneKey(t, "example.")
+
+	upstream.respond(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.signValid(t, root.key), nil)
+	exampleDS := example.key.ToDS(dns.SHA256)
+	exampleDS.Hdr.Ttl = 3600
+	upstream.respond("example.", dns.TypeDS, dns.RcodeSuccess, root.signValid(t, exampleDS), nil)
+	upstream.respond("example.", dns.TypeDNSKEY, dns.RcodeSuccess, example.signValid(t, example.key), nil)
+
+	upstream.respond("www.example.", dns.TypeA, dns.RcodeSuccess,
+		example.signValid(t, testRR(t, "www.example. 300 IN A 192.0.2.1")), nil)
+	upstream.respond("forged.example.", dns.TypeA, dns.RcodeSuccess,
+		rogue.signValid(t, testRR(t, "forged.example. 300 IN A 192.0.2.2")), nil)
+	upstream.respond("expired.example.", dns.TypeA, dns.RcodeSuccess,
+		example.sign(t, []dns.RR{testRR(t, "expired.example. 300 IN A 192.0.2.3")}, -2*time.Hour, -time.Hour), nil)
+
+	upstream.respond("stripped.example.", dns.TypeA, dns.RcodeSuccess,
+		[]dns.RR{testRR(t, "stripped.example. 300 IN A 192.0.2.4")}, nil)
+	upstream.respond("stripped.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		example.signValid(t, testRR(t, "stripped.example. 300 IN NSEC unproven.example. A RRSIG NSEC")))
+
+	upstream.respond("host.insecure.example.", dns.TypeA, dns.RcodeSuccess,
+		[]dns.RR{testRR(t, "host.insecure.example. 300 IN A 192.0.2.5")}, nil)
+	upstream.respond("insecure.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		example.signValid(t, testRR(t, "insecure.example. 300 IN NSEC optout.example. NS RRSIG NSEC")))
+
+	// NSEC3 hash of optout.example., with no salt and no extra iterations
+	hashed := dns.HashName("optout.example.", dns.SHA1, 0, "")
+	before, after := "00000000000000000000000000000000", "VVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVV"
+	if hashed == before || hashed == after {
+		t.Fatal("NSEC3 hash collides with the covering record")
+	}
+	upstream.respond("host.optout.example.", dns.TypeA, dns.RcodeSuccess,
+		[]dns.RR{testRR(t, "host.optout.example. 300 IN A 192.0.2.6")}, nil)
+	upstream.respond("optout.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		example.signValid(t, testRR(t, before+".example. 300 IN NSEC3 1 1 0 - "+after+" NS")))
+
+	upstream.respond("host.unproven.example.", dns.TypeA, dns.RcodeSuccess,
+		[]dns.RR{testRR(t, "host.unproven.example. 300 IN A 192.0.2.7")}, nil)
+
+	anchor := root.key.ToDS(dns.SHA256)
+	return newTestServer(t, &Config{
+		Upstreams:          []string{upstream.addr},
+		DNSSECValidation:   dnssecValidate,
+		DNSSECTrustAnchors: []string{anchor.String()},
+	})
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	server := newTestDNSSECServer(t)
+	h := &handler{server: server, clients: server.makeUpstreamClients(transportUDP)}
+
+	tests := []struct {
+		name    string
+		secure  bool
+		wantErr error
+	}{
+		{name: "www.example.", secure: true},
+		{name: "forged.example.", wantErr: errDNSSECBogus},
+		{name: "expired.example.", wantErr: errDNSSECBogus},
+		{name: "stripped.example.", wantErr: errDNSSECBogus},
+		{name: "host.insecure.example."},
+		{name: "host.optout.example."},
+		{name: "host.unproven.example.", wantErr: errDNSSECBogus},
+		{name: "missing.example."},
+	}
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion(test.name, dns.TypeA)
+		query.SetEdns0(defaultEDNSBufferSize, true)
+
+		resp, err := h.exchangeUpstreams(context.Background(), query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		secure, err := server.validator.validate(context.Background(), h, resp)
+		if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+		}
+		if secure != test.secure {
+			t.Errorf("%s: got secure %t, want %t", test.name, secure, test.secure)
+		}
+	}
+}
+
+func TestDenialOfDS(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+		rr   string
+		want error
+	}{
+		{"delegation without DS", "child.example.", "child.example. 300 IN NSEC d.example. NS RRSIG NSEC", errDNSSECInsecure},
+		{"delegation with DS", "child.example.", "child.example. 300 IN NSEC d.example. NS DS RRSIG NSEC", nil},
+		{"child apex", "child.example.", "child.example. 300 IN NSEC d.example. NS SOA RRSIG NSEC", nil},
+		{"not a delegation", "child.example.", "child.example. 300 IN NSEC d.example. A RRSIG NSEC", errNotZoneCut},
+		{"empty non-terminal", "child.example.", "b.example. 300 IN NSEC a.child.example. A RRSIG NSEC", errNotZoneCut},
+		{"unrelated", "child.example.", "b.example. 300 IN NSEC c.example. A RRSIG NSEC", nil},
+	}
+	for _, test := range tests {
+		if got := denialOfDS(test.zone, testRR(t, test.rr)); !errors.Is(got, test.want) || (test.want == nil && got != nil) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	framestream "github.com/farsightsec/golang-framestream"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	dnstapVersion = "tailscale-dns-proxy"
+
+	// Messages are dropped rather than blocking queries once this many are
+	// waiting to be written
+	dnstapQueueSize      = 4096
+	dnstapReconnectDelay = 5 * time.Second
+	dnstapHandshakeTime  = 5 * time.Second
+
+	// Number of files from previous streams to keep alongside the dnstap file
+	dnstapFileBackups = 5
+)
+
+// dnstapLogger sends dnstap messages to a collector over Frame Streams, in the
+// background so that slow or missing collectors never delay queries.
+type dnstapLogger struct {
+	logger     *zap.Logger
+	socketPath string
+	filePath   string
+	identity   string
+	frames     chan []byte
+}
+
+// newDnstapLogger returns a dnstap logger for the config, or nil if dnstap is
+// disabled.
+func newDnstapLogger(logger *zap.Logger, config *Config) *dnstapLogger {
+	if config.DnstapSocketPath == "" && config.DnstapFilePath == "" {
+		return nil
+	}
+
+	identity := config.DnstapIdentity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+
+	return &dnstapLogger{
+		logger:     logger,
+		socketPath: config.DnstapSocketPath,
+		filePath:   config.DnstapFilePath,
+		identity:   identity,
+		frames:     make(chan []byte, dnstapQueueSize),
+	}
+}
+
+// dnstapEvent is a single query or response seen by the proxy.
+type dnstapEvent struct {
+	messageType  dnstap.Message_Type
+	protocol     dnstap.SocketProtocol
+	queryAddr    net.Addr
+	responseAddr net.Addr
+	queryTime    time.Time
+	responseTime time.Time
+	query        *dns.Msg
+	response     *dns.Msg
+}
+
+func (d *dnstapLogger) log(event *dnstapEvent) {
+	frame, err := event.marshal(d.identity)
+	if err != nil {
+		d.logger.Debug("failed to encode dnstap message", zap.Error(err))
+		return
+	}
+
+	select {
+	case d.frames <- frame:
+	default:
+	}
+}
+
+// marshal encodes the event as a dnstap.Dnstap protobuf message.
+func (e *dnstapEvent) marshal(identity string) ([]byte, error) {
+	msg := &dnstap.Message{
+		Type:           e.messageType.Enum(),
+		SocketProtocol: e.protocol.Enum(),
+	}
+
+	if ip := addrIP(e.queryAddr); ip != nil {
+		msg.SocketFamily, msg.QueryAddress = dnstapSocketFamily(ip)
+		msg.QueryPort = proto.Uint32(uint32(addrPort(e.queryAddr)))
+	}
+	if ip := addrIP(e.responseAddr); ip != nil {
+		msg.SocketFamily, msg.ResponseAddress = dnstapSocketFamily(ip)
+		msg.ResponsePort = proto.Uint32(uint32(addrPort(e.responseAddr)))
+	}
+
+	if !e.queryTime.IsZero() {
+		msg.QueryTimeSec = proto.Uint64(uint64(e.queryTime.Unix()))
+		msg.QueryTimeNsec = proto.Uint32(uint32(e.queryTime.Nanosecond()))
+	}
+	if !e.responseTime.IsZero() {
+		msg.ResponseTimeSec = proto.Uint64(uint64(e.responseTime.Unix()))
+		msg.ResponseTimeNsec = proto.Uint32(uint32(e.responseTime.Nanosecond()))
+	}
+
+	var err error
+	if e.query != nil {
+		if msg.QueryMessage, err = e.query.Pack(); err != nil {
+			return nil, fmt.Errorf("failed to pack DNS message: %w", err)
+		}
+	}
+	if e.response != nil {
+		if msg.ResponseMessage, err = e.response.Pack(); err != nil {
+			return nil, fmt.Errorf("failed to pack DNS message: %w", err)
+		}
+	}
+
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Identity: []byte(identity),
+		Version:  []byte(dnstapVersion),
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Message:  msg,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dnstap message: %w", err)
+	}
+	return frame, nil
+}
+
+// dnstapSocketFamily returns the dnstap socket family of an IP, and the IP in
+// its shortest form.
+func dnstapSocketFamily(ip net.IP) (*dnstap.SocketFamily, []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return dnstap.SocketFamily_INET.Enum(), ip4
+	}
+	return dnstap.SocketFamily_INET6.Enum(), ip
+}
+
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.Port
+	case *net.TCPAddr:
+		return a.Port
+	default:
+		return 0
+	}
+}
+
+// dnstapProtocol returns the dnstap socket protocol of a transport.
+func dnstapProtocol(transport string) dnstap.SocketProtocol {
+	switch transport {
+	case transportTCP:
+		return dnstap.SocketProtocol_TCP
+	case transportTLS:
+		return dnstap.SocketProtocol_DOT
+	case transportHTTPS:
+		return dnstap.SocketProtocol_DOH
+	default:
+		return dnstap.SocketProtocol_UDP
+	}
+}
+
+// run writes messages to the collector until the context is done,
+// reconnecting whenever the connection fails.
+func (d *dnstapLogger) run(ctx context.Context) {
+	for {
+		err := d.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		d.logger.Warn("dnstap output failed", zap.Error(err))
+		if !sleepContext(ctx, dnstapReconnectDelay) {
+			return
+		}
+	}
+}
+
+// stream opens the output and writes messages to it, as a bidirectional
+// Frame Streams connection for sockets or a unidirectional one for files.
+func (d *dnstapLogger) stream(ctx context.Context) error {
+	var out io.WriteCloser
+	var err error
+	options := &framestream.WriterOptions{
+		ContentTypes: [][]byte{dnstap.FSContentType},
+	}
+	if d.socketPath != "" {
+		var dialer net.Dialer
+		out, err = dialer.DialContext(ctx, "unix", d.socketPath)
+		options.Bidirectional = true
+		options.Timeout = dnstapHandshakeTime
+	} else {
+		out, err = openDnstapFile(d.filePath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open dnstap output: %w", err)
+	}
+	defer out.Close()
+
+	w, err := framestream.NewWriter(out, options)
+	if err != nil {
+		return fmt.Errorf("failed to start dnstap stream: %w", err)
+	}
+
+	for {
+		select {
+		case frame := <-d.frames:
+			if _, err := w.WriteFrame(frame); err != nil {
+				return fmt.Errorf("failed to write dnstap frame: %w", err)
+			}
+
+			// Batch up writes while messages are arriving faster than we can
+			// write them
+			if len(d.frames) == 0 {
+				if err := w.Flush(); err != nil {
+					return fmt.Errorf("failed to write dnstap frame: %w", err)
+				}
+			}
+		case <-ctx.Done():
+			if err := w.Close(); err != nil {
+				return fmt.Errorf("failed to stop dnstap stream: %w", err)
+			}
+			return nil
+		}
+	}
+}
+
+// openDnstapFile opens a new dnstap file for a stream. Readers stop at the end
+// of the first stream in a file, so any previous file (e.g. from before a
+// restart) is rotated out of the way rather than appended to.
+func openDnstapFile(path string) (*os.File, error) {
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		previous := &rotatingFile{path: path, maxBackups: dnstapFileBackups}
+		if err := previous.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0o640) //nolint:gosec
+}
+
+// dnstapHandler logs client queries and our responses to them.
+type dnstapHandler struct {
+	server   *Server
+	protocol string
+	next     dns.Handler
+}
+
+func (d *dnstapHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	queryTime := time.Now()
+	d.server.dnstap.log(&dnstapEvent{
+		messageType:  dnstap.Message_CLIENT_QUERY,
+		protocol:     dnstapProtocol(d.protocol),
+		queryAddr:    w.RemoteAddr(),
+		responseAddr: w.LocalAddr(),
+		queryTime:    queryTime,
+		query:        req,
+	})
+
+	d.next.ServeDNS(&dnstapWriter{ResponseWriter: w, handler: d, queryTime: queryTime}, req)
+}
+
+type dnstapWriter struct {
+	dns.ResponseWriter
+	handler   *dnstapHandler
+	queryTime time.Time
+}
+
+func (w *dnstapWriter) Unwrap() dns.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *dnstapWriter) WriteMsg(msg *dns.Msg) error {
+	w.handler.server.dnstap.log(&dnstapEvent{
+		messageType:  dnstap.Message_CLIENT_RESPONSE,
+		protocol:     dnstapProtocol(w.handler.protocol),
+		queryAddr:    w.RemoteAddr(),
+		responseAddr: w.LocalAddr(),
+		queryTime:    w.queryTime,
+		responseTime: time.Now(),
+		response:     msg,
+	})
+
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// logUpstreamExchange logs a query we sent to an upstream, and its response
+// if there was one.
+func (d *dnstapLogger) logUpstreamExchange(u *upstream, transport string, req *dns.Msg, resp *dns.Msg, queryTime time.Time) {
+	// Upstreams given by hostname are logged without an address, rather than
+	// looking up the name for every exchange
+	var upstreamAddr net.Addr
+	if transport != transportHTTPS {
+		if host, port, err := net.SplitHostPort(u.addr); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				portNum, _ := strconv.Atoi(port)
+				upstreamAddr = &net.TCPAddr{IP: ip, Port: portNum}
+			}
+		}
+	}
+
+	d.log(&dnstapEvent{
+		messageType:  dnstap.Message_FORWARDER_QUERY,
+		protocol:     dnstapProtocol(transport),
+		responseAddr: upstreamAddr,
+		queryTime:    queryTime,
+		query:        req,
+	})
+
+	if resp != nil {
+		d.log(&dnstapEvent{
+			messageType:  dnstap.Message_FORWARDER_RESPONSE,
+			protocol:     dnstapProtocol(transport),
+			responseAddr: upstreamAddr,
+			queryTime:    queryTime,
+			responseTime: time.Now(),
+			response:     resp,
+		})
+	}
+}
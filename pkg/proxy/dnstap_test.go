@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	framestream "github.com/farsightsec/golang-framestream"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// readDnstapFile decodes every dnstap message in a Frame Streams file.
+func readDnstapFile(t *testing.T, path string) []*dnstap.Dnstap {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	r, err := framestream.NewReader(file, &framestream.ReaderOptions{ContentTypes: [][]byte{dnstap.FSContentType}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []*dnstap.Dnstap
+	buf := make([]byte, framestream.DEFAULT_MAX_PAYLOAD_SIZE)
+	for {
+		n, err := r.ReadFrame(buf)
+		if err == framestream.EOF {
+			return messages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		message := &dnstap.Dnstap{}
+		if err := proto.Unmarshal(buf[:n], message); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+}
+
+func TestDnstapFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	logger := newDnstapLogger(zap.NewNop(), &Config{DnstapFilePath: path, DnstapIdentity: "test"})
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+
+	w := newTestResponseWriter("192.0.2.10")
+	logger.log(&dnstapEvent{
+		messageType:  dnstap.Message_CLIENT_QUERY,
+		protocol:     dnstapProtocol(transportUDP),
+		queryAddr:    w.RemoteAddr(),
+		responseAddr: w.LocalAddr(),
+		queryTime:    time.Now(),
+		query:        query,
+	})
+	logger.logUpstreamExchange(&upstream{addr: "[2001:db8::53]:853"}, transportTLS, query, response, time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		logger.run(ctx)
+		close(done)
+	}()
+
+	// Wait for the queue to drain before stopping the stream
+	for len(logger.frames) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	messages := readDnstapFile(t, path)
+	if len(messages) != 3 {
+		t.Fatalf("got %d messages, want 3", len(messages))
+	}
+
+	tests := []struct {
+		messageType dnstap.Message_Type
+		protocol    dnstap.SocketProtocol
+		family      dnstap.SocketFamily
+		query       bool
+		response    bool
+	}{
+		{dnstap.Message_CLIENT_QUERY, dnstap.SocketProtocol_UDP, dnstap.SocketFamily_INET, true, false},
+		{dnstap.Message_FORWARDER_QUERY, dnstap.SocketProtocol_DOT, dnstap.SocketFamily_INET6, true, false},
+		{dnstap.Message_FORWARDER_RESPONSE, dnstap.SocketProtocol_DOT, dnstap.SocketFamily_INET6, false, true},
+	}
+
+	for i, tt := range tests {
+		message := messages[i]
+		if string(message.GetIdentity()) != "test" || message.GetType() != dnstap.Dnstap_MESSAGE {
+			t.Errorf("message %d: got identity %q and type %v", i, message.GetIdentity(), message.GetType())
+		}
+
+		m := message.GetMessage()
+		if m.GetType() != tt.messageType || m.GetSocketProtocol() != tt.protocol || m.GetSocketFamily() != tt.family {
+			t.Errorf("message %d: got %v over %v/%v, want %v over %v/%v", i,
+				m.GetType(), m.GetSocketFamily(), m.GetSocketProtocol(), tt.messageType, tt.family, tt.protocol)
+		}
+		if (m.QueryMessage != nil) != tt.query || (m.ResponseMessage != nil) != tt.response {
+			t.Errorf("message %d: got query %t and response %t", i, m.QueryMessage != nil, m.ResponseMessage != nil)
+		}
+	}
+
+	if addr := net.IP(messages[1].GetMessage().GetResponseAddress()); !addr.Equal(net.ParseIP("2001:db8::53")) {
+		t.Errorf("got upstream address %s", addr)
+	}
+}
+
+func TestDnstapFileRotated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	if err := os.WriteFile(path, []byte("previous stream"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := openDnstapFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Errorf("expected a new empty file, got %v, %v", info, err)
+	}
+
+	previous, err := os.ReadFile(path + ".1")
+	if err != nil || string(previous) != "previous stream" {
+		t.Errorf("expected previous stream to be kept, got %q, %v", previous, err)
+	}
+}
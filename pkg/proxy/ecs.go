@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Remove any EDNS Client Subnet option before forwarding upstream
+	ecsPolicyStrip = "strip"
+	// Replace any EDNS Client Subnet option with a configured subnet
+	ecsPolicyInject = "inject"
+
+	// UDP buffer size to advertise if we have to add an OPT record to a query
+	// that didn't have one
+	defaultEDNSBufferSize = 1232
+)
+
+var errECSInjectSubnetRequired = errors.New("ecs_inject_subnet must be set when ecs_policy is 'inject'")
+
+// parseECSSubnet parses the subnet to inject into upstream queries.
+func parseECSSubnet(config *Config) (*dns.EDNS0_SUBNET, error) {
+	if config.ECSPolicy != ecsPolicyInject {
+		return nil, nil
+	}
+
+	if config.ECSInjectSubnet == "" {
+		return nil, errECSInjectSubnetRequired
+	}
+
+	_, subnet, err := net.ParseCIDR(config.ECSInjectSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ECS inject subnet: %w", err)
+	}
+
+	ones, _ := subnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+		Address:       subnet.IP,
+	}
+
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.Address = ip4
+	} else {
+		ecs.Family = 2
+	}
+
+	return ecs, nil
+}
+
+// applyECSPolicy returns the query to send upstream according to the EDNS
+// Client Subnet policy. If the query needs changing, a modified copy is
+// returned; otherwise, the query itself is returned.
+func (s *Server) applyECSPolicy(req *dns.Msg) *dns.Msg {
+	switch s.config.ECSPolicy {
+	case ecsPolicyStrip:
+		if opt := req.IsEdns0(); opt == nil || findECS(opt) == nil {
+			return req
+		}
+
+		upstreamReq := req.Copy()
+		removeECS(upstreamReq.IsEdns0())
+		return upstreamReq
+	case ecsPolicyInject:
+		upstreamReq := req.Copy()
+
+		opt := upstreamReq.IsEdns0()
+		if opt == nil {
+			upstreamReq.SetEdns0(defaultEDNSBufferSize, false)
+			opt = upstreamReq.IsEdns0()
+		}
+
+		removeECS(opt)
+		ecs := *s.ecsSubnet
+		opt.Option = append(opt.Option, &ecs)
+		return upstreamReq
+	default:
+		return req
+	}
+}
+
+// restoreECS replaces the EDNS Client Subnet option in an upstream response
+// (which reflects what we sent upstream, not what the client sent us) with
+// the client's original option, if it had one.
+func restoreECS(req *dns.Msg, resp *dns.Msg) {
+	respOpt := resp.IsEdns0()
+	if respOpt == nil {
+		return
+	}
+	removeECS(respOpt)
+
+	if reqOpt := req.IsEdns0(); reqOpt != nil {
+		if ecs := findECS(reqOpt); ecs != nil {
+			// A scope of zero tells the client that the answer doesn't depend
+			// on its subnet, which is true from the client's point of view
+			echoed := *ecs
+			echoed.SourceScope = 0
+			respOpt.Option = append(respOpt.Option, &echoed)
+		}
+	}
+}
+
+func findECS(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	for _, option := range opt.Option {
+		if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+func removeECS(opt *dns.OPT) {
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// fitResponse makes a response fit the client's transport: responses to EDNS
+// clients advertise our own UDP payload size, and responses over UDP are
+// truncated (setting the TC bit) if they exceed what the client can accept.
+// Over TCP, responses are always sent in full.
+func (s *Server) fitResponse(w dns.ResponseWriter, req *dns.Msg, msg *dns.Msg) {
+	ourSize := uint16(defaultEDNSBufferSize)
+	if s.config.EDNSUDPSize > 0 {
+		ourSize = uint16(s.config.EDNSUDPSize)
+	}
+
+	clientSize := uint16(dns.MinMsgSize)
+	if reqOpt := req.IsEdns0(); reqOpt != nil {
+		clientSize = min(max(reqOpt.UDPSize(), dns.MinMsgSize), ourSize)
+
+		// Responses to EDNS queries must include an OPT record; the one from
+		// upstream (if any) advertises upstream's buffer size, not ours
+		respOpt := msg.IsEdns0()
+		if respOpt == nil {
+			msg.SetEdns0(ourSize, reqOpt.Do())
+		} else {
+			respOpt.SetUDPSize(ourSize)
+			respOpt.SetDo(reqOpt.Do())
+		}
+	} else if msg.IsEdns0() != nil {
+		// Non-EDNS clients mustn't get an OPT record back (RFC 6891 § 7)
+		removeOPT(msg)
+	}
+
+	if w.LocalAddr().Network() == "udp" {
+		msg.Truncate(int(clientSize))
+	}
+}
+
+func removeOPT(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	blocklistFormatAdblock = "adblock"
+
+	// Answer blocked A/AAAA queries with the unspecified address rather than
+	// NXDOMAIN
+	blockResponseNull = "null"
+
+	// Maximum size of a blocklist we'll download
+	maxBlocklistSize = 64 << 20
+
+	// How long we'll wait to download a blocklist
+	blocklistFetchTimeout = time.Minute
+)
+
+var (
+	errBlocklistBadStatus = errors.New("unexpected HTTP status fetching blocklist")
+	errBlocklistBadURL    = errors.New("invalid blocklist URL")
+)
+
+// Names in hosts files that refer to the local machine rather than anything
+// that should be blocked
+//
+//nolint:gochecknoglobals
+var hostsLocalNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"broadcasthost.":         true,
+	"local.":                 true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+}
+
+// nameSet is a set of names, each of which may also match its subdomains.
+type nameSet struct {
+	exact   map[string]bool
+	domains map[string]bool
+}
+
+func newNameSet() *nameSet {
+	return &nameSet{exact: make(map[string]bool), domains: make(map[string]bool)}
+}
+
+func (n *nameSet) matches(name string) bool {
+	name = dns.CanonicalName(name)
+	if n.exact[name] {
+		return true
+	}
+
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(name, offset) {
+		if n.domains[name[offset:]] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blocklist is a list of blocked (and, for adblock lists, explicitly allowed)
+// names, loaded from a file or URL and periodically refreshed.
+type blocklist struct {
+	config *Blocklist
+
+	mu      sync.RWMutex
+	blocked *nameSet
+	allowed *nameSet
+}
+
+// parseBlocklist parses a list in either hosts format ('0.0.0.0 example.com',
+// or just 'example.com') or adblock format ('||example.com^', with
+// '@@||example.com^' for exceptions).
+func parseBlocklist(r io.Reader, format string) (blocked *nameSet, allowed *nameSet, err error) {
+	blocked, allowed = newNameSet(), newNameSet()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if format == blocklistFormatAdblock {
+			parseAdblockLine(line, blocked, allowed)
+			continue
+		}
+
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+
+		for _, field := range fields {
+			name := dns.CanonicalName(field)
+			if _, ok := dns.IsDomainName(name); ok && !hostsLocalNames[name] {
+				blocked.exact[name] = true
+			}
+		}
+	}
+
+	return blocked, allowed, scanner.Err()
+}
+
+func parseAdblockLine(line string, blocked *nameSet, allowed *nameSet) {
+	target := blocked
+	if strings.HasPrefix(line, "@@") {
+		target = allowed
+		line = line[2:]
+	}
+
+	// We only understand basic domain rules: anything with modifiers or
+	// paths is for browsers, not DNS
+	if !strings.HasPrefix(line, "||") || !strings.HasSuffix(line, "^") {
+		return
+	}
+
+	name := dns.CanonicalName(line[2 : len(line)-1])
+	if _, ok := dns.IsDomainName(name); ok && !strings.ContainsAny(name, "*/$") {
+		target.domains[name] = true
+	}
+}
+
+// isRemoteBlocklist returns true if the blocklist source is a URL rather
+// than a local file.
+func isRemoteBlocklist(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// checkBlocklistURL checks that a remote blocklist's URL could be fetched,
+// without fetching it.
+func checkBlocklistURL(source string) error {
+	u, err := url.Parse(source)
+	if err != nil {
+		return fmt.Errorf("%w '%s': %w", errBlocklistBadURL, source, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%w '%s': no host", errBlocklistBadURL, source)
+	}
+	return nil
+}
+
+func (b *blocklist) load(ctx context.Context) error {
+	var data []byte
+	var err error
+	if isRemoteBlocklist(b.config.Source) {
+		data, err = fetchBlocklist(ctx, b.config.Source)
+	} else {
+		data, err = os.ReadFile(b.config.Source)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read blocklist '%s': %w", b.config.Source, err)
+	}
+
+	blocked, allowed, err := parseBlocklist(bytes.NewReader(data), b.config.Format)
+	if err != nil {
+		return fmt.Errorf("failed to parse blocklist '%s': %w", b.config.Source, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blocked, b.allowed = blocked, allowed
+	return nil
+}
+
+func fetchBlocklist(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, blocklistFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %d", errBlocklistBadStatus, resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxBlocklistSize))
+}
+
+// verdict returns whether the list blocks the name, and whether it explicitly
+// allows it.
+func (b *blocklist) verdict(name string) (blocked bool, allowed bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.blocked == nil {
+		return false, false
+	}
+	return b.blocked.matches(name), b.allowed.matches(name)
+}
+
+func makeAllowlist(names []string) *nameSet {
+	allowlist := newNameSet()
+	for _, name := range names {
+		allowlist.domains[dns.CanonicalName(name)] = true
+	}
+	return allowlist
+}
+
+func (s *Server) makeBlocklists(ctx context.Context) ([]*blocklist, error) {
+	lists := make([]*blocklist, 0, len(s.config.Blocklists))
+	for i := range s.config.Blocklists {
+		list := &blocklist{config: &s.config.Blocklists[i]}
+		if err := list.load(ctx); err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+
+	return lists, nil
+}
+
+// refreshBlocklist periodically reloads a blocklist until the context is done.
+// If reloading fails, the previous version of the list stays in use.
+func (s *Server) refreshBlocklist(ctx context.Context, list *blocklist) {
+	ticker := time.NewTicker(list.config.RefreshSeconds)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := list.load(ctx); err != nil {
+				s.logger.Warn("failed to refresh blocklist", zap.String("source", list.config.Source), zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// isBlocked returns true if a name is blocked by any list, and not allowed by
+// the allowlist or an exception in any list.
+func (s *Server) isBlocked(name string) bool {
+	if s.allowlist.matches(name) {
+		return false
+	}
+
+	var blocked bool
+	for _, list := range s.blocklists {
+		listBlocked, listAllowed := list.verdict(name)
+		if listAllowed {
+			return false
+		}
+		blocked = blocked || listBlocked
+	}
+
+	return blocked
+}
+
+// filter answers queries for blocked names itself, passing everything else on.
+type filter struct {
+	server *Server
+	next   dns.Handler
+}
+
+func (f *filter) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 || len(f.server.blocklists) == 0 || !f.server.isBlocked(req.Question[0].Name) {
+		f.next.ServeDNS(w, req)
+		return
+	}
+
+	question := req.Question[0]
+	msg := f.server.synthesizedReply(req)
+	hdr := &dns.RR_Header{Name: question.Name, Ttl: directAnswerTTL}
+	switch {
+	case f.server.config.BlockResponse != blockResponseNull:
+		msg.Rcode = dns.RcodeNameError
+	case question.Qtype == dns.TypeA:
+		msg.Answer = makeIPRecords(hdr, []net.IP{net.IPv4zero})
+	case question.Qtype == dns.TypeAAAA:
+		msg.Answer = makeIPRecords(hdr, []net.IP{net.IPv6zero})
+	}
+
+	(&handler{server: f.server}).writeMsg(w, req, msg)
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestCheckDoesntFetchBlocklists(t *testing.T) {
+	fetched := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+	}))
+	defer server.Close()
+
+	config := &Config{
+		ListenAddr: "127.0.0.1:0",
+		Upstreams:  []string{"192.0.2.53"},
+		Blocklists: []Blocklist{{Source: server.URL + "/hosts"}},
+	}
+	if err := Check(zap.NewNop(), nil, config); err != nil {
+		t.Fatal(err)
+	}
+	if fetched {
+		t.Error("blocklist was fetched")
+	}
+
+	config.Blocklists = []Blocklist{{Source: "https:///hosts"}}
+	if err := Check(zap.NewNop(), nil, config); err == nil {
+		t.Error("expected an error for a blocklist URL without a host")
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+const (
+	// Answer REFUSED rather than SERVFAIL when upstream resolution fails
+	failureRcodeRefused = "refused"
+
+	// Remove extended rcodes and EDE options from upstream responses
+	upstreamEDNSStrip = "strip"
+)
+
+// failureResponse returns the response we send when we couldn't get an answer
+// from upstream.
+func (s *Server) failureResponse(req *dns.Msg) *dns.Msg {
+	rcode := dns.RcodeServerFailure
+	if s.config.UpstreamFailureRcode == failureRcodeRefused {
+		rcode = dns.RcodeRefused
+	}
+
+	msg := new(dns.Msg)
+	msg.SetRcode(req, rcode)
+	return msg
+}
+
+// synthesizedReply returns an empty reply to the request for answers that we
+// make up ourselves, with the AA and RA bits set as configured.
+func (s *Server) synthesizedReply(req *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.Authoritative = s.config.SynthesizedAuthoritative
+	msg.RecursionAvailable = s.config.SynthesizedRecursionAvailable
+	return msg
+}
+
+// applyUpstreamEDNSPolicy strips extended rcodes and Extended DNS Errors from
+// an upstream response, if configured to. Extended rcodes become SERVFAIL, as
+// that's the closest thing a plain rcode can say.
+func (s *Server) applyUpstreamEDNSPolicy(resp *dns.Msg) {
+	if s.config.UpstreamEDNSOptions != upstreamEDNSStrip {
+		return
+	}
+
+	if resp.Rcode > 0xF {
+		resp.Rcode = dns.RcodeServerFailure
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0EDE {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+	opt.SetExtendedRcode(0)
+}
+
+// applyMinimalResponses strips the authority and additional sections from an
+// upstream response if configured to, except for the SOA record that
+// negative answers need for caching and the OPT record.
+func (s *Server) applyMinimalResponses(req *dns.Msg, resp *dns.Msg) {
+	if !s.config.MinimalResponses {
+		return
+	}
+
+	if !isNegativeResponse(req, resp) {
+		resp.Ns = nil
+	}
+
+	var extra []dns.RR
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// forwardZone is a zone whose queries are answered by its own group of
+// upstreams.
+type forwardZone struct {
+	zone      string
+	upstreams *upstreamGroup
+}
+
+func (s *Server) makeUpstreamGroup(raw []string, weights []int, retry retryPolicy) (*upstreamGroup, error) {
+	group := &upstreamGroup{
+		strategy:   s.config.UpstreamSelectionStrategy,
+		raw:        raw,
+		weights:    weights,
+		usesSystem: slices.Contains(raw, upstreamSystem),
+		retry:      retry,
+	}
+
+	var system []string
+	if group.usesSystem {
+		var err error
+		system, err = readSystemUpstreams()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	upstreams, err := s.parseUpstreams(group, system)
+	if err != nil {
+		return nil, err
+	}
+
+	group.upstreams = upstreams
+	return group, nil
+}
+
+func (s *Server) parseUpstreams(group *upstreamGroup, system []string) ([]*upstream, error) {
+	upstreams, err := parseUpstreams(group.raw, group.weights, system)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.UpstreamUnhealthyCooldownSeconds > 0 {
+		cooldown := s.config.UpstreamUnhealthyCooldownSeconds
+		for _, u := range upstreams {
+			u.health = newUpstreamHealth(s.config.UpstreamFailureThreshold, cooldown)
+		}
+	}
+
+	return upstreams, nil
+}
+
+func (s *Server) makeForwardZones(zones []ForwardZone) ([]*forwardZone, error) {
+	forwardZones := make([]*forwardZone, 0, len(zones))
+	for _, zone := range zones {
+		group, err := s.makeUpstreamGroup(zone.Upstreams, zone.UpstreamWeights, newZoneRetryPolicy(s.config, &zone))
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstreams for zone '%s': %w", zone.Zone, err)
+		}
+
+		forwardZones = append(forwardZones, &forwardZone{
+			zone:      dns.CanonicalName(zone.Zone),
+			upstreams: group,
+		})
+	}
+
+	return forwardZones, nil
+}
+
+// upstreamGroupFor returns the upstreams that should answer the given query:
+// those of the most specific forward zone containing the query name, or the
+// default upstreams if there is no such zone.
+func (s *Server) upstreamGroupFor(req *dns.Msg) *upstreamGroup {
+	if len(req.Question) == 0 {
+		return s.upstreams
+	}
+
+	name := strings.ToLower(req.Question[0].Name)
+
+	var best *forwardZone
+	for _, zone := range s.forwardZones {
+		if !dns.IsSubDomain(zone.zone, name) {
+			continue
+		}
+
+		if best == nil || dns.CountLabel(zone.zone) > dns.CountLabel(best.zone) {
+			best = zone
+		}
+	}
+
+	if best == nil {
+		return s.upstreams
+	}
+
+	return best.upstreams
+}
+
+// allUpstreams returns every upstream known to the server, across the default
+// upstreams and all forward zones.
+func (s *Server) allUpstreams() []*upstream {
+	upstreams := append([]*upstream(nil), s.upstreams.members()...)
+	for _, zone := range s.forwardZones {
+		upstreams = append(upstreams, zone.upstreams.members()...)
+	}
+	return upstreams
+}
+
+// upstreamGroups returns the default upstream group along with those of every
+// forward zone.
+func (s *Server) upstreamGroups() []*upstreamGroup {
+	groups := []*upstreamGroup{s.upstreams}
+	for _, zone := range s.forwardZones {
+		groups = append(groups, zone.upstreams)
+	}
+	return groups
+}
@@ -0,0 +1,577 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/iplist"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	errTotalUpstreamTimeoutExceeded = fmt.Errorf("timeout exceeded for response from any upstream servers: %w", context.DeadlineExceeded)
+	errAnswerNotIPRecord            = errors.New("answer is not an A or AAAA record")
+	errNoTailscaleIPs               = errors.New("no tailscale IPs found for given address")
+	errNotInterceptableQuestion     = errors.New("more than one question or question type is not intercepted")
+	errNoTailscaleIPsAfterFiltering = errors.New("we found tailscale IPs, but none were of the requested record type (IPv4 vs IPv6)")
+)
+
+// Intercept modes where Tailscale A/AAAA records are returned alongside the
+// upstream ones, rather than replacing them, and where answers are rewritten
+// only for logging while clients get the upstream ones
+const (
+	interceptModeAppend = "append"
+	interceptModeShadow = "shadow"
+)
+
+type handler struct {
+	server  *Server
+	clients *upstreamClients
+}
+
+// Convenience function to apply rewrite rules, clamp TTLs and fit responses to
+// the client's EDNS buffer size, and log when writing responses fails
+func (h *handler) writeMsg(w dns.ResponseWriter, req *dns.Msg, msg *dns.Msg) {
+	h.server.applyRewriteRules(w, req, msg)
+	h.server.clampTTLs(msg)
+	h.server.fitResponse(w, req, msg)
+
+	start := time.Now()
+	err := w.WriteMsg(msg)
+	recordPhaseDuration(queryRecordFrom(w), phaseWrite, time.Since(start))
+	if err != nil {
+		h.server.logger.Warn("failed to write response to client", zap.Error(err))
+	}
+}
+
+func (h *handler) intercept(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	if !h.decideInterception(ctx, w, req, true) {
+		h.forward(ctx, w, req)
+		return
+	}
+
+	h.doIntercept(ctx, w, req)
+}
+
+// decideInterception returns true if the query should be intercepted, given
+// whether it fell within a proxy zone.
+func (h *handler) decideInterception(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, inProxyZone bool) bool {
+	if !h.server.interceptsClient(w.RemoteAddr()) {
+		traceStep(ctx, "forwarding: client isn't intercepted")
+		return false
+	}
+
+	intercept, reason := h.server.interceptDecision(req, inProxyZone)
+	if intercept {
+		traceStep(ctx, "intercepting: %s", reason)
+	} else {
+		traceStep(ctx, "forwarding: %s", reason)
+	}
+	return intercept
+}
+
+func (h *handler) doIntercept(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	h.server.metrics.handled.WithLabelValues("intercept", h.server.queryZone(req)).Inc()
+	recordIntercepted(ctx)
+
+	// The hook may decide differently for each client or over time, so its
+	// decisions can't be shared through the cache
+	cacheKind := cacheKindIntercept
+	if h.server.interceptionHook != nil {
+		cacheKind = cacheKindNone
+	}
+
+	if h.answerZoneAuthority(w, req) || h.answerFromCache(ctx, w, req, cacheKind) {
+		return
+	}
+
+	msg, outcome, err := h.interceptedResponse(ctx, req)
+	h.server.recordResolution(msg, err)
+	h.recordOutcome(ctx, req, outcome)
+	switch {
+	case err != nil:
+		msg = h.upstreamFailed(ctx, req, cacheKind, err)
+	case msg.Rcode == dns.RcodeServerFailure:
+		if stale, ok := h.staleFromCache(ctx, req, cacheKind); ok {
+			msg = stale
+		}
+	default:
+		h.storeInCache(req, msg, outcome, cacheKind)
+	}
+
+	h.writeMsg(w, req, msg)
+}
+
+// interceptionOutcome is what became of an intercepted query. It's kept with
+// cached responses, so that answers from the cache are counted and audited
+// like the original.
+type interceptionOutcome struct {
+	Result string `json:"result"`
+
+	// The addresses of the response before and after we rewrote it, and the
+	// resolver's evidence for them, if the audit log is enabled
+	OriginalIPs  []net.IP `json:"original_ips,omitempty"`
+	TailscaleIPs []net.IP `json:"tailscale_ips,omitempty"`
+	Evidence     []string `json:"evidence,omitempty"`
+}
+
+// recordOutcome counts an intercepted query by what became of it, if it got
+// as far as trying to rewrite the answer, and notes any rewrite for the audit
+// log.
+func (h *handler) recordOutcome(ctx context.Context, req *dns.Msg, outcome *interceptionOutcome) {
+	if outcome == nil {
+		return
+	}
+
+	h.server.countInterception(req, outcome.Result)
+	if outcome.Result != interceptionPassthrough {
+		recordRewrite(ctx, outcome)
+	}
+}
+
+// interceptedResponse builds the response to a query that we want to
+// intercept: Tailscale IPs where we have them, or otherwise whatever upstream
+// says, along with what became of the interception (nil if we didn't get as
+// far as trying it). Returns an error only if we couldn't get a response from
+// upstream.
+func (h *handler) interceptedResponse(ctx context.Context, req *dns.Msg) (*dns.Msg, *interceptionOutcome, error) {
+	if h.server.inDirectAnswerZone(req) {
+		msg, err := h.directAnswer(ctx, req)
+		if err == nil {
+			err = h.checkInterceptionHook(ctx, req, nil, msg)
+		}
+		if err == nil {
+			traceStep(ctx, "answered directly from the resolver")
+			return h.interceptionResult(ctx, req, nil, nil, msg)
+		}
+
+		traceStep(ctx, "no direct answer: %v", err)
+
+		// The name exists, just not with this type of address
+		if errors.Is(err, errNoDirectAnswerOfType) {
+			if msg := h.server.noDataResponse(req); msg != nil {
+				return msg, nil, nil
+			}
+		}
+
+		h.server.logger.Debug("falling back to upstream for direct answer zone", zap.NamedError("reason", err))
+	}
+
+	resp, err := h.resolveUpstream(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	toIntercept := resp
+	if h.server.config.ChaseCNAMEs && len(req.Question) == 1 && !isSVCBQuestion(req) {
+		chased, err := h.chaseCNAMEs(ctx, req, resp)
+		if err != nil {
+			h.server.logger.Debug("failed to chase CNAMEs", zap.Error(err))
+		} else {
+			toIntercept = chased
+		}
+	}
+
+	if h.server.config.SynthesizeOnNegative && isNegativeResponse(req, toIntercept) {
+		msg, err := h.directAnswer(ctx, req)
+		if err == nil {
+			err = h.checkInterceptionHook(ctx, req, toIntercept, msg)
+		}
+		if err == nil {
+			traceStep(ctx, "synthesized answer for negative upstream response")
+			return h.interceptionResult(ctx, req, resp, nil, msg)
+		}
+
+		traceStep(ctx, "not synthesizing answer for negative response: %v", err)
+		h.server.logger.Debug("not synthesizing answer for negative response", zap.NamedError("reason", err))
+	}
+
+	var newResp *dns.Msg
+	if isSVCBQuestion(req) {
+		newResp, err = h.doSVCBInterception(ctx, req, resp)
+	} else {
+		newResp, err = h.doInterception(ctx, req, toIntercept)
+
+		// Fall back to DNS64/4via6 if the name has no Tailscale IPv6 addresses
+		if err != nil && h.server.synthesizesIPv6() && req.Question[0].Qtype == dns.TypeAAAA &&
+			h.server.interceptsQtype(dns.TypeAAAA) {
+			newResp, err = h.doIPv6Synthesis(ctx, req)
+		}
+	}
+	if err == nil {
+		err = h.checkInterceptionHook(ctx, req, toIntercept, newResp)
+	}
+	if err != nil {
+		traceStep(ctx, "not intercepting: %v", err)
+		h.server.logger.Debug("decided not to intercept",
+			zap.NamedError("reason", err),
+			zap.Any("req", req),
+			zap.Any("resp", resp),
+		)
+		return resp, &interceptionOutcome{Result: interceptionPassthrough}, nil
+	}
+
+	traceStep(ctx, "rewrote answer with Tailscale IPs")
+	return h.interceptionResult(ctx, req, resp, toIntercept, newResp)
+}
+
+// interceptionResult finishes an interception that replaced the original
+// response (nil if there were no original addresses) with the rewritten one.
+// In shadow mode, the rewrite is only recorded (including whenever the
+// upstream response is answered from the cache), and the upstream response
+// (which is fetched if we haven't asked upstream yet) is returned instead.
+func (h *handler) interceptionResult(ctx context.Context, req *dns.Msg, upstream *dns.Msg, original *dns.Msg, rewritten *dns.Msg) (*dns.Msg, *interceptionOutcome, error) {
+	outcome := &interceptionOutcome{Result: interceptionRewritten}
+	if h.server.auditLog != nil {
+		outcome.TailscaleIPs = auditIPs(rewritten)
+		outcome.Evidence = recordedEvidence(ctx)
+		if original != nil {
+			outcome.OriginalIPs = auditIPs(original)
+		}
+	}
+
+	if h.server.config.InterceptMode != interceptModeShadow {
+		if h.server.config.ReversePTR {
+			h.server.reverseNames.record(req.Question[0].Name, answerIPs(rewritten))
+		}
+
+		return rewritten, outcome, nil
+	}
+
+	traceStep(ctx, "shadow mode: answering with the upstream response instead")
+	h.server.logger.Debug("shadow mode: would have rewritten answer",
+		zap.String("qname", req.Question[0].Name),
+		zap.Stringers("tailscale_ips", answerIPs(rewritten)),
+	)
+
+	outcome.Result = interceptionShadowed
+	if upstream == nil {
+		resp, err := h.resolveUpstream(ctx, req)
+		return resp, outcome, err
+	}
+	return upstream, outcome, nil
+}
+
+func (h *handler) doInterception(ctx context.Context, req *dns.Msg, resp *dns.Msg) (*dns.Msg, error) {
+	// We can't deal with things that aren't A/AAAA queries and exactly one question.
+	// I don't think anyone sends things with multiple questions anyway!
+	if len(req.Question) != 1 || !h.server.interceptsQtype(req.Question[0].Qtype) {
+		return nil, errNotInterceptableQuestion
+	}
+
+	return h.interceptAddresses(ctx, req, resp)
+}
+
+// interceptAddresses rewrites the A/AAAA answers of an upstream response to
+// the corresponding Tailscale IPs.
+func (h *handler) interceptAddresses(ctx context.Context, req *dns.Msg, resp *dns.Msg) (*dns.Msg, error) {
+	// We only rewrite the A/AAAA records at the end of the answer: any CNAME
+	// chain leading to them, along with the other sections, is passed through
+	// untouched by rewriteAnswer.
+	var ipAnswers []dns.RR
+	for _, answer := range resp.Answer {
+		switch answer.Header().Rrtype {
+		case dns.TypeCNAME, dns.TypeDNAME, dns.TypeRRSIG:
+			continue
+		}
+		ipAnswers = append(ipAnswers, answer)
+	}
+
+	if len(ipAnswers) == 0 {
+		return nil, errNoTailscaleIPs
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	resolvedIPs := make(chan []net.IP)
+
+	// XXX: This is almost certainly a premature parallelisation!!
+	for _, answer := range ipAnswers {
+		answer := answer
+
+		g.Go(func() error {
+			var ips []net.IP
+			var err error
+			if a, ok := answer.(*dns.A); ok {
+				ips, err = h.server.lookupTailscaleIPs(ctx, req.Question[0].Name, a.A)
+				if err != nil {
+					return fmt.Errorf("error getting tailscale IPs: %w", err)
+				}
+
+				// Generally, all answers will be the same type; if we get a
+				// Tailscale IP that isn't the same type as our answer, we should
+				// get rid of it, as we shouldn't return *mixed* A/AAAA answers
+				// for a single A or AAAA query!
+				ips = iplist.FilterIPv4Only(ips)
+			} else if aaaa, ok := answer.(*dns.AAAA); ok {
+				ips, err = h.server.lookupTailscaleIPs(ctx, req.Question[0].Name, aaaa.AAAA)
+				if err != nil {
+					return fmt.Errorf("error getting tailscale IPs: %w", err)
+				}
+				ips = iplist.FilterIPv6Only(ips)
+			} else {
+				// We can't deal with non A/AAAA records, so bail out if we see one
+				return errAnswerNotIPRecord
+			}
+
+			// If we get a record in the answers with no Tailscale IPs, we should
+			// *not* return our intercepted response: if we had an answer with
+			// Tailscale IPs as well, then we'd be returning a mixture of TS
+			// & non-TS IPs, which is bad!
+			if len(ips) == 0 {
+				return errNoTailscaleIPs
+			}
+
+			select {
+			case resolvedIPs <- ips:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			return nil
+		})
+	}
+
+	go func() {
+		// Close the channel after the errgroup is finished so that the read
+		// loop below doesn't hang!
+		// We don't care about the error here: we check it outside of this goroutine
+		_ = g.Wait()
+		close(resolvedIPs)
+	}()
+
+	var tailscaleIPs []net.IP
+	for resolvedIPSet := range resolvedIPs {
+		tailscaleIPs = append(tailscaleIPs, resolvedIPSet...)
+	}
+
+	if err := g.Wait(); err != nil {
+		if !errors.Is(err, errAnswerNotIPRecord) && !errors.Is(err, errNoTailscaleIPs) {
+			h.server.logger.Error("unerror during wait for concurrent resolution of tailscale IPs", zap.Error(err))
+		}
+
+		return nil, err
+	}
+
+	if req.Question[0].Qtype == dns.TypeA {
+		tailscaleIPs = iplist.FilterIPv4Only(tailscaleIPs)
+	} else {
+		tailscaleIPs = iplist.FilterIPv6Only(tailscaleIPs)
+	}
+
+	if len(tailscaleIPs) == 0 {
+		return nil, errNoTailscaleIPsAfterFiltering
+	}
+
+	tailscaleIPs = h.server.orderTailscaleIPs(tailscaleIPs)
+
+	keepOriginal := h.server.config.InterceptMode == interceptModeAppend
+	return rewriteAnswer(resp, ipAnswers[0].Header(), tailscaleIPs, keepOriginal), nil
+}
+
+// interceptsQtype returns true if queries of the given type are configured to
+// be intercepted.
+func (s *Server) interceptsQtype(qtype uint16) bool {
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return false
+	}
+
+	if len(s.config.InterceptQtypes) == 0 {
+		return true
+	}
+
+	for _, t := range s.config.InterceptQtypes {
+		if dns.StringToType[t] == qtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rewriteAnswer copies the upstream response, replacing its A/AAAA answers
+// with records for the given IPs (or, if keepOriginal is set, appending the
+// new records after the original ones). The new records take their owner name
+// and TTL from the given header (i.e. that of the original terminal records),
+// and are placed after any CNAMEs.
+func rewriteAnswer(resp *dns.Msg, hdr *dns.RR_Header, ips []net.IP, keepOriginal bool) *dns.Msg {
+	msg := resp.Copy()
+	msg.Answer = nil
+
+	// Whatever upstream validated, it wasn't these records
+	msg.AuthenticatedData = false
+
+	var originals []dns.RR
+	for _, answer := range resp.Answer {
+		switch answer.Header().Rrtype {
+		case dns.TypeCNAME, dns.TypeDNAME:
+			msg.Answer = append(msg.Answer, dns.Copy(answer))
+		case dns.TypeRRSIG:
+			if sig := answer.(*dns.RRSIG); sig.TypeCovered == dns.TypeCNAME || sig.TypeCovered == dns.TypeDNAME {
+				msg.Answer = append(msg.Answer, dns.Copy(answer))
+			}
+		default:
+			if keepOriginal {
+				originals = append(originals, dns.Copy(answer))
+			}
+		}
+	}
+
+	msg.Answer = append(msg.Answer, originals...)
+	msg.Answer = append(msg.Answer, makeIPRecords(hdr, ips)...)
+	return msg
+}
+
+func makeIPRecords(hdr *dns.RR_Header, ips []net.IP) []dns.RR {
+	records := make([]dns.RR, 0, len(ips))
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			rr := new(dns.A)
+			rr.Hdr = dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: hdr.Ttl}
+			rr.A = ip4
+			records = append(records, rr)
+		} else {
+			rr := new(dns.AAAA)
+			rr.Hdr = dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: hdr.Ttl}
+			rr.AAAA = ip
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// forwardOrIntercept handles queries outside of proxy zones, which are only
+// intercepted if they match one of the proxy patterns.
+func (h *handler) forwardOrIntercept(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	if h.decideInterception(ctx, w, req, false) {
+		h.doIntercept(ctx, w, req)
+		return
+	}
+
+	h.forward(ctx, w, req)
+}
+
+func (h *handler) forward(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	h.server.metrics.handled.WithLabelValues("forward", h.server.queryZone(req)).Inc()
+
+	if h.answerFromCache(ctx, w, req, cacheKindForward) {
+		return
+	}
+
+	resp, err := h.resolveForward(ctx, req)
+	h.server.recordResolution(resp, err)
+	switch {
+	case err != nil:
+		resp = h.upstreamFailed(ctx, req, cacheKindForward, err)
+	case resp.Rcode == dns.RcodeServerFailure:
+		if stale, ok := h.staleFromCache(ctx, req, cacheKindForward); ok {
+			resp = stale
+		}
+	default:
+		h.storeInCache(req, resp, nil, cacheKindForward)
+	}
+
+	h.writeMsg(w, req, resp)
+}
+
+// resolveForward resolves a query that we aren't intercepting.
+func (h *handler) resolveForward(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if h.server.validator != nil {
+		return h.resolveValidated(ctx, req)
+	}
+	return h.resolveUpstream(ctx, req)
+}
+
+// upstreamFailed returns the response to send when we couldn't get one from
+// upstream: a stale cached response if we're allowed to serve one, or
+// otherwise an error.
+func (h *handler) upstreamFailed(ctx context.Context, req *dns.Msg, cacheKind string, err error) *dns.Msg {
+	if !errors.Is(err, context.DeadlineExceeded) {
+		h.server.logger.Warn("upstream resolution failed: %w", zap.Error(err))
+	}
+
+	if msg, ok := h.staleFromCache(ctx, req, cacheKind); ok {
+		h.server.logger.Debug("serving stale response", zap.String("name", req.Question[0].Name))
+		return msg
+	}
+
+	return h.server.failureResponse(req)
+}
+
+func (h *handler) resolveUpstream(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	ecsReq := h.server.applyECSPolicy(req)
+	upstreamReq := h.server.attachTraceID(ctx, ecsReq)
+
+	resp, err := h.exchangeCoalesced(ctx, upstreamReq)
+	if err != nil {
+		traceStep(ctx, "upstream failed: %v", err)
+		return nil, err
+	}
+	traceResponse(ctx, "upstream answered", resp)
+
+	h.server.removeTraceOption(resp)
+	h.server.applyUpstreamEDNSPolicy(resp)
+	h.server.applyMinimalResponses(req, resp)
+
+	if ecsReq != req {
+		restoreECS(req, resp)
+	}
+
+	return resp, nil
+}
+
+func (h *handler) exchangeUpstreams(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeoutCause(
+		ctx,
+		h.server.upstreamTotalTimeout(),
+		errTotalUpstreamTimeoutExceeded,
+	)
+	defer cancel()
+
+	group := h.server.upstreamGroupFor(req)
+
+	if h.server.config.UpstreamQueryStrategy == queryStrategyRace {
+		return h.raceUpstreams(ctx, group, req)
+	}
+
+	// Fail over to the next upstream on any error or failure response, unless
+	// we've exceeded our total timeout
+	var lastResp *dns.Msg
+	var errs []error
+	for _, upstream := range group.selectUpstreams() {
+		resp, err := h.exchangeWithRetries(ctx, group.retry, upstream, req)
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+
+		if err != nil {
+			h.server.logger.Debug("upstream exchange failed", zap.String("upstream", upstream.name), zap.Error(err))
+			errs = append(errs, err)
+			continue
+		}
+
+		if isValidUpstreamResponse(resp) {
+			// We got a response! Return it
+			recordUpstream(ctx, upstream)
+			return resp, nil
+		}
+
+		lastResp = resp
+	}
+
+	// Every upstream failed, but if any of them actually responded (e.g. with
+	// SERVFAIL) we should pass that on
+	if lastResp != nil {
+		return lastResp, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, errNoUpstreams
+	}
+
+	return nil, fmt.Errorf("all upstreams failed (without exceeding total timeout): %w", errors.Join(errs...))
+}
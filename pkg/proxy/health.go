@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const defaultHealthCheckName = "."
+
+var errUpstreamProbeFailed = errors.New("upstream answered health check with failure")
+
+// upstreamHealth is a simple circuit breaker for an upstream: after enough
+// consecutive failures, the upstream is considered unhealthy and skipped until
+// its cooldown expires or a health check probe succeeds.
+type upstreamHealth struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	unhealthyUntil      time.Time
+}
+
+func newUpstreamHealth(threshold int, cooldown time.Duration) *upstreamHealth {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return &upstreamHealth{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+func (h *upstreamHealth) healthy() bool {
+	if h == nil {
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Now().After(h.unhealthyUntil)
+}
+
+// record updates the breaker with the result of an exchange. Returns true if
+// this result caused the upstream to become unhealthy.
+func (h *upstreamHealth) record(resp *dns.Msg, err error) bool {
+	if h == nil {
+		return false
+	}
+
+	// Exchanges that we cancelled ourselves (e.g. because another upstream won
+	// a race) say nothing about the health of the upstream
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil && isValidUpstreamResponse(resp) {
+		h.consecutiveFailures = 0
+		h.unhealthyUntil = time.Time{}
+		return false
+	}
+
+	h.consecutiveFailures++
+	if h.consecutiveFailures >= h.threshold && time.Now().After(h.unhealthyUntil) {
+		h.unhealthyUntil = time.Now().Add(h.cooldown)
+		return true
+	}
+
+	return false
+}
+
+// healthyUpstreams returns the upstreams whose circuits are closed, in order.
+// If every upstream is unhealthy, all of them are returned: trying a
+// potentially dead upstream is better than not trying at all.
+func (g *upstreamGroup) healthyUpstreams() []*upstream {
+	members := g.members()
+	healthy := make([]*upstream, 0, len(members))
+	for _, u := range members {
+		if u.health.healthy() {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return members
+	}
+
+	return healthy
+}
+
+// runHealthChecks periodically probes every upstream until the context is
+// done, feeding the results into each upstream's circuit breaker.
+func (s *Server) runHealthChecks(ctx context.Context) {
+	name := s.config.UpstreamHealthCheckName
+	if name == "" {
+		name = defaultHealthCheckName
+	}
+
+	clients := s.makeUpstreamClients(transportUDP)
+	ticker := time.NewTicker(s.config.UpstreamHealthCheckPeriodSeconds)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, u := range s.allUpstreams() {
+				probe := new(dns.Msg)
+				probe.SetQuestion(dns.Fqdn(name), dns.TypeSOA)
+
+				// Health is recorded by the exchange itself
+				if _, err := clients.exchange(ctx, u, probe); err != nil {
+					s.logger.Debug("upstream health check failed", zap.String("upstream", u.name), zap.Error(err))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// UpstreamProbe is the result of probing an upstream once.
+type UpstreamProbe struct {
+	Upstream string
+	Err      error
+}
+
+// ProbeUpstreams sends a single health check query to every upstream,
+// including those of views, e.g. to check that they're reachable before
+// deploying a config.
+func (s *Server) ProbeUpstreams(ctx context.Context) []UpstreamProbe {
+	s = s.current()
+	name := s.config.UpstreamHealthCheckName
+	if name == "" {
+		name = defaultHealthCheckName
+	}
+
+	servers := []*Server{s}
+	for _, view := range s.views {
+		servers = append(servers, view.server)
+	}
+
+	var probes []UpstreamProbe
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		clients := server.makeUpstreamClients(transportUDP)
+		for _, u := range server.allUpstreams() {
+			if seen[u.name] {
+				continue
+			}
+			seen[u.name] = true
+
+			probe := new(dns.Msg)
+			probe.SetQuestion(dns.Fqdn(name), dns.TypeSOA)
+
+			resp, err := clients.exchange(ctx, u, probe)
+			if err == nil && !isValidUpstreamResponse(resp) {
+				err = fmt.Errorf("%w: %s", errUpstreamProbeFailed, dns.RcodeToString[resp.Rcode])
+			}
+			probes = append(probes, UpstreamProbe{Upstream: u.name, Err: err})
+		}
+	}
+
+	return probes
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+var errInterceptionDeclined = errors.New("interception hook declined to intercept")
+
+// Interception is an answer that the proxy is about to rewrite.
+type Interception struct {
+	Name string
+	// Addresses in the upstream answer; empty if we answered without asking
+	// upstream
+	ExternalIPs  []net.IP
+	TailscaleIPs []net.IP
+	// Objects the resolver took the mapping from, if it says (and the audit
+	// log is enabled)
+	Evidence []string
+}
+
+// InterceptionHook makes the final decision on whether to intercept queries,
+// e.g. to apply policies based on the time of day or client identity. If it
+// returns false or an error, the upstream answer is passed on untouched. The
+// hook is asked about every query, so intercepted answers aren't cached while
+// one is set.
+type InterceptionHook interface {
+	ShouldIntercept(ctx context.Context, req *dns.Msg, upstreamResp *dns.Msg, mapping *Interception) (bool, error)
+}
+
+// SetInterceptionHook sets the hook that decides on every interception, in
+// every view. It must be set before the server starts.
+func (s *Server) SetInterceptionHook(hook InterceptionHook) {
+	s.interceptionHook = hook
+	for _, view := range s.views {
+		view.server.interceptionHook = hook
+	}
+}
+
+// checkInterceptionHook asks the hook, if there is one, whether we should
+// replace the upstream response (nil if we didn't ask upstream) with the
+// rewritten one.
+func (h *handler) checkInterceptionHook(ctx context.Context, req *dns.Msg, upstreamResp *dns.Msg, rewritten *dns.Msg) error {
+	hook := h.server.interceptionHook
+	if hook == nil {
+		return nil
+	}
+
+	mapping := &Interception{
+		Name:         req.Question[0].Name,
+		TailscaleIPs: auditIPs(rewritten),
+	}
+	if upstreamResp != nil {
+		mapping.ExternalIPs = auditIPs(upstreamResp)
+	}
+	mapping.Evidence = recordedEvidence(ctx)
+
+	intercept, err := hook.ShouldIntercept(ctx, req, upstreamResp, mapping)
+	if err != nil {
+		return fmt.Errorf("interception hook failed: %w", err)
+	}
+	if !intercept {
+		return errInterceptionDeclined
+	}
+	return nil
+}
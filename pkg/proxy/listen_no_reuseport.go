@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+func reusePortControl(_ string, _ string, _ syscall.RawConn) error {
+	return errReusePortUnsupported
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0 option, from the range for local use, marking our own liveness probes
+const livenessProbeOption = 65431
+
+// CheckLiveness sends a query to the server's own UDP listener, and returns
+// an error unless it gets a response of any kind before the context is done.
+// Any response (even a SERVFAIL, if upstream is failing) means that the
+// listener and handlers are still serving queries, so this is suitable for a
+// watchdog that restarts us if we hang.
+func (s *Server) CheckLiveness(ctx context.Context) error {
+	s = s.current()
+	name := s.config.UpstreamHealthCheckName
+	if name == "" {
+		name = defaultHealthCheckName
+	}
+
+	addr, err := loopbackAddr(s.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	probe := new(dns.Msg)
+	probe.SetQuestion(dns.Fqdn(name), dns.TypeSOA)
+	probe.SetEdns0(dns.DefaultMsgSize, false)
+	opt := probe.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: livenessProbeOption})
+
+	client := &dns.Client{Net: transportUDP}
+	if _, _, err := client.ExchangeContext(ctx, probe, addr); err != nil {
+		return fmt.Errorf("no response to query sent to ourselves at %s: %w", addr, err)
+	}
+	return nil
+}
+
+// loopbackAddr returns the address to reach a listener on the given address
+// from the same host: the loopback address if it listens on every address.
+func loopbackAddr(listenAddr string) (string, error) {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address '%s': %w", listenAddr, err)
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// isLivenessProbe returns true if a query from the client is one of our own
+// liveness probes.
+func isLivenessProbe(ip net.IP, req *dns.Msg) bool {
+	if ip == nil || !ip.IsLoopback() {
+		return false
+	}
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, option := range opt.Option {
+		if option.Option() == livenessProbeOption {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIsLivenessProbe(t *testing.T) {
+	probe := func(code uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("health.example.", dns.TypeSOA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: code})
+		return msg
+	}
+	plain := new(dns.Msg)
+	plain.SetQuestion("health.example.", dns.TypeSOA)
+
+	tests := []struct {
+		name string
+		ip   net.IP
+		req  *dns.Msg
+		want bool
+	}{
+		{"probe from loopback", net.ParseIP("127.0.0.1"), probe(livenessProbeOption), true},
+		{"probe from IPv6 loopback", net.ParseIP("::1"), probe(livenessProbeOption), true},
+		{"probe from elsewhere", net.ParseIP("192.0.2.1"), probe(livenessProbeOption), false},
+		{"other option from loopback", net.ParseIP("127.0.0.1"), probe(livenessProbeOption + 1), false},
+		{"plain query from loopback", net.ParseIP("127.0.0.1"), plain, false},
+		{"unknown client", nil, probe(livenessProbeOption), false},
+	}
+	for _, test := range tests {
+		if got := isLivenessProbe(test.ip, test.req); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/metrics"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	metricsNamespace = "tsdnsproxy_"
+
+	// Zone label for queries outside of every configured zone
+	metricsZoneOther = "."
+
+	defaultMetricsMaxZones = 50
+)
+
+// serverMetrics holds the metrics of a server. Views share the metrics of the
+// server they belong to.
+type serverMetrics struct {
+	queries          *prometheus.CounterVec
+	handled          *prometheus.CounterVec
+	interceptions    *prometheus.CounterVec
+	upstreamDuration *prometheus.HistogramVec
+	upstreamResults  *prometheus.CounterVec
+	resolverLookups  *prometheus.CounterVec
+	resolverDuration *prometheus.HistogramVec
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		queries: metrics.NewCounterVec(
+			metricsNamespace+"queries_total",
+			"Queries answered, by response code, query type and configured zone.",
+			"rcode", "qtype", "zone",
+		),
+		handled: metrics.NewCounterVec(
+			metricsNamespace+"queries_handled_total",
+			"Queries that were candidates for interception, and queries that were forwarded, by configured zone.",
+			"mode", "zone",
+		),
+		interceptions: metrics.NewCounterVec(
+			metricsNamespace+"interceptions_total",
+			"Queries that were candidates for interception, by configured zone and whether the answer was rewritten (or would have been, in shadow mode).",
+			"zone", "result",
+		),
+		upstreamDuration: metrics.NewHistogramVec(
+			metricsNamespace+"upstream_exchange_duration_seconds",
+			"Duration of exchanges with each upstream that got a response.",
+			metrics.DefaultLatencyBuckets(),
+			"upstream",
+		),
+		upstreamResults: metrics.NewCounterVec(
+			metricsNamespace+"upstream_exchanges_total",
+			"Exchanges with each upstream, by result: success, servfail, refused or error.",
+			"upstream", "result",
+		),
+		resolverLookups: metrics.NewCounterVec(
+			metricsNamespace+"resolver_lookups_total",
+			"Lookups of Tailscale IPs by external IP, by result.",
+			"result",
+		),
+		resolverDuration: metrics.NewHistogramVec(
+			metricsNamespace+"resolver_lookup_duration_seconds",
+			"Duration of lookups of Tailscale IPs by external IP.",
+			metrics.DefaultLatencyBuckets(),
+		),
+	}
+}
+
+// RegisterMetrics registers the server's metrics, including those of its
+// views, with the registry.
+func (s *Server) RegisterMetrics(registry prometheus.Registerer) {
+	m := s.metrics
+	registry.MustRegister(s.sloMetrics()...)
+
+	// Start every zone's interception counts at zero, so that zones whose
+	// interception never fires are visible
+	servers := []*Server{s}
+	for _, view := range s.views {
+		servers = append(servers, view.server)
+	}
+	for _, server := range servers {
+		for _, zone := range append([]string{metricsZoneOther}, server.metricsZones...) {
+			for _, result := range []string{interceptionRewritten, interceptionPassthrough, interceptionShadowed} {
+				m.interceptions.WithLabelValues(zone, result)
+			}
+		}
+	}
+	registry.MustRegister(
+		m.queries,
+		m.handled,
+		m.interceptions,
+		m.upstreamDuration,
+		m.upstreamResults,
+		m.resolverLookups,
+		m.resolverDuration,
+		metrics.NewGaugeFunc(
+			metricsNamespace+"cache_entries",
+			"Responses in each view's cache.",
+			func() []metrics.Sample {
+				return s.cacheSamples(func(c CacheStats) float64 { return float64(c.Entries) })
+			},
+			"view",
+		),
+		metrics.NewCounterFunc(
+			metricsNamespace+"cache_hits_total",
+			"Queries answered from each view's cache.",
+			func() []metrics.Sample {
+				return s.cacheSamples(func(c CacheStats) float64 { return float64(c.Hits) })
+			},
+			"view",
+		),
+		metrics.NewCounterFunc(
+			metricsNamespace+"cache_misses_total",
+			"Cacheable queries that weren't in each view's cache.",
+			func() []metrics.Sample {
+				return s.cacheSamples(func(c CacheStats) float64 { return float64(c.Misses) })
+			},
+			"view",
+		),
+		metrics.NewGaugeFunc(
+			metricsNamespace+"upstream_window_success_ratio",
+			"Fraction of exchanges with each upstream that succeeded over the last five minutes.",
+			func() []metrics.Sample {
+				return s.upstreamSamples(func(u UpstreamStats) float64 { return u.SuccessRatio })
+			},
+			"view", "upstream",
+		),
+		metrics.NewGaugeFunc(
+			metricsNamespace+"upstream_window_servfails",
+			"SERVFAIL responses from each upstream over the last five minutes.",
+			func() []metrics.Sample {
+				return s.upstreamSamples(func(u UpstreamStats) float64 { return float64(u.ServFails) })
+			},
+			"view", "upstream",
+		),
+		metrics.NewGaugeFunc(
+			metricsNamespace+"upstream_window_latency_p95_seconds",
+			"Estimated 95th percentile latency of each upstream over the last five minutes.",
+			func() []metrics.Sample {
+				return s.upstreamSamples(func(u UpstreamStats) float64 { return u.LatencyP95Ms / 1000 })
+			},
+			"view", "upstream",
+		),
+		metrics.NewGaugeFunc(
+			metricsNamespace+"upstream_healthy",
+			"Whether each upstream's circuit breaker considers it healthy.",
+			func() []metrics.Sample {
+				return s.upstreamSamples(func(u UpstreamStats) float64 {
+					if u.Healthy {
+						return 1
+					}
+					return 0
+				})
+			},
+			"view", "upstream",
+		),
+	)
+}
+
+func (s *Server) upstreamSamples(value func(UpstreamStats) float64) []metrics.Sample {
+	stats := s.UpstreamStats()
+	samples := make([]metrics.Sample, 0, len(stats))
+	for _, u := range stats {
+		samples = append(samples, metrics.Sample{LabelValues: []string{u.View, u.Name}, Value: value(u)})
+	}
+	return samples
+}
+
+func (s *Server) cacheSamples(value func(CacheStats) float64) []metrics.Sample {
+	stats := s.CacheStats()
+	samples := make([]metrics.Sample, 0, len(stats))
+	for _, c := range stats {
+		samples = append(samples, metrics.Sample{LabelValues: []string{c.View}, Value: value(c)})
+	}
+	return samples
+}
+
+// makeMetricsZones returns the zones that per-zone metrics are labelled with:
+// the configured zones, up to the limit, so that the cardinality of the
+// metrics is bounded by the config.
+func (s *Server) makeMetricsZones() []string {
+	limit := s.config.MetricsMaxZones
+	if limit == 0 {
+		limit = defaultMetricsMaxZones
+	}
+
+	candidates := make([]string, 0, len(s.config.ProxyZones)+len(s.config.AnswerWithoutUpstreamZones)+len(s.forwardZones)+len(s.staticZones))
+	candidates = append(candidates, s.config.ProxyZones...)
+	candidates = append(candidates, s.config.AnswerWithoutUpstreamZones...)
+	for _, zone := range s.forwardZones {
+		candidates = append(candidates, zone.zone)
+	}
+	for _, zone := range s.staticZones {
+		candidates = append(candidates, zone.origin)
+	}
+
+	seen := make(map[string]bool)
+	var zones []string
+	for _, zone := range candidates {
+		zone = dns.CanonicalName(zone)
+		if seen[zone] || zone == metricsZoneOther {
+			continue
+		}
+
+		if len(zones) == limit {
+			s.logger.Warn("too many zones for per-zone metrics; counting the rest under '.'", zap.Int("limit", limit))
+			break
+		}
+
+		seen[zone] = true
+		zones = append(zones, zone)
+	}
+
+	return zones
+}
+
+// metricsZone returns the most specific of the metrics zones containing the
+// name, or '.' if there isn't one.
+func (s *Server) metricsZone(name string) string {
+	name = dns.CanonicalName(name)
+
+	best := metricsZoneOther
+	for _, zone := range s.metricsZones {
+		if dns.IsSubDomain(zone, name) && dns.CountLabel(zone) > dns.CountLabel(best) {
+			best = zone
+		}
+	}
+
+	return best
+}
+
+// queryZone returns the metrics zone of a query's question.
+func (s *Server) queryZone(req *dns.Msg) string {
+	if len(req.Question) == 0 {
+		return metricsZoneOther
+	}
+	return s.metricsZone(req.Question[0].Name)
+}
+
+// Results of queries that we tried to intercept
+const (
+	interceptionRewritten   = "rewritten"
+	interceptionPassthrough = "passthrough"
+	interceptionShadowed    = "shadowed"
+)
+
+// countInterception counts a query that we tried to intercept by its zone
+// and what we did with the answer.
+func (s *Server) countInterception(req *dns.Msg, result string) {
+	s.metrics.interceptions.WithLabelValues(s.queryZone(req), result).Inc()
+}
+
+// instrumented counts the responses written to queries.
+type instrumented struct {
+	server *Server
+	next   dns.Handler
+}
+
+func (i *instrumented) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	i.next.ServeDNS(&metricsWriter{ResponseWriter: w, server: i.server}, req)
+}
+
+type metricsWriter struct {
+	dns.ResponseWriter
+	server *Server
+}
+
+func (w *metricsWriter) Unwrap() dns.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *metricsWriter) WriteMsg(msg *dns.Msg) error {
+	qtype, zone := "", metricsZoneOther
+	if len(msg.Question) > 0 {
+		qtype = dns.Type(msg.Question[0].Qtype).String()
+		zone = w.server.metricsZone(msg.Question[0].Name)
+	}
+
+	w.server.metrics.queries.WithLabelValues(dns.RcodeToString[msg.Rcode], qtype, zone).Inc()
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// observeUpstream records the outcome of an exchange with an upstream.
+func (m *serverMetrics) observeUpstream(u *upstream, resp *dns.Msg, latency time.Duration, err error) {
+	switch {
+	case err != nil:
+		m.upstreamResults.WithLabelValues(u.name, "error").Inc()
+		return
+	case resp.Rcode == dns.RcodeServerFailure:
+		m.upstreamResults.WithLabelValues(u.name, "servfail").Inc()
+	case resp.Rcode == dns.RcodeRefused:
+		m.upstreamResults.WithLabelValues(u.name, "refused").Inc()
+	default:
+		m.upstreamResults.WithLabelValues(u.name, "success").Inc()
+	}
+
+	m.upstreamDuration.WithLabelValues(u.name).Observe(latency.Seconds())
+}
+
+// lookupTailscaleIPs asks the resolver for the Tailscale IPs corresponding to
+// an external IP in the answers to a query for the name, recording the lookup
+// in the metrics (and, if the audit log is enabled, the resolver's evidence
+// for it in the query's record).
+func (s *Server) lookupTailscaleIPs(ctx context.Context, name string, ip net.IP) ([]net.IP, error) {
+	start := time.Now()
+	resolver := s.resolverFor(name)
+
+	var ips []net.IP
+	var err error
+	if explainer, ok := resolver.(resolvers.EvidenceResolver); ok && s.auditLog != nil {
+		var evidence []string
+		ips, evidence, err = explainer.ExplainTailscaleIPsByExternalIP(ip)
+		recordEvidence(ctx, evidence)
+	} else {
+		ips, err = resolver.GetTailscaleIPsByExternalIP(ip)
+	}
+
+	s.metrics.resolverDuration.WithLabelValues().Observe(time.Since(start).Seconds())
+	recordPhase(ctx, phaseResolver, start)
+	traceLookup(ctx, ip.String(), ips, err)
+
+	switch {
+	case err != nil:
+		s.metrics.resolverLookups.WithLabelValues("error").Inc()
+	case len(ips) == 0:
+		s.metrics.resolverLookups.WithLabelValues("not_found").Inc()
+	default:
+		s.metrics.resolverLookups.WithLabelValues("found").Inc()
+	}
+
+	return ips, err
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Stages that every query passes through, in order, which middleware can be
+// inserted around.
+const (
+	StageACL       = "acl"
+	StagePolicy    = "policy"
+	StageOverrides = "overrides"
+	StageFilter    = "filter"
+	StageAliases   = "aliases"
+	// Answers from static zones or the cache, or by intercepting or
+	// forwarding the query upstream. This is always the last stage.
+	StageResolve = "resolve"
+)
+
+var (
+	errUnknownStage    = errors.New("unknown handler stage")
+	errAfterFinalStage = errors.New("middleware can't be inserted after the final stage")
+	errServerListening = errors.New("middleware must be inserted before the server starts")
+)
+
+// Middleware is a stage of handling queries: it either answers the query
+// itself, or passes it on to the next handler.
+type Middleware func(next dns.Handler) dns.Handler
+
+type insertedMiddleware struct {
+	stage  string
+	before bool
+	wrap   Middleware
+}
+
+// handlerStage is one of the built-in stages, which wraps the next.
+type handlerStage struct {
+	name string
+	wrap Middleware
+}
+
+// Use adds middleware that runs just before the resolve stage, i.e. after all
+// of the built-in stages that might answer or drop the query.
+func (s *Server) Use(middleware Middleware) {
+	// The resolve stage always exists, so this can't fail
+	_ = s.InsertBefore(StageResolve, middleware)
+}
+
+// InsertBefore adds middleware that runs before the given stage. Middleware
+// inserted at the same place runs in the order it was inserted. It applies to
+// every view, and must be inserted before the server starts.
+func (s *Server) InsertBefore(stage string, middleware Middleware) error {
+	return s.insertMiddleware(insertedMiddleware{stage: stage, before: true, wrap: middleware})
+}
+
+// InsertAfter adds middleware that runs after the given stage, which can't be
+// the resolve stage.
+func (s *Server) InsertAfter(stage string, middleware Middleware) error {
+	if stage == StageResolve {
+		return errAfterFinalStage
+	}
+	return s.insertMiddleware(insertedMiddleware{stage: stage, before: false, wrap: middleware})
+}
+
+func (s *Server) insertMiddleware(middleware insertedMiddleware) error {
+	if s.started.Load() {
+		return errServerListening
+	}
+
+	switch middleware.stage {
+	case StageACL, StagePolicy, StageOverrides, StageFilter, StageAliases, StageResolve:
+	default:
+		return fmt.Errorf("%w '%s'", errUnknownStage, middleware.stage)
+	}
+
+	s.middleware = append(s.middleware, middleware)
+	for _, view := range s.views {
+		view.server.middleware = append(view.server.middleware, middleware)
+	}
+	return nil
+}
+
+// handlerStages returns the built-in stages that queries pass through before
+// the resolve stage, in order.
+func (s *Server) handlerStages() []handlerStage {
+	return []handlerStage{
+		{StageACL, func(next dns.Handler) dns.Handler { return &clientACL{server: s, next: next} }},
+		{StagePolicy, func(next dns.Handler) dns.Handler { return &queryPolicy{server: s, next: next} }},
+		{StageOverrides, func(next dns.Handler) dns.Handler {
+			return &overrides{server: s, next: next, records: s.overrideRecords}
+		}},
+		{StageFilter, func(next dns.Handler) dns.Handler { return &filter{server: s, next: next} }},
+		{StageAliases, func(next dns.Handler) dns.Handler { return &aliases{next: next, targets: s.aliasTargets} }},
+	}
+}
+
+// buildChain wraps the resolve stage in the built-in stages and any inserted
+// middleware.
+func (s *Server) buildChain(resolve dns.Handler) dns.Handler {
+	// Work out the order from the first stage to the last, then wrap from the
+	// last back to the first
+	var ordered []Middleware
+	for _, stage := range s.handlerStages() {
+		ordered = append(ordered, s.insertedAt(stage.name, true)...)
+		ordered = append(ordered, stage.wrap)
+		ordered = append(ordered, s.insertedAt(stage.name, false)...)
+	}
+	ordered = append(ordered, s.insertedAt(StageResolve, true)...)
+
+	chain := resolve
+	for i := len(ordered) - 1; i >= 0; i-- {
+		chain = ordered[i](chain)
+	}
+	return chain
+}
+
+func (s *Server) insertedAt(stage string, before bool) []Middleware {
+	var middleware []Middleware
+	for _, m := range s.middleware {
+		if m.stage == stage && m.before == before {
+			middleware = append(middleware, m.wrap)
+		}
+	}
+	return middleware
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var errInvalidZone = errors.New("invalid zone name")
+
+// NormaliseZone returns the canonical form of a zone name: lowercased and
+// fully-qualified (i.e. with a trailing dot). Patterns aren't zones, so
+// wildcards are rejected.
+func NormaliseZone(zone string) (string, error) {
+	if zone == "" || strings.Contains(zone, "*") {
+		return "", fmt.Errorf("%w '%s'", errInvalidZone, zone)
+	}
+
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return "", fmt.Errorf("%w '%s'", errInvalidZone, zone)
+	}
+
+	return dns.CanonicalName(zone), nil
+}
+
+// NormaliseZones replaces every zone name in the config with its canonical
+// form, so that zones given without a trailing dot or in mixed case match
+// queries. Returns an error naming an invalid zone, if there are any.
+func (c *Config) NormaliseZones() error {
+	lists := []struct {
+		field string
+		zones []string
+	}{
+		{"proxy_zones", c.ProxyZones},
+		{"answer_without_upstream_zones", c.AnswerWithoutUpstreamZones},
+		{"cache_exclude_zones", c.CacheExcludeZones},
+	}
+	for _, list := range lists {
+		for i, zone := range list.zones {
+			normalised, err := NormaliseZone(zone)
+			if err != nil {
+				return fmt.Errorf("%s: %w", list.field, err)
+			}
+			list.zones[i] = normalised
+		}
+	}
+
+	fields := make(map[string]*string)
+	for i := range c.StaticZones {
+		fields[fmt.Sprintf("static_zones[%d].zone", i)] = &c.StaticZones[i].Zone
+	}
+	for i := range c.ForwardZones {
+		fields[fmt.Sprintf("forward_zones[%d].zone", i)] = &c.ForwardZones[i].Zone
+	}
+	for i := range c.ZoneACLs {
+		fields[fmt.Sprintf("zone_acls[%d].zone", i)] = &c.ZoneACLs[i].Zone
+	}
+	for field, zone := range fields {
+		normalised, err := NormaliseZone(*zone)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		*zone = normalised
+	}
+
+	return nil
+}
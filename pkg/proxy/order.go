@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sort"
+)
+
+const (
+	// Shuffle the Tailscale IPs randomly in each response
+	answerOrderShuffle = "shuffle"
+	// Rotate the Tailscale IPs by one position for each response
+	answerOrderRoundRobin = "round_robin"
+)
+
+// orderTailscaleIPs de-duplicates the Tailscale IPs for an answer and orders
+// them according to the configured answer order. By default (the 'ordered'
+// order), IPs are sorted so that answers are stable regardless of the order
+// in which we resolved them.
+func (s *Server) orderTailscaleIPs(ips []net.IP) []net.IP {
+	ordered := make([]net.IP, 0, len(ips))
+	seen := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		if key := ip.String(); !seen[key] {
+			seen[key] = true
+			ordered = append(ordered, ip)
+		}
+	}
+
+	sort.Slice(ordered, func(i, j int) bool {
+		return bytes.Compare(ordered[i].To16(), ordered[j].To16()) < 0
+	})
+
+	switch s.config.AnswerOrder {
+	case answerOrderShuffle:
+		rand.Shuffle(len(ordered), func(i, j int) { //nolint:gosec
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case answerOrderRoundRobin:
+		if len(ordered) > 1 {
+			offset := int(s.answerRotation.Add(1) % uint64(len(ordered)))
+			rotated := make([]net.IP, 0, len(ordered))
+			rotated = append(rotated, ordered[offset:]...)
+			ordered = append(rotated, ordered[:offset]...)
+		}
+	}
+
+	return ordered
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// Maximum number of CNAMEs we'll follow within the overrides
+const maxOverrideCNAMEDepth = 8
+
+// overrides answers queries for individual names pinned in the config,
+// without consulting upstream. Queries for other names are passed on.
+type overrides struct {
+	server  *Server
+	next    dns.Handler
+	records map[string][]dns.RR
+}
+
+func makeOverrideRecords(configs []Override) (map[string][]dns.RR, error) {
+	records := make(map[string][]dns.RR)
+	for _, config := range configs {
+		ttl := ttlSeconds(config.TTLSeconds)
+		if ttl == 0 {
+			ttl = directAnswerTTL
+		}
+
+		name := dns.CanonicalName(config.Name)
+		value := config.Value
+		if config.Type == "TXT" {
+			value = strconv.Quote(value)
+		}
+
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, config.Type, value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid override for '%s': %w", config.Name, err)
+		}
+
+		records[name] = append(records[name], rr)
+	}
+
+	return records, nil
+}
+
+func (o *overrides) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		o.next.ServeDNS(w, req)
+		return
+	}
+
+	question := req.Question[0]
+	if _, ok := o.records[dns.CanonicalName(question.Name)]; !ok {
+		o.next.ServeDNS(w, req)
+		return
+	}
+
+	msg := o.server.synthesizedReply(req)
+	name := dns.CanonicalName(question.Name)
+	for depth := 0; depth < maxOverrideCNAMEDepth; depth++ {
+		var cname *dns.CNAME
+		for _, rr := range o.records[name] {
+			if rr.Header().Rrtype == question.Qtype {
+				msg.Answer = append(msg.Answer, dns.Copy(rr))
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+
+		if len(msg.Answer) > 0 && msg.Answer[len(msg.Answer)-1].Header().Rrtype == question.Qtype {
+			break
+		}
+
+		if cname == nil {
+			break
+		}
+
+		// Follow CNAMEs through the overrides; the client has to resolve
+		// targets that aren't overridden itself
+		msg.Answer = append(msg.Answer, dns.Copy(cname))
+		name = dns.CanonicalName(cname.Target)
+	}
+
+	(&handler{server: o.server}).writeMsg(w, req, msg)
+}
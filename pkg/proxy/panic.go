@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"runtime/debug"
+
+	"github.com/miekg/dns"
+)
+
+// SetPanicHandler sets a function to call when handling a query panics, e.g.
+// to report the panic, before the panic carries on as usual. It must be
+// called before the server is started.
+func (s *Server) SetPanicHandler(handler func(recovered any, stack []byte)) {
+	s.panicHandler = handler
+}
+
+type panicReporter struct {
+	server *Server
+	next   dns.Handler
+}
+
+func (p *panicReporter) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			p.server.panicHandler(recovered, debug.Stack())
+			panic(recovered)
+		}
+	}()
+
+	p.next.ServeDNS(w, req)
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Prefix marking a name pattern as a regular expression rather than a glob
+const regexPatternPrefix = "regex:"
+
+// namePatterns matches query names against globs and regular expressions.
+//
+// In globs, '*' matches anything within a single label, and '**' matches any
+// number of labels; e.g. '*.svc.example.com' matches 'foo.svc.example.com' but
+// not 'foo.bar.svc.example.com'. Regular expressions are prefixed with
+// 'regex:' and are matched against the whole lowercased, fully-qualified name
+// (i.e. with a trailing dot).
+type namePatterns []*regexp.Regexp
+
+func compileNamePatterns(patterns []string) (namePatterns, error) {
+	compiled := make(namePatterns, 0, len(patterns))
+	for _, pattern := range patterns {
+		var expr string
+		if re, ok := strings.CutPrefix(pattern, regexPatternPrefix); ok {
+			// Anchored so that e.g. 'regex:.*\.internal\.' can't match
+			// 'x.internal.attacker.com.'
+			expr = "^(?:" + re + ")$"
+		} else {
+			expr = globToRegex(dns.CanonicalName(pattern))
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern '%s': %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+
+	return compiled, nil
+}
+
+func globToRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		if glob[i] != '*' {
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			continue
+		}
+
+		if i+1 < len(glob) && glob[i+1] == '*' {
+			b.WriteString(".*")
+			i++
+		} else {
+			b.WriteString("[^.]*")
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func (p namePatterns) matches(name string) bool {
+	name = dns.CanonicalName(name)
+	for _, re := range p {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldIntercept decides whether a query should be intercepted according to
+// the configured patterns, given whether it fell within a proxy zone.
+func (s *Server) shouldIntercept(req *dns.Msg, inProxyZone bool) bool {
+	intercept, _ := s.interceptDecision(req, inProxyZone)
+	return intercept
+}
+
+// interceptDecision is shouldIntercept, along with the reason for the
+// decision for query traces.
+func (s *Server) interceptDecision(req *dns.Msg, inProxyZone bool) (bool, string) {
+	if s.interceptionDisabled.Load() {
+		return false, "interception is disabled"
+	}
+
+	if len(req.Question) != 1 {
+		if inProxyZone {
+			return true, "query is in a proxy zone"
+		}
+		return false, "query doesn't have exactly one question"
+	}
+
+	name := req.Question[0].Name
+	if s.excludePatterns.matches(name) {
+		return false, "name matches an exclude pattern"
+	}
+
+	switch {
+	case inProxyZone:
+		return true, "name is in a proxy zone"
+	case s.proxyPatterns.matches(name):
+		return true, "name matches a proxy pattern"
+	default:
+		return false, "name isn't in a proxy zone and doesn't match a proxy pattern"
+	}
+}
+
+// interceptsClient returns true if queries from the client should be
+// intercepted at all, rather than purely forwarded.
+func (s *Server) interceptsClient(addr net.Addr) bool {
+	if len(s.interceptClients) == 0 {
+		return true
+	}
+
+	ip := addrIP(addr)
+	return ip != nil && containsIP(s.interceptClients, ip)
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import "testing"
+
+func TestNamePatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.svc.example.com", "foo.svc.example.com.", true},
+		{"*.svc.example.com", "FOO.svc.example.com", true},
+		{"*.svc.example.com", "foo.bar.svc.example.com.", false},
+		{"*.svc.example.com", "svc.example.com.", false},
+		{"**.svc.example.com", "foo.bar.svc.example.com.", true},
+		{"db-*.example.com", "db-1.example.com.", true},
+		{"db-*.example.com", "web-1.example.com.", false},
+
+		// Regular expressions must match the whole name
+		{`regex:.*\.internal\.`, "db.internal.", true},
+		{`regex:.*\.internal\.`, "db.internal.attacker.com.", false},
+		{`regex:internal`, "db.internal.", false},
+		{`regex:db|web`, "db.example.com.", false},
+		{`regex:(db|web)\.example\.com\.`, "web.example.com.", true},
+		{`regex:^db\.example\.com\.$`, "db.example.com.", true},
+	}
+	for _, test := range tests {
+		patterns, err := compileNamePatterns([]string{test.pattern})
+		if err != nil {
+			t.Fatalf("%s: %v", test.pattern, err)
+		}
+		if got := patterns.matches(test.name); got != test.want {
+			t.Errorf("%s against %s: got %t, want %t", test.pattern, test.name, got, test.want)
+		}
+	}
+
+	if _, err := compileNamePatterns([]string{"regex:("}); err == nil {
+		t.Error("expected an error for an invalid regular expression")
+	}
+}
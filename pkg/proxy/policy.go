@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Answer ANY queries with a synthesized HINFO record, as per RFC 8482
+	anyPolicyHINFO = "hinfo"
+	// Answer ANY queries with REFUSED
+	anyPolicyRefuse = "refuse"
+
+	// TTL of the HINFO records we answer ANY queries with
+	anyHINFOTTL = 3600
+)
+
+// queryPolicy decides what to do with queries that we don't want to pass on
+// as-is, before they reach the rest of the handlers.
+type queryPolicy struct {
+	server *Server
+	next   dns.Handler
+}
+
+// parseCIDRs parses a list of CIDRs from the config, where kind describes
+// what they're for in error messages.
+func parseCIDRs(kind string, cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s CIDR '%s': %w", kind, cidr, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// containsIP returns true if any of the networks contains the IP.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *queryPolicy) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		p.next.ServeDNS(w, req)
+		return
+	}
+
+	switch req.Question[0].Qtype {
+	case dns.TypeANY:
+		switch p.server.config.AnyQueryPolicy {
+		case anyPolicyHINFO:
+			msg := p.server.synthesizedReply(req)
+			msg.Answer = []dns.RR{&dns.HINFO{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyHINFOTTL},
+				Cpu: "RFC8482",
+			}}
+			p.writeMsg(w, req, msg)
+			return
+		case anyPolicyRefuse:
+			p.refuse(w, req)
+			return
+		}
+	case dns.TypeAXFR, dns.TypeIXFR:
+		if !p.transferAllowed(w.RemoteAddr()) {
+			p.refuse(w, req)
+			return
+		}
+	}
+
+	p.next.ServeDNS(w, req)
+}
+
+// transferAllowed returns true if the client may make zone transfer requests.
+func (p *queryPolicy) transferAllowed(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return ip != nil && containsIP(p.server.transferCIDRs, ip)
+}
+
+func (p *queryPolicy) refuse(w dns.ResponseWriter, req *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetRcode(req, dns.RcodeRefused)
+	p.writeMsg(w, req, msg)
+}
+
+func (p *queryPolicy) writeMsg(w dns.ResponseWriter, req *dns.Msg, msg *dns.Msg) {
+	(&handler{server: p.server}).writeMsg(w, req, msg)
+}
+
+// addrIP returns the IP of a TCP or UDP address, or nil for other addresses.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+// acceptOpcodes is the server's message acceptance function when unknown
+// opcodes are to be dropped: rather than answering NOTIMP (as the default
+// does), we ignore such messages entirely.
+func acceptOpcodes(dh dns.Header) dns.MsgAcceptAction {
+	action := dns.DefaultMsgAcceptFunc(dh)
+	if action == dns.MsgRejectNotImplemented {
+		return dns.MsgIgnore
+	}
+	return action
+}
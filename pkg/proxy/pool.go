@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// connPool keeps persistent connections to stream-based (TCP and TLS)
+// upstreams, so that we don't pay for a dial (and TLS handshake) on every
+// query.
+type connPool struct {
+	maxConns    int
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*connPoolEntry
+}
+
+type connPoolEntry struct {
+	// Semaphore bounding the number of connections (idle or in use) to this
+	// upstream
+	slots chan struct{}
+
+	mu   sync.Mutex
+	idle []*pooledConn
+}
+
+type pooledConn struct {
+	*dns.Conn
+	lastUsed time.Time
+}
+
+func newConnPool(maxConns int, idleTimeout time.Duration) *connPool {
+	return &connPool{
+		maxConns:    maxConns,
+		idleTimeout: idleTimeout,
+		entries:     make(map[string]*connPoolEntry),
+	}
+}
+
+func (p *connPool) entry(key string) *connPoolEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[key]
+	if !ok {
+		entry = &connPoolEntry{slots: make(chan struct{}, p.maxConns)}
+		p.entries[key] = entry
+	}
+	return entry
+}
+
+// exchange sends a query to the given address using a pooled connection,
+// dialing a new one with the client if none are idle.
+func (p *connPool) exchange(ctx context.Context, client *dns.Client, addr string, req *dns.Msg) (*dns.Msg, error) {
+	entry := p.entry(client.Net + "://" + addr)
+
+	select {
+	case entry.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-entry.slots }()
+
+	conn := p.takeIdle(entry)
+	if conn != nil {
+		resp, _, err := client.ExchangeWithConnContext(ctx, req, conn.Conn)
+		if err == nil {
+			p.putIdle(entry, conn)
+			return resp, nil
+		}
+
+		_ = conn.Close()
+
+		// The upstream may well have closed the connection while it was idle;
+		// if so, retry below on a fresh connection
+		if ctx.Err() != nil || !isStaleConnError(err) {
+			return nil, err
+		}
+	}
+
+	dialed, err := client.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn = &pooledConn{Conn: dialed}
+	resp, _, err := client.ExchangeWithConnContext(ctx, req, conn.Conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	p.putIdle(entry, conn)
+	return resp, nil
+}
+
+func (p *connPool) takeIdle(entry *connPoolEntry) *pooledConn {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	for len(entry.idle) > 0 {
+		// Take the most recently used connection, as it's the least likely to
+		// have been closed by the upstream
+		conn := entry.idle[len(entry.idle)-1]
+		entry.idle = entry.idle[:len(entry.idle)-1]
+
+		if p.idleTimeout > 0 && time.Since(conn.lastUsed) > p.idleTimeout {
+			_ = conn.Close()
+			continue
+		}
+
+		return conn
+	}
+
+	return nil
+}
+
+func (p *connPool) putIdle(entry *connPoolEntry, conn *pooledConn) {
+	conn.lastUsed = time.Now()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	entry.idle = append(entry.idle, conn)
+}
+
+// Close closes all idle connections in the pool.
+func (p *connPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, entry := range p.entries {
+		entry.mu.Lock()
+		for _, conn := range entry.idle {
+			_ = conn.Close()
+		}
+		entry.idle = nil
+		entry.mu.Unlock()
+	}
+}
+
+func isStaleConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,544 @@
+// Package proxy implements the DNS server: it forwards queries to upstream
+// servers, and rewrites A/AAAA answers for external IPs to the Tailscale IPs
+// that a resolver maps them to. Programs can embed it by creating a Server
+// with New and running its ListenAndServeContext method.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+type Server struct {
+	logger       *zap.Logger
+	config       *Config
+	resolver     resolvers.Resolver
+	upstreams    *upstreamGroup
+	forwardZones []*forwardZone
+	staticZones  []*staticZone
+	pool         *connPool
+	reverseNames *reverseNames
+
+	// Zones holding the synthesized SOA/NS records of proxy zones
+	interceptedZones []*staticZone
+
+	proxyPatterns   namePatterns
+	excludePatterns namePatterns
+
+	// Resolvers to use for particular names, in order of precedence
+	resolverBindings []*resolverBinding
+
+	// Clients whose queries may be intercepted; empty means everyone
+	interceptClients []*net.IPNet
+
+	// Subnet to inject into upstream queries; nil unless the ECS policy is
+	// 'inject'
+	ecsSubnet *dns.EDNS0_SUBNET
+
+	// NAT64 prefix for synthesizing AAAA records; nil unless DNS64 is on
+	dns64Prefix *net.IPNet
+	via6Sites   []*via6Site
+
+	// Clients allowed to make zone transfer requests
+	transferCIDRs []*net.IPNet
+
+	// Clients allowed to query anything, and to query particular zones
+	allowedClients []*net.IPNet
+	zoneACLs       []*zoneACL
+
+	// Records pinned in the config, by name
+	overrideRecords map[string][]dns.RR
+
+	// Names that queries are rewritten to before forwarding, by alias
+	aliasTargets map[string]string
+
+	blocklists []*blocklist
+	allowlist  *nameSet
+
+	rewriteRules []*rewriteRule
+
+	// Alternative configurations for particular clients
+	views []*view
+
+	// Counter for round-robin ordering of intercepted answers
+	answerRotation atomic.Uint64
+
+	// Upstream exchanges in flight, for coalescing identical queries
+	inFlight singleflight.Group
+
+	// Response cache; nil if caching is disabled
+	cache *responseCache
+
+	metrics *serverMetrics
+	// Zones that per-zone metrics are labelled with
+	metricsZones []string
+
+	// Logger for dnstap messages; nil unless dnstap is enabled
+	dnstap *dnstapLogger
+
+	// Logger for the query log; nil unless the query log is enabled
+	queryLog *jsonLogger
+
+	// Logger for the audit log of rewritten answers; nil unless it's enabled
+	auditLog *jsonLogger
+
+	// Recent and live queries, for the admin API
+	queryTail *queryTail
+
+	// Outcomes of resolutions, for the overall SLO. Shared with views.
+	slo *sloCounter
+
+	// Called with queries' panics; nil if unset
+	panicHandler func(recovered any, stack []byte)
+
+	// Middleware inserted around the built-in handler stages
+	middleware []insertedMiddleware
+	started    atomic.Bool
+
+	// Closed once every socket is bound
+	listening chan struct{}
+
+	// The server built from the latest config, if it's been reloaded (see
+	// Reload), and what's needed to start it
+	active   atomic.Pointer[Server]
+	reloadMu sync.Mutex
+	serveCtx context.Context //nolint:containedctx
+
+	// This generation's handlers for each socket, by protocol, and how to
+	// stop its background tasks
+	handlers  map[string][]dns.Handler
+	stopTasks context.CancelFunc
+
+	// Set through the admin API to forward every query untouched
+	interceptionDisabled atomic.Bool
+
+	// Has the final say on interceptions; nil if unset
+	interceptionHook InterceptionHook
+
+	// Counter of slow queries, for sampling the slow query log
+	slowQueries atomic.Uint64
+
+	// Resolver for upstream hostnames; nil to use the system resolver
+	bootstrapResolver *net.Resolver
+	tlsConfig         *tls.Config
+
+	// Validator for forwarded responses; nil unless DNSSEC validation is on
+	validator *dnssecValidator
+}
+
+func New(logger *zap.Logger, resolver resolvers.Resolver, config *Config) (*Server, error) {
+	server := &Server{
+		logger:       logger,
+		config:       config,
+		resolver:     resolver,
+		reverseNames: newReverseNames(reverseNamesMaxEntries),
+		metrics:      newServerMetrics(),
+		dnstap:       newDnstapLogger(logger, config),
+		queryLog:     newQueryLogger(logger, config),
+		auditLog:     newAuditLogger(logger, config),
+		slo:          &sloCounter{},
+		listening:    make(chan struct{}),
+	}
+
+	tlsConfig, err := makeUpstreamTLSConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream TLS config: %w", err)
+	}
+	server.tlsConfig = tlsConfig
+
+	if len(config.BootstrapResolvers) > 0 {
+		bootstrap, err := newBootstrapResolver(config.BootstrapResolvers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create bootstrap resolver: %w", err)
+		}
+		server.bootstrapResolver = bootstrap
+	}
+
+	server.upstreams, err = server.makeUpstreamGroup(config.Upstreams, config.UpstreamWeights, newRetryPolicy(config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstreams: %w", err)
+	}
+
+	server.forwardZones, err = server.makeForwardZones(config.ForwardZones)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse forward zones: %w", err)
+	}
+
+	server.proxyPatterns, err = compileNamePatterns(config.ProxyPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile proxy patterns: %w", err)
+	}
+
+	server.excludePatterns, err = compileNamePatterns(config.ProxyExcludePatterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile proxy exclude patterns: %w", err)
+	}
+
+	server.resolverBindings, err = makeResolverBindings(resolver, config.ResolverBindings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind resolvers: %w", err)
+	}
+
+	server.interceptClients, err = parseCIDRs("intercept client", config.InterceptClientCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	server.ecsSubnet, err = parseECSSubnet(config)
+	if err != nil {
+		return nil, err
+	}
+
+	server.dns64Prefix, err = parseDNS64Prefix(config)
+	if err != nil {
+		return nil, err
+	}
+
+	server.via6Sites, err = makeVia6Sites(config.Via6Sites)
+	if err != nil {
+		return nil, err
+	}
+
+	server.transferCIDRs, err = parseCIDRs("zone transfer", config.ZoneTransferAllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	server.overrideRecords, err = makeOverrideRecords(config.Overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	server.aliasTargets = makeAliasTargets(config.Aliases)
+	server.allowlist = makeAllowlist(config.Allowlist)
+	server.blocklists, err = server.makeBlocklists(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	server.rewriteRules, err = compileRewriteRules(config.RewriteRules)
+	if err != nil {
+		return nil, err
+	}
+
+	server.allowedClients, err = parseCIDRs("allowed client", config.AllowedClients)
+	if err != nil {
+		return nil, err
+	}
+
+	server.zoneACLs, err = makeZoneACLs(config.ZoneACLs)
+	if err != nil {
+		return nil, err
+	}
+
+	server.staticZones, err = server.makeStaticZones(config.StaticZones)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load static zones: %w", err)
+	}
+
+	server.interceptedZones, err = server.makeInterceptedZones()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create proxy zone SOA records: %w", err)
+	}
+
+	if config.DNSSECValidation == dnssecValidate {
+		server.validator, err = newDNSSECValidator(config.DNSSECTrustAnchors)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.CacheMaxEntries > 0 {
+		server.cache = newResponseCache(
+			config.CacheMaxEntries,
+			config.CacheServeStaleSeconds,
+			config.CachePrefetchHits,
+		)
+
+		if config.CachePersistPath != "" {
+			if err := server.cache.load(config.CachePersistPath); err != nil {
+				// Starting with an empty cache is just slower, not broken
+				logger.Warn("failed to load persisted cache", zap.Error(err))
+			}
+		}
+	}
+
+	if config.UpstreamPoolMaxConns > 0 {
+		server.pool = newConnPool(config.UpstreamPoolMaxConns, durationOrDefault(config.UpstreamPoolIdleTimeoutSeconds, defaultUpstreamPoolIdleTimeout))
+	}
+
+	server.metricsZones = server.makeMetricsZones()
+
+	server.views, err = server.makeViews()
+	if err != nil {
+		return nil, err
+	}
+
+	// We want to be as transparent as possible, so by default we forward TCP
+	// packets when we get a TCP request, and UDP packets when we get a UDP
+	// request. Upstreams can override this by specifying a transport.
+
+	return server, nil
+}
+
+// Check checks the parts of the config that the config validator can't, e.g.
+// upstream schemes and zones, as New would. Unlike New, it doesn't fetch
+// remote blocklists: their URLs are only checked to be valid.
+func Check(logger *zap.Logger, resolver resolvers.Resolver, config *Config) error {
+	local := *config
+	local.Blocklists = nil
+	for _, list := range config.Blocklists {
+		if !isRemoteBlocklist(list.Source) {
+			local.Blocklists = append(local.Blocklists, list)
+			continue
+		}
+		if err := checkBlocklistURL(list.Source); err != nil {
+			return err
+		}
+	}
+
+	_, err := New(logger, resolver, &local)
+	return err
+}
+
+// makeDNSServer creates the DNS server for one of our sockets. Its handler
+// passes queries on to the active generation of the server, so that the
+// config can be reloaded without restarting it.
+func (s *Server) makeDNSServer(protocol string, index int) *dns.Server {
+	server := &dns.Server{
+		Addr:       s.config.ListenAddr,
+		Net:        protocol,
+		Handler:    &reloadableHandler{server: s, protocol: protocol, index: index},
+		TsigSecret: s.tsigSecrets(),
+	}
+
+	if s.config.DropUnknownOpcodes {
+		server.MsgAcceptFunc = acceptOpcodes
+	}
+
+	return server
+}
+
+// makeServeChain creates the full chain of handlers for one of our sockets.
+func (s *Server) makeServeChain(ctx context.Context, protocol string) dns.Handler {
+	chain := s.makeChain(ctx, protocol)
+	if s.dnstap != nil {
+		chain = &dnstapHandler{server: s, protocol: protocol, next: chain}
+	}
+	if s.recordsQueries() {
+		chain = &queryRecorder{server: s, protocol: protocol, next: chain}
+	}
+	if s.panicHandler != nil {
+		chain = &panicReporter{server: s, next: chain}
+	}
+	return chain
+}
+
+// makeChain creates the handlers that every query passes through, except for
+// those that only observe queries (e.g. for logging).
+func (s *Server) makeChain(ctx context.Context, protocol string) dns.Handler {
+	chain := s.makeHandler(ctx, protocol)
+	if len(s.views) > 0 {
+		chain = s.makeViewSelector(ctx, protocol, chain)
+	}
+	if protocol == transportUDP && s.config.DeduplicateUDPQueries {
+		chain = newUDPDedup(s, chain)
+	}
+	chain = &sanitizer{server: s, next: chain}
+	chain = &instrumented{server: s, next: chain}
+	return chain
+}
+
+// makeHandler creates the handler for queries received over the given
+// protocol.
+func (s *Server) makeHandler(ctx context.Context, protocol string) dns.Handler {
+	handler := &handler{
+		server:  s,
+		clients: s.makeUpstreamClients(protocol),
+	}
+	mux := dns.NewServeMux()
+	// Direct answer zones are implicitly proxy zones too
+	proxyZones := append(slices.Clone(s.config.ProxyZones), s.config.AnswerWithoutUpstreamZones...)
+	for _, pattern := range proxyZones {
+		mux.HandleFunc(pattern, func(w dns.ResponseWriter, m *dns.Msg) { handler.intercept(queryContext(ctx, w), w, m) })
+	}
+
+	for _, zone := range s.staticZones {
+		zone := zone
+		mux.HandleFunc(zone.origin, func(w dns.ResponseWriter, m *dns.Msg) { handler.authoritative(w, m, zone) })
+	}
+
+	if s.config.ReversePTR {
+		for _, zone := range []string{reverseZoneIPv4, reverseZoneIPv6} {
+			mux.HandleFunc(zone, func(w dns.ResponseWriter, m *dns.Msg) { handler.reverse(queryContext(ctx, w), w, m) })
+		}
+	}
+
+	// ServeMux uses the most-specific handler that matches the zone, so our
+	// 'default' handler is the root zone (.)
+	mux.HandleFunc(".", func(w dns.ResponseWriter, m *dns.Msg) { handler.forwardOrIntercept(queryContext(ctx, w), w, m) })
+
+	return s.buildChain(mux)
+}
+
+func (s *Server) ListenAndServeContext(ctx context.Context) error {
+	s.started.Store(true)
+	g, ctx := errgroup.WithContext(ctx)
+
+	// Each socket gets its own server (and hence handler); with more than one
+	// listener, the kernel load-balances between them via SO_REUSEPORT
+	listeners := s.listeners()
+	var servers []*dns.Server
+	for i := 0; i < listeners; i++ {
+		for _, protocol := range []string{"tcp", "udp"} {
+			server := s.makeDNSServer(protocol, i)
+			server.ReusePort = listeners > 1
+			servers = append(servers, server)
+		}
+	}
+
+	// To accept PROXY protocol headers, we need to create the TCP listeners
+	// ourselves. Do this before starting anything so that we can bail out
+	// cleanly if it fails.
+	if s.config.ProxyProtocol {
+		for _, server := range servers {
+			if server.Net != "tcp" {
+				continue
+			}
+
+			listener, err := s.listenProxyProto(server.ReusePort)
+			if err != nil {
+				for _, other := range servers {
+					if other.Listener != nil {
+						_ = other.Listener.Close()
+					}
+				}
+				return err
+			}
+			server.Listener = listener
+		}
+	}
+
+	var bound sync.WaitGroup
+	bound.Add(len(servers))
+	for _, server := range servers {
+		server.NotifyStartedFunc = bound.Done
+	}
+	go func() {
+		bound.Wait()
+		close(s.listening)
+	}()
+
+	// Handlers have to exist before any queries arrive
+	s.reloadMu.Lock()
+	s.serveCtx = ctx
+	s.current().activate(ctx, listeners)
+	s.reloadMu.Unlock()
+
+	for _, server := range servers {
+		server := server
+		g.Go(func() error {
+			if server.Listener != nil {
+				return server.ActivateAndServe()
+			}
+			return server.ListenAndServe()
+		})
+	}
+
+	// Views share our dnstap, query and audit loggers, so they're started here
+	// rather than as one of each server's background tasks
+	if s.dnstap != nil {
+		go s.dnstap.run(ctx)
+	}
+	if s.queryLog != nil {
+		go s.queryLog.run(ctx)
+	}
+	if s.auditLog != nil {
+		go s.auditLog.run(ctx)
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.logger.Info("Context done: shutting down servers")
+		for _, server := range servers {
+			if err := server.Shutdown(); err != nil {
+				s.logger.Warn("failed to shutdown DNS server", zap.String("protocol", server.Net), zap.Error(err))
+			}
+		}
+	}()
+
+	err := g.Wait()
+
+	// Clean up only once the servers have stopped, so that nothing is still
+	// using the pools or adding to the caches
+	active := s.current()
+	active.closePool()
+	active.saveCache()
+	for _, view := range active.views {
+		view.server.closePool()
+		view.server.saveCache()
+	}
+
+	return err
+}
+
+// Listening returns a channel that's closed once the server is listening on
+// every socket, after ListenAndServeContext has been called.
+func (s *Server) Listening() <-chan struct{} {
+	return s.listening
+}
+
+// startBackgroundTasks starts the goroutines that maintain the server's state,
+// which run until the context is done.
+func (s *Server) startBackgroundTasks(ctx context.Context) {
+	if s.config.UpstreamHealthCheckPeriodSeconds > 0 {
+		go s.runHealthChecks(ctx)
+	}
+
+	if s.usesSystemUpstreams() {
+		go s.watchSystemUpstreams(ctx)
+	}
+}
+
+// startBlocklistRefreshes starts refreshing the blocklists that need it. Views
+// share the blocklists of the server they belong to, so only that server
+// refreshes them.
+func (s *Server) startBlocklistRefreshes(ctx context.Context) {
+	for _, list := range s.blocklists {
+		if list.config.RefreshSeconds > 0 {
+			go s.refreshBlocklist(ctx, list)
+		}
+	}
+}
+
+func (s *Server) closePool() {
+	if s.pool != nil {
+		s.pool.Close()
+	}
+}
+
+func (s *Server) listenProxyProto(reusePort bool) (net.Listener, error) {
+	listener, err := listenTCP(s.config.ListenAddr, reusePort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on TCP: %w", err)
+	}
+
+	proxyListener, err := newProxyProtoListener(listener, s.config.ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	return proxyListener, nil
+}
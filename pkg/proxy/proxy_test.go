@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// testUpstream is a DNS server that answers queries from a fixed set of
+// responses, for tests that forward queries upstream.
+type testUpstream struct {
+	addr      string
+	responses map[dns.Question]*dns.Msg
+}
+
+// newTestUpstream starts an upstream on a loopback UDP port, which answers
+// queries without a response of their own with an empty NOERROR.
+func newTestUpstream(t *testing.T) *testUpstream {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := &testUpstream{addr: conn.LocalAddr().String(), responses: make(map[dns.Question]*dns.Msg)}
+	server := &dns.Server{PacketConn: conn, Handler: upstream}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	return upstream
+}
+
+// respond sets the answer and authority sections of the response to a query.
+func (u *testUpstream) respond(name string, qtype uint16, rcode int, answer []dns.RR, ns []dns.RR) {
+	msg := new(dns.Msg)
+	msg.Rcode = rcode
+	msg.Answer = answer
+	msg.Ns = ns
+	u.responses[dns.Question{Name: dns.CanonicalName(name), Qtype: qtype, Qclass: dns.ClassINET}] = msg
+}
+
+func (u *testUpstream) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	question := req.Question[0]
+	question.Name = dns.CanonicalName(question.Name)
+
+	msg := new(dns.Msg)
+	if canned, ok := u.responses[question]; ok {
+		msg = canned.Copy()
+	}
+	msg.SetRcode(req, msg.Rcode)
+	if opt := req.IsEdns0(); opt != nil {
+		msg.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	_ = w.WriteMsg(msg)
+}
+
+// newTestServer creates a server with the config, without a resolver.
+func newTestServer(t *testing.T, config *Config) *Server {
+	t.Helper()
+
+	if config.ListenAddr == "" {
+		config.ListenAddr = "127.0.0.1:0"
+	}
+
+	server, err := New(zap.NewNop(), nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// testResponseWriter records the responses written to a client.
+type testResponseWriter struct {
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func newTestResponseWriter(client string) *testResponseWriter {
+	return &testResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 53000}}
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *testResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.msgs = append(w.msgs, msg)
+	return nil
+}
+
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(msg)
+}
+
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Longest possible PROXY protocol v1 header, including the CRLF
+	proxyProtoV1MaxLength = 107
+
+	proxyProtoHeaderTimeout = 5 * time.Second
+
+	proxyProtoV2CmdLocal = 0x0
+	proxyProtoV2CmdProxy = 0x1
+
+	proxyProtoV2FamilyTCP4 = 0x11
+	proxyProtoV2FamilyUDP4 = 0x12
+	proxyProtoV2FamilyTCP6 = 0x21
+	proxyProtoV2FamilyUDP6 = 0x22
+)
+
+var (
+	proxyProtoV1Prefix  = []byte("PROXY ")
+	proxyProtoV2Magic   = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errProxyProtoHeader = errors.New("invalid PROXY protocol header")
+)
+
+// listenTCP opens a TCP listener, optionally with SO_REUSEPORT set.
+func listenTCP(addr string, reusePort bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// proxyProtoListener wraps a listener to accept PROXY protocol (v1 or v2)
+// headers on incoming connections, such that the connection's remote address
+// is the real client address rather than that of the load balancer in front
+// of us.
+type proxyProtoListener struct {
+	net.Listener
+
+	// If non-empty, only connections from these networks are expected to
+	// send a PROXY protocol header; others are treated as direct connections
+	trusted []*net.IPNet
+}
+
+func newProxyProtoListener(l net.Listener, trustedCIDRs []string) (*proxyProtoListener, error) {
+	listener := &proxyProtoListener{Listener: l}
+	for _, cidr := range trustedCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol trusted CIDR '%s': %w", cidr, err)
+		}
+		listener.trusted = append(listener.trusted, network)
+	}
+
+	return listener, nil
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	// The header is parsed lazily on first use, so that a slow client can't
+	// block the accept loop
+	return &proxyProtoConn{Conn: conn, reader: bufio.NewReaderSize(conn, proxyProtoV1MaxLength)}, nil
+}
+
+// isTrusted returns true if the address may send a PROXY header. Nobody is
+// trusted if no CIDRs are given, as anyone could otherwise claim any address
+// and get around client ACLs.
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout)); err != nil {
+			c.err = err
+			return
+		}
+
+		c.remoteAddr, c.err = readProxyProtoHeader(c.reader)
+
+		// Clear the deadline; the DNS server sets its own before each read
+		if err := c.Conn.SetReadDeadline(time.Time{}); err != nil && c.err == nil {
+			c.err = err
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtoHeader reads a v1 or v2 PROXY protocol header, returning the
+// source address it contains. A nil address with no error means that the
+// header was valid but didn't specify an address (e.g. a health check).
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyProtoV1Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+
+	if bytes.Equal(prefix, proxyProtoV1Prefix) {
+		return readProxyProtoV1Header(r)
+	}
+
+	magic, err := r.Peek(len(proxyProtoV2Magic))
+	if err != nil || !bytes.Equal(magic, proxyProtoV2Magic) {
+		return nil, errProxyProtoHeader
+	}
+
+	return readProxyProtoV2Header(r)
+}
+
+func readProxyProtoV1Header(r *bufio.Reader) (net.Addr, error) {
+	// The reader's buffer is exactly the maximum header length, so this will
+	// fail rather than read forever if there's no newline
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errProxyProtoHeader, err)
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyProtoHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyProtoHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtoV2Header(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", errProxyProtoHeader, err)
+	}
+
+	version, command, family := header[12]>>4, header[12]&0xF, header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if version != 2 {
+		return nil, errProxyProtoHeader
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %w", errProxyProtoHeader, err)
+	}
+
+	switch command {
+	case proxyProtoV2CmdLocal:
+		return nil, nil
+	case proxyProtoV2CmdProxy:
+	default:
+		return nil, errProxyProtoHeader
+	}
+
+	// Any TLVs after the addresses are ignored
+	switch family {
+	case proxyProtoV2FamilyTCP4, proxyProtoV2FamilyUDP4:
+		if length < 12 {
+			return nil, errProxyProtoHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case proxyProtoV2FamilyTCP6, proxyProtoV2FamilyUDP6:
+		if length < 36 {
+			return nil, errProxyProtoHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// Unix sockets and unspecified families don't give us a useful address
+		return nil, nil
+	}
+}
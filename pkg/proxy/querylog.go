@@ -0,0 +1,416 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/iplist"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Log entries are dropped rather than blocking queries once this many are
+// waiting to be written
+const jsonLogQueueSize = 4096
+
+// queryLogEntry is a line of the query log.
+type queryLogEntry struct {
+	Time         time.Time `json:"time"`
+	Client       string    `json:"client"`
+	Protocol     string    `json:"protocol"`
+	Name         string    `json:"qname"`
+	Type         string    `json:"qtype"`
+	Rcode        string    `json:"rcode"`
+	Intercepted  bool      `json:"intercepted"`
+	TailscaleIPs []string  `json:"tailscale_ips,omitempty"`
+	Upstream     string    `json:"upstream,omitempty"`
+	LatencyMs    float64   `json:"latency_ms"`
+	TraceID      string    `json:"trace_id,omitempty"`
+}
+
+// Phases of handling a query that we time, for the slow query log
+const (
+	phaseUpstream = iota
+	phaseResolver
+	phaseWrite
+	numPhases
+)
+
+// queryRecord collects what happened to a query as it passes through the
+// handlers, for the query log and slow query log.
+type queryRecord struct {
+	mu          sync.Mutex
+	intercepted bool
+	upstream    string
+	response    *dns.Msg
+	phases      [numPhases]time.Duration
+
+	// ID sent upstream with the query, if tracing is enabled
+	traceID string
+
+	// Objects the resolver used for the mappings we looked up, and the
+	// rewrite we made with them (if any), for the audit log
+	evidence []string
+	rewrite  *rewriteRecord
+
+	// What happened to the query, step by step, if it's being traced
+	trace *queryTrace
+}
+
+type queryRecordKey struct{}
+
+// queryRecordFrom finds the record of the query that the writer responds to,
+// if the query is being recorded.
+func queryRecordFrom(w dns.ResponseWriter) *queryRecord {
+	for {
+		switch writer := w.(type) {
+		case *recordingWriter:
+			return writer.record
+		case interface{ Unwrap() dns.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// queryContext returns a context carrying the query's record, if the query is
+// being recorded.
+func queryContext(ctx context.Context, w dns.ResponseWriter) context.Context {
+	if record := queryRecordFrom(w); record != nil {
+		return context.WithValue(ctx, queryRecordKey{}, record)
+	}
+	return ctx
+}
+
+func recordFromContext(ctx context.Context) *queryRecord {
+	record, _ := ctx.Value(queryRecordKey{}).(*queryRecord)
+	return record
+}
+
+// recordUpstream notes the upstream that answered the query. Only the first
+// upstream is kept, so that lookups made while validating the answer don't
+// replace it.
+func recordUpstream(ctx context.Context, u *upstream) {
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		defer record.mu.Unlock()
+		if record.upstream == "" {
+			record.upstream = u.name
+		}
+	}
+}
+
+// recordPhase adds the time since start to the given phase of the query.
+// Phases can run several times (or in parallel) for one query, so this is
+// the total time spent in them.
+func recordPhase(ctx context.Context, phase int, start time.Time) {
+	recordPhaseDuration(recordFromContext(ctx), phase, time.Since(start))
+}
+
+func recordPhaseDuration(record *queryRecord, phase int, d time.Duration) {
+	if record != nil {
+		record.mu.Lock()
+		defer record.mu.Unlock()
+		record.phases[phase] += d
+	}
+}
+
+func recordIntercepted(ctx context.Context) {
+	if record := recordFromContext(ctx); record != nil {
+		record.mu.Lock()
+		defer record.mu.Unlock()
+		record.intercepted = true
+	}
+}
+
+// jsonLogger writes a log of JSON lines (e.g. the query log) in the
+// background, so that a slow disk never delays queries.
+type jsonLogger struct {
+	logger  *zap.Logger
+	name    string
+	file    *rotatingFile
+	entries chan any
+}
+
+func newJSONLogger(logger *zap.Logger, name string, file *rotatingFile) *jsonLogger {
+	return &jsonLogger{
+		logger:  logger,
+		name:    name,
+		file:    file,
+		entries: make(chan any, jsonLogQueueSize),
+	}
+}
+
+// newQueryLogger returns a query logger for the config, or nil if the query
+// log is disabled.
+func newQueryLogger(logger *zap.Logger, config *Config) *jsonLogger {
+	if config.QueryLogPath == "" {
+		return nil
+	}
+
+	return newJSONLogger(logger, "query log", &rotatingFile{
+		path:       config.QueryLogPath,
+		maxSize:    int64(config.QueryLogMaxSizeMB) * 1024 * 1024,
+		maxAge:     config.QueryLogMaxAgeSeconds,
+		maxBackups: config.QueryLogMaxBackups,
+	})
+}
+
+// log queues an entry to be written, returning false if it was dropped
+// because the queue is full.
+func (j *jsonLogger) log(entry any) bool {
+	select {
+	case j.entries <- entry:
+		return true
+	default:
+		return false
+	}
+}
+
+// run writes entries to the log until the context is done.
+func (j *jsonLogger) run(ctx context.Context) {
+	defer j.file.close()
+
+	for {
+		select {
+		case entry := <-j.entries:
+			line, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+
+			if err := j.file.write(append(line, '\n')); err != nil {
+				j.logger.Warn("failed to write "+j.name, zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recordsQueries returns true if anything needs a record of what happened to
+// each query: the query, audit or slow query logs, the query tail, or upstream
+// tracing.
+func (s *Server) recordsQueries() bool {
+	return s.queryLog != nil || s.auditLog != nil || s.queryTail != nil ||
+		s.config.SlowQueryThresholdMillis > 0 || s.tracingEnabled()
+}
+
+// queryRecorder records what happens to every query, and logs those that get
+// a response to the query log, the query tail and (if they were slow) the slow
+// query log.
+type queryRecorder struct {
+	server   *Server
+	protocol string
+	next     dns.Handler
+}
+
+func (q *queryRecorder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	start := time.Now()
+	writer := &recordingWriter{ResponseWriter: w, record: &queryRecord{}}
+	if q.server.tracingEnabled() {
+		writer.record.traceID = newTraceID()
+	}
+	q.next.ServeDNS(writer, req)
+	latency := time.Since(start)
+
+	record := writer.record
+	record.mu.Lock()
+	defer record.mu.Unlock()
+
+	// Queries that we dropped have nothing worth logging
+	if record.response == nil {
+		return
+	}
+
+	if q.server.isSlowQuery(latency) {
+		q.server.logSlowQuery(w, req, record, latency)
+	}
+
+	if record.rewrite != nil && q.server.auditLog != nil {
+		q.server.auditRewrite(w, req, record)
+	}
+
+	entry := &queryLogEntry{
+		Time:        start,
+		Protocol:    q.protocol,
+		Rcode:       dns.RcodeToString[record.response.Rcode],
+		Intercepted: record.intercepted,
+		Upstream:    record.upstream,
+		LatencyMs:   durationMillis(latency),
+		TraceID:     record.traceID,
+	}
+
+	if ip := addrIP(w.RemoteAddr()); ip != nil {
+		entry.Client = ip.String()
+	}
+
+	if len(req.Question) > 0 {
+		entry.Name = req.Question[0].Name
+		entry.Type = dns.Type(req.Question[0].Qtype).String()
+	}
+
+	for _, rr := range record.response.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+
+		if ip != nil && iplist.IsTailscaleIP(ip) {
+			entry.TailscaleIPs = append(entry.TailscaleIPs, ip.String())
+		}
+	}
+
+	if q.server.queryTail != nil {
+		q.server.queryTail.publish(entry)
+	}
+	if q.server.queryLog != nil {
+		_ = q.server.queryLog.log(entry)
+	}
+}
+
+type recordingWriter struct {
+	dns.ResponseWriter
+	record *queryRecord
+}
+
+func (w *recordingWriter) WriteMsg(msg *dns.Msg) error {
+	w.record.mu.Lock()
+	w.record.response = msg
+	w.record.mu.Unlock()
+
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// rotatingFile is a file that is rotated once it reaches a maximum size or
+// age, keeping a number of old files alongside it (path.1 being the newest).
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func (r *rotatingFile) write(p []byte) error {
+	if r.file != nil && r.needsRotation(len(p)) {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write to '%s': %w", r.path, err)
+	}
+	return nil
+}
+
+func (r *rotatingFile) needsRotation(pending int) bool {
+	return (r.maxSize > 0 && r.size+int64(pending) > r.maxSize) ||
+		(r.maxAge > 0 && time.Since(r.opened) > r.maxAge)
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %w", r.path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat '%s': %w", r.path, err)
+	}
+
+	r.file, r.size, r.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// rotate closes the current file and shifts it and its backups along,
+// deleting the oldest backup if there are too many.
+func (r *rotatingFile) rotate() error {
+	r.close()
+
+	if r.maxBackups < 1 {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove '%s': %w", r.path, err)
+		}
+		return nil
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate '%s': %w", r.path, err)
+	}
+	return nil
+}
+
+func (r *rotatingFile) close() {
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file = nil
+	}
+}
+
+// isSlowQuery returns true if a query that took the given time should go in
+// the slow query log, sampling one in every SlowQuerySampleEvery slow queries.
+func (s *Server) isSlowQuery(latency time.Duration) bool {
+	threshold := s.config.SlowQueryThresholdMillis
+	if threshold <= 0 || latency < threshold {
+		return false
+	}
+
+	every := uint64(max(s.config.SlowQuerySampleEvery, 1))
+	return s.slowQueries.Add(1)%every == 0
+}
+
+func (s *Server) logSlowQuery(w dns.ResponseWriter, req *dns.Msg, record *queryRecord, latency time.Duration) {
+	fields := []zap.Field{
+		zap.Stringer("client", w.RemoteAddr()),
+		zap.Duration("latency", latency),
+		zap.String("rcode", dns.RcodeToString[record.response.Rcode]),
+		zap.Bool("intercepted", record.intercepted),
+		zap.String("upstream", record.upstream),
+		zap.Duration("upstream_time", record.phases[phaseUpstream]),
+		zap.Duration("resolver_time", record.phases[phaseResolver]),
+		zap.Duration("write_time", record.phases[phaseWrite]),
+	}
+
+	if record.traceID != "" {
+		fields = append(fields, zap.String("trace_id", record.traceID))
+	}
+
+	if len(req.Question) > 0 {
+		fields = append(fields,
+			zap.String("qname", req.Question[0].Name),
+			zap.String("qtype", dns.Type(req.Question[0].Qtype).String()),
+		)
+	}
+
+	s.logger.Warn("slow query", fields...)
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+const (
+	// Entries are dropped for subscribers that fall this far behind
+	queryTailBufferSize = 256
+	// Number of recent queries kept for the admin API
+	recentQueriesSize = 100
+)
+
+// queryTail keeps the most recent queries, and passes every query on to
+// subscribers as it's answered, e.g. for tailing through the admin API.
+type queryTail struct {
+	mu          sync.Mutex
+	recent      [recentQueriesSize]*queryLogEntry
+	next        int
+	subscribers map[chan *queryLogEntry]struct{}
+}
+
+func newQueryTail() *queryTail {
+	return &queryTail{subscribers: make(map[chan *queryLogEntry]struct{})}
+}
+
+// EnableQueryTail starts keeping recent queries, in every view, for the admin
+// API and TailQueries. Without it, queries needn't be recorded at all, so it
+// must be called before the server starts.
+func (s *Server) EnableQueryTail() {
+	if s.queryTail != nil {
+		return
+	}
+
+	tail := newQueryTail()
+	s.queryTail = tail
+	for _, view := range s.views {
+		view.server.queryTail = tail
+	}
+}
+
+func (t *queryTail) publish(entry *queryLogEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.recent[t.next] = entry
+	t.next = (t.next + 1) % recentQueriesSize
+
+	for subscriber := range t.subscribers {
+		select {
+		case subscriber <- entry:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel of queries as they're answered, and a function
+// that must be called to unsubscribe.
+func (t *queryTail) subscribe() (<-chan *queryLogEntry, func()) {
+	subscriber := make(chan *queryLogEntry, queryTailBufferSize)
+
+	t.mu.Lock()
+	t.subscribers[subscriber] = struct{}{}
+	t.mu.Unlock()
+
+	return subscriber, func() {
+		t.mu.Lock()
+		delete(t.subscribers, subscriber)
+		t.mu.Unlock()
+	}
+}
+
+// recentQueries returns the most recent queries, oldest first.
+func (t *queryTail) recentQueries() []*queryLogEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := make([]*queryLogEntry, 0, recentQueriesSize)
+	for i := 0; i < recentQueriesSize; i++ {
+		if entry := t.recent[(t.next+i)%recentQueriesSize]; entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// TailQueries calls send with each query as it's answered, until the context
+// is done or send fails. It needs EnableQueryTail to have been called.
+func (s *Server) TailQueries(ctx context.Context, send func(entry any) error) error {
+	entries, unsubscribe := s.queryTail.subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case entry := <-entries:
+			if err := send(entry); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// serveQueryTail streams queries to the client as JSON lines until it goes
+// away.
+func (s *Server) serveQueryTail(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	_ = s.TailQueries(r.Context(), func(entry any) error {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+}
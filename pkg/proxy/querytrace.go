@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errNoTraceResponse = errors.New("query was dropped without a response")
+
+// TraceStep is something that happened while handling a traced query.
+type TraceStep struct {
+	Elapsed time.Duration
+	Message string
+}
+
+// QueryTrace is the result of tracing a query through the handlers.
+type QueryTrace struct {
+	Steps       []TraceStep
+	Intercepted bool
+	Upstream    string
+	Response    *dns.Msg
+}
+
+type queryTrace struct {
+	start time.Time
+	steps []TraceStep
+}
+
+// traceStep notes a step in handling the query, if it's being traced.
+func traceStep(ctx context.Context, format string, args ...any) {
+	record := recordFromContext(ctx)
+	if record == nil {
+		return
+	}
+
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	if record.trace != nil {
+		record.trace.steps = append(record.trace.steps, TraceStep{
+			Elapsed: time.Since(record.trace.start),
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+}
+
+// traceResponse notes a response, along with its answers, in the trace.
+func traceResponse(ctx context.Context, what string, resp *dns.Msg) {
+	if record := recordFromContext(ctx); record == nil || record.trace == nil {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s with %d answers", what, dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	for _, rr := range resp.Answer {
+		b.WriteString("\n\t")
+		b.WriteString(rr.String())
+	}
+	traceStep(ctx, "%s", b.String())
+}
+
+// traceLookup notes a resolver lookup in the trace.
+func traceLookup(ctx context.Context, key string, ips []net.IP, err error) {
+	switch {
+	case err != nil:
+		traceStep(ctx, "resolver lookup of %s failed: %v", key, err)
+	case len(ips) == 0:
+		traceStep(ctx, "resolver lookup of %s: no Tailscale IPs", key)
+	default:
+		traceStep(ctx, "resolver lookup of %s: %s", key, strings.Join(ipStrings(ips), ", "))
+	}
+}
+
+// TraceQuery sends a query from the given client through the server's
+// handlers, as if it had arrived over UDP, and returns what happened to it.
+// The query isn't logged anywhere.
+func (s *Server) TraceQuery(ctx context.Context, req *dns.Msg, client net.IP) (*QueryTrace, error) {
+	s = s.current()
+	record := &queryRecord{trace: &queryTrace{start: time.Now()}}
+	if s.tracingEnabled() {
+		record.traceID = newTraceID()
+	}
+
+	writer := &recordingWriter{
+		ResponseWriter: &traceWriter{remote: &net.UDPAddr{IP: client, Port: 53}},
+		record:         record,
+	}
+	s.makeChain(ctx, transportUDP).ServeDNS(writer, req)
+
+	record.mu.Lock()
+	defer record.mu.Unlock()
+
+	if record.response == nil {
+		return nil, errNoTraceResponse
+	}
+
+	return &QueryTrace{
+		Steps:       record.trace.steps,
+		Intercepted: record.intercepted,
+		Upstream:    record.upstream,
+		Response:    record.response,
+	}, nil
+}
+
+// traceWriter is a response writer for traced queries, which don't come from
+// a real client.
+type traceWriter struct {
+	remote net.Addr
+}
+
+func (w *traceWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4zero} }
+func (w *traceWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *traceWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (w *traceWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *traceWriter) Close() error                { return nil }
+func (w *traceWriter) TsigStatus() error           { return nil }
+func (w *traceWriter) TsigTimersOnly(bool)         {}
+func (w *traceWriter) Hijack()                     {}
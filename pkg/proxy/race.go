@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const queryStrategyRace = "race"
+
+var errNoUpstreams = errors.New("no upstreams configured")
+
+type raceResult struct {
+	upstream *upstream
+	resp     *dns.Msg
+	err      error
+}
+
+// isValidUpstreamResponse determines whether a response is good enough to win
+// a race: failures from one upstream shouldn't beat a real answer from another.
+func isValidUpstreamResponse(resp *dns.Msg) bool {
+	return resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
+
+// raceUpstreams sends the query to several upstreams in parallel, starting
+// each one after a hedge delay, and returns the first valid response.
+func (h *handler) raceUpstreams(ctx context.Context, group *upstreamGroup, req *dns.Msg) (*dns.Msg, error) {
+	candidates := group.selectUpstreams()
+	if n := h.server.config.UpstreamRaceCount; n > 0 && n < len(candidates) {
+		candidates = candidates[:n]
+	}
+
+	if len(candidates) == 0 {
+		return nil, errNoUpstreams
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hedgeDelay := h.server.config.UpstreamHedgeDelayMillis
+
+	// Buffered so that losing goroutines never block after we've returned
+	results := make(chan raceResult, len(candidates))
+	for i, upstream := range candidates {
+		i, upstream := i, upstream
+
+		go func() {
+			if delay := time.Duration(i) * hedgeDelay; delay > 0 {
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					results <- raceResult{upstream: upstream, err: ctx.Err()}
+					return
+				}
+			}
+
+			// Each exchange gets its own copy of the request, as packing a
+			// message isn't safe to do concurrently
+			resp, err := h.exchangeWithRetries(ctx, group.retry, upstream, req.Copy())
+			results <- raceResult{upstream: upstream, resp: resp, err: err}
+		}()
+	}
+
+	var fallback *dns.Msg
+	var errs []error
+	for range candidates {
+		result := <-results
+		if result.err != nil {
+			errs = append(errs, fmt.Errorf("upstream '%s': %w", result.upstream.name, result.err))
+			continue
+		}
+
+		if isValidUpstreamResponse(result.resp) {
+			h.server.logger.Debug("upstream won race", zap.String("upstream", result.upstream.name))
+			recordUpstream(ctx, result.upstream)
+			return result.resp, nil
+		}
+
+		if fallback == nil {
+			fallback = result.resp
+		}
+	}
+
+	// No upstream gave a valid answer, but if any of them answered at all then
+	// we should pass on what they said
+	if fallback != nil {
+		return fallback, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
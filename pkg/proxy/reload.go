@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Extra time that retired generations' connection pools are kept open for,
+// beyond the upstream timeout, so that queries in flight can finish
+const reloadDrainGrace = 5 * time.Second
+
+// reloadableHandler passes queries to the active generation's handler for
+// the socket.
+type reloadableHandler struct {
+	server   *Server
+	protocol string
+	index    int
+}
+
+func (h *reloadableHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	h.server.current().handlers[h.protocol][h.index].ServeDNS(w, req)
+}
+
+// current returns the server built from the latest config.
+func (s *Server) current() *Server {
+	if active := s.active.Load(); active != nil {
+		return active
+	}
+	return s
+}
+
+func (s *Server) listeners() int {
+	return max(s.config.Listeners, 1)
+}
+
+// activate builds the generation's handlers for each socket and starts its
+// background tasks. Queries are handled under the serve context, so that
+// they aren't cancelled when the generation is retired.
+func (s *Server) activate(serveCtx context.Context, listeners int) {
+	taskCtx, cancel := context.WithCancel(serveCtx)
+	s.stopTasks = cancel
+
+	s.handlers = make(map[string][]dns.Handler)
+	for i := 0; i < listeners; i++ {
+		for _, protocol := range []string{"tcp", "udp"} {
+			s.handlers[protocol] = append(s.handlers[protocol], s.makeServeChain(serveCtx, protocol))
+		}
+	}
+
+	s.startBackgroundTasks(taskCtx)
+	s.startBlocklistRefreshes(taskCtx)
+	for _, view := range s.views {
+		view.server.startBackgroundTasks(taskCtx)
+	}
+}
+
+// retire stops the generation's background tasks, and closes its connection
+// pools once queries still using them have had time to finish.
+func (s *Server) retire() {
+	if s.stopTasks != nil {
+		s.stopTasks()
+	}
+
+	drain := s.upstreamTotalTimeout() + reloadDrainGrace
+	time.AfterFunc(drain, func() {
+		s.closePool()
+		for _, view := range s.views {
+			view.server.closePool()
+		}
+	})
+}
+
+// Reload applies a new config without restarting the server: queries that
+// arrive afterwards are handled with the new config, while those in flight
+// finish with the old one. Cached responses are dropped, since they may not
+// be valid under the new config. Changes to how we listen (e.g. the listen
+// address) and to the dnstap, query and audit logs can't be applied, and are
+// logged and ignored until the next restart.
+func (s *Server) Reload(config *Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	next, err := New(s.logger, s.resolver, config)
+	if err != nil {
+		return fmt.Errorf("failed to apply new config: %w", err)
+	}
+
+	previous := s.current()
+	for _, field := range restartRequiredChanges(previous.config, config) {
+		s.logger.Warn("config change requires a restart to take effect", zap.String("field", field))
+	}
+
+	next.inherit(previous)
+	next.FlushCache("", "")
+
+	if s.serveCtx != nil {
+		next.activate(s.serveCtx, s.listeners())
+	}
+	s.active.Store(next)
+
+	if s.serveCtx != nil {
+		previous.retire()
+	}
+
+	s.logger.Info("reloaded config")
+	return nil
+}
+
+// inherit takes the state that outlives configs from the previous generation,
+// in the new one and its views.
+func (s *Server) inherit(previous *Server) {
+	servers := []*Server{s}
+	for _, view := range s.views {
+		servers = append(servers, view.server)
+	}
+
+	for _, server := range servers {
+		server.metrics = previous.metrics
+		server.dnstap = previous.dnstap
+		server.queryLog = previous.queryLog
+		server.auditLog = previous.auditLog
+		server.slo = previous.slo
+		server.queryTail = previous.queryTail
+		server.panicHandler = previous.panicHandler
+		server.interceptionHook = previous.interceptionHook
+		server.middleware = previous.middleware
+		server.interceptionDisabled.Store(previous.interceptionDisabled.Load())
+		server.started.Store(previous.started.Load())
+	}
+}
+
+// restartRequiredChanges returns the config fields that differ between the
+// configs but can't be reloaded.
+func restartRequiredChanges(old *Config, updated *Config) []string {
+	fields := []struct {
+		name     string
+		old, new any
+	}{
+		{"listen_addr", old.ListenAddr, updated.ListenAddr},
+		{"listeners", old.Listeners, updated.Listeners},
+		{"proxy_protocol", old.ProxyProtocol, updated.ProxyProtocol},
+		{"proxy_protocol_trusted_cidrs", old.ProxyProtocolTrustedCIDRs, updated.ProxyProtocolTrustedCIDRs},
+		{"drop_unknown_opcodes", old.DropUnknownOpcodes, updated.DropUnknownOpcodes},
+		{"tsig_keys", old.TSIGKeys, updated.TSIGKeys},
+		{"dnstap_socket_path", old.DnstapSocketPath, updated.DnstapSocketPath},
+		{"dnstap_file_path", old.DnstapFilePath, updated.DnstapFilePath},
+		{"query_log_path", old.QueryLogPath, updated.QueryLogPath},
+		{"audit_log_path", old.AuditLogPath, updated.AuditLogPath},
+	}
+
+	var changed []string
+	for _, field := range fields {
+		if !reflect.DeepEqual(field.old, field.new) {
+			changed = append(changed, field.name)
+		}
+	}
+	return changed
+}
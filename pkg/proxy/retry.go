@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// retryPolicy is how exchanges with a group of upstreams are retried.
+type retryPolicy struct {
+	retries    int
+	tryTimeout time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newRetryPolicy(config *Config) retryPolicy {
+	return retryPolicy{
+		retries:    config.UpstreamRetries,
+		tryTimeout: config.UpstreamTryTimeoutMillis,
+		backoff:    config.UpstreamRetryBackoffMillis,
+		maxBackoff: config.UpstreamRetryBackoffMaxMillis,
+	}
+}
+
+// newZoneRetryPolicy returns the retry policy of a forward zone's upstreams:
+// the default policy, with any settings the zone overrides.
+func newZoneRetryPolicy(config *Config, zone *ForwardZone) retryPolicy {
+	policy := newRetryPolicy(config)
+	if zone.UpstreamRetries != nil {
+		policy.retries = *zone.UpstreamRetries
+	}
+	if zone.UpstreamTryTimeoutMillis != nil {
+		policy.tryTimeout = *zone.UpstreamTryTimeoutMillis
+	}
+	if zone.UpstreamRetryBackoffMillis != nil {
+		policy.backoff = *zone.UpstreamRetryBackoffMillis
+	}
+	if zone.UpstreamRetryBackoffMaxMillis != nil {
+		policy.maxBackoff = *zone.UpstreamRetryBackoffMaxMillis
+	}
+	return policy
+}
+
+// exchangeWithRetries sends a query to a single upstream, retrying failed
+// exchanges (including SERVFAIL and REFUSED responses) according to the
+// upstream's retry policy. If every attempt fails, the result of the last
+// attempt is returned.
+func (h *handler) exchangeWithRetries(ctx context.Context, policy retryPolicy, u *upstream, req *dns.Msg) (*dns.Msg, error) {
+	backoff := policy.backoff
+
+	var resp *dns.Msg
+	var err error
+	for attempt := 0; attempt <= policy.retries; attempt++ {
+		if attempt > 0 && backoff > 0 {
+			if !sleepContext(ctx, backoff) {
+				return nil, context.Cause(ctx)
+			}
+
+			backoff *= 2
+			if policy.maxBackoff > 0 && backoff > policy.maxBackoff {
+				backoff = policy.maxBackoff
+			}
+		}
+
+		resp, err = h.exchangeOnce(ctx, u, req, policy.tryTimeout)
+		if err == nil && isValidUpstreamResponse(resp) {
+			return resp, nil
+		}
+
+		// No point retrying if we've run out of time altogether
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+	}
+
+	return resp, err
+}
+
+func (h *handler) exchangeOnce(ctx context.Context, u *upstream, req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return h.clients.exchange(ctx, u, req)
+}
+
+// sleepContext sleeps for the given duration, returning false if the context
+// was done before the duration elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	reverseZoneIPv4 = "in-addr.arpa."
+	reverseZoneIPv6 = "ip6.arpa."
+
+	// TTL of synthesized PTR records
+	reverseTTL = 300
+
+	// Number of Tailscale IPs whose intercepted names we remember
+	reverseNamesMaxEntries = 65536
+)
+
+// reverseNames remembers the names that we've handed out Tailscale IPs for,
+// so that PTR queries for those IPs can be answered with the name the client
+// actually used. Only the most recently used IPs are remembered, so that a
+// large tailnet (or a client querying lots of names) can't grow it forever.
+type reverseNames struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type reverseNameEntry struct {
+	ip   string
+	name string
+}
+
+func newReverseNames(maxEntries int) *reverseNames {
+	return &reverseNames{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (r *reverseNames) record(name string, ips []net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, ip := range ips {
+		key := ip.String()
+		if element, ok := r.entries[key]; ok {
+			element.Value.(*reverseNameEntry).name = dns.Fqdn(name)
+			r.lru.MoveToFront(element)
+			continue
+		}
+
+		r.entries[key] = r.lru.PushFront(&reverseNameEntry{ip: key, name: dns.Fqdn(name)})
+		for r.lru.Len() > r.maxEntries {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.entries, oldest.Value.(*reverseNameEntry).ip)
+		}
+	}
+}
+
+func (r *reverseNames) lookup(ip net.IP) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	element, ok := r.entries[ip.String()]
+	if !ok {
+		return "", false
+	}
+
+	r.lru.MoveToFront(element)
+	return element.Value.(*reverseNameEntry).name, true
+}
+
+// reverse answers PTR queries for Tailscale IPs that we know about, and
+// forwards everything else upstream.
+func (h *handler) reverse(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypePTR {
+		h.forward(ctx, w, req)
+		return
+	}
+
+	ip := reverseNameToIP(req.Question[0].Name)
+	if ip == nil {
+		h.forward(ctx, w, req)
+		return
+	}
+
+	names := h.server.namesForTailscaleIP(ip)
+	if len(names) == 0 {
+		h.forward(ctx, w, req)
+		return
+	}
+
+	msg := h.server.synthesizedReply(req)
+	for _, name := range names {
+		msg.Answer = append(msg.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: reverseTTL},
+			Ptr: dns.Fqdn(name),
+		})
+	}
+
+	h.writeMsg(w, req, msg)
+}
+
+// namesForTailscaleIP returns the names to give in PTR answers for the given
+// Tailscale IP: the name we last intercepted for it, followed by any names
+// from the resolver.
+func (s *Server) namesForTailscaleIP(ip net.IP) []string {
+	var names []string
+	if name, ok := s.reverseNames.lookup(ip); ok {
+		names = append(names, name)
+	}
+
+	if reverse, ok := s.resolver.(resolvers.ReverseResolver); ok {
+		resolved, err := reverse.GetNamesByTailscaleIP(ip)
+		if err != nil {
+			s.logger.Warn("failed to reverse resolve Tailscale IP", zap.Stringer("ip", ip), zap.Error(err))
+		}
+
+		for _, name := range resolved {
+			if len(names) == 0 || !strings.EqualFold(dns.Fqdn(name), names[0]) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// reverseNameToIP parses an in-addr.arpa or ip6.arpa name into an IP,
+// returning nil if the name isn't a complete reverse name.
+func reverseNameToIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	switch {
+	case strings.HasSuffix(name, "."+reverseZoneIPv4):
+		labels := strings.Split(strings.TrimSuffix(name, "."+reverseZoneIPv4), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(octet)
+		}
+		return ip
+	case strings.HasSuffix(name, "."+reverseZoneIPv6):
+		labels := strings.Split(strings.TrimSuffix(name, "."+reverseZoneIPv6), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+
+			// Labels are in reverse order, least significant nibble first
+			pos := len(labels) - 1 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(nibble) << 4
+			} else {
+				ip[pos/2] |= byte(nibble)
+			}
+		}
+		return ip
+	default:
+		return nil
+	}
+}
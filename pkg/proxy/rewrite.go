@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	rewriteActionReplaceIP   = "replace_ip"
+	rewriteActionReplaceName = "replace_name"
+	rewriteActionDrop        = "drop"
+)
+
+var (
+	errRewriteInvalidIP  = errors.New("replace_ip rewrite rules need an IP address as their value")
+	errRewriteNoName     = errors.New("replace_name rewrite rules need a name as their value")
+	errRewriteNoCriteria = errors.New("rewrite rules need at least one match criterion")
+)
+
+// rewriteRule is a compiled RewriteRule. Nil criteria match everything.
+type rewriteRule struct {
+	name       *regexp.Regexp
+	answerCIDR *net.IPNet
+	clientCIDR *net.IPNet
+
+	action string
+	ip     net.IP
+	target string
+}
+
+func compileRewriteRules(configs []RewriteRule) ([]*rewriteRule, error) {
+	rules := make([]*rewriteRule, 0, len(configs))
+	for i, config := range configs {
+		rule := &rewriteRule{action: config.Action}
+
+		if config.MatchName == "" && config.MatchAnswerCIDR == "" && config.MatchClientCIDR == "" {
+			return nil, fmt.Errorf("rewrite rule %d: %w", i, errRewriteNoCriteria)
+		}
+
+		var err error
+		if config.MatchName != "" {
+			if rule.name, err = regexp.Compile(config.MatchName); err != nil {
+				return nil, fmt.Errorf("rewrite rule %d: invalid name regex: %w", i, err)
+			}
+		}
+
+		if config.MatchAnswerCIDR != "" {
+			if _, rule.answerCIDR, err = net.ParseCIDR(config.MatchAnswerCIDR); err != nil {
+				return nil, fmt.Errorf("rewrite rule %d: invalid answer CIDR: %w", i, err)
+			}
+		}
+
+		if config.MatchClientCIDR != "" {
+			if _, rule.clientCIDR, err = net.ParseCIDR(config.MatchClientCIDR); err != nil {
+				return nil, fmt.Errorf("rewrite rule %d: invalid client CIDR: %w", i, err)
+			}
+		}
+
+		switch config.Action {
+		case rewriteActionReplaceIP:
+			if rule.ip = net.ParseIP(config.Value); rule.ip == nil {
+				return nil, fmt.Errorf("rewrite rule %d: %w", i, errRewriteInvalidIP)
+			}
+		case rewriteActionReplaceName:
+			if config.Value == "" {
+				return nil, fmt.Errorf("rewrite rule %d: %w", i, errRewriteNoName)
+			}
+			rule.target = dns.Fqdn(config.Value)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// matches returns true if the rule applies to the given answer record.
+func (r *rewriteRule) matches(qname string, client net.IP, rr dns.RR) bool {
+	if r.name != nil && !r.name.MatchString(qname) {
+		return false
+	}
+
+	if r.clientCIDR != nil && (client == nil || !r.clientCIDR.Contains(client)) {
+		return false
+	}
+
+	if r.answerCIDR != nil {
+		ips := answerIPs(&dns.Msg{Answer: []dns.RR{rr}})
+		if len(ips) == 0 || !r.answerCIDR.Contains(ips[0]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply applies the rule's action to the record, returning nil if the record
+// should be dropped.
+func (r *rewriteRule) apply(rr dns.RR) dns.RR {
+	switch r.action {
+	case rewriteActionDrop:
+		return nil
+	case rewriteActionReplaceIP:
+		// Only replace addresses of the same family, so that we never put an
+		// IPv6 address in an A record or vice versa
+		switch record := rr.(type) {
+		case *dns.A:
+			if ip4 := r.ip.To4(); ip4 != nil {
+				record.A = ip4
+			}
+		case *dns.AAAA:
+			if r.ip.To4() == nil {
+				record.AAAA = r.ip
+			}
+		}
+	case rewriteActionReplaceName:
+		switch record := rr.(type) {
+		case *dns.CNAME:
+			record.Target = r.target
+		case *dns.PTR:
+			record.Ptr = r.target
+		}
+	}
+
+	return rr
+}
+
+// applyRewriteRules rewrites the answer section of a response according to
+// the first matching rule for each record.
+func (s *Server) applyRewriteRules(w dns.ResponseWriter, req *dns.Msg, msg *dns.Msg) {
+	if len(s.rewriteRules) == 0 || len(req.Question) != 1 {
+		return
+	}
+
+	qname := req.Question[0].Name
+	client := addrIP(w.RemoteAddr())
+
+	answer := msg.Answer[:0]
+	for _, rr := range msg.Answer {
+		for _, rule := range s.rewriteRules {
+			if rule.matches(qname, client, rr) {
+				rr = rule.apply(rr)
+				break
+			}
+		}
+
+		if rr != nil {
+			answer = append(answer, rr)
+		}
+	}
+	msg.Answer = answer
+}
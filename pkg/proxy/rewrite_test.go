@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestApplyRewriteRules(t *testing.T) {
+	rules, err := compileRewriteRules([]RewriteRule{
+		{MatchName: `^drop\.`, Action: rewriteActionDrop},
+		{MatchAnswerCIDR: "10.0.0.0/8", MatchClientCIDR: "100.64.0.0/10", Action: rewriteActionReplaceIP, Value: "100.100.1.1"},
+		{MatchAnswerCIDR: "fd00::/8", Action: rewriteActionReplaceIP, Value: "192.0.2.9"},
+		{MatchName: `^old\.`, Action: rewriteActionReplaceName, Value: "new.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{rewriteRules: rules}
+
+	tests := []struct {
+		desc   string
+		name   string
+		client string
+		answer []string
+		want   []string
+	}{
+		{
+			desc:   "drop by name",
+			name:   "drop.example.com.",
+			client: "100.64.0.1",
+			answer: []string{"drop.example.com. 60 IN A 10.0.0.1"},
+			want:   nil,
+		},
+		{
+			desc:   "replace IP for matching client",
+			name:   "app.example.com.",
+			client: "100.64.0.1",
+			answer: []string{"app.example.com. 60 IN A 10.0.0.1", "app.example.com. 60 IN A 192.0.2.1"},
+			want:   []string{"app.example.com. 60 IN A 100.100.1.1", "app.example.com. 60 IN A 192.0.2.1"},
+		},
+		{
+			desc:   "leave IP for other clients",
+			name:   "app.example.com.",
+			client: "192.0.2.50",
+			answer: []string{"app.example.com. 60 IN A 10.0.0.1"},
+			want:   []string{"app.example.com. 60 IN A 10.0.0.1"},
+		},
+		{
+			desc:   "never put IPv4 in AAAA",
+			name:   "app.example.com.",
+			client: "192.0.2.50",
+			answer: []string{"app.example.com. 60 IN AAAA fd00::1"},
+			want:   []string{"app.example.com. 60 IN AAAA fd00::1"},
+		},
+		{
+			desc:   "replace CNAME target",
+			name:   "old.example.com.",
+			client: "192.0.2.50",
+			answer: []string{"old.example.com. 60 IN CNAME legacy.example.com."},
+			want:   []string{"old.example.com. 60 IN CNAME new.example.com."},
+		},
+	}
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeA)
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		for _, rr := range test.answer {
+			msg.Answer = append(msg.Answer, testRR(t, rr))
+		}
+
+		server.applyRewriteRules(newTestResponseWriter(test.client), req, msg)
+
+		var got []string
+		for _, rr := range msg.Answer {
+			got = append(got, strings.ReplaceAll(rr.String(), "\t", " "))
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestCompileRewriteRulesErrors(t *testing.T) {
+	tests := []RewriteRule{
+		{Action: rewriteActionDrop},
+		{MatchName: "(", Action: rewriteActionDrop},
+		{MatchAnswerCIDR: "10.0.0.0", Action: rewriteActionDrop},
+		{MatchName: "x", Action: rewriteActionReplaceIP, Value: "not-an-ip"},
+		{MatchName: "x", Action: rewriteActionReplaceName},
+	}
+	for i, rule := range tests {
+		if _, err := compileRewriteRules([]RewriteRule{rule}); err == nil {
+			t.Errorf("rule %d: expected an error", i)
+		}
+	}
+}
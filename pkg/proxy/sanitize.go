@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Largest query we'll accept. Real queries are far smaller, even with EDNS
+// options and padding; anything bigger is garbage or an attack.
+const maxQueryLength = 1232
+
+// sanitizer rejects malformed queries before they reach anything that might
+// forward or intercept them. The DNS server has already checked the section
+// counts in the header (one question, and at most one answer, one authority
+// and two additional records).
+type sanitizer struct {
+	server *Server
+	next   dns.Handler
+}
+
+func (s *sanitizer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if rcode, reason := checkQuery(req); rcode != dns.RcodeSuccess {
+		s.server.logger.Debug("rejecting malformed query",
+			zap.String("reason", reason),
+			zap.Stringer("client", w.RemoteAddr()),
+		)
+
+		msg := new(dns.Msg)
+		msg.SetRcode(req, rcode)
+
+		// BADVERS is an extended rcode, so needs an OPT record to carry it
+		if rcode == dns.RcodeBadVers {
+			msg.SetEdns0(defaultEDNSBufferSize, false)
+		}
+
+		// Don't use writeMsg: the query may be too broken to fit a response
+		// to it
+		if err := w.WriteMsg(msg); err != nil {
+			s.server.logger.Debug("failed to write response to malformed query", zap.Error(err))
+		}
+		return
+	}
+
+	s.next.ServeDNS(w, req)
+}
+
+// checkQuery returns a non-success rcode, and the reason for it, if the query
+// is malformed or something that we don't support.
+func checkQuery(req *dns.Msg) (int, string) {
+	if req.Opcode != dns.OpcodeQuery {
+		return dns.RcodeNotImplemented, "opcode is not QUERY"
+	}
+
+	if req.Len() > maxQueryLength {
+		return dns.RcodeFormatError, "query too long"
+	}
+
+	if len(req.Question) != 1 {
+		return dns.RcodeFormatError, "query must have exactly one question"
+	}
+
+	question := req.Question[0]
+	if _, ok := dns.IsDomainName(question.Name); !ok {
+		return dns.RcodeFormatError, "invalid query name"
+	}
+
+	switch question.Qtype {
+	case dns.TypeOPT, dns.TypeTSIG, dns.TypeTKEY, dns.TypeNone:
+		return dns.RcodeFormatError, "meta-type in question"
+	}
+
+	if question.Qclass != dns.ClassINET && question.Qclass != dns.ClassCHAOS {
+		return dns.RcodeRefused, "unsupported query class"
+	}
+
+	// Queries can only carry an answer (or authority) for IXFR, which is
+	// answered in full regardless
+	if len(req.Answer) > 0 {
+		return dns.RcodeFormatError, "query has records in its answer section"
+	}
+
+	// OPT is a pseudo-record that only belongs in the additional section
+	for _, rr := range req.Ns {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			return dns.RcodeFormatError, "OPT record outside the additional section"
+		}
+	}
+
+	var opts int
+	for _, rr := range req.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			opts++
+			if opt.Hdr.Name != "." {
+				return dns.RcodeFormatError, "OPT record not owned by root"
+			}
+			if opt.Version() != 0 {
+				return dns.RcodeBadVers, "unsupported EDNS version"
+			}
+		}
+	}
+
+	// RFC 6891 § 6.1.1
+	if opts > 1 {
+		return dns.RcodeFormatError, "more than one OPT record"
+	}
+
+	return dns.RcodeSuccess, ""
+}
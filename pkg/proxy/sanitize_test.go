@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func packQuery(t testing.TB, build func(msg *dns.Msg)) []byte {
+	t.Helper()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	build(msg)
+
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func FuzzCheckQuery(f *testing.F) {
+	f.Add(packQuery(f, func(*dns.Msg) {}))
+	f.Add(packQuery(f, func(msg *dns.Msg) { msg.SetEdns0(1232, true) }))
+
+	// Malformed QDCOUNTs: none, and more than the message holds
+	for _, count := range []uint16{0, 2, 0xffff} {
+		packed := packQuery(f, func(*dns.Msg) {})
+		binary.BigEndian.PutUint16(packed[4:], count)
+		f.Add(packed)
+	}
+	f.Add(packQuery(f, func(msg *dns.Msg) {
+		msg.Question = append(msg.Question, dns.Question{Name: "example.org.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	}))
+
+	// Oversized labels and names, which have to be spliced in by hand
+	packed := packQuery(f, func(*dns.Msg) {})
+	long := append([]byte{64}, strings.Repeat("a", 64)...)
+	f.Add(append(append(packed[:12:12], long...), packed[12:]...))
+	var name []byte
+	for i := 0; i < 5; i++ {
+		name = append(name, 63)
+		name = append(name, strings.Repeat("b", 63)...)
+	}
+	f.Add(append(append(packed[:12:12], name...), packed[12:]...))
+
+	// OPT records in the wrong sections, and too many of them
+	opt := func() *dns.OPT {
+		return &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: 1232}}
+	}
+	f.Add(packQuery(f, func(msg *dns.Msg) { msg.Answer = append(msg.Answer, opt()) }))
+	f.Add(packQuery(f, func(msg *dns.Msg) { msg.Ns = append(msg.Ns, opt()) }))
+	f.Add(packQuery(f, func(msg *dns.Msg) { msg.Extra = append(msg.Extra, opt(), opt()) }))
+	f.Add(packQuery(f, func(msg *dns.Msg) {
+		o := opt()
+		o.Hdr.Name = "example.com."
+		msg.Extra = append(msg.Extra, o)
+	}))
+	f.Add(packQuery(f, func(msg *dns.Msg) {
+		o := opt()
+		o.SetVersion(1)
+		msg.Extra = append(msg.Extra, o)
+	}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req := new(dns.Msg)
+		if err := req.Unpack(data); err != nil {
+			return
+		}
+
+		rcode, reason := checkQuery(req)
+		switch rcode {
+		case dns.RcodeSuccess, dns.RcodeFormatError, dns.RcodeNotImplemented, dns.RcodeRefused, dns.RcodeBadVers:
+		default:
+			t.Fatalf("unexpected rcode %s", dns.RcodeToString[rcode])
+		}
+		if (rcode == dns.RcodeSuccess) != (reason == "") {
+			t.Fatalf("rcode %s with reason %q", dns.RcodeToString[rcode], reason)
+		}
+
+		if again, _ := checkQuery(req); again != rcode {
+			t.Fatalf("rcode changed from %s to %s", dns.RcodeToString[rcode], dns.RcodeToString[again])
+		}
+	})
+}
+
+func TestCheckQuery(t *testing.T) {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: 1232}}
+
+	tests := []struct {
+		name  string
+		build func(msg *dns.Msg)
+		want  int
+	}{
+		{"plain query", func(*dns.Msg) {}, dns.RcodeSuccess},
+		{"EDNS query", func(msg *dns.Msg) { msg.SetEdns0(1232, true) }, dns.RcodeSuccess},
+		{"not a query", func(msg *dns.Msg) { msg.Opcode = dns.OpcodeNotify }, dns.RcodeNotImplemented},
+		{"no question", func(msg *dns.Msg) { msg.Question = nil }, dns.RcodeFormatError},
+		{"meta-type", func(msg *dns.Msg) { msg.Question[0].Qtype = dns.TypeOPT }, dns.RcodeFormatError},
+		{"other class", func(msg *dns.Msg) { msg.Question[0].Qclass = dns.ClassHESIOD }, dns.RcodeRefused},
+		{"OPT in answer", func(msg *dns.Msg) { msg.Answer = []dns.RR{opt} }, dns.RcodeFormatError},
+		{"OPT in authority", func(msg *dns.Msg) { msg.Ns = []dns.RR{opt} }, dns.RcodeFormatError},
+		{"two OPTs", func(msg *dns.Msg) { msg.Extra = []dns.RR{opt, opt} }, dns.RcodeFormatError},
+		{"EDNS version 1", func(msg *dns.Msg) {
+			o := *opt
+			o.SetVersion(1)
+			msg.Extra = []dns.RR{&o}
+		}, dns.RcodeBadVers},
+	}
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.com.", dns.TypeA)
+		test.build(msg)
+
+		if got, reason := checkQuery(msg); got != test.want {
+			t.Errorf("%s: got %s (%s), want %s", test.name, dns.RcodeToString[got], reason, dns.RcodeToString[test.want])
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	selectionStrategyRoundRobin    = "round_robin"
+	selectionStrategyWeighted      = "weighted"
+	selectionStrategyLowestLatency = "lowest_latency"
+
+	// Smoothing factor for the latency EWMA: higher values favour recent
+	// exchanges
+	latencyEWMAAlpha = 0.3
+)
+
+// latencyTracker keeps an exponentially weighted moving average of the
+// latency of successful exchanges with an upstream.
+type latencyTracker struct {
+	mu   sync.Mutex
+	ewma time.Duration
+}
+
+func (l *latencyTracker) record(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ewma == 0 {
+		l.ewma = latency
+		return
+	}
+
+	l.ewma = time.Duration(latencyEWMAAlpha*float64(latency) + (1-latencyEWMAAlpha)*float64(l.ewma))
+}
+
+func (l *latencyTracker) average() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ewma
+}
+
+// upstreamGroup is a list of upstreams that can answer the same queries,
+// ordered for each query according to the configured strategy.
+type upstreamGroup struct {
+	strategy string
+	next     atomic.Uint64
+
+	// The upstreams as given in the config, kept so that the group can be
+	// rebuilt when the system resolvers change
+	raw        []string
+	weights    []int
+	usesSystem bool
+
+	// How exchanges with the group's upstreams are retried
+	retry retryPolicy
+
+	mu        sync.RWMutex
+	upstreams []*upstream
+}
+
+func (g *upstreamGroup) members() []*upstream {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.upstreams
+}
+
+// replace swaps in a new list of upstreams, carrying over the health and
+// latency state of any upstreams that were already in the group.
+func (g *upstreamGroup) replace(upstreams []*upstream) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	previous := make(map[string]*upstream, len(g.upstreams))
+	for _, u := range g.upstreams {
+		previous[u.name] = u
+	}
+
+	for i, u := range upstreams {
+		if p, ok := previous[u.name]; ok {
+			p.weight = u.weight
+			upstreams[i] = p
+		}
+	}
+
+	g.upstreams = upstreams
+}
+
+// selectUpstreams returns the healthy upstreams in the order they should be
+// tried.
+func (g *upstreamGroup) selectUpstreams() []*upstream {
+	healthy := g.healthyUpstreams()
+	if len(healthy) <= 1 {
+		return healthy
+	}
+
+	// Never reorder the slice returned by healthyUpstreams, as it may be the
+	// server's own list of upstreams
+	ordered := make([]*upstream, len(healthy))
+
+	switch g.strategy {
+	case selectionStrategyRoundRobin:
+		start := int(g.next.Add(1) % uint64(len(healthy)))
+		for i := range healthy {
+			ordered[i] = healthy[(start+i)%len(healthy)]
+		}
+	case selectionStrategyWeighted:
+		ordered = weightedOrder(healthy)
+	case selectionStrategyLowestLatency:
+		copy(ordered, healthy)
+
+		// Upstreams we haven't measured yet have zero latency, so they sort
+		// first and get measured
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].latency.average() < ordered[j].latency.average()
+		})
+	default:
+		copy(ordered, healthy)
+	}
+
+	return ordered
+}
+
+// weightedOrder returns a random ordering of the upstreams, where upstreams
+// with a higher weight are more likely to come first.
+func weightedOrder(upstreams []*upstream) []*upstream {
+	remaining := make([]*upstream, len(upstreams))
+	copy(remaining, upstreams)
+
+	ordered := make([]*upstream, 0, len(upstreams))
+	for len(remaining) > 0 {
+		total := 0
+		for _, u := range remaining {
+			total += u.weight
+		}
+
+		pick := 0
+		if total > 0 {
+			r := rand.Intn(total) //nolint:gosec
+			for i, u := range remaining {
+				if r < u.weight {
+					pick = i
+					break
+				}
+				r -= u.weight
+			}
+		}
+
+		ordered = append(ordered, remaining[pick])
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+	}
+
+	return ordered
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/metrics"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// SLO windows are made of buckets of this width, covering the longest
+	// window (six hours)
+	sloBucketWidth = time.Minute
+	sloBuckets     = 360
+
+	defaultSLOObjective = 0.999
+)
+
+type sloWindow struct {
+	label    string
+	duration time.Duration
+}
+
+// sloWindows returns the windows over which we report success ratios and
+// burn rates, short and long as needed for multi-window burn rate alerts.
+func sloWindows() []sloWindow {
+	return []sloWindow{
+		{"5m", 5 * time.Minute},
+		{"30m", 30 * time.Minute},
+		{"1h", time.Hour},
+		{"6h", 6 * time.Hour},
+	}
+}
+
+type sloBucket struct {
+	start    time.Time
+	requests int
+	errors   int
+}
+
+// sloCounter counts good and bad events, both in total (for rate() in burn
+// rate alerts) and over rolling windows (for those without a metrics stack
+// that can do that).
+type sloCounter struct {
+	requests atomic.Uint64
+	errors   atomic.Uint64
+
+	mu      sync.Mutex
+	buckets [sloBuckets]sloBucket
+}
+
+func (c *sloCounter) record(good bool) {
+	c.requests.Add(1)
+	if !good {
+		c.errors.Add(1)
+	}
+
+	now := time.Now()
+	start := now.Truncate(sloBucketWidth)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bucket := &c.buckets[(start.UnixNano()/int64(sloBucketWidth))%sloBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = sloBucket{start: start}
+	}
+
+	bucket.requests++
+	if !good {
+		bucket.errors++
+	}
+}
+
+// window returns the requests and failures counted over the window.
+func (c *sloCounter) window(d time.Duration) (requests int, failures int) {
+	windowStart := time.Now().Add(-d)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, bucket := range c.buckets {
+		if bucket.start.After(windowStart) {
+			requests += bucket.requests
+			failures += bucket.errors
+		}
+	}
+	return requests, failures
+}
+
+// recordUpstreamSLO counts an exchange with an upstream towards its SLO.
+// Exchanges that we cancelled ourselves don't count.
+func recordUpstreamSLO(u *upstream, resp *dns.Msg, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	u.slo.record(err == nil && isValidUpstreamResponse(resp))
+}
+
+// recordResolution counts a query that we asked upstream about towards the
+// overall SLO: it fails if we couldn't get a response, or got SERVFAIL.
+func (s *Server) recordResolution(resp *dns.Msg, err error) {
+	s.slo.record(err == nil && resp.Rcode != dns.RcodeServerFailure)
+}
+
+func (s *Server) sloObjective() float64 {
+	if s.config.SLOObjective == 0 {
+		return defaultSLOObjective
+	}
+	return s.config.SLOObjective
+}
+
+// sloMetrics returns the SLO metrics, for the server overall (with an empty
+// upstream label) and for each upstream.
+func (s *Server) sloMetrics() []prometheus.Collector {
+	type scope struct {
+		upstream string
+		counter  *sloCounter
+	}
+
+	scopes := func() []scope {
+		scopes := []scope{{"", s.slo}}
+		active := s.current()
+		servers := []*Server{active}
+		for _, view := range active.views {
+			servers = append(servers, view.server)
+		}
+
+		// Upstreams are reported by name, as in the upstream stats
+		seen := make(map[string]bool)
+		for _, server := range servers {
+			for _, u := range server.allUpstreams() {
+				if !seen[u.name] {
+					seen[u.name] = true
+					scopes = append(scopes, scope{u.name, u.slo})
+				}
+			}
+		}
+		return scopes
+	}
+
+	objective := s.sloObjective()
+	windowSamples := func(value func(requests int, failures int) float64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, scope := range scopes() {
+				for _, window := range sloWindows() {
+					requests, failures := scope.counter.window(window.duration)
+					samples = append(samples, metrics.Sample{
+						LabelValues: []string{scope.upstream, window.label},
+						Value:       value(requests, failures),
+					})
+				}
+			}
+			return samples
+		}
+	}
+
+	errorRatio := func(requests int, failures int) float64 {
+		if requests == 0 {
+			return 0
+		}
+		return float64(failures) / float64(requests)
+	}
+
+	return []prometheus.Collector{
+		metrics.NewGaugeFunc(
+			metricsNamespace+"slo_objective",
+			"Target fraction of successful resolutions.",
+			func() []metrics.Sample { return []metrics.Sample{{Value: objective}} },
+		),
+		metrics.NewCounterFunc(
+			metricsNamespace+"slo_requests_total",
+			"Resolutions counted towards the SLO, overall (empty upstream) and by upstream.",
+			func() []metrics.Sample {
+				var samples []metrics.Sample
+				for _, scope := range scopes() {
+					samples = append(samples, metrics.Sample{LabelValues: []string{scope.upstream}, Value: float64(scope.counter.requests.Load())})
+				}
+				return samples
+			},
+			"upstream",
+		),
+		metrics.NewCounterFunc(
+			metricsNamespace+"slo_errors_total",
+			"Resolutions that failed, overall (empty upstream) and by upstream.",
+			func() []metrics.Sample {
+				var samples []metrics.Sample
+				for _, scope := range scopes() {
+					samples = append(samples, metrics.Sample{LabelValues: []string{scope.upstream}, Value: float64(scope.counter.errors.Load())})
+				}
+				return samples
+			},
+			"upstream",
+		),
+		metrics.NewGaugeFunc(
+			metricsNamespace+"slo_success_ratio",
+			"Fraction of resolutions that succeeded over each window; 1 if there were none.",
+			windowSamples(func(requests int, failures int) float64 { return 1 - errorRatio(requests, failures) }),
+			"upstream", "window",
+		),
+		metrics.NewGaugeFunc(
+			metricsNamespace+"slo_burn_rate",
+			"Rate at which the error budget is being spent over each window, where 1 spends exactly the budget.",
+			windowSamples(func(requests int, failures int) float64 { return errorRatio(requests, failures) / (1 - objective) }),
+			"upstream", "window",
+		),
+	}
+}
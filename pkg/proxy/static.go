@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultStaticTTL = 300
+
+	staticSOARefresh = 3600
+	staticSOARetry   = 600
+	staticSOAExpire  = 86400
+
+	// Maximum number of CNAMEs we'll follow within a static zone
+	maxStaticCNAMEDepth = 8
+)
+
+var errRecordOutsideZone = errors.New("record is outside of its static zone")
+
+// staticZone is a zone that we're authoritative for, serving records from the
+// config without ever contacting upstream.
+type staticZone struct {
+	origin  string
+	soa     *dns.SOA
+	ns      []dns.RR
+	records map[string][]dns.RR
+
+	// Names with no records of their own but with records below them (empty
+	// non-terminals), which exist as far as negative answers are concerned
+	emptyNonTerminals map[string]bool
+}
+
+func newStaticZone(config *StaticZone, serial uint32) (*staticZone, error) {
+	origin := dns.CanonicalName(config.Zone)
+
+	ttl := uint32(defaultStaticTTL)
+	if config.TTLSeconds > 0 {
+		ttl = ttlSeconds(config.TTLSeconds)
+	}
+
+	zone := &staticZone{
+		origin:            origin,
+		records:           make(map[string][]dns.RR),
+		emptyNonTerminals: make(map[string]bool),
+	}
+
+	nameservers := config.Nameservers
+	if len(nameservers) == 0 {
+		nameservers = []string{"ns." + origin}
+	}
+	for _, ns := range nameservers {
+		zone.ns = append(zone.ns, &dns.NS{
+			Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  dns.Fqdn(ns),
+		})
+	}
+
+	hostmaster := config.Hostmaster
+	if hostmaster == "" {
+		hostmaster = "hostmaster." + origin
+	}
+
+	zone.soa = &dns.SOA{
+		Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      dns.Fqdn(nameservers[0]),
+		Mbox:    dns.Fqdn(strings.Replace(hostmaster, "@", ".", 1)),
+		Serial:  serial,
+		Refresh: staticSOARefresh,
+		Retry:   staticSOARetry,
+		Expire:  staticSOAExpire,
+		Minttl:  ttl,
+	}
+
+	// Records are given in zone file format, relative to the zone's origin
+	parser := dns.NewZoneParser(strings.NewReader(strings.Join(config.Records, "\n")), origin, "")
+	parser.SetDefaultTTL(ttl)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		name := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(origin, name) {
+			return nil, fmt.Errorf("%w: '%s'", errRecordOutsideZone, rr.String())
+		}
+
+		rr.Header().Name = name
+		zone.records[name] = append(zone.records[name], rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse records for static zone '%s': %w", origin, err)
+	}
+
+	for name := range zone.records {
+		for offset, end := dns.NextLabel(name, 0); !end; offset, end = dns.NextLabel(name, offset) {
+			parent := name[offset:]
+			if parent == origin {
+				break
+			}
+			if _, ok := zone.records[parent]; !ok {
+				zone.emptyNonTerminals[parent] = true
+			}
+		}
+	}
+
+	return zone, nil
+}
+
+func (s *Server) makeStaticZones(configs []StaticZone) ([]*staticZone, error) {
+	serial := uint32(time.Now().Unix())
+
+	zones := make([]*staticZone, 0, len(configs))
+	for i := range configs {
+		zone, err := newStaticZone(&configs[i], serial)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// lookup finds the records for the given name and type, returning the records
+// and whether the name exists in the zone at all.
+func (z *staticZone) lookup(name string, qtype uint16) ([]dns.RR, bool) {
+	name = dns.CanonicalName(name)
+
+	if name == z.origin {
+		switch qtype {
+		case dns.TypeSOA:
+			return []dns.RR{z.soa}, true
+		case dns.TypeNS:
+			return z.ns, true
+		}
+	}
+
+	records, exists := z.records[name]
+	if name == z.origin || z.emptyNonTerminals[name] {
+		exists = true
+	}
+
+	var matching []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+			matching = append(matching, rr)
+		}
+	}
+
+	return matching, exists
+}
+
+// answer builds an authoritative response to the given query from the zone's
+// records.
+func (z *staticZone) answer(req *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.Authoritative = true
+
+	if len(req.Question) != 1 {
+		msg.Rcode = dns.RcodeFormatError
+		return msg
+	}
+
+	question := req.Question[0]
+	name := question.Name
+	for depth := 0; depth < maxStaticCNAMEDepth; depth++ {
+		records, exists := z.lookup(name, question.Qtype)
+		if len(records) > 0 {
+			msg.Answer = append(msg.Answer, dnsCopyAll(records)...)
+			return msg
+		}
+
+		// Follow CNAMEs, as long as they stay within this zone
+		cnames, _ := z.lookup(name, dns.TypeCNAME)
+		if len(cnames) > 0 && question.Qtype != dns.TypeCNAME {
+			msg.Answer = append(msg.Answer, dns.Copy(cnames[0]))
+
+			name = cnames[0].(*dns.CNAME).Target
+			if !dns.IsSubDomain(z.origin, dns.CanonicalName(name)) {
+				return msg
+			}
+			continue
+		}
+
+		// Negative answers carry our SOA so that they can be cached (RFC 2308)
+		if !exists && len(msg.Answer) == 0 {
+			msg.Rcode = dns.RcodeNameError
+		}
+		msg.Ns = []dns.RR{dns.Copy(z.soa)}
+		return msg
+	}
+
+	return msg
+}
+
+func dnsCopyAll(records []dns.RR) []dns.RR {
+	copied := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		copied = append(copied, dns.Copy(rr))
+	}
+	return copied
+}
+
+// authoritative answers queries for a static zone.
+func (h *handler) authoritative(w dns.ResponseWriter, req *dns.Msg, zone *staticZone) {
+	if len(req.Question) == 1 && (req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR) {
+		h.transfer(w, req, zone)
+		return
+	}
+
+	h.writeMsg(w, req, zone.answer(req))
+}
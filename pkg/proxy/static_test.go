@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStaticZoneAnswer(t *testing.T) {
+	zone, err := newStaticZone(&StaticZone{
+		Zone: "example.internal",
+		Records: []string{
+			"www IN A 192.0.2.1",
+			"alias IN CNAME www",
+			"outside IN CNAME www.example.com.",
+			"missing IN CNAME nowhere",
+			"_http._tcp.svc IN SRV 0 0 80 www",
+		},
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		soa     bool
+	}{
+		{"www.example.internal.", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"WWW.Example.Internal.", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"www.example.internal.", dns.TypeAAAA, dns.RcodeSuccess, 0, true},
+		{"nope.example.internal.", dns.TypeA, dns.RcodeNameError, 0, true},
+		{"below.www.example.internal.", dns.TypeA, dns.RcodeNameError, 0, true},
+
+		// Empty non-terminals exist, so have no data rather than no name
+		{"_tcp.svc.example.internal.", dns.TypeA, dns.RcodeSuccess, 0, true},
+		{"svc.example.internal.", dns.TypeSRV, dns.RcodeSuccess, 0, true},
+		{"_http._tcp.svc.example.internal.", dns.TypeSRV, dns.RcodeSuccess, 1, false},
+
+		// The apex always exists
+		{"example.internal.", dns.TypeA, dns.RcodeSuccess, 0, true},
+		{"example.internal.", dns.TypeSOA, dns.RcodeSuccess, 1, false},
+		{"example.internal.", dns.TypeNS, dns.RcodeSuccess, 1, false},
+
+		// CNAMEs are followed within the zone, and answers with a CNAME in
+		// them are never NXDOMAIN
+		{"alias.example.internal.", dns.TypeA, dns.RcodeSuccess, 2, false},
+		{"alias.example.internal.", dns.TypeAAAA, dns.RcodeSuccess, 1, true},
+		{"alias.example.internal.", dns.TypeCNAME, dns.RcodeSuccess, 1, false},
+		{"outside.example.internal.", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"missing.example.internal.", dns.TypeA, dns.RcodeSuccess, 1, true},
+	}
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		msg := zone.answer(req)
+
+		desc := test.name + " " + dns.TypeToString[test.qtype]
+		if msg.Rcode != test.rcode {
+			t.Errorf("%s: got rcode %s, want %s", desc, dns.RcodeToString[msg.Rcode], dns.RcodeToString[test.rcode])
+		}
+		if len(msg.Answer) != test.answers {
+			t.Errorf("%s: got %d answers, want %d", desc, len(msg.Answer), test.answers)
+		}
+		if hasSOA := len(msg.Ns) == 1 && msg.Ns[0].Header().Rrtype == dns.TypeSOA; hasSOA != test.soa {
+			t.Errorf("%s: got SOA in authority %t, want %t", desc, hasSOA, test.soa)
+		}
+		if !msg.Authoritative {
+			t.Errorf("%s: answer isn't authoritative", desc)
+		}
+	}
+}
+
+func TestStaticZoneRejectsRecordsOutsideZone(t *testing.T) {
+	_, err := newStaticZone(&StaticZone{Zone: "example.internal", Records: []string{"www.example.com. IN A 192.0.2.1"}}, 1)
+	if err == nil {
+		t.Error("expected an error for a record outside the zone")
+	}
+}
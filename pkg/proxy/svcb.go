@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/iplist"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Replace IP hints that map to Tailscale IPs with those Tailscale IPs
+	svcbHintsRewrite = "rewrite"
+	// Remove IP hints altogether, forcing clients to use A/AAAA queries
+	svcbHintsStrip = "strip"
+	// Leave IP hints untouched
+	svcbHintsPassthrough = "passthrough"
+)
+
+var errNoSVCBRewrites = errors.New("no SVCB/HTTPS IP hints needed rewriting")
+
+func isSVCBQuestion(req *dns.Msg) bool {
+	return len(req.Question) == 1 && (req.Question[0].Qtype == dns.TypeSVCB || req.Question[0].Qtype == dns.TypeHTTPS)
+}
+
+// doSVCBInterception rewrites or strips the ipv4hint and ipv6hint parameters
+// of SVCB and HTTPS records, so that clients which use the hints don't bypass
+// our rewritten A/AAAA answers and connect to the external IPs.
+func (h *handler) doSVCBInterception(ctx context.Context, req *dns.Msg, resp *dns.Msg) (*dns.Msg, error) {
+	policy := h.server.config.SVCBHints
+	if policy == "" {
+		policy = svcbHintsRewrite
+	}
+
+	if policy == svcbHintsPassthrough {
+		return nil, errNoSVCBRewrites
+	}
+
+	msg := resp.Copy()
+	changed := false
+	for _, answer := range msg.Answer {
+		var svcb *dns.SVCB
+		switch rr := answer.(type) {
+		case *dns.SVCB:
+			svcb = rr
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		default:
+			continue
+		}
+
+		values := make([]dns.SVCBKeyValue, 0, len(svcb.Value))
+		for _, value := range svcb.Value {
+			switch hint := value.(type) {
+			case *dns.SVCBIPv4Hint:
+				if policy == svcbHintsStrip {
+					changed = true
+					continue
+				}
+
+				ips, err := h.tailscaleIPsForHints(ctx, req.Question[0].Name, hint.Hint, iplist.FilterIPv4Only)
+				if err != nil {
+					return nil, err
+				}
+				if ips != nil {
+					value = &dns.SVCBIPv4Hint{Hint: ips}
+					changed = true
+				}
+			case *dns.SVCBIPv6Hint:
+				if policy == svcbHintsStrip {
+					changed = true
+					continue
+				}
+
+				ips, err := h.tailscaleIPsForHints(ctx, req.Question[0].Name, hint.Hint, iplist.FilterIPv6Only)
+				if err != nil {
+					return nil, err
+				}
+				if ips != nil {
+					value = &dns.SVCBIPv6Hint{Hint: ips}
+					changed = true
+				}
+			}
+
+			values = append(values, value)
+		}
+		svcb.Value = values
+	}
+
+	if !changed {
+		return nil, errNoSVCBRewrites
+	}
+
+	return msg, nil
+}
+
+// tailscaleIPsForHints maps every hint IP to its Tailscale IPs of the same
+// family. As with A/AAAA answers, we don't mix Tailscale and non-Tailscale
+// IPs: if any hint has no Tailscale IPs, nil is returned.
+func (h *handler) tailscaleIPsForHints(ctx context.Context, name string, hints []net.IP, filter func([]net.IP) []net.IP) ([]net.IP, error) {
+	var tailscaleIPs []net.IP
+	for _, hint := range hints {
+		ips, err := h.server.lookupTailscaleIPs(ctx, name, hint)
+		if err != nil {
+			return nil, fmt.Errorf("error getting tailscale IPs: %w", err)
+		}
+
+		ips = filter(ips)
+		if len(ips) == 0 {
+			return nil, nil
+		}
+		tailscaleIPs = append(tailscaleIPs, ips...)
+	}
+
+	return tailscaleIPs, nil
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	// Upstream value that is replaced by the nameservers in resolv.conf
+	upstreamSystem = "system"
+
+	resolvConfPath = "/etc/resolv.conf"
+
+	// How often resolv.conf is checked for changes
+	resolvConfPollInterval = 30 * time.Second
+)
+
+var errNoSystemUpstreams = errors.New("no nameservers found in " + resolvConfPath)
+
+// readSystemUpstreams returns the nameservers in resolv.conf as upstream
+// addresses.
+func readSystemUpstreams() ([]string, error) {
+	cfg, err := dns.ClientConfigFromFile(resolvConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system resolvers: %w", err)
+	}
+
+	if len(cfg.Servers) == 0 {
+		return nil, errNoSystemUpstreams
+	}
+
+	upstreams := make([]string, 0, len(cfg.Servers))
+	for _, server := range cfg.Servers {
+		upstreams = append(upstreams, net.JoinHostPort(server, cfg.Port))
+	}
+
+	return upstreams, nil
+}
+
+// watchSystemUpstreams polls resolv.conf for changes until the context is
+// done, rebuilding any upstream groups that use the system resolvers.
+func (s *Server) watchSystemUpstreams(ctx context.Context) {
+	var lastModified time.Time
+	if info, err := os.Stat(resolvConfPath); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	ticker := time.NewTicker(resolvConfPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(resolvConfPath)
+			if err != nil {
+				s.logger.Warn("failed to stat resolv.conf", zap.Error(err))
+				continue
+			}
+
+			if info.ModTime().Equal(lastModified) {
+				continue
+			}
+			lastModified = info.ModTime()
+
+			if err := s.reloadSystemUpstreams(); err != nil {
+				// Keep using the previous resolvers: they're more likely to
+				// work than nothing at all
+				s.logger.Warn("failed to reload system resolvers", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) reloadSystemUpstreams() error {
+	system, err := readSystemUpstreams()
+	if err != nil {
+		return err
+	}
+
+	for _, group := range s.upstreamGroups() {
+		if !group.usesSystem {
+			continue
+		}
+
+		upstreams, err := s.parseUpstreams(group, system)
+		if err != nil {
+			return err
+		}
+		group.replace(upstreams)
+	}
+
+	s.logger.Info("reloaded system resolvers", zap.Strings("upstreams", system))
+	return nil
+}
+
+// usesSystemUpstreams returns true if any upstream group uses the system
+// resolvers.
+func (s *Server) usesSystemUpstreams() bool {
+	for _, group := range s.upstreamGroups() {
+		if group.usesSystem {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	errClientCertWithoutKey = errors.New("upstream TLS client certificate and key must be given together")
+	errNoCACertificates     = errors.New("no certificates found in upstream TLS CA bundle")
+)
+
+// makeUpstreamTLSConfig creates the base TLS config for DoT and DoH upstreams,
+// including the client certificate for mutual TLS and custom CA bundle, if
+// configured.
+func makeUpstreamTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if (config.UpstreamTLSClientCertFile == "") != (config.UpstreamTLSClientKeyFile == "") {
+		return nil, errClientCertWithoutKey
+	}
+
+	if config.UpstreamTLSClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.UpstreamTLSClientCertFile, config.UpstreamTLSClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream TLS client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.UpstreamTLSCAFile != "" {
+		pem, err := os.ReadFile(config.UpstreamTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream TLS CA bundle: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errNoCACertificates
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/miekg/dns"
+)
+
+// newTraceID returns a random ID for correlating a query with the queries we
+// make upstream for it.
+func newTraceID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// tracingEnabled returns true if trace IDs should be sent upstream.
+func (s *Server) tracingEnabled() bool {
+	return s.config.UpstreamTraceOptionCode != 0
+}
+
+// attachTraceID returns a copy of the upstream query carrying the query's
+// trace ID in an EDNS0 option, or the query itself if tracing is disabled.
+func (s *Server) attachTraceID(ctx context.Context, req *dns.Msg) *dns.Msg {
+	if !s.tracingEnabled() {
+		return req
+	}
+
+	record := recordFromContext(ctx)
+	if record == nil || record.traceID == "" {
+		return req
+	}
+
+	upstreamReq := req.Copy()
+	opt := upstreamReq.IsEdns0()
+	if opt == nil {
+		upstreamReq.SetEdns0(defaultEDNSBufferSize, false)
+		opt = upstreamReq.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: uint16(s.config.UpstreamTraceOptionCode),
+		Data: []byte(record.traceID),
+	})
+	return upstreamReq
+}
+
+// removeTraceOption removes our trace ID option from a message, e.g. if
+// upstream echoed it back to us.
+func (s *Server) removeTraceOption(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if !s.tracingEnabled() || opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == uint16(s.config.UpstreamTraceOptionCode) {
+			continue
+		}
+		options = append(options, option)
+	}
+	opt.Option = options
+}
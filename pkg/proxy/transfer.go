@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Number of records sent in each message of a zone transfer
+const transferChunkSize = 100
+
+// tsigSecrets returns the secrets of the configured TSIG keys, keyed by key
+// name, as the DNS server wants them.
+func (s *Server) tsigSecrets() map[string]string {
+	if len(s.config.TSIGKeys) == 0 {
+		return nil
+	}
+
+	secrets := make(map[string]string, len(s.config.TSIGKeys))
+	for _, key := range s.config.TSIGKeys {
+		secrets[dns.CanonicalName(key.Name)] = key.Secret
+	}
+	return secrets
+}
+
+// tsigAuthorized returns true if the request is signed with one of our TSIG
+// keys, using the algorithm configured for that key.
+func (s *Server) tsigAuthorized(w dns.ResponseWriter, req *dns.Msg) bool {
+	tsig := req.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		return false
+	}
+
+	for _, key := range s.config.TSIGKeys {
+		if dns.CanonicalName(key.Name) != dns.CanonicalName(tsig.Hdr.Name) {
+			continue
+		}
+
+		algorithm := key.Algorithm
+		if algorithm == "" {
+			algorithm = dns.HmacSHA256
+		}
+		return dns.CanonicalName(algorithm) == dns.CanonicalName(tsig.Algorithm)
+	}
+
+	return false
+}
+
+// transferRecords returns the records of the zone in AXFR order: the SOA,
+// followed by every other record, followed by the SOA again.
+func (z *staticZone) transferRecords() []dns.RR {
+	names := make([]string, 0, len(z.records))
+	for name := range z.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	records := []dns.RR{z.soa}
+	records = append(records, z.ns...)
+	for _, name := range names {
+		records = append(records, z.records[name]...)
+	}
+	return append(records, z.soa)
+}
+
+// transfer answers an AXFR (or IXFR, to which we always respond with the full
+// zone) request for a static zone. Transfers must be made over TCP and signed
+// with one of our TSIG keys.
+func (h *handler) transfer(w dns.ResponseWriter, req *dns.Msg, zone *staticZone) {
+	if w.LocalAddr().Network() != "tcp" || dns.CanonicalName(req.Question[0].Name) != zone.origin {
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeRefused)
+		h.writeMsg(w, req, msg)
+		return
+	}
+
+	if !h.server.tsigAuthorized(w, req) {
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeNotAuth)
+		h.writeMsg(w, req, msg)
+		return
+	}
+
+	records := dnsCopyAll(zone.transferRecords())
+
+	// Buffer every envelope up front, so that nothing blocks if the transfer
+	// fails part way through
+	envelopes := make(chan *dns.Envelope, len(records)/transferChunkSize+1)
+	for start := 0; start < len(records); start += transferChunkSize {
+		end := min(start+transferChunkSize, len(records))
+		envelopes <- &dns.Envelope{RR: records[start:end]}
+	}
+	close(envelopes)
+
+	if err := new(dns.Transfer).Out(w, req, envelopes); err != nil {
+		h.server.logger.Warn("zone transfer failed", zap.String("zone", zone.origin), zap.Error(err))
+	}
+}
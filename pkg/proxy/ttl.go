@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ttlSeconds converts a TTL from the config to whole seconds, as DNS TTLs
+// are, rounding up so that sub-second TTLs aren't taken as unset.
+func ttlSeconds(ttl time.Duration) uint32 {
+	return uint32((ttl + time.Second - 1) / time.Second)
+}
+
+// clampTTLs limits the TTLs of every record in a response to the configured
+// minimum and maximum, if set.
+func (s *Server) clampTTLs(msg *dns.Msg) {
+	minTTL := ttlSeconds(s.config.TTLMinSeconds)
+	maxTTL := ttlSeconds(s.config.TTLMaxSeconds)
+	if minTTL == 0 && maxTTL == 0 {
+		return
+	}
+
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+
+			// The TTL field of OPT records holds flags, not a TTL, and TSIG
+			// records are always sent with a zero TTL
+			if hdr.Rrtype == dns.TypeOPT || hdr.Rrtype == dns.TypeTSIG {
+				continue
+			}
+
+			if hdr.Ttl < minTTL {
+				hdr.Ttl = minTTL
+			}
+			if maxTTL > 0 && hdr.Ttl > maxTTL {
+				hdr.Ttl = maxTTL
+			}
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	// Transport used when an upstream doesn't specify one: queries are sent
+	// using the same protocol that the client used to reach us
+	transportInbound = ""
+	transportUDP     = "udp"
+	transportTCP     = "tcp"
+	transportTLS     = "tcp-tls"
+	transportHTTPS   = "https"
+
+	dohMediaType = "application/dns-message"
+
+	defaultUpstreamDialTimeout     = 2 * time.Second
+	defaultUpstreamReadTimeout     = 2 * time.Second
+	defaultUpstreamWriteTimeout    = 2 * time.Second
+	defaultUpstreamTotalTimeout    = 5 * time.Second
+	defaultUpstreamPoolIdleTimeout = 10 * time.Second
+)
+
+var (
+	errUnsupportedUpstreamScheme = errors.New("unsupported upstream scheme (must be one of udp, tcp, tls, https)")
+	errDoHBadStatus              = errors.New("DNS-over-HTTPS upstream returned non-200 status")
+	errUpstreamWeightsMismatch   = errors.New("number of upstream weights does not match number of upstreams")
+)
+
+// upstream is a single upstream DNS server, along with the transport we should
+// use to talk to it.
+type upstream struct {
+	// The upstream as written in the config; used for logging
+	name      string
+	transport string
+
+	// host:port for udp/tcp/tls upstreams, or the full URL for https upstreams
+	addr string
+
+	// Circuit breaker for the upstream; nil if circuit breaking is disabled
+	health *upstreamHealth
+
+	weight  int
+	latency *latencyTracker
+	stats   *upstreamStats
+	slo     *sloCounter
+}
+
+// parseUpstream parses an upstream of the form '[scheme://]host[:port]'. If no
+// scheme is given, the upstream uses whichever protocol the client queried us
+// with. Upstreams using the 'https' scheme are treated as DoH endpoint URLs.
+func parseUpstream(raw string) (*upstream, error) {
+	u := &upstream{name: raw, weight: 1, latency: &latencyTracker{}, stats: &upstreamStats{}, slo: &sloCounter{}}
+
+	scheme, rest, found := strings.Cut(raw, "://")
+	if !found {
+		u.transport = transportInbound
+		u.addr = withDefaultPort(raw, "53")
+		return u, nil
+	}
+
+	switch strings.ToLower(scheme) {
+	case "udp":
+		u.transport, u.addr = transportUDP, withDefaultPort(rest, "53")
+	case "tcp":
+		u.transport, u.addr = transportTCP, withDefaultPort(rest, "53")
+	case "tls":
+		u.transport, u.addr = transportTLS, withDefaultPort(rest, "853")
+	case "https":
+		u.transport, u.addr = transportHTTPS, raw
+	default:
+		return nil, fmt.Errorf("%w: '%s'", errUnsupportedUpstreamScheme, raw)
+	}
+
+	return u, nil
+}
+
+// parseUpstreams parses a list of upstreams from the config, expanding any
+// 'system' upstream into the given system resolvers.
+func parseUpstreams(raw []string, weights []int, system []string) ([]*upstream, error) {
+	if len(weights) > 0 && len(weights) != len(raw) {
+		return nil, errUpstreamWeightsMismatch
+	}
+
+	upstreams := make([]*upstream, 0, len(raw))
+	for i, r := range raw {
+		expanded := []string{r}
+		if r == upstreamSystem {
+			expanded = system
+		}
+
+		for _, e := range expanded {
+			u, err := parseUpstream(e)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(weights) > 0 {
+				u.weight = weights[i]
+			}
+
+			upstreams = append(upstreams, u)
+		}
+	}
+	return upstreams, nil
+}
+
+func withDefaultPort(addr string, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	// Strip brackets from bare IPv6 addresses so that JoinHostPort doesn't
+	// double them up
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// hostname returns the host part of the upstream's address, which is used as
+// the TLS server name.
+func (u *upstream) hostname() string {
+	host, _, err := net.SplitHostPort(u.addr)
+	if err != nil {
+		return u.addr
+	}
+	return host
+}
+
+// upstreamClients holds one DNS client per transport, so that upstreams can
+// be queried independently of the protocol the client used to reach us.
+type upstreamClients struct {
+	logger    *zap.Logger
+	metrics   *serverMetrics
+	dnstap    *dnstapLogger
+	inbound   string
+	tlsConfig *tls.Config
+	dns       map[string]*dns.Client
+	http      *http.Client
+	pool      *connPool
+	timeout   time.Duration
+
+	// Randomize the case of query names sent over plain UDP
+	randomizeCase bool
+}
+
+// durationOrDefault returns a duration from the config, or the default if it
+// isn't set.
+func durationOrDefault(d time.Duration, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+func (s *Server) upstreamDialTimeout() time.Duration {
+	return durationOrDefault(s.config.UpstreamDialTimeoutSeconds, defaultUpstreamDialTimeout)
+}
+
+func (s *Server) upstreamReadTimeout() time.Duration {
+	return durationOrDefault(s.config.UpstreamReadTimeoutSeconds, defaultUpstreamReadTimeout)
+}
+
+func (s *Server) upstreamWriteTimeout() time.Duration {
+	return durationOrDefault(s.config.UpstreamWriteTimeoutSeconds, defaultUpstreamWriteTimeout)
+}
+
+func (s *Server) upstreamTotalTimeout() time.Duration {
+	return durationOrDefault(s.config.UpstreamTotalTimeoutSeconds, defaultUpstreamTotalTimeout)
+}
+
+func (s *Server) makeUpstreamClients(inbound string) *upstreamClients {
+	clients := &upstreamClients{
+		logger:    s.logger,
+		metrics:   s.metrics,
+		dnstap:    s.dnstap,
+		inbound:   inbound,
+		tlsConfig: s.tlsConfig,
+		dns:       make(map[string]*dns.Client),
+		pool:      s.pool,
+		timeout:   s.upstreamDialTimeout() + s.upstreamReadTimeout() + s.upstreamWriteTimeout(),
+
+		randomizeCase: s.config.UpstreamRandomizeCase,
+	}
+
+	dialer := &net.Dialer{
+		Timeout:  s.upstreamDialTimeout(),
+		Resolver: s.bootstrapResolver,
+	}
+
+	for _, transport := range []string{transportUDP, transportTCP, transportTLS} {
+		clients.dns[transport] = &dns.Client{
+			Net:          transport,
+			DialTimeout:  s.upstreamDialTimeout(),
+			ReadTimeout:  s.upstreamReadTimeout(),
+			WriteTimeout: s.upstreamWriteTimeout(),
+		}
+
+		// The DNS client ignores DialTimeout if given a dialer, so we only do
+		// this when we need to (i.e. to resolve upstream hostnames ourselves)
+		if s.bootstrapResolver != nil {
+			clients.dns[transport].Dialer = dialer
+		}
+	}
+
+	clients.http = &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			DialContext:       dialer.DialContext,
+			TLSClientConfig:   s.tlsConfig.Clone(),
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	return clients
+}
+
+func (c *upstreamClients) exchange(ctx context.Context, u *upstream, req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := c.exchangeWithTransport(ctx, u, req)
+	latency := time.Since(start)
+	if err == nil {
+		u.latency.record(latency)
+	}
+	u.stats.record(resp, err, latency)
+	recordUpstreamSLO(u, resp, err)
+	c.metrics.observeUpstream(u, resp, latency, err)
+
+	if c.dnstap != nil {
+		c.dnstap.logUpstreamExchange(u, c.transportFor(u), req, resp, start)
+	}
+
+	if u.health.record(resp, err) {
+		c.logger.Warn("upstream marked unhealthy", zap.String("upstream", u.name), zap.Error(err))
+	}
+	return resp, err
+}
+
+// transportFor returns the transport used to talk to the upstream.
+func (c *upstreamClients) transportFor(u *upstream) string {
+	if u.transport == transportInbound {
+		return c.inbound
+	}
+	return u.transport
+}
+
+func (c *upstreamClients) exchangeWithTransport(ctx context.Context, u *upstream, req *dns.Msg) (*dns.Msg, error) {
+	switch transport := c.transportFor(u); transport {
+	case transportHTTPS:
+		return c.exchangeHTTPS(ctx, u, req)
+	case transportTLS:
+		// The TLS config depends on the upstream, so we need a copy of the
+		// client for each exchange
+		client := *c.dns[transportTLS]
+		client.TLSConfig = c.tlsConfig.Clone()
+		client.TLSConfig.ServerName = u.hostname()
+		return c.exchangeDNS(ctx, &client, u, req)
+	case transportUDP:
+		exchange := c.exchangeDNS
+		if c.randomizeCase {
+			exchange = c.exchangeRandomizedCase
+		}
+
+		resp, err := exchange(ctx, c.dns[transportUDP], u, req)
+		if err != nil || !resp.Truncated {
+			return resp, err
+		}
+
+		// Upstream couldn't fit the whole response in a UDP packet: retry over
+		// TCP so that we have the full answer to intercept and fit to the
+		// client ourselves
+		return c.exchangeDNS(ctx, c.dns[transportTCP], u, req)
+	default:
+		return c.exchangeDNS(ctx, c.dns[transport], u, req)
+	}
+}
+
+func (c *upstreamClients) exchangeDNS(ctx context.Context, client *dns.Client, u *upstream, req *dns.Msg) (*dns.Msg, error) {
+	// Only stream-based transports benefit from connection reuse
+	if c.pool != nil && client.Net != transportUDP {
+		return c.pool.exchange(ctx, client, u.addr, req)
+	}
+
+	resp, _, err := client.ExchangeContext(ctx, req, u.addr)
+	return resp, err
+}
+
+// exchangeHTTPS sends a query to a DNS-over-HTTPS upstream, as per RFC 8484.
+func (c *upstreamClients) exchangeHTTPS(ctx context.Context, u *upstream, req *dns.Msg) (*dns.Msg, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	// RFC 8484 recommends a zero ID to maximise HTTP cache friendliness
+	query := req.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS query: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.addr, bytes.NewReader(packed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DNS-over-HTTPS request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", dohMediaType)
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	httpResp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %d", errDoHBadStatus, httpResp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS-over-HTTPS response body: %w", err)
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("failed to unpack DNS-over-HTTPS response: %w", err)
+	}
+	resp.Id = req.Id
+
+	return resp, nil
+}
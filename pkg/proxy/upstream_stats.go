@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errAllUpstreamsFailing = errors.New("all upstreams are unhealthy or failing")
+
+const (
+	// Upstream stats cover a sliding window of this many buckets of the given
+	// width, i.e. the last five minutes
+	upstreamStatsBucketWidth = 10 * time.Second
+	upstreamStatsBuckets     = 30
+)
+
+// upstreamLatencyBounds returns the upper bounds of the latency histogram
+// buckets kept for each upstream.
+func upstreamLatencyBounds() []time.Duration {
+	return []time.Duration{
+		1 * time.Millisecond,
+		2500 * time.Microsecond,
+		5 * time.Millisecond,
+		10 * time.Millisecond,
+		25 * time.Millisecond,
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		250 * time.Millisecond,
+		500 * time.Millisecond,
+		1 * time.Second,
+		2500 * time.Millisecond,
+		5 * time.Second,
+	}
+}
+
+type upstreamStatsBucket struct {
+	start     time.Time
+	exchanges int
+	errors    int
+	servfails int
+
+	// Count of exchanges that got a response in each latency bucket, with one
+	// extra bucket for anything slower than the largest bound
+	latencies []int
+}
+
+// upstreamStats tracks the outcomes and latencies of exchanges with an
+// upstream over a sliding window.
+type upstreamStats struct {
+	mu      sync.Mutex
+	buckets [upstreamStatsBuckets]upstreamStatsBucket
+}
+
+// current returns the bucket for the current time, resetting it if it was
+// last used for an earlier window.
+func (s *upstreamStats) current(now time.Time) *upstreamStatsBucket {
+	start := now.Truncate(upstreamStatsBucketWidth)
+	bucket := &s.buckets[(start.UnixNano()/int64(upstreamStatsBucketWidth))%upstreamStatsBuckets]
+
+	if !bucket.start.Equal(start) {
+		*bucket = upstreamStatsBucket{start: start, latencies: make([]int, len(upstreamLatencyBounds())+1)}
+	}
+
+	return bucket
+}
+
+func (s *upstreamStats) record(resp *dns.Msg, err error, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.current(time.Now())
+	bucket.exchanges++
+
+	switch {
+	case err != nil:
+		bucket.errors++
+		return
+	case resp.Rcode == dns.RcodeServerFailure:
+		bucket.servfails++
+	}
+
+	bounds := upstreamLatencyBounds()
+	i := 0
+	for i < len(bounds) && latency > bounds[i] {
+		i++
+	}
+	bucket.latencies[i]++
+}
+
+// UpstreamStats describes the recent behaviour of an upstream.
+type UpstreamStats struct {
+	View    string `json:"view"`
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+
+	// Over the sliding window
+	WindowSeconds int     `json:"window_seconds"`
+	Exchanges     int     `json:"exchanges"`
+	Errors        int     `json:"errors"`
+	ServFails     int     `json:"servfails"`
+	SuccessRatio  float64 `json:"success_ratio"`
+	LatencyP50Ms  float64 `json:"latency_p50_ms"`
+	LatencyP95Ms  float64 `json:"latency_p95_ms"`
+	LatencyP99Ms  float64 `json:"latency_p99_ms"`
+
+	// Moving average used by the lowest-latency selection strategy
+	LatencyEWMAMs float64 `json:"latency_ewma_ms"`
+}
+
+func (s *upstreamStats) snapshot(u *upstream) UpstreamStats {
+	stats := UpstreamStats{
+		Name:          u.name,
+		Healthy:       u.health.healthy(),
+		WindowSeconds: int(upstreamStatsBuckets * upstreamStatsBucketWidth / time.Second),
+		LatencyEWMAMs: durationMillis(u.latency.average()),
+	}
+
+	bounds := upstreamLatencyBounds()
+	latencies := make([]int, len(bounds)+1)
+
+	s.mu.Lock()
+	windowStart := time.Now().Add(-upstreamStatsBuckets * upstreamStatsBucketWidth)
+	for _, bucket := range s.buckets {
+		if !bucket.start.After(windowStart) {
+			continue
+		}
+
+		stats.Exchanges += bucket.exchanges
+		stats.Errors += bucket.errors
+		stats.ServFails += bucket.servfails
+		for i, n := range bucket.latencies {
+			latencies[i] += n
+		}
+	}
+	s.mu.Unlock()
+
+	if stats.Exchanges > 0 {
+		stats.SuccessRatio = float64(stats.Exchanges-stats.Errors-stats.ServFails) / float64(stats.Exchanges)
+	}
+
+	stats.LatencyP50Ms = latencyQuantile(latencies, bounds, 0.5)
+	stats.LatencyP95Ms = latencyQuantile(latencies, bounds, 0.95)
+	stats.LatencyP99Ms = latencyQuantile(latencies, bounds, 0.99)
+
+	return stats
+}
+
+// latencyQuantile estimates a quantile of the latency histogram, in
+// milliseconds, as the upper bound of the bucket containing it. Latencies
+// above the largest bound are reported as that bound.
+func latencyQuantile(counts []int, bounds []time.Duration, q float64) float64 {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	cumulative := 0
+	for i, n := range counts {
+		cumulative += n
+		if float64(cumulative) >= rank {
+			return durationMillis(bounds[min(i, len(bounds)-1)])
+		}
+	}
+
+	return durationMillis(bounds[len(bounds)-1])
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// CheckUpstreams returns an error if every upstream is failing: either marked
+// unhealthy, or with no successful exchanges over the stats window despite
+// trying.
+func (s *Server) CheckUpstreams() error {
+	stats := s.UpstreamStats()
+	for _, u := range stats {
+		if u.Healthy && (u.Exchanges == 0 || u.SuccessRatio > 0) {
+			return nil
+		}
+	}
+
+	if len(stats) == 0 {
+		return nil
+	}
+
+	return errAllUpstreamsFailing
+}
+
+// UpstreamStats returns the recent behaviour of every upstream, including
+// those of views.
+func (s *Server) UpstreamStats() []UpstreamStats {
+	s = s.current()
+	servers := []*Server{s}
+	names := []string{""}
+	for _, view := range s.views {
+		servers = append(servers, view.server)
+		names = append(names, view.name)
+	}
+
+	var stats []UpstreamStats
+	for i, server := range servers {
+		// Forward zones may list the same upstreams as each other, but they're
+		// tracked separately; report the first of each
+		seen := make(map[string]bool)
+		for _, u := range server.allUpstreams() {
+			if seen[u.name] {
+				continue
+			}
+			seen[u.name] = true
+
+			snapshot := u.stats.snapshot(u)
+			snapshot.View = names[i]
+			stats = append(stats, snapshot)
+		}
+	}
+
+	return stats
+}
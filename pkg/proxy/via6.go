@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// Prefix of Tailscale's 4via6 addresses, which are made up of this prefix, a
+// 32-bit site ID, and an IPv4 address
+//
+//nolint:gochecknoglobals
+var via6Prefix = net.IP{0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 0x0b, 0x1a, 0, 0, 0, 0, 0, 0, 0, 0}
+
+type via6Site struct {
+	subnet *net.IPNet
+	siteID uint32
+}
+
+func makeVia6Sites(configs []Via6Site) ([]*via6Site, error) {
+	sites := make([]*via6Site, 0, len(configs))
+	for _, config := range configs {
+		_, subnet, err := net.ParseCIDR(config.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 4via6 subnet '%s': %w", config.Subnet, err)
+		}
+
+		sites = append(sites, &via6Site{subnet: subnet, siteID: uint32(config.SiteID)})
+	}
+
+	return sites, nil
+}
+
+// embed returns the 4via6 address through which the site's router reaches the
+// given IPv4 address.
+func (v *via6Site) embed(ip net.IP) net.IP {
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, via6Prefix)
+
+	ip6[8] = byte(v.siteID >> 24)
+	ip6[9] = byte(v.siteID >> 16)
+	ip6[10] = byte(v.siteID >> 8)
+	ip6[11] = byte(v.siteID)
+	copy(ip6[12:], ip.To4())
+
+	return ip6
+}
+
+// via6SiteFor returns the 4via6 site whose subnet contains the IP, if any. If
+// several do, the most specific subnet wins.
+func (s *Server) via6SiteFor(ip net.IP) *via6Site {
+	var best *via6Site
+	bestOnes := -1
+	for _, site := range s.via6Sites {
+		if !site.subnet.Contains(ip) {
+			continue
+		}
+
+		if ones, _ := site.subnet.Mask.Size(); ones > bestOnes {
+			best, bestOnes = site, ones
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// view is an alternative configuration of the server, used for queries from
+// particular clients.
+type view struct {
+	name    string
+	clients []*net.IPNet
+	server  *Server
+}
+
+func (s *Server) makeViews() ([]*view, error) {
+	views := make([]*view, 0, len(s.config.Views))
+	for i := range s.config.Views {
+		config := &s.config.Views[i]
+
+		clients, err := parseCIDRs(fmt.Sprintf("view '%s' client", config.Name), config.ClientCIDRs)
+		if err != nil {
+			return nil, err
+		}
+
+		server, err := New(s.logger.With(zap.String("view", config.Name)), s.resolver, s.viewConfig(config))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create view '%s': %w", config.Name, err)
+		}
+
+		// Blocklists can be large, so views share ours rather than loading
+		// their own copies
+		server.blocklists = s.blocklists
+		server.metrics = s.metrics
+		server.dnstap = s.dnstap
+		server.queryLog = s.queryLog
+		server.auditLog = s.auditLog
+		server.slo = s.slo
+		server.queryTail = s.queryTail
+
+		views = append(views, &view{name: config.Name, clients: clients, server: server})
+	}
+
+	return views, nil
+}
+
+// viewConfig returns the server config with the view's changes applied.
+func (s *Server) viewConfig(view *View) *Config {
+	config := *s.config
+	config.Views = nil
+	config.Blocklists = nil
+
+	if config.CachePersistPath != "" {
+		config.CachePersistPath += "." + view.Name
+	}
+
+	if view.DisableInterception {
+		config.ProxyZones = nil
+		config.ProxyPatterns = nil
+		config.AnswerWithoutUpstreamZones = nil
+	}
+
+	if len(view.Upstreams) > 0 {
+		config.Upstreams = view.Upstreams
+		config.UpstreamWeights = nil
+	}
+
+	if len(view.Overrides) > 0 {
+		config.Overrides = view.Overrides
+	}
+
+	return &config
+}
+
+// viewSelector passes queries to the handler of the first view that the
+// client belongs to, or to the default handler if there is none.
+type viewSelector struct {
+	views    []*view
+	handlers []dns.Handler
+	fallback dns.Handler
+}
+
+func (s *Server) makeViewSelector(ctx context.Context, protocol string, fallback dns.Handler) *viewSelector {
+	selector := &viewSelector{views: s.views, fallback: fallback}
+	for _, view := range s.views {
+		selector.handlers = append(selector.handlers, view.server.makeHandler(ctx, protocol))
+	}
+	return selector
+}
+
+func (v *viewSelector) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if ip := addrIP(w.RemoteAddr()); ip != nil {
+		for i, view := range v.views {
+			if containsIP(view.clients, ip) {
+				v.handlers[i].ServeDNS(w, req)
+				return
+			}
+		}
+	}
+
+	v.fallback.ServeDNS(w, req)
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type namedHandler struct {
+	name   string
+	served *string
+}
+
+func (h *namedHandler) ServeDNS(dns.ResponseWriter, *dns.Msg) {
+	*h.served = h.name
+}
+
+func TestViewSelector(t *testing.T) {
+	server := newTestServer(t, &Config{
+		Upstreams:  []string{"192.0.2.53"},
+		ProxyZones: []string{"example.com"},
+		Views: []View{
+			{Name: "kids", ClientCIDRs: []string{"100.64.1.0/24"}, Upstreams: []string{"192.0.2.54"}},
+			{Name: "guests", ClientCIDRs: []string{"100.64.0.0/16", "fd7a:115c:a1e0::/48"}, DisableInterception: true},
+		},
+	})
+
+	var served string
+	selector := &viewSelector{views: server.views, fallback: &namedHandler{name: "default", served: &served}}
+	for _, view := range server.views {
+		selector.handlers = append(selector.handlers, &namedHandler{name: view.name, served: &served})
+	}
+
+	tests := []struct {
+		client string
+		want   string
+	}{
+		// The first matching view wins, even if a later one is also a match
+		{"100.64.1.7", "kids"},
+		{"100.64.2.7", "guests"},
+		{"fd7a:115c:a1e0::1", "guests"},
+		{"100.65.0.1", "default"},
+		{"192.0.2.1", "default"},
+	}
+	for _, test := range tests {
+		served = ""
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		selector.ServeDNS(newTestResponseWriter(test.client), req)
+
+		if served != test.want {
+			t.Errorf("%s: served by %q, want %q", test.client, served, test.want)
+		}
+	}
+}
+
+func TestViewConfig(t *testing.T) {
+	server := newTestServer(t, &Config{
+		Upstreams:        []string{"192.0.2.53"},
+		UpstreamWeights:  []int{1},
+		ProxyZones:       []string{"example.com"},
+		CachePersistPath: "/var/cache/proxy",
+	})
+
+	kids := server.viewConfig(&View{Name: "kids", Upstreams: []string{"192.0.2.54"}})
+	if len(kids.Upstreams) != 1 || kids.Upstreams[0] != "192.0.2.54" || kids.UpstreamWeights != nil {
+		t.Errorf("kids view didn't replace upstreams: %v %v", kids.Upstreams, kids.UpstreamWeights)
+	}
+	if len(kids.ProxyZones) != 1 {
+		t.Errorf("kids view lost its proxy zones")
+	}
+	if kids.CachePersistPath != "/var/cache/proxy.kids" {
+		t.Errorf("got cache persist path %s", kids.CachePersistPath)
+	}
+
+	guests := server.viewConfig(&View{Name: "guests", DisableInterception: true})
+	if guests.ProxyZones != nil || guests.Upstreams[0] != "192.0.2.53" {
+		t.Errorf("guests view: got proxy zones %v and upstreams %v", guests.ProxyZones, guests.Upstreams)
+	}
+
+	// Views mustn't change the config they're derived from
+	if len(server.config.ProxyZones) != 1 || server.config.Upstreams[0] != "192.0.2.53" {
+		t.Error("view config changed the server's config")
+	}
+}
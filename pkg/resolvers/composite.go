@@ -0,0 +1,232 @@
+package resolvers
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prioritised is a resolver that takes part in a [CompositeResolver].
+type Prioritised struct {
+	Resolver Resolver
+	// Optional name, by which the resolver can be picked out with Named
+	Name string
+	// Resolvers with higher priorities are consulted first
+	Priority int
+	// If given, the resolver is only consulted for names in these zones
+	Zones []string
+}
+
+// CompositeResolver consults several resolvers in order of priority, using
+// the first that knows of a mapping, so that e.g. overrides from one resolver
+// beat discovery by another. It supports every optional interface, doing
+// nothing for resolvers that don't.
+type CompositeResolver struct {
+	resolvers []Prioritised
+}
+
+// NewCompositeResolver creates a resolver that consults the given resolvers in
+// order of priority. Resolvers with the same priority are consulted in the
+// order given.
+func NewCompositeResolver(resolvers ...Prioritised) *CompositeResolver {
+	sorted := make([]Prioritised, len(resolvers))
+	for i, r := range resolvers {
+		r.Zones = canonicalZones(r.Zones)
+		sorted[i] = r
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority > sorted[j].Priority })
+
+	return &CompositeResolver{resolvers: sorted}
+}
+
+func canonicalZones(zones []string) []string {
+	canonical := make([]string, len(zones))
+	for i, zone := range zones {
+		canonical[i] = dns.CanonicalName(zone)
+	}
+	return canonical
+}
+
+// inZones returns true if the name is in any of the zones, or if there are no
+// zones at all.
+func inZones(name string, zones []string) bool {
+	if len(zones) == 0 {
+		return true
+	}
+
+	name = dns.CanonicalName(name)
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForName returns a resolver that only consults the resolvers that are
+// consulted for the name, for looking up the answers to a query for it.
+func (c *CompositeResolver) ForName(name string) Resolver {
+	return c.forName(name)
+}
+
+func (c *CompositeResolver) forName(name string) *CompositeResolver {
+	var resolvers []Prioritised
+	for _, r := range c.resolvers {
+		if inZones(name, r.Zones) {
+			resolvers = append(resolvers, r)
+		}
+	}
+	return &CompositeResolver{resolvers: resolvers}
+}
+
+// Named returns the resolver with the given name, if there is one.
+func (c *CompositeResolver) Named(name string) (Resolver, bool) {
+	for _, r := range c.resolvers {
+		if r.Name != "" && r.Name == name {
+			return r.Resolver, true
+		}
+	}
+	return nil, false
+}
+
+func (c *CompositeResolver) GetTailscaleIPsByExternalIP(ip net.IP) ([]net.IP, error) {
+	ips, _, err := c.ExplainTailscaleIPsByExternalIP(ip)
+	return ips, err
+}
+
+func (c *CompositeResolver) ExplainTailscaleIPsByExternalIP(ip net.IP) ([]net.IP, []string, error) {
+	return c.first(func(r Resolver) ([]net.IP, []string, error) {
+		if explainer, ok := r.(EvidenceResolver); ok {
+			return explainer.ExplainTailscaleIPsByExternalIP(ip)
+		}
+		ips, err := r.GetTailscaleIPsByExternalIP(ip)
+		return ips, nil, err
+	})
+}
+
+func (c *CompositeResolver) GetTailscaleIPsByName(name string) ([]net.IP, error) {
+	ips, _, err := c.ExplainTailscaleIPsByName(name)
+	return ips, err
+}
+
+func (c *CompositeResolver) ExplainTailscaleIPsByName(name string) ([]net.IP, []string, error) {
+	return c.forName(name).first(func(r Resolver) ([]net.IP, []string, error) {
+		if explainer, ok := r.(EvidenceResolver); ok {
+			return explainer.ExplainTailscaleIPsByName(name)
+		}
+		if named, ok := r.(NameResolver); ok {
+			ips, err := named.GetTailscaleIPsByName(name)
+			return ips, nil, err
+		}
+		return nil, nil, nil
+	})
+}
+
+// first returns the result of the first resolver to return any IPs. Errors
+// are only returned if no resolver does, so that one failing resolver doesn't
+// stop the rest from being used.
+func (c *CompositeResolver) first(lookup func(Resolver) ([]net.IP, []string, error)) ([]net.IP, []string, error) {
+	var errs []error
+	for _, r := range c.resolvers {
+		ips, evidence, err := lookup(r.Resolver)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(ips) > 0 {
+			return ips, evidence, nil
+		}
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// GetNamesByTailscaleIP returns the names from every resolver, leaving out
+// those outside the resolver's zones.
+func (c *CompositeResolver) GetNamesByTailscaleIP(ip net.IP) ([]string, error) {
+	var names []string
+	var errs []error
+	for _, r := range c.resolvers {
+		reverse, ok := r.Resolver.(ReverseResolver)
+		if !ok {
+			continue
+		}
+
+		found, err := reverse.GetNamesByTailscaleIP(ip)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, name := range found {
+			if inZones(name, r.Zones) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	if len(names) > 0 {
+		return names, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Mappings lists the mappings of every resolver, highest priority first.
+func (c *CompositeResolver) Mappings() ([]Mapping, error) {
+	var mappings []Mapping
+	for _, r := range c.resolvers {
+		if lister, ok := r.Resolver.(MappingLister); ok {
+			listed, err := lister.Mappings()
+			if err != nil {
+				return nil, err
+			}
+			mappings = append(mappings, listed...)
+		}
+	}
+	return mappings, nil
+}
+
+// RegisterMetrics registers the metrics of every resolver, with a resolver
+// label telling them apart: the resolver's name, or its position in order of
+// priority if it has none.
+func (c *CompositeResolver) RegisterMetrics(registry prometheus.Registerer) {
+	for i, r := range c.resolvers {
+		reporter, ok := r.Resolver.(MetricsReporter)
+		if !ok {
+			continue
+		}
+
+		name := r.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		reporter.RegisterMetrics(prometheus.WrapRegistererWith(prometheus.Labels{"resolver": name}, registry))
+	}
+}
+
+// Ready returns an error if any of the resolvers isn't ready.
+func (c *CompositeResolver) Ready() error {
+	var errs []error
+	for _, r := range c.resolvers {
+		if checker, ok := r.Resolver.(ReadinessChecker); ok {
+			if err := checker.Ready(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Start starts every resolver that needs starting, in turn.
+func (c *CompositeResolver) Start(cancel <-chan struct{}) error {
+	for _, r := range c.resolvers {
+		if startable, ok := r.Resolver.(Startable); ok {
+			if err := startable.Start(cancel); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
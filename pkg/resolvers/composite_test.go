@@ -0,0 +1,55 @@
+package resolvers_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type countingResolver struct {
+	lookups prometheus.Counter
+}
+
+func newCountingResolver() *countingResolver {
+	return &countingResolver{lookups: prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "test_lookups_total",
+		Help: "Lookups.",
+	})}
+}
+
+func (r *countingResolver) GetTailscaleIPsByExternalIP(net.IP) ([]net.IP, error) {
+	r.lookups.Inc()
+	return nil, nil
+}
+
+func (r *countingResolver) RegisterMetrics(registry prometheus.Registerer) {
+	registry.MustRegister(r.lookups)
+}
+
+func TestCompositeRegisterMetricsLabelsResolvers(t *testing.T) {
+	named := newCountingResolver()
+	unnamed := newCountingResolver()
+	composite := resolvers.NewCompositeResolver(
+		resolvers.Prioritised{Resolver: named, Name: "cluster", Priority: 1},
+		resolvers.Prioritised{Resolver: unnamed},
+	)
+
+	registry := prometheus.NewPedanticRegistry()
+	composite.RegisterMetrics(registry)
+	if _, err := named.GetTailscaleIPsByExternalIP(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_lookups_total Lookups.
+# TYPE test_lookups_total counter
+test_lookups_total{resolver="1"} 0
+test_lookups_total{resolver="cluster"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,458 @@
+package resolvers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/iplist"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	indexByServicePath = "IndexByServicePath"
+	indexByExternalIP  = "IndexByExternalIp"
+	indexByTailscaleIP = "IndexByTailscaleIp"
+	indexByHostname    = "IndexByHostname"
+
+	defaultInformerResyncPeriod = 10 * time.Minute
+
+	labelTailscaleParentResource     = "tailscale.com/parent-resource"
+	labelTailscaleParentResourceNs   = "tailscale.com/parent-resource-ns"
+	labelTailscaleParentResourceType = "tailscale.com/parent-resource-type"
+
+	// Annotation used by external-dns to publish a Service under a hostname
+	annotationExternalDNSHostname = "external-dns.alpha.kubernetes.io/hostname"
+
+	// Key in tailscale-operator Secrets' data for device IPs
+	tailscaleSecretDataDeviceIps = "device_ips"
+	// Key in tailscale-operator Secrets' data for the device's MagicDNS name
+	tailscaleSecretDataDeviceFQDN = "device_fqdn"
+
+	typeService = "svc"
+
+	// Prefixes of the paths of objects given as evidence for mappings
+	evidenceService = "service/"
+	evidenceSecret  = "secret/"
+)
+
+func makeServicePath(namespace string, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+// normaliseHostname lowercases a hostname and strips any trailing dot, so that
+// names from DNS queries and from Kubernetes objects can be compared.
+func normaliseHostname(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+type KubernetesConfig struct {
+	// How often informers resync their caches (default 600)
+	InformerResyncPeriodSeconds time.Duration `mapstructure:"informer_resync_period_seconds"`
+	TailscaleOperatorNamespace  string        `mapstructure:"tailscale_operator_namespace"`
+	// Kubeconfig to connect to the cluster with, instead of the in-cluster
+	// config (or the default kubeconfig outside a cluster)
+	KubeconfigPath string `mapstructure:"kubeconfig_path"`
+	// Kubeconfig context to use, instead of the current context
+	Context string `mapstructure:"context"`
+}
+
+// KubernetesResolver is a [Resolver] that resolves Tailscale IPs from external
+// IPs by peeking at internal state of the tailscale-operator. This resolver is
+// able to map Services with an External (ingress) IP to the corresponding
+// Tailscale IP, provided the Service is exposed by the tailscale-operator.
+//
+// Note that this resolver must first be started before use with
+// [KubernetesResolver.StartAndWaitForCacheSync].
+// TODO implement self resolver func
+type KubernetesResolver struct {
+	serviceFactory  informers.SharedInformerFactory
+	secretInformer  cache.SharedIndexInformer
+	secretFactory   informers.SharedInformerFactory
+	serviceInformer cache.SharedIndexInformer
+
+	secretHealth  *informerHealth
+	serviceHealth *informerHealth
+
+	lookups *prometheus.CounterVec
+}
+
+func NewKubernetesResolverWithDefaultClient(config *KubernetesConfig) (*KubernetesResolver, error) {
+	kubeConfig, err := restConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	kube, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	return NewKubernetesResolverFromConfig(kube, config)
+}
+
+// restConfig returns the config for connecting to the cluster given by the
+// resolver's config, or to the cluster we're running in if it doesn't give one.
+func restConfig(config *KubernetesConfig) (*rest.Config, error) {
+	if config.KubeconfigPath != "" || config.Context != "" {
+		// The context alone picks out a context of the default kubeconfig
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = config.KubeconfigPath
+
+		clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			loadingRules,
+			&clientcmd.ConfigOverrides{CurrentContext: config.Context},
+		)
+
+		kubeConfig, err := clientConfig.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+		}
+		return kubeConfig, nil
+	}
+
+	// Try the in-cluster config first: this throws an error if we're not in the cluster,
+	// at which point we'll try loading the kubeconfig from default locations
+	// instead (user's home directory etc.)
+	kubeConfig, err := rest.InClusterConfig()
+	if err == nil {
+		return kubeConfig, nil
+	}
+	if !errors.Is(err, rest.ErrNotInCluster) {
+		return nil, fmt.Errorf("failed to create in-cluster kubeconfig: %w", err)
+	}
+
+	// We're not in a cluster: try loading kubeconfig from default locations
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{},
+	)
+
+	kubeConfig, err = clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("not in cluster and failed to load kubeconfig from default out-of-cluster locations: %w", err)
+	}
+	return kubeConfig, nil
+}
+
+func NewKubernetesResolverFromConfig(client kubernetes.Interface, config *KubernetesConfig) (*KubernetesResolver, error) {
+	resync := config.InformerResyncPeriodSeconds
+	if resync <= 0 {
+		resync = defaultInformerResyncPeriod
+	}
+
+	return NewKubernetesResolver(client, resync, config.TailscaleOperatorNamespace)
+}
+
+func NewKubernetesResolver(client kubernetes.Interface, resync time.Duration, tailscaleOperatorNamespace string) (*KubernetesResolver, error) {
+	registry := &KubernetesResolver{
+		secretHealth:  &informerHealth{kind: "secret"},
+		serviceHealth: &informerHealth{kind: "service"},
+		lookups:       newKubernetesLookupsCounter(),
+	}
+
+	// The informers are built by hand, rather than taken from the factories,
+	// so that their lists can be instrumented
+	registry.secretFactory = informers.NewSharedInformerFactoryWithOptions(client, resync,
+		informers.WithNamespace(tailscaleOperatorNamespace),
+	)
+	registry.secretInformer = registry.secretFactory.InformerFor(&corev1.Secret{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		secrets := client.CoreV1().Secrets(tailscaleOperatorNamespace)
+		return cache.NewSharedIndexInformer(
+			instrumentedListWatch(registry.secretHealth, secrets.List, secrets.Watch),
+			&corev1.Secret{},
+			resync,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		)
+	})
+
+	if err := registry.secretHealth.watch(registry.secretInformer); err != nil {
+		return nil, err
+	}
+
+	err := registry.secretInformer.AddIndexers(map[string]cache.IndexFunc{
+		indexByServicePath: func(obj interface{}) ([]string, error) {
+			secret := obj.(*corev1.Secret)
+
+			parentResource, ok := secret.Labels[labelTailscaleParentResource]
+			if !ok {
+				return nil, nil
+			}
+
+			parentResourceNs, ok := secret.Labels[labelTailscaleParentResourceNs]
+			if !ok {
+				return nil, nil
+			}
+
+			parentResourceType, ok := secret.Labels[labelTailscaleParentResourceType]
+			if !ok || parentResourceType != typeService {
+				return nil, nil
+			}
+
+			return []string{makeServicePath(parentResourceNs, parentResource)}, nil
+		},
+		indexByHostname: func(obj interface{}) ([]string, error) {
+			secret := obj.(*corev1.Secret)
+			if fqdn, ok := secret.Data[tailscaleSecretDataDeviceFQDN]; ok && len(fqdn) > 0 {
+				return []string{normaliseHostname(string(fqdn))}, nil
+			}
+			return nil, nil
+		},
+		indexByTailscaleIP: func(obj interface{}) ([]string, error) {
+			secret := obj.(*corev1.Secret)
+
+			ipsJSON, ok := secret.Data[tailscaleSecretDataDeviceIps]
+			if !ok {
+				return nil, nil
+			}
+
+			var ips []string
+			if err := json.Unmarshal(ipsJSON, &ips); err != nil {
+				// Not much we can do about a malformed secret; just don't index it
+				return nil, nil
+			}
+
+			return ips, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add secret informer indexers: %w", err)
+	}
+
+	registry.serviceFactory = informers.NewSharedInformerFactory(client, resync)
+	registry.serviceInformer = registry.serviceFactory.InformerFor(&corev1.Service{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		services := client.CoreV1().Services(metav1.NamespaceAll)
+		return cache.NewSharedIndexInformer(
+			instrumentedListWatch(registry.serviceHealth, services.List, services.Watch),
+			&corev1.Service{},
+			resync,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		)
+	})
+
+	if err := registry.serviceHealth.watch(registry.serviceInformer); err != nil {
+		return nil, err
+	}
+
+	err = registry.serviceInformer.AddIndexers(map[string]cache.IndexFunc{
+		indexByExternalIP: func(obj interface{}) ([]string, error) {
+			service := obj.(*corev1.Service)
+
+			var ips []string
+			for _, ingress := range service.Status.LoadBalancer.Ingress {
+				if ingress.IP != "" {
+					ips = append(ips, ingress.IP)
+				}
+			}
+
+			return ips, nil
+		},
+		indexByHostname: func(obj interface{}) ([]string, error) {
+			service := obj.(*corev1.Service)
+			hostnames, ok := service.Annotations[annotationExternalDNSHostname]
+			if !ok {
+				return nil, nil
+			}
+
+			var names []string
+			for _, hostname := range strings.Split(hostnames, ",") {
+				if hostname = strings.TrimSpace(hostname); hostname != "" {
+					names = append(names, normaliseHostname(hostname))
+				}
+			}
+
+			return names, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add service informer indexers: %w", err)
+	}
+
+	return registry, nil
+}
+
+func startAndWaitForCacheSync(factory informers.SharedInformerFactory, cancel <-chan struct{}) error {
+	factory.Start(cancel)
+
+	var syncErrors []error
+	for cache, ok := range factory.WaitForCacheSync(cancel) {
+		if !ok {
+			syncErrors = append(syncErrors, &CacheSyncError{cache: cache})
+		}
+	}
+
+	return errors.Join(syncErrors...)
+}
+
+func (r *KubernetesResolver) Start(cancel <-chan struct{}) error {
+	return errors.Join(
+		startAndWaitForCacheSync(r.secretFactory, cancel),
+		startAndWaitForCacheSync(r.serviceFactory, cancel),
+	)
+}
+
+func (r *KubernetesResolver) GetTailscaleIPsByService(serviceNamespace string, serviceName string) ([]string, error) {
+	ips, _, err := r.getTailscaleIPsByService(serviceNamespace, serviceName)
+	return ips, err
+}
+
+// getTailscaleIPsByService also returns the path of the Secret that the IPs
+// were found in.
+func (r *KubernetesResolver) getTailscaleIPsByService(serviceNamespace string, serviceName string) ([]string, string, error) {
+	secrets, err := r.secretInformer.GetIndexer().ByIndex(indexByServicePath, makeServicePath(serviceNamespace, serviceName))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query secret informer index: %w", err)
+	}
+
+	for _, secretI := range secrets {
+		secret := secretI.(*corev1.Secret)
+		ipsJSON, ok := secret.Data[tailscaleSecretDataDeviceIps]
+		if !ok {
+			// This secret doesn't have the device_ips key. This could be because it's
+			// not the secret we're looking for (unlikely), or because the corresponding
+			// tailscale pod hasn't come up yet
+			continue
+		}
+
+		var ips []string
+		if err := json.Unmarshal(ipsJSON, &ips); err != nil {
+			return nil, "", fmt.Errorf("failed to unmarshal tailscale-operator secret device IPs data: %w", err)
+		}
+
+		// XXX: We assume that there will only ever be one secret referring to this service here. I think
+		// that makes sense with the operator currently: there is only one replica of the tailscale pod
+		// in the replicaset, however that might change in future!
+		if len(ips) > 0 {
+			return ips, makeServicePath(secret.Namespace, secret.Name), nil
+		}
+	}
+
+	return nil, "", nil
+}
+
+func (r *KubernetesResolver) GetTailscaleIPsByExternalIP(externalIP net.IP) ([]net.IP, error) {
+	ips, _, err := r.ExplainTailscaleIPsByExternalIP(externalIP)
+	return ips, err
+}
+
+// ExplainTailscaleIPsByExternalIP is [KubernetesResolver.GetTailscaleIPsByExternalIP],
+// but also returns the Service and Secret that the mapping came from.
+func (r *KubernetesResolver) ExplainTailscaleIPsByExternalIP(externalIP net.IP) ([]net.IP, []string, error) {
+	ips, evidence, err := r.getTailscaleIPsByExternalIP(externalIP)
+	r.recordLookup(lookupByExternalIP, len(ips) > 0, err)
+	return ips, evidence, err
+}
+
+func (r *KubernetesResolver) getTailscaleIPsByExternalIP(externalIP net.IP) ([]net.IP, []string, error) {
+	services, err := r.serviceInformer.GetIndexer().ByIndex(indexByExternalIP, externalIP.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query service informer index: %w", err)
+	}
+
+	return r.tailscaleIPsOfServices(services)
+}
+
+// tailscaleIPsOfServices returns the Tailscale IPs of the first of the
+// Services that has any, along with the Service and Secret they came from.
+func (r *KubernetesResolver) tailscaleIPsOfServices(services []interface{}) ([]net.IP, []string, error) {
+	for _, serviceI := range services {
+		service := serviceI.(*corev1.Service)
+		ips, secretPath, err := r.getTailscaleIPsByService(service.Namespace, service.Name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get tailscale IPs for service '%s/%s': %w", service.Namespace, service.Name, err)
+		} else if len(ips) > 0 {
+			parsed, err := iplist.ParseIPs(ips)
+			return parsed, []string{evidenceService + makeServicePath(service.Namespace, service.Name), evidenceSecret + secretPath}, err
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// GetTailscaleIPsByName returns the Tailscale IPs for a name, which may be
+// either the MagicDNS name of a tailscale-operator device, or a hostname
+// that a Service exposed by the operator is published under with external-dns.
+func (r *KubernetesResolver) GetTailscaleIPsByName(name string) ([]net.IP, error) {
+	ips, _, err := r.ExplainTailscaleIPsByName(name)
+	return ips, err
+}
+
+// ExplainTailscaleIPsByName is [KubernetesResolver.GetTailscaleIPsByName], but
+// also returns the objects that the mapping came from.
+func (r *KubernetesResolver) ExplainTailscaleIPsByName(name string) ([]net.IP, []string, error) {
+	ips, evidence, err := r.getTailscaleIPsByName(normaliseHostname(name))
+	r.recordLookup(lookupByName, len(ips) > 0, err)
+	return ips, evidence, err
+}
+
+func (r *KubernetesResolver) getTailscaleIPsByName(name string) ([]net.IP, []string, error) {
+	secrets, err := r.secretInformer.GetIndexer().ByIndex(indexByHostname, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query secret informer index: %w", err)
+	}
+
+	for _, secretI := range secrets {
+		secret := secretI.(*corev1.Secret)
+		ipsJSON, ok := secret.Data[tailscaleSecretDataDeviceIps]
+		if !ok {
+			continue
+		}
+
+		var ips []string
+		if err := json.Unmarshal(ipsJSON, &ips); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal tailscale-operator secret device IPs data: %w", err)
+		}
+
+		if len(ips) > 0 {
+			parsed, err := iplist.ParseIPs(ips)
+			return parsed, []string{evidenceSecret + makeServicePath(secret.Namespace, secret.Name)}, err
+		}
+	}
+
+	services, err := r.serviceInformer.GetIndexer().ByIndex(indexByHostname, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query service informer index: %w", err)
+	}
+
+	return r.tailscaleIPsOfServices(services)
+}
+
+// GetNamesByTailscaleIP returns the MagicDNS name of the tailscale-operator
+// device with the given Tailscale IP, if any.
+func (r *KubernetesResolver) GetNamesByTailscaleIP(ip net.IP) ([]string, error) {
+	secrets, err := r.secretInformer.GetIndexer().ByIndex(indexByTailscaleIP, ip.String())
+	if err != nil {
+		r.recordLookup(lookupByTailscaleIP, false, err)
+		return nil, fmt.Errorf("failed to query secret informer index: %w", err)
+	}
+
+	var names []string
+	for _, secretI := range secrets {
+		secret := secretI.(*corev1.Secret)
+		if fqdn, ok := secret.Data[tailscaleSecretDataDeviceFQDN]; ok && len(fqdn) > 0 {
+			names = append(names, string(fqdn))
+		}
+	}
+
+	r.recordLookup(lookupByTailscaleIP, len(names) > 0, nil)
+	return names, nil
+}
+
+type CacheSyncError struct {
+	cache reflect.Type
+}
+
+func (c *CacheSyncError) Error() string {
+	return fmt.Sprintf("failed to sync informer cache of type '%v'", c.cache)
+}
@@ -0,0 +1,196 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// A watch that has been failing for longer than this, without the informer
+// managing to list or receive anything since, makes the resolver unready.
+// Reflectors retry with backoff, so shorter blips are expected.
+const informerWatchErrorGracePeriod = time.Minute
+
+var (
+	errInformerNotSynced = errors.New("informer has not synced")
+	errInformerStale     = errors.New("informer watch is failing")
+)
+
+// informerHealth tracks the lists and watch errors of an informer, so that a
+// broken watch (which otherwise just leaves the cache stale) is visible.
+type informerHealth struct {
+	kind string
+
+	mu             sync.Mutex
+	lists          int
+	listErrors     int
+	watchErrors    int
+	lastSync       time.Time
+	lastWatchError time.Time
+	lastError      error
+}
+
+// instrumentedListWatch builds a list-watch from a client's List and Watch,
+// recording lists in the health. Each list after the first is a relist, which
+// the reflector does when a watch can't resume.
+func instrumentedListWatch[T runtime.Object](h *informerHealth, list func(context.Context, metav1.ListOptions) (T, error), watchFn func(context.Context, metav1.ListOptions) (watch.Interface, error)) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			obj, err := list(context.TODO(), options)
+
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.lists++
+			if err != nil {
+				h.listErrors++
+				h.lastError = err
+				return nil, err
+			}
+
+			h.lastSync = time.Now()
+			return obj, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return watchFn(context.TODO(), options)
+		},
+	}
+}
+
+// watchErrorHandler records watch errors before logging them as usual.
+func (h *informerHealth) watchErrorHandler(r *cache.Reflector, err error) {
+	h.mu.Lock()
+	h.watchErrors++
+	h.lastWatchError = time.Now()
+	h.lastError = err
+	h.mu.Unlock()
+
+	cache.DefaultWatchErrorHandler(r, err)
+}
+
+// eventHandler returns a handler that counts any event (including periodic
+// resyncs) as evidence that the informer is up to date.
+func (h *informerHealth) eventHandler() cache.ResourceEventHandler {
+	touch := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.lastSync = time.Now()
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { touch() },
+		UpdateFunc: func(interface{}, interface{}) { touch() },
+		DeleteFunc: func(interface{}) { touch() },
+	}
+}
+
+// watch attaches the health tracking to an informer. It must be called before
+// the informer is started.
+func (h *informerHealth) watch(informer cache.SharedIndexInformer) error {
+	if err := informer.SetWatchErrorHandler(h.watchErrorHandler); err != nil {
+		return fmt.Errorf("failed to set %s informer watch error handler: %w", h.kind, err)
+	}
+
+	if _, err := informer.AddEventHandler(h.eventHandler()); err != nil {
+		return fmt.Errorf("failed to add %s informer event handler: %w", h.kind, err)
+	}
+
+	return nil
+}
+
+// ready returns an error if the informer hasn't synced, or if its watch has
+// been failing for a while without the informer recovering.
+func (h *informerHealth) ready(informer cache.SharedIndexInformer) error {
+	if !informer.HasSynced() {
+		return fmt.Errorf("%s %w", h.kind, errInformerNotSynced)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.lastWatchError.After(h.lastSync) && time.Since(h.lastSync) > informerWatchErrorGracePeriod {
+		return fmt.Errorf("%s %w since %s: %w", h.kind, errInformerStale, h.lastWatchError.Format(time.RFC3339), h.lastError)
+	}
+
+	return nil
+}
+
+// Ready returns an error if either informer's cache is missing or stale, in
+// which case the mappings we return can't be trusted.
+func (r *KubernetesResolver) Ready() error {
+	return errors.Join(
+		r.secretHealth.ready(r.secretInformer),
+		r.serviceHealth.ready(r.serviceInformer),
+	)
+}
+
+func (r *KubernetesResolver) informerHealthMetrics() []prometheus.Collector {
+	type informer struct {
+		health   *informerHealth
+		informer cache.SharedIndexInformer
+	}
+	informers := []informer{{r.secretHealth, r.secretInformer}, {r.serviceHealth, r.serviceInformer}}
+
+	samples := func(value func(h *informerHealth, i cache.SharedIndexInformer) float64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			samples := make([]metrics.Sample, 0, len(informers))
+			for _, i := range informers {
+				i.health.mu.Lock()
+				samples = append(samples, metrics.Sample{LabelValues: []string{i.health.kind}, Value: value(i.health, i.informer)})
+				i.health.mu.Unlock()
+			}
+			return samples
+		}
+	}
+
+	return []prometheus.Collector{
+		metrics.NewCounterFunc(
+			"tsdnsproxy_kubernetes_informer_lists_total",
+			"Lists made by each informer, including the initial list; any more are relists.",
+			samples(func(h *informerHealth, _ cache.SharedIndexInformer) float64 { return float64(h.lists) }),
+			"kind",
+		),
+		metrics.NewCounterFunc(
+			"tsdnsproxy_kubernetes_informer_list_errors_total",
+			"Lists made by each informer that failed.",
+			samples(func(h *informerHealth, _ cache.SharedIndexInformer) float64 { return float64(h.listErrors) }),
+			"kind",
+		),
+		metrics.NewCounterFunc(
+			"tsdnsproxy_kubernetes_informer_watch_errors_total",
+			"Errors from each informer's watch.",
+			samples(func(h *informerHealth, _ cache.SharedIndexInformer) float64 { return float64(h.watchErrors) }),
+			"kind",
+		),
+		metrics.NewGaugeFunc(
+			"tsdnsproxy_kubernetes_informer_last_sync_timestamp_seconds",
+			"Unix time each informer last listed successfully or received an event.",
+			samples(func(h *informerHealth, _ cache.SharedIndexInformer) float64 {
+				if h.lastSync.IsZero() {
+					return 0
+				}
+				return float64(h.lastSync.Unix())
+			}),
+			"kind",
+		),
+		metrics.NewGaugeFunc(
+			"tsdnsproxy_kubernetes_informer_synced",
+			"Whether each informer has completed its initial sync.",
+			samples(func(_ *informerHealth, i cache.SharedIndexInformer) float64 {
+				if i.HasSynced() {
+					return 1
+				}
+				return 0
+			}),
+			"kind",
+		),
+	}
+}
@@ -0,0 +1,68 @@
+package resolvers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Mappings returns a mapping for every external IP of a Service exposed by
+// the tailscale-operator, sorted by external IP.
+func (r *KubernetesResolver) Mappings() ([]Mapping, error) {
+	mappings := []Mapping{}
+	for _, obj := range r.serviceInformer.GetStore().List() {
+		service := obj.(*corev1.Service)
+
+		ips, secretPath, err := r.getTailscaleIPsByService(service.Namespace, service.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tailscale IPs for service '%s/%s': %w", service.Namespace, service.Name, err)
+		}
+		if len(ips) == 0 {
+			continue
+		}
+
+		names := r.serviceNames(service, secretPath)
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP == "" {
+				continue
+			}
+
+			mappings = append(mappings, Mapping{
+				ExternalIP:   ingress.IP,
+				TailscaleIPs: ips,
+				Names:        names,
+				Evidence: []string{
+					evidenceService + makeServicePath(service.Namespace, service.Name),
+					evidenceSecret + secretPath,
+				},
+			})
+		}
+	}
+
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].ExternalIP < mappings[j].ExternalIP
+	})
+
+	return mappings, nil
+}
+
+// serviceNames returns the names that resolve directly to a Service's
+// Tailscale IPs: its external-dns hostnames, and its device's MagicDNS name.
+func (r *KubernetesResolver) serviceNames(service *corev1.Service, secretPath string) []string {
+	var names []string
+	for _, hostname := range strings.Split(service.Annotations[annotationExternalDNSHostname], ",") {
+		if hostname = strings.TrimSpace(hostname); hostname != "" {
+			names = append(names, normaliseHostname(hostname))
+		}
+	}
+
+	if obj, ok, err := r.secretInformer.GetStore().GetByKey(secretPath); err == nil && ok {
+		if fqdn := obj.(*corev1.Secret).Data[tailscaleSecretDataDeviceFQDN]; len(fqdn) > 0 {
+			names = append(names, normaliseHostname(string(fqdn)))
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,82 @@
+package resolvers
+
+import (
+	"github.com/davejbax/tailscale-dns-proxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	lookupByExternalIP  = "external_ip"
+	lookupByName        = "name"
+	lookupByTailscaleIP = "tailscale_ip"
+)
+
+func newKubernetesLookupsCounter() *prometheus.CounterVec {
+	return metrics.NewCounterVec(
+		"tsdnsproxy_kubernetes_lookups_total",
+		"Lookups made against the Kubernetes resolver, by method and whether anything was found.",
+		"method", "result",
+	)
+}
+
+// recordLookup counts a lookup as a hit if it found anything.
+func (r *KubernetesResolver) recordLookup(method string, found bool, err error) {
+	result := "miss"
+	switch {
+	case err != nil:
+		result = "error"
+	case found:
+		result = "hit"
+	}
+
+	r.lookups.WithLabelValues(method, result).Inc()
+}
+
+// RegisterMetrics registers the resolver's metrics with the registry.
+func (r *KubernetesResolver) RegisterMetrics(registry prometheus.Registerer) {
+	registry.MustRegister(r.informerHealthMetrics()...)
+	registry.MustRegister(
+		r.lookups,
+		metrics.NewGaugeFunc(
+			"tsdnsproxy_kubernetes_mappings",
+			"External IPs of Services that currently map to Tailscale IPs.",
+			func() []metrics.Sample {
+				return []metrics.Sample{{Value: float64(r.countMappings())}}
+			},
+		),
+		metrics.NewGaugeFunc(
+			"tsdnsproxy_kubernetes_informer_objects",
+			"Objects in each informer's cache.",
+			func() []metrics.Sample {
+				return []metrics.Sample{
+					{LabelValues: []string{"secret"}, Value: float64(len(r.secretInformer.GetStore().ListKeys()))},
+					{LabelValues: []string{"service"}, Value: float64(len(r.serviceInformer.GetStore().ListKeys()))},
+				}
+			},
+			"kind",
+		),
+	)
+}
+
+// countMappings returns the number of external IPs that we can map to
+// Tailscale IPs.
+func (r *KubernetesResolver) countMappings() int {
+	mappings := 0
+	for _, obj := range r.serviceInformer.GetStore().List() {
+		service := obj.(*corev1.Service)
+
+		ips, err := r.GetTailscaleIPsByService(service.Namespace, service.Name)
+		if err != nil || len(ips) == 0 {
+			continue
+		}
+
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				mappings++
+			}
+		}
+	}
+
+	return mappings
+}
@@ -0,0 +1,59 @@
+package resolvers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestConfigFromKubeconfigPathAndContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	kubeconfig := `apiVersion: v1
+kind: Config
+current-context: first
+clusters:
+- name: first
+  cluster:
+    server: https://first.example:6443
+- name: second
+  cluster:
+    server: https://second.example:6443
+users:
+- name: user
+  user:
+    token: secret
+contexts:
+- name: first
+  context:
+    cluster: first
+    user: user
+- name: second
+  context:
+    cluster: second
+    user: user
+`
+	if err := os.WriteFile(path, []byte(kubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		context string
+		server  string
+	}{
+		{"", "https://first.example:6443"},
+		{"second", "https://second.example:6443"},
+	}
+	for _, test := range tests {
+		config, err := restConfig(&KubernetesConfig{KubeconfigPath: path, Context: test.context})
+		if err != nil {
+			t.Fatalf("context %q: %v", test.context, err)
+		}
+		if config.Host != test.server {
+			t.Errorf("context %q: got server %s, want %s", test.context, config.Host, test.server)
+		}
+	}
+
+	if _, err := restConfig(&KubernetesConfig{KubeconfigPath: path, Context: "missing"}); err == nil {
+		t.Error("expected an error for a missing context")
+	}
+}
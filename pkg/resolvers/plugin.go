@@ -0,0 +1,74 @@
+package resolvers
+
+import (
+	"errors"
+	"fmt"
+	"plugin"
+)
+
+// Name of the symbol that resolver plugins must export
+const pluginSymbol = "Resolvers"
+
+var (
+	errPluginSymbolType     = errors.New("plugin's " + pluginSymbol + " symbol must be a map[string]resolvers.PluginFactory")
+	errPluginResolverAbsent = errors.New("no loaded plugin provides resolver")
+	errPluginResolverClash  = errors.New("more than one plugin provides resolver")
+)
+
+// PluginFactory creates a resolver from its config, which is the plugin's
+// section of the config file as-is.
+type PluginFactory func(config map[string]any) (Resolver, error)
+
+// PluginConfig selects a resolver provided by a plugin. Plugins are Go plugins
+// (built with -buildmode=plugin against the same version of this module) that
+// export a variable named Resolvers, of type map[string]PluginFactory, keyed
+// by resolver name. Go plugins need cgo, so they can't be loaded by static
+// builds: this includes the Docker image, which is built with CGO_ENABLED=0
+// onto a base image without libc. Using plugins means building the proxy
+// (and the plugins) with cgo, and running it where glibc is available.
+type PluginConfig struct {
+	// Paths of the plugins to load
+	Paths []string `mapstructure:"paths" validate:"required,min=1"`
+	// Name of the resolver to use, out of all the loaded plugins' resolvers
+	Name   string         `mapstructure:"name" validate:"required"`
+	Config map[string]any `mapstructure:"config"`
+}
+
+// NewPluginResolver loads the configured plugins and creates the selected
+// resolver with its config.
+func NewPluginResolver(config *PluginConfig) (Resolver, error) {
+	var factory PluginFactory
+	for _, path := range config.Paths {
+		p, err := plugin.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load resolver plugin '%s': %w", path, err)
+		}
+
+		symbol, err := p.Lookup(pluginSymbol)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load resolver plugin '%s': %w", path, err)
+		}
+
+		factories, ok := symbol.(*map[string]PluginFactory)
+		if !ok {
+			return nil, fmt.Errorf("failed to load resolver plugin '%s': %w", path, errPluginSymbolType)
+		}
+
+		if f, ok := (*factories)[config.Name]; ok {
+			if factory != nil {
+				return nil, fmt.Errorf("%w '%s'", errPluginResolverClash, config.Name)
+			}
+			factory = f
+		}
+	}
+
+	if factory == nil {
+		return nil, fmt.Errorf("%w '%s'", errPluginResolverAbsent, config.Name)
+	}
+
+	resolver, err := factory(config.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create plugin resolver '%s': %w", config.Name, err)
+	}
+	return resolver, nil
+}
@@ -0,0 +1,97 @@
+// Package resolvers maps external IPs (and optionally names) to Tailscale IPs.
+// Resolvers implement Resolver, plus whichever of the optional interfaces in
+// this package they support.
+package resolvers
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Resolver interface {
+	GetTailscaleIPsByExternalIP(ip net.IP) ([]net.IP, error)
+}
+
+// NameResolver is implemented by resolvers that can map a DNS name directly to
+// Tailscale IPs, without needing an external IP from upstream.
+type NameResolver interface {
+	GetTailscaleIPsByName(name string) ([]net.IP, error)
+}
+
+// ReverseResolver is implemented by resolvers that can map a Tailscale IP back
+// to the names of the device that owns it, e.g. for answering PTR queries.
+type ReverseResolver interface {
+	GetNamesByTailscaleIP(ip net.IP) ([]string, error)
+}
+
+// EvidenceResolver is implemented by resolvers that can say which objects a
+// mapping came from (e.g. "service/ns/name"), for the audit log.
+type EvidenceResolver interface {
+	ExplainTailscaleIPsByExternalIP(ip net.IP) ([]net.IP, []string, error)
+	ExplainTailscaleIPsByName(name string) ([]net.IP, []string, error)
+}
+
+// Mapping is an external IP that a resolver maps to Tailscale IPs.
+type Mapping struct {
+	ExternalIP   string   `json:"external_ip"`
+	TailscaleIPs []string `json:"tailscale_ips"`
+	// Names that resolve directly to the Tailscale IPs
+	Names    []string `json:"names,omitempty"`
+	Evidence []string `json:"evidence,omitempty"`
+}
+
+// MappingLister is implemented by resolvers that can list every mapping they
+// know of, e.g. for debugging why a query wasn't intercepted.
+type MappingLister interface {
+	Mappings() ([]Mapping, error)
+}
+
+// MetricsReporter is implemented by resolvers that export their own metrics.
+type MetricsReporter interface {
+	RegisterMetrics(registry prometheus.Registerer)
+}
+
+// ReadinessChecker is implemented by resolvers that can tell whether their
+// view of the world is current enough to be relied on.
+type ReadinessChecker interface {
+	Ready() error
+}
+
+// ScopedResolver is implemented by resolvers that only consult some of their
+// backends for a given name, e.g. [CompositeResolver]. Lookups for the
+// answers to a query should use the resolver returned by ForName.
+type ScopedResolver interface {
+	ForName(name string) Resolver
+}
+
+// NamedResolvers is implemented by resolvers made up of others that have
+// names, e.g. [CompositeResolver], so that queries can be bound to one of
+// them.
+type NamedResolvers interface {
+	Named(name string) (Resolver, bool)
+}
+
+type SelfResolver interface {
+	GetProcessTailscaleIPs() ([]net.IP, error)
+}
+
+type Startable interface {
+	Start(cancel <-chan struct{}) error
+}
+
+func StartWithTimeout(ctx context.Context, s Startable, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err := s.Start(ctx.Done()); err != nil {
+		return err
+	}
+
+	return nil
+}
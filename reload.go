@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/proxy"
+	"go.uber.org/zap"
+)
+
+// reloadRequest asks for the config to be reloaded. The trigger names what
+// asked, for logging. If patch isn't nil, it's applied to the config's patches
+// first, and kept only if the reload works. If result isn't nil, the outcome
+// of the reload is sent to it, so it must have room for one error.
+type reloadRequest struct {
+	trigger string
+	patch   map[string]any
+	result  chan<- error
+}
+
+// runReloads reloads the proxy config from the config file each time a reload
+// is requested, until the context is done. Overrides from flags and patches
+// from the admin API still apply. Only the proxy section is reloaded; anything
+// else needs a restart.
+func runReloads(ctx context.Context, logger *zap.Logger, server *proxy.Server, configPath string, overrides configOverrides, reloads <-chan reloadRequest) {
+	var patches configPatches
+	for {
+		select {
+		case req := <-reloads:
+			patched := patches
+			if req.patch != nil {
+				patched = patches.apply(req.patch)
+			}
+
+			err := reload(logger, server, configPath, withPatches(overrides, patched), req.trigger)
+			if err == nil {
+				patches = patched
+			}
+			if req.result != nil {
+				req.result <- err
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func reload(logger *zap.Logger, server *proxy.Server, configPath string, overrides configOverrides, trigger string) error {
+	logger.Info("reloading config", zap.String("trigger", trigger))
+	cfg, err := loadConfig(configPath, overrides)
+	if err != nil {
+		logger.Error("failed to load config; keeping the old one", zap.Error(err))
+		return err
+	}
+	if err := server.Reload(&cfg.Proxy); err != nil {
+		logger.Error("failed to reload config; keeping the old one", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// reloadHandler serves the admin API's POST /reload, which reloads the config
+// just like SIGHUP does, and reports whether it worked.
+func reloadHandler(reloads chan<- reloadRequest) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		result := make(chan error, 1)
+		select {
+		case reloads <- reloadRequest{trigger: "admin API", result: result}:
+		case <-r.Context().Done():
+			return
+		}
+
+		select {
+		case err := <-result:
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case <-r.Context().Done():
+		}
+	})
+}
@@ -0,0 +1,58 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/proxy"
+	"go.uber.org/zap"
+)
+
+// handleInterceptionSignals disables interception on SIGUSR1 and enables it
+// again on SIGUSR2, until the context is done, as an escape hatch that works
+// even without the admin API.
+func handleInterceptionSignals(ctx context.Context, logger *zap.Logger, server *proxy.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case sig := <-signals:
+				enabled := sig == syscall.SIGUSR2
+				server.SetInterceptionEnabled(enabled)
+				logger.Warn("interception toggled by signal", zap.Stringer("signal", sig), zap.Bool("enabled", enabled))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// handleReloadSignal requests a config reload on SIGHUP, until the context is
+// done.
+func handleReloadSignal(ctx context.Context, reloads chan<- reloadRequest) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+				select {
+				case reloads <- reloadRequest{trigger: "SIGHUP"}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,18 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"context"
+
+	"github.com/davejbax/tailscale-dns-proxy/pkg/proxy"
+	"go.uber.org/zap"
+)
+
+// handleInterceptionSignals does nothing, as there's no SIGUSR1/SIGUSR2 on
+// this platform; use the admin API instead.
+func handleInterceptionSignals(context.Context, *zap.Logger, *proxy.Server) {}
+
+// handleReloadSignal does nothing, as there's no SIGHUP on this platform; use
+// the admin API's POST /reload instead.
+func handleReloadSignal(context.Context, chan<- reloadRequest) {}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/davejbax/tailscale-dns-proxy/internal/systemd"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/proxy"
+	"github.com/davejbax/tailscale-dns-proxy/pkg/resolvers"
+	"go.uber.org/zap"
+)
+
+// How often to check whether the resolver is ready before telling systemd
+const systemdReadyPollInterval = time.Second
+
+// notifySystemd tells systemd (if it started us) that we're ready once the
+// proxy is listening and the resolver is ready, pings the watchdog while the
+// proxy keeps answering queries sent to itself and the resolver stays ready,
+// and tells systemd when we start shutting down.
+func notifySystemd(ctx context.Context, logger *zap.Logger, server *proxy.Server, resolver resolvers.Resolver) {
+	healthy := func() error { return nil }
+	if checker, ok := resolver.(resolvers.ReadinessChecker); ok {
+		healthy = checker.Ready
+	}
+
+	select {
+	case <-server.Listening():
+	case <-ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(systemdReadyPollInterval)
+	defer ticker.Stop()
+	for healthy() != nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	if err := systemd.Notify(systemd.StateReady); err != nil {
+		logger.Warn("failed to notify systemd of readiness", zap.Error(err))
+	}
+
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		// Leave time to ping before systemd gives up on us, even if the
+		// check takes as long as it's allowed to
+		live := func() error {
+			if err := healthy(); err != nil {
+				return err
+			}
+
+			checkCtx, cancel := context.WithTimeout(ctx, interval/4)
+			defer cancel()
+			return server.CheckLiveness(checkCtx)
+		}
+
+		go systemd.Watchdog(ctx, interval, live, func(err error) {
+			logger.Warn("not pinging systemd watchdog", zap.Error(err))
+		})
+	}
+
+	<-ctx.Done()
+	if err := systemd.Notify(systemd.StateStopping); err != nil {
+		logger.Warn("failed to notify systemd of shutdown", zap.Error(err))
+	}
+}